@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+
+	"custom_vpn/tlsconfig"
+)
+
+/*
+	`client fingerprint server.pem` prints the pin for each cert in the file,
+	ready for -pin or tls.pins in the client config. Run it where the server cert lives, and carry the pin, not the CA.
+*/
+func runFingerprint(args []string) error {
+	fs := flag.NewFlagSet("fingerprint", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: client fingerprint cert.pem...\n")
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	for _, path := range fs.Args() {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		found := false
+		for {
+			var block *pem.Block
+			block, raw = pem.Decode(raw)
+			if block == nil {
+				break
+			}
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			found = true
+			fmt.Printf("%s  %s (%s)\n", tlsconfig.SPKIPin(cert), path, cert.Subject)
+		}
+		if !found {
+			return fmt.Errorf("%s: no certificates", path)
+		}
+	}
+	return nil
+}
@@ -2,19 +2,32 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"sync"
 
 	"custom_vpn/config"
+	"custom_vpn/internal/auth"
 	"custom_vpn/internal/helpers"
+	"custom_vpn/internal/httpproxy"
+	"custom_vpn/internal/logging"
+	"custom_vpn/internal/metrics"
 	"custom_vpn/internal/quic"
+	"custom_vpn/internal/socks"
 	"custom_vpn/internal/tcp"
+	"custom_vpn/internal/transport"
+	"custom_vpn/internal/udpforward"
+	"custom_vpn/internal/wire"
+	"custom_vpn/tlsconfig"
 )
 
+var logger = logging.For("client")
+
 /*
 	A client needs to be more explicit about what it needs to do.
 	A server makes services available, a client has to be decisive about what it needs to do.
@@ -22,14 +35,98 @@ import (
 	Any of the default actions are me being lazy, because I don't want to spend the time to make the behaviour opt in
 */
 
-func main(){
+func main() {
+
+	// the one subcommand, everything else is flags
+	if len(os.Args) > 1 && os.Args[1] == "fingerprint" {
+		if err := runFingerprint(os.Args[2:]); err != nil {
+			log.Fatalf("client: %v", err)
+		}
+		return
+	}
 
-	clientListenerPort := flag.Int("p", config.ClientListnerPort, "Port used to connect to client (via socat, postman, ssh, etc.)")
-	remoteServerAddress := flag.String("addr", "127.0.0.1", "Server IP Address")
-	mode := flag.String("mode", "quic", "Connection mode. options are: \"tcp\", \"tls\", and \"quic\"")
-	caCertLoc := flag.String("ca", "", "specify a custom CA cert")
+	defaults := config.DefaultClient()
+	configPath := flag.String("config", "", "path to a YAML config file")
+	clientListenerPort := flag.Int("p", defaults.ListenPort, "Port used to connect to client (via socat, postman, ssh, etc.)")
+	remoteServerAddress := flag.String("addr", defaults.Server, "Server IP Address")
+	mode := flag.String("mode", defaults.Mode, "Connection mode. options are: \"tcp\", \"tls\", \"quic\" and \"tun\" (layer 3 VPN over QUIC, needs root)")
+	service := flag.String("service", defaults.Service, "name of the service to reach on the server (QUIC only)")
+	caCertLoc := flag.String("ca", "", "specify a custom CA cert (overrides tls.ca and CA_CERT_LOC)")
+	certLoc := flag.String("cert", "", "client certificate, for servers which require mutual TLS (overrides tls.cert)")
+	keyLoc := flag.String("key", "", "client private key (overrides tls.key)")
+	serverName := flag.String("server-name", defaults.TLS.ServerName, "name to expect on the server's cert, also sent as SNI to pick the server's virtual host (overrides tls.server_name)")
+	flag.StringVar(serverName, "sni", defaults.TLS.ServerName, "same as -server-name")
+	socksListen := flag.String("socks", "", "run a SOCKS5 proxy on this local address, eg. 127.0.0.1:1080")
+	httpProxyListen := flag.String("http-proxy", "", "run an HTTP proxy (CONNECT and absolute-URI requests) on this local address, eg. 127.0.0.1:8888")
+	token := flag.String("token", "", "token (pre-shared or JWT) for servers which want one (overrides auth.token)")
+	tokenFile := flag.String("token-file", "", "read the token from this file, on every new connection (overrides auth.token_file)")
+	var pins pinFlags
+	flag.Var(&pins, "pin", "server key pin, sha256/<base64> from `client fingerprint`. Repeatable, replaces tls.pins. Works without -ca")
+	var forwards forwardFlags
+	flag.Var(&forwards, "forward", "local listener bound to a server side service, as [udp:]local=service[/transport]. eg. 127.0.0.1:2022=http/quic or udp:127.0.0.1:5353=dns. Repeatable, replaces the forwards in the config file")
+	metricsListen := flag.String("metrics", "", "serve Prometheus metrics on http://<addr>/metrics, eg. 127.0.0.1:9101 (overrides metrics.listen)")
+	logLevel := flag.String("log-level", "", "debug, info, warn or error (overrides logging.level)")
+	logFormat := flag.String("log-format", "", "\"text\" or \"json\" (overrides logging.format)")
+	var reverses reverseFlags
+	flag.Var(&reverses, "reverse", "have the server listen on a port and send its connections here, as [:]remote=local. eg. :8443=127.0.0.1:3000. Repeatable, replaces the reverse forwards in the config file. Needs reverse forwards on the server")
 	flag.Parse()
 
+	// see config/config.go for the precedence of file, env vars and flags
+	conf, err := config.LoadClient(*configPath)
+	if err != nil {
+		log.Fatalf("client: %v", err)
+	}
+	conf.ApplyEnv()
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "p":
+			conf.ListenPort = *clientListenerPort
+		case "addr":
+			conf.Server = *remoteServerAddress
+		case "mode":
+			conf.Mode = *mode
+		case "service":
+			conf.Service = *service
+		case "ca":
+			conf.TLS.CA = *caCertLoc
+		case "cert":
+			conf.TLS.Cert = *certLoc
+		case "key":
+			conf.TLS.Key = *keyLoc
+		case "server-name", "sni":
+			conf.TLS.ServerName = *serverName
+		case "token":
+			conf.Auth.Token = *token
+		case "token-file":
+			conf.Auth.TokenFile = *tokenFile
+		case "pin":
+			conf.TLS.Pins = pins
+		case "forward":
+			conf.Forwards = forwards
+		case "reverse":
+			conf.Reverse = reverses
+		case "metrics":
+			conf.Metrics.Listen = *metricsListen
+		case "socks":
+			conf.Socks.Listen = *socksListen
+		case "http-proxy":
+			conf.HTTPProxy.Listen = *httpProxyListen
+		case "log-level":
+			conf.Logging.Level = *logLevel
+		case "log-format":
+			conf.Logging.Format = *logFormat
+		}
+	})
+	if err := conf.Validate(); err != nil {
+		log.Fatalf("client: %v", err)
+	}
+	if err := logging.Setup(os.Stderr, conf.Logging.Format); err != nil {
+		log.Fatalf("client: %v", err)
+	}
+	if err := logging.SetLevels(conf.Logging.Level, conf.Logging.Subsystems); err != nil {
+		log.Fatalf("client: %v", err)
+	}
+
 	errCh := make(chan error, 1)
 	done := make(chan struct{})
 	go helpers.ErrorCollector(errCh, done)
@@ -37,82 +134,219 @@ func main(){
 	ctx := helpers.SetupShutdownHelper()
 	var wg sync.WaitGroup
 
+	openers, manager, err := setupOpeners(ctx, conf)
+	if err != nil {
+		log.Fatalf("client: %v", err)
+	}
+
+	// one listener per forward, all of them stop when ctx is cancelled
+	for _, fwd := range conf.Forwards {
+		wg.Add(1)
+		if fwd.Network == "udp" {
+			forwarder := udpforward.Forwarder{Flows: manager, Service: fwd.Service, IdleTimeout: fwd.IdleTimeout}
+			go forwarder.ListenAndServe(ctx, errCh, &wg, fwd.Local)
+			continue
+		}
+		go startLocalListener(ctx, errCh, &wg, fwd, openers[fwd.Transport])
+	}
+
+	if conf.Socks.Listen != "" {
+		socksServer := socks.Server{Opener: openers[conf.Socks.Transport], Flows: manager}
+		wg.Add(1)
+		go socksServer.ListenAndServe(ctx, errCh, &wg, conf.Socks.Listen)
+	}
+
+	if conf.HTTPProxy.Listen != "" {
+		proxyServer := httpproxy.Server{Opener: openers[conf.HTTPProxy.Transport]}
+		wg.Add(1)
+		go proxyServer.ListenAndServe(ctx, errCh, &wg, conf.HTTPProxy.Listen)
+	}
+
+	if conf.Mode == "tun" {
+		wg.Add(1)
+		go runTUN(ctx, errCh, &wg, conf, manager)
+	}
+
+	for _, rev := range conf.Reverse {
+		wg.Add(1)
+		go runReverse(ctx, errCh, &wg, rev, manager)
+	}
+
+	if conf.Metrics.Listen != "" {
+		wg.Add(1)
+		go metrics.ListenAndServe(ctx, errCh, &wg, conf.Metrics.Listen, metrics.ClientRegistry())
+	}
+
+	// same as the server, kill -HUP reads the log levels from the config file again
 	wg.Add(1)
-	// add local listener calls to multiple ports here
-	// also add context to start listner, just like with server, to kill client if sigterm is sent
-	go startLocalListener(ctx, errCh, &wg, *clientListenerPort, *remoteServerAddress, *caCertLoc, *mode)
+	go logging.ReloadOnSIGHUP(ctx, &wg, errCh, func() (string, map[string]string, error) {
+		reloaded, err := config.LoadClient(*configPath)
+		if err != nil {
+			return "", nil, err
+		}
+		if *logLevel != "" {
+			reloaded.Logging.Level = *logLevel
+		}
+		return reloaded.Logging.Level, reloaded.Logging.Subsystems, nil
+	})
 
 	wg.Wait()
+	// the go-routine in setupOpeners may not have got to it yet, and the server should hear we're gone
+	if manager != nil {
+		manager.Close()
+	}
 	close(errCh)
 
 	<-done
-	log.Print("all listeners stopped...exiting client")
+	logger.Info("all listeners stopped, exiting")
 }
 
+// Collects repeated -forward flags
+type forwardFlags []config.Forward
+
+func (f *forwardFlags) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *forwardFlags) Set(value string) error {
+	fwd, err := config.ParseForward(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, fwd)
+	return nil
+}
+
+// Collects repeated -reverse flags
+type reverseFlags []config.ReverseForward
+
+func (r *reverseFlags) String() string {
+	return fmt.Sprint(*r)
+}
+
+func (r *reverseFlags) Set(value string) error {
+	rev, err := config.ParseReverseForward(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rev)
+	return nil
+}
+
+// Collects repeated -pin flags
+type pinFlags []string
+
+func (p *pinFlags) String() string {
+	return fmt.Sprint(*p)
+}
+
+func (p *pinFlags) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
 
 /*
-	Creates a tcp net.conn on the clientListnerPort
-	The user can establish multiple connections to this port. but why?
-	based on user's selection of TLS or not (transSec)
-	tries to establish remote conn with or without tls
-	We need to be able to start multiple listeners (HTTP, SSH, etc...)
+	Builds a tunnel opener for each transport the config uses.
+	Every QUIC user (forwards, SOCKS, HTTP proxy, TUN mode, reverse forwards) shares one ConnManager, so one connection to the server.
 */
-func startLocalListener(ctx context.Context, errCh chan<-error, wg *sync.WaitGroup, clientListenerPort int, remoteServerAddr, caCertLoc string, mode string) {
-	defer wg.Done()
+func setupOpeners(ctx context.Context, conf *config.Client) (map[string]transport.Opener, *quic.ConnManager, error) {
+	used := make(map[string]bool)
+	for _, fwd := range conf.Forwards {
+		used[fwd.Transport] = true
+	}
+	if conf.Socks.Listen != "" {
+		used[conf.Socks.Transport] = true
+		used["quic"] = true // UDP ASSOCIATE
+	}
+	if conf.HTTPProxy.Listen != "" {
+		used[conf.HTTPProxy.Transport] = true
+	}
+	if conf.Mode == "tun" || len(conf.Reverse) > 0 {
+		used["quic"] = true
+	}
 
-	localAddr := net.TCPAddr{
-		IP: net.ParseIP("0.0.0.0"),
-		Port: clientListenerPort,
+	openers := make(map[string]transport.Opener)
+	token := auth.ClientToken(conf.Auth)
+	var manager *quic.ConnManager
+	var tlsConf *tls.Config
+	if used["tls"] || used["quic"] {
+		var err error
+		tlsConf, err = tlsconfig.ClientTLSConfig(conf.TLS)
+		if err != nil {
+			return nil, nil, fmt.Errorf("TLS config: %v", err)
+		}
 	}
 
-	// Start a local listener...what if this was UDP?
-	localListener, err := net.Listen("tcp", localAddr.String())
-	if err != nil{
+	if used["tcp"] {
+		openers["tcp"] = &tcp.Dialer{
+			ServerAddr: &net.TCPAddr{IP: net.ParseIP(conf.Server), Port: conf.ServerPorts.TCP},
+			Token:      token,
+		}
+	}
+	if used["tls"] {
+		openers["tls"] = &tcp.Dialer{
+			ServerAddr: &net.TCPAddr{IP: net.ParseIP(conf.Server), Port: conf.ServerPorts.TLS},
+			TLSConf:    tlsConf,
+			Token:      token,
+		}
+	}
+	if used["quic"] {
+		remoteAddr := net.UDPAddr{
+			IP:   net.ParseIP(conf.Server),
+			Port: conf.ServerPorts.Quic,
+		}
+		var err error
+		manager, err = quic.NewConnManager(&remoteAddr, tlsConf, conf.Quic.QuicConfig())
+		if err != nil {
+			return nil, nil, err
+		}
+		manager.Token = token
+		openers["quic"] = manager
+		// closing the connection on shutdown ends the tunnels still running on it
+		go func() {
+			<-ctx.Done()
+			manager.Close()
+		}()
+	}
+	return openers, manager, nil
+}
+
+/*
+	Creates a tcp net.conn on the forward's local address
+	The user can establish multiple connections to this port.
+	Each accepted conn is sent to the forward's service on the server, over the forward's transport
+*/
+func startLocalListener(ctx context.Context, errCh chan<- error, wg *sync.WaitGroup, fwd config.Forward, opener transport.Opener) {
+	defer wg.Done()
+
+	// Start a local listener. UDP forwards have their own, see udpforward
+	localListener, err := net.Listen("tcp", fwd.Local)
+	if err != nil {
 		errCh <- fmt.Errorf("error creating listener: %v", err)
 		return
 	} else {
-		log.Printf("Client: listener started on %d", localAddr.Port)
+		logger.Info("listener started", "forward", fwd.String(), "addr", localListener.Addr().String())
 	}
 	defer localListener.Close()
-	
+
 	wg.Add(1)
-	go helpers.CaptureCancel(ctx, wg, errCh, localAddr.Port, localListener)
+	go helpers.CaptureCancel(ctx, wg, errCh, localListener.Addr().(*net.TCPAddr).Port, localListener)
 
 	for {
 		conn, err := localListener.Accept()
 		if err != nil {
-			//_ , match := err.(net.Error) 
-			if errors.Is(err, net.ErrClosed){
-				errCh <- err
+			//_ , match := err.(net.Error)
+			// closed by CaptureCancel, we're shutting down
+			if errors.Is(err, net.ErrClosed) {
 				return
 			}
 			continue
 		}
 
-		log.Printf("client: recieved client request from: %v\n", conn.RemoteAddr().String())
-	
-		switch mode{
-		case "tls":
-			remoteAddr := net.TCPAddr{
-				IP: net.ParseIP(remoteServerAddr),
-				Port: config.TcpTlsServerPort,
-			}
-			wg.Add(1)
-			go tcp.ConnectRemoteSecure(wg, errCh, conn, caCertLoc, &remoteAddr)
-		case "tcp":
-			remoteAddr := net.TCPAddr{
-				IP: net.ParseIP(remoteServerAddr),
-				Port: config.RawTcpServerPort,
-			}
-			wg.Add(1)
-			go tcp.ConnectRemoteUnsec(wg, errCh, conn, &remoteAddr)
-		default:
-			wg.Add(1)
-			remoteAddr := net.UDPAddr{
-				IP: net.ParseIP(remoteServerAddr),
-				Port: config.QuicServerPort,
-			}
-			go quic.ConnectRemoteQuic(ctx, wg, errCh, &remoteAddr, caCertLoc, conn)
-		}
+		connCtx := context.WithValue(context.WithValue(ctx, helpers.Client, conn.RemoteAddr().String()), helpers.Service, fwd.Service)
+		logger.DebugContext(connCtx, "connection accepted", "forward", fwd.Local)
+
+		wg.Add(1)
+		go transport.Forward(connCtx, wg, errCh, opener, wire.Header{Service: fwd.Service}, conn)
 	}
-}
\ No newline at end of file
+}
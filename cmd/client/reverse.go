@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"custom_vpn/config"
+	"custom_vpn/internal/quic"
+	"custom_vpn/internal/wire"
+)
+
+// Backoff between attempts to re-register a reverse forward
+const (
+	minReverseBackoff = time.Second
+	maxReverseBackoff = 30 * time.Second
+)
+
+/*
+	Keeps one reverse forward registered with the server until ctx is cancelled.
+	The registration goes when the connection does (server restart, idle timeout...), so it's redone, backing off between attempts.
+	A port in use on the server is worth retrying, it may be a registration of ours that hasn't timed out yet.
+	A port we're not allowed isn't, that takes a config change on one end or the other.
+*/
+func runReverse(ctx context.Context, errCh chan<- error, wg *sync.WaitGroup, rev config.ReverseForward, manager *quic.ConnManager) {
+	defer wg.Done()
+
+	dial := func(ctx context.Context, from netip.AddrPort) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", rev.Local)
+		if err != nil {
+			logger.Warn("reverse forward: dialing the local address", "forward", rev.String(), "from", from, "err", err)
+			return nil, err
+		}
+		logger.Info("reverse forward: connection", "forward", rev.String(), "from", from)
+		return conn, nil
+	}
+
+	backoff := minReverseBackoff
+	for {
+		logger.Info("registering reverse forward", "forward", rev.String())
+		start := time.Now()
+		err := manager.ServeReverse(ctx, uint16(rev.Remote), dial)
+		if ctx.Err() != nil {
+			return
+		}
+		var rejected *wire.RejectedError
+		if errors.As(err, &rejected) && (rejected.Status == wire.StatusUnauthorized || rejected.Status == wire.StatusBadRequest) {
+			errCh <- fmt.Errorf("client: reverse forward %v: %v", rev, err)
+			return
+		}
+		// a registration that held for a while was a working one, start over
+		if time.Since(start) > maxReverseBackoff {
+			backoff = minReverseBackoff
+		}
+		logger.Warn("reverse forward lost, retrying", "forward", rev.String(), "backoff", backoff, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxReverseBackoff)
+	}
+}
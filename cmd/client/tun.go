@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"custom_vpn/config"
+	"custom_vpn/internal/quic"
+	"custom_vpn/internal/transport"
+	"custom_vpn/internal/tun"
+	"custom_vpn/internal/wire"
+)
+
+/*
+	-mode tun. Brings up the TUN interface and keeps a TUN link open on the shared QUIC connection until ctx is cancelled.
+	Our addresses, plus routes and DNS servers, come from the server's lease on every (re)connect.
+	They're only touched when the lease changes, so a reconnect doesn't disturb connections running over the tunnel.
+	The interface and every route we added go away when the client exits. Routes left by a crash go on the next start.
+*/
+func runTUN(ctx context.Context, errCh chan<- error, wg *sync.WaitGroup, conf *config.Client, manager *quic.ConnManager) {
+	defer wg.Done()
+
+	if err := tun.RestoreRoutes(conf.TUN.StateFile); err != nil {
+		errCh <- fmt.Errorf("client: %v", err)
+		return
+	}
+	// before anything of ours is in the routing table, so the bypasses take the way out we had without the tunnel
+	include, bypass := splitRoutes(ctx, conf)
+
+	dev, err := tun.Open(tun.Config{Name: conf.TUN.Name, MTU: conf.TUN.MTU})
+	if err != nil {
+		errCh <- fmt.Errorf("client: %v", err)
+		return
+	}
+	routes := tun.NewRouteSet(conf.TUN.StateFile)
+	defer func() {
+		if err := routes.Clear(); err != nil {
+			errCh <- fmt.Errorf("client: %v", err)
+		}
+	}()
+
+	var current wire.Lease
+	open := func(ctx context.Context) (transport.Flow, error) {
+		link, lease, err := manager.OpenTUN(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if sameLease(lease, current) {
+			return link, nil
+		}
+		logger.Info("leased", "addrs", lease.Addresses, "routes", lease.Routes, "dns", lease.DNS)
+		if err := tun.SetAddresses(dev, lease.Addresses); err != nil {
+			link.Close()
+			return nil, err
+		}
+		if err := routes.Set(tunnelRoutes(dev.Name(), lease, include, bypass)); err != nil {
+			link.Close()
+			return nil, err
+		}
+		// not having the tunnel's DNS servers isn't worth tearing the tunnel down over
+		if err := tun.SetDNS(dev, lease.DNS); err != nil {
+			logger.Warn("setting the tunnel's DNS servers", "err", err)
+		}
+		current = lease
+		return link, nil
+	}
+	if err := tun.RunClient(ctx, dev, open); err != nil {
+		errCh <- fmt.Errorf("client: TUN mode: %v", err)
+	}
+}
+
+/*
+	The split tunnel config, resolved: the subnets to send into the tunnel, and the routes which keep
+	the server and the excluded subnets going the way they go now. Names which don't resolve are logged and skipped
+*/
+func splitRoutes(ctx context.Context, conf *config.Client) ([]netip.Prefix, []tun.Route) {
+	// all checked by Validate
+	var include, exclude []netip.Prefix
+	for _, route := range conf.TUN.Routes {
+		p, _ := config.ParsePrefix(route)
+		include = append(include, p)
+	}
+	for _, route := range conf.TUN.Exclude {
+		p, _ := config.ParsePrefix(route)
+		exclude = append(exclude, p)
+	}
+	include = append(include, lookupHosts(ctx, conf.TUN.Domains)...)
+	exclude = append(exclude, lookupHosts(ctx, conf.TUN.ExcludeDomains)...)
+	// the tunnel's own packets going into the tunnel would be a loop
+	exclude = append(exclude, lookupHosts(ctx, []string{conf.Server})...)
+
+	var bypass []tun.Route
+	for _, p := range exclude {
+		route, err := tun.Bypass(p)
+		if err != nil {
+			logger.Warn("not excluding a prefix from the tunnel", "prefix", p, "err", err)
+			continue
+		}
+		bypass = append(bypass, route)
+	}
+	return include, bypass
+}
+
+// Each host's addresses, as single address prefixes
+func lookupHosts(ctx context.Context, hosts []string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, host := range hosts {
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			logger.Warn("split tunnel: looking up a host", "host", host, "err", err)
+			continue
+		}
+		for _, a := range addrs {
+			prefixes = append(prefixes, netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()))
+		}
+	}
+	return prefixes
+}
+
+/*
+	Every route the client wants for lease: the server's routes and ours into dev, for the address families we were leased,
+	then the bypasses. A default route goes in as two halves, so the one we had stays put for the bypasses to use
+*/
+func tunnelRoutes(dev string, lease wire.Lease, include []netip.Prefix, bypass []tun.Route) []tun.Route {
+	var v4, v6 bool
+	for _, a := range lease.Addresses {
+		v4 = v4 || a.Addr().Is4()
+		v6 = v6 || a.Addr().Is6()
+	}
+	var routes []tun.Route
+	for _, p := range append(slices.Clone(lease.Routes), include...) {
+		if (p.Addr().Is4() && !v4) || (p.Addr().Is6() && !v6) {
+			continue
+		}
+		if p.Bits() == 0 {
+			high := p.Addr().AsSlice()
+			high[0] = 0x80
+			upper, _ := netip.AddrFromSlice(high)
+			routes = append(routes, tun.Route{Dst: netip.PrefixFrom(p.Addr(), 1), Dev: dev}, tun.Route{Dst: netip.PrefixFrom(upper, 1), Dev: dev})
+			continue
+		}
+		routes = append(routes, tun.Route{Dst: p, Dev: dev})
+	}
+	return append(routes, bypass...)
+}
+
+func sameLease(a, b wire.Lease) bool {
+	return slices.Equal(a.Addresses, b.Addresses) && slices.Equal(a.Routes, b.Routes) && slices.Equal(a.DNS, b.DNS)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"custom_vpn/internal/admin"
+	"custom_vpn/internal/session"
+)
+
+const ctlUsage = `usage: custom_vpn ctl [-socket path] [-json] <subcommand> [arguments]
+
+talks to a running server's admin API (admin.socket, or -admin-socket, on the server)
+
+subcommands:
+	conns                      list the connections, and the tunnels on them
+	conn <id>                  one connection. Any prefix of its ID nothing else shares will do
+	kill <id> [stream]         close a connection, or just one tunnel on it (-1 is a TCP or TLS connection's)
+	listeners                  list the listeners, and how many connections each has
+	drain <tcp|tls|quic>       stop a listener accepting, the connections it has keep going
+	reload                     read the config file again: services, virtual hosts, log levels and certs
+	sessions [n]               the last n finished tunnels (20 if not given)
+	log-level [name level]     show the log levels, or set one. "default" is what subsystems without a level follow
+
+flags:
+	-socket    the admin socket (default ` + admin.DefaultSocket + `)
+	-json      print the server's JSON reply as it is
+`
+
+func runCtl(args []string) error {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, ctlUsage) }
+	socket := fs.String("socket", admin.DefaultSocket, "admin socket")
+	raw := fs.Bool("json", false, "print the JSON reply")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fmt.Fprint(os.Stderr, ctlUsage)
+		os.Exit(2)
+	}
+
+	c := &ctlClient{socket: *socket, raw: *raw}
+	c.http = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", c.socket)
+		}},
+	}
+	cmd, rest := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "conns":
+		return c.conns()
+	case "conn":
+		if len(rest) != 1 {
+			return fmt.Errorf("ctl: conn takes a connection ID")
+		}
+		return c.conn(rest[0])
+	case "kill":
+		if len(rest) != 1 && len(rest) != 2 {
+			return fmt.Errorf("ctl: kill takes a connection ID, and maybe a stream ID")
+		}
+		return c.kill(rest[0], rest[1:])
+	case "listeners":
+		return c.listeners()
+	case "drain":
+		if len(rest) != 1 {
+			return fmt.Errorf("ctl: drain takes a listener: tcp, tls or quic")
+		}
+		return c.drain(rest[0])
+	case "reload":
+		return c.reload()
+	case "sessions":
+		n := 20
+		if len(rest) > 0 {
+			var err error
+			if n, err = strconv.Atoi(rest[0]); err != nil {
+				return fmt.Errorf("ctl: sessions takes a number, got %q", rest[0])
+			}
+		}
+		return c.sessions(n)
+	case "log-level":
+		if len(rest) != 0 && len(rest) != 2 {
+			return fmt.Errorf("ctl: log-level takes nothing, or a subsystem and a level")
+		}
+		return c.logLevel(rest)
+	case "-h", "-help", "--help", "help":
+		fmt.Print(ctlUsage)
+		return nil
+	}
+	return fmt.Errorf("ctl: unknown subcommand %q\n\n%s", cmd, ctlUsage)
+}
+
+type ctlClient struct {
+	socket string
+	raw    bool
+	http   *http.Client
+}
+
+/*
+	Sends a request to the admin API and decodes the reply into out.
+	With -json the reply is printed instead, and out is left alone: done says whether that happened
+*/
+func (c *ctlClient) call(method, path string, body, out any) (done bool, err error) {
+	var reqBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return false, err
+		}
+		reqBody = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, "http://admin"+path, reqBody)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("ctl: can't reach the admin API on %s, is the server running with admin.socket set? (%v)", c.socket, errors.Unwrap(err))
+	}
+	defer resp.Body.Close()
+	reply, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, fmt.Errorf("ctl: reading the reply: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(reply, &apiErr) != nil || apiErr.Error == "" {
+			apiErr.Error = resp.Status
+		}
+		return false, fmt.Errorf("ctl: %s", apiErr.Error)
+	}
+	if c.raw {
+		_, err := os.Stdout.Write(reply)
+		return true, err
+	}
+	if err := json.Unmarshal(reply, out); err != nil {
+		return false, fmt.Errorf("ctl: bad reply from the server: %v", err)
+	}
+	return false, nil
+}
+
+func (c *ctlClient) conns() error {
+	var conns []session.ConnInfo
+	if done, err := c.call("GET", "/conns", nil, &conns); done || err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CONN\tTRANSPORT\tCLIENT\tIDENTITY\tTUNNELS\tAGE\tIN\tOUT")
+	for _, conn := range conns {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", shortID(conn.ConnID), conn.Transport, conn.Client, orDash(conn.Identity),
+			len(conn.Tunnels), age(conn.Age), size(conn.FromClient), size(conn.ToClient))
+	}
+	return w.Flush()
+}
+
+func (c *ctlClient) conn(id string) error {
+	var conn session.ConnInfo
+	if done, err := c.call("GET", "/conns/"+id, nil, &conn); done || err != nil {
+		return err
+	}
+	fmt.Printf("conn:      %s\n", conn.ConnID)
+	fmt.Printf("transport: %s\n", conn.Transport)
+	fmt.Printf("client:    %s\n", conn.Client)
+	fmt.Printf("identity:  %s\n", orDash(conn.Identity))
+	fmt.Printf("age:       %s (since %s)\n", age(conn.Age), conn.Start.Local().Format(time.DateTime))
+	fmt.Printf("bytes:     %s in, %s out\n\n", size(conn.FromClient), size(conn.ToClient))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STREAM\tKIND\tSERVICE\tTARGET\tAGE\tIN\tOUT")
+	for _, t := range conn.Tunnels {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", t.StreamID, t.Kind, orDash(t.Service), orDash(t.Target), age(t.Age), size(t.FromClient), size(t.ToClient))
+	}
+	return w.Flush()
+}
+
+func (c *ctlClient) kill(id string, stream []string) error {
+	var conn session.ConnInfo
+	if len(stream) == 0 {
+		if done, err := c.call("POST", "/conns/"+id+"/kill", nil, &conn); done || err != nil {
+			return err
+		}
+		fmt.Printf("killed %s (%s %s)\n", conn.ConnID, conn.Client, conn.Identity)
+		return nil
+	}
+	if done, err := c.call("POST", "/conns/"+id+"/streams/"+stream[0]+"/kill", nil, &conn); done || err != nil {
+		return err
+	}
+	fmt.Printf("killed stream %s of %s\n", stream[0], conn.ConnID)
+	return nil
+}
+
+func (c *ctlClient) listeners() error {
+	var listeners []session.ListenerInfo
+	if done, err := c.call("GET", "/listeners", nil, &listeners); done || err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tADDR\tSTATE\tCONNS")
+	for _, l := range listeners {
+		state := "accepting"
+		if l.Draining {
+			state = "draining"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", l.Name, l.Addr, state, l.Conns)
+	}
+	return w.Flush()
+}
+
+func (c *ctlClient) drain(name string) error {
+	var drained struct {
+		Listener string `json:"listener"`
+		Conns    int    `json:"conns"`
+	}
+	if done, err := c.call("POST", "/listeners/"+name+"/drain", nil, &drained); done || err != nil {
+		return err
+	}
+	fmt.Printf("%s isn't accepting anymore, %d connections still open on it\n", drained.Listener, drained.Conns)
+	return nil
+}
+
+func (c *ctlClient) reload() error {
+	var reloaded struct {
+		Reloaded []string `json:"reloaded"`
+	}
+	if done, err := c.call("POST", "/reload", nil, &reloaded); done || err != nil {
+		return err
+	}
+	fmt.Printf("reloaded %s\n", strings.Join(reloaded.Reloaded, ", "))
+	return nil
+}
+
+func (c *ctlClient) sessions(n int) error {
+	var recs []session.Record
+	if done, err := c.call("GET", fmt.Sprintf("/sessions?n=%d", n), nil, &recs); done || err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ENDED\tCONN\tSTREAM\tKIND\tCLIENT\tIDENTITY\tSERVICE\tTARGET\tDURATION\tIN\tOUT\tREASON")
+	for _, rec := range recs {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", rec.End.Local().Format(time.TimeOnly), shortID(rec.ConnID), rec.StreamID, rec.Kind,
+			rec.Client, orDash(rec.Identity), orDash(rec.Service), orDash(rec.Target), rec.Duration().Round(time.Millisecond),
+			size(rec.FromClient), size(rec.ToClient), rec.CloseReason)
+	}
+	return w.Flush()
+}
+
+func (c *ctlClient) logLevel(set []string) error {
+	var levels map[string]string
+	if len(set) == 2 {
+		change := admin.LevelChange{Subsystem: set[0], Level: set[1]}
+		if change.Subsystem == "default" {
+			change.Subsystem = ""
+		}
+		if done, err := c.call("POST", "/log-levels", change, &levels); done || err != nil {
+			return err
+		}
+	} else if done, err := c.call("GET", "/log-levels", nil, &levels); done || err != nil {
+		return err
+	}
+	names := make([]string, 0, len(levels))
+	for name := range levels {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SUBSYSTEM\tLEVEL")
+	fmt.Fprintf(w, "default\t%s\n", levels[""])
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%s\n", name, levels[name])
+	}
+	return w.Flush()
+}
+
+// The first block of a UUID, which is enough to tell the connections on one server apart
+func shortID(id string) string {
+	if short, _, ok := strings.Cut(id, "-"); ok {
+		return short
+	}
+	return id
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func age(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second)).Round(time.Second)
+}
+
+// Bytes, in the biggest unit that keeps it above 1
+func size(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+/*
+	The odds and ends that aren't the server or the client.
+	Each subcommand parses its own flags, so `custom_vpn pki issue-server -h` shows just what that one takes.
+*/
+
+const usage = `usage: custom_vpn <command> [arguments]
+
+commands:
+	pki    create a CA, and issue or revoke the certs the server and clients use
+	ctl    look at and manage a running server: connections, tunnels, listeners, reloads
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "pki":
+		err = runPKI(os.Args[2:])
+	case "ctl":
+		err = runCtl(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "custom_vpn: unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "custom_vpn: %v\n", err)
+		os.Exit(1)
+	}
+}
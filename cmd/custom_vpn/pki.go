@@ -0,0 +1,167 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"custom_vpn/internal/pki"
+)
+
+const pkiUsage = `usage: custom_vpn pki <subcommand> [flags]
+
+subcommands:
+	init            create the CA
+	issue-server    issue a server cert (localhost and 127.0.0.1 are always in the SANs)
+	issue-client    issue a client cert for mutual TLS. Its name is the identity the server sees
+	revoke          revoke a cert by serial or name, and rewrite the CRL
+	list            show every cert the CA has issued
+
+every subcommand takes -dir (default ~/.custom_vpn/ssl)
+`
+
+func runPKI(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, pkiUsage)
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "init":
+		return pkiInit(args[1:])
+	case "issue-server":
+		return pkiIssue(pki.KindServer, args[1:])
+	case "issue-client":
+		return pkiIssue(pki.KindClient, args[1:])
+	case "revoke":
+		return pkiRevoke(args[1:])
+	case "list":
+		return pkiList(args[1:])
+	case "-h", "-help", "--help", "help":
+		fmt.Print(pkiUsage)
+		return nil
+	}
+	return fmt.Errorf("pki: unknown subcommand %q\n\n%s", args[0], pkiUsage)
+}
+
+// A flag set with the -dir flag every subcommand shares
+func pkiFlags(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet("pki "+name, flag.ExitOnError)
+	dir := fs.String("dir", pki.DefaultDir(), "PKI directory")
+	return fs, dir
+}
+
+func pkiInit(args []string) error {
+	fs, dir := pkiFlags("init")
+	name := fs.String("name", "custom_vpn CA", "CA common name")
+	validity := fs.Duration("validity", pki.DefaultCAValidity, "how long the CA is valid for")
+	fs.Parse(args)
+
+	ca, err := pki.Init(*dir, *name, *validity)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("CA created\n\tcert: %s\n\tkey:  %s\n\tCRL:  %s\n", ca.CertPath(), ca.KeyPath(), ca.CRLPath())
+	fmt.Printf("point the client's tls.ca (or CA_CERT_LOC) at the cert, and the server's tls.client_ca too for mutual TLS\n")
+	return nil
+}
+
+// Collects repeated string flags, eg. -dns a -dns b
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+func pkiIssue(kind pki.Kind, args []string) error {
+	fs, dir := pkiFlags("issue-" + string(kind))
+	defaultName := "server"
+	if kind == pki.KindClient {
+		defaultName = ""
+	}
+	name := fs.String("name", defaultName, "common name, and the file name the cert and key are written to")
+	validity := fs.Duration("validity", pki.DefaultCertValidity, "how long the cert is valid for")
+	var dnsNames, ips listFlag
+	fs.Var(&dnsNames, "dns", "DNS name to put in the SANs. Repeatable, or comma separated")
+	fs.Var(&ips, "ip", "IP address to put in the SANs, eg. the server's LAN address. Repeatable, or comma separated")
+	fs.Parse(args)
+	// issue-client alice reads better than issue-client -name alice
+	if *name == "" && fs.NArg() > 0 {
+		*name = fs.Arg(0)
+	}
+	if *name == "" {
+		return fmt.Errorf("pki: issue-%s needs a name", kind)
+	}
+
+	req := pki.Request{Kind: kind, Name: *name, DNSNames: dnsNames, Validity: *validity}
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("pki: %q is not an IP address", s)
+		}
+		req.IPs = append(req.IPs, ip)
+	}
+
+	ca, err := pki.Open(*dir)
+	if err != nil {
+		return err
+	}
+	entry, err := ca.Issue(req)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("issued %s cert %q (serial %s), valid until %s\n", entry.Kind, entry.Name, entry.Serial, entry.NotAfter.Format(time.DateOnly))
+	fmt.Printf("\tcert: %s\n\tkey:  %s\n", entry.CertFile, entry.KeyFile)
+	if kind == pki.KindServer {
+		fmt.Printf("\tSANs: %s %s\n", strings.Join(entry.DNSNames, " "), strings.Join(entry.IPs, " "))
+	}
+	return nil
+}
+
+func pkiRevoke(args []string) error {
+	fs, dir := pkiFlags("revoke")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("pki: revoke takes one serial or name")
+	}
+
+	ca, err := pki.Open(*dir)
+	if err != nil {
+		return err
+	}
+	entry, err := ca.Revoke(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("revoked %s cert %q (serial %s)\n", entry.Kind, entry.Name, entry.Serial)
+	fmt.Printf("CRL rewritten: %s\n", ca.CRLPath())
+	return nil
+}
+
+func pkiList(args []string) error {
+	fs, dir := pkiFlags("list")
+	fs.Parse(args)
+
+	ca, err := pki.Open(*dir)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SERIAL\tKIND\tNAME\tSTATUS\tEXPIRES\tSANS")
+	for _, e := range ca.Entries() {
+		sans := strings.TrimSpace(strings.Join(e.DNSNames, " ") + " " + strings.Join(e.IPs, " "))
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", e.Serial, e.Kind, e.Name, e.Status(now), e.NotAfter.Format(time.DateOnly), sans)
+	}
+	return w.Flush()
+}
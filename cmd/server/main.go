@@ -1,22 +1,96 @@
 package main
 
 import (
+	"context"
 	"custom_vpn/config"
+	"custom_vpn/internal/admin"
+	"custom_vpn/internal/auth"
 	"custom_vpn/internal/helpers"
+	"custom_vpn/internal/logging"
+	"custom_vpn/internal/metrics"
+	"custom_vpn/internal/policy"
 	"custom_vpn/internal/quic"
+	"custom_vpn/internal/services"
+	"custom_vpn/internal/session"
 	"custom_vpn/internal/tcp"
+	"custom_vpn/internal/tun"
+	"custom_vpn/tlsconfig"
+	"flag"
 	"log"
+	"net/netip"
+	"os"
+	"strings"
 	"sync"
+	"time"
 )
 
+var logger = logging.For("server")
 
-func main(){
+func main() {
+
+	// see config/config.go for the precedence of file, env vars and flags
+	configPath := flag.String("config", "", "path to a YAML config file")
+	certLoc := flag.String("cert", "", "server certificate (overrides tls.cert and SERVER_PEM)")
+	keyLoc := flag.String("key", "", "server private key (overrides tls.key and SERVER_KEY)")
+	clientCALoc := flag.String("client-ca", "", "require client certs signed by this CA, ie. mutual TLS (overrides tls.client_ca)")
+	certDir := flag.String("cert-dir", "", "directory of <name>.pem/<name>.key pairs, picked by the client's SNI (overrides tls.cert_dir)")
+	clientCRLLoc := flag.String("client-crl", "", "reject client certs listed in this CRL (overrides tls.client_crl)")
+	metricsListen := flag.String("metrics", "", "serve Prometheus metrics on http://<addr>/metrics, eg. 127.0.0.1:9100 (overrides metrics.listen)")
+	logLevel := flag.String("log-level", "", "debug, info, warn or error (overrides logging.level)")
+	logFormat := flag.String("log-format", "", "\"text\" or \"json\" (overrides logging.format)")
+	adminSocket := flag.String("admin-socket", "", "serve the admin API on this Unix socket, eg. "+admin.DefaultSocket+" (overrides admin.socket)")
+	drainTimeout := flag.Duration("drain-timeout", 0, "at shutdown, how long tunnels get to finish before they're cut, eg. 1m (overrides drain_timeout)")
+	flag.Parse()
+
+	// the file, env vars and flags, checked. Again on a reload, which sees the same flags
+	loadConfig := func() (*config.Server, error) {
+		conf, err := config.LoadServer(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		conf.ApplyEnv()
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "cert":
+				conf.TLS.Cert = *certLoc
+			case "key":
+				conf.TLS.Key = *keyLoc
+			case "client-ca":
+				conf.TLS.ClientCA = *clientCALoc
+			case "cert-dir":
+				conf.TLS.CertDir = *certDir
+			case "client-crl":
+				conf.TLS.ClientCRL = *clientCRLLoc
+			case "metrics":
+				conf.Metrics.Listen = *metricsListen
+			case "log-level":
+				conf.Logging.Level = *logLevel
+			case "log-format":
+				conf.Logging.Format = *logFormat
+			case "admin-socket":
+				conf.Admin.Socket = *adminSocket
+			case "drain-timeout":
+				conf.DrainTimeout = *drainTimeout
+			}
+		})
+		return conf, conf.Validate()
+	}
+	conf, err := loadConfig()
+	if err != nil {
+		log.Fatalf("server: %v", err)
+	}
+	if err := logging.Setup(os.Stderr, conf.Logging.Format); err != nil {
+		log.Fatalf("server: %v", err)
+	}
+	if err := logging.SetLevels(conf.Logging.Level, conf.Logging.Subsystems); err != nil {
+		log.Fatalf("server: %v", err)
+	}
 
 	// The returned returned context is a WithCancel() context
 	// Its purpose it to shutdown the entire server upon a closing signal
 	cancelCtx := helpers.SetupShutdownHelper()
 	var wg sync.WaitGroup
-	
+
 	/* 
 		Shifted strategy: since we have go-routines called by go-routines, this leads to a bastardized mix of error handling.
 		Some places I was returning errors, others I was writing to an error channel. nothing worse than a mix.
@@ -24,17 +98,117 @@ func main(){
 		(using errgroup package is another approach, but not gonna look into that righ now...)
 	*/
 	errCh := make(chan error)
-	done := make(chan struct{})		// this done channel was created to ensure the ordering of the logs
+	done := make(chan struct{}) // this done channel was created to ensure the ordering of the logs
 	go helpers.ErrorCollector(errCh, done)
 
+	registry := services.NewRegistry(conf.Services)
+	registry.ReplaceVirtualHosts(conf.VirtualHosts)
+	registry.AllowDynamic = conf.AllowDynamicTargets
+	registry.Policy, err = policy.New(conf.Policy)
+	if err != nil {
+		log.Fatalf("server: %v", err)
+	}
+	if conf.Reverse.Enabled {
+		if registry.Reverse, err = policy.NewReverse(conf.Reverse); err != nil {
+			log.Fatalf("server: %v", err)
+		}
+		logger.Info("clients may register reverse forwards", "bind", conf.Reverse.Bind)
+	}
+	var ring *session.Ring
+	registry.Sessions, ring, err = setupSessions(conf.Sessions, conf.Metrics.Listen != "")
+	if err != nil {
+		log.Fatalf("server: %v", err)
+	}
+	defer registry.Sessions.Close()
+	registry.Live = session.NewTable()
+	// the listeners close on their own, what's left running on them is drained before we exit
 	wg.Add(1)
-	go tcp.ListenAndServeNoTLS(cancelCtx, errCh, &wg, config.RawTcpServerPort, config.HTTPEndpointService)
+	go drain(cancelCtx, &wg, registry.Live, conf.DrainTimeout)
+	logger.Info("offering services", "services", registry.Names())
+	if hosts := registry.VirtualHosts(); len(hosts) > 0 {
+		logger.Info("virtual hosts", "hosts", hosts)
+	}
 
-	wg.Add(1)
-	go tcp.ListenAndServeWithTLS(cancelCtx, errCh, &wg, config.TcpTlsServerPort, config.HTTPEndpointService)
+	// nil when no auth is configured, clients get in without a token
+	authenticator, err := auth.New(conf.Auth)
+	if err != nil {
+		log.Fatalf("server: %v", err)
+	}
+	if authenticator != nil {
+		logger.Info("clients need a token")
+	}
 
+	// nil unless tun.enabled, then QUIC clients asking for a TUN link get refused
+	var tunSwitch *tun.Switch
+	if conf.TUN.Enabled {
+		tunSwitch, err = setupTUN(cancelCtx, errCh, &wg, conf.TUN, registry.Policy)
+		if err != nil {
+			log.Fatalf("server: %v", err)
+		}
+	}
+
+	if conf.Metrics.Listen != "" {
+		wg.Add(1)
+		go metrics.ListenAndServe(cancelCtx, errCh, &wg, conf.Metrics.Listen, metrics.ServerRegistry())
+	}
+
+	// kill -HUP turns a subsystem up (or down) from the config file, without a restart
 	wg.Add(1)
-	go quic.QuicServer(cancelCtx, errCh, &wg, config.QuicServerPort)
+	go logging.ReloadOnSIGHUP(cancelCtx, &wg, errCh, func() (string, map[string]string, error) {
+		reloaded, err := loadConfig()
+		if err != nil {
+			return "", nil, err
+		}
+		return reloaded.Logging.Level, reloaded.Logging.Subsystems, nil
+	})
+
+	if conf.Listeners.TCP.Enabled {
+		if conf.TLS.ClientCA != "" {
+			logger.Warn("the raw TCP listener doesn't check client certs, anyone reaching it gets past mutual TLS", "port", conf.Listeners.TCP.Port)
+		}
+		if authenticator != nil {
+			logger.Warn("tokens sent to the raw TCP listener travel in the clear", "port", conf.Listeners.TCP.Port)
+		}
+		wg.Add(1)
+		go tcp.ListenAndServeNoTLS(cancelCtx, errCh, &wg, conf.Listeners.TCP, registry, authenticator)
+	}
+
+	// set when the TLS or QUIC listener is on
+	var certs *tlsconfig.CertReloader
+
+	if conf.Listeners.TLS.Enabled || conf.Listeners.Quic.Enabled {
+		// one keypair for both listeners, reloaded (with the client CRL) when the files change or on SIGHUP
+		certs, err = tlsconfig.NewCertReloader(conf.TLS.Cert, conf.TLS.Key, conf.TLS.CertDir)
+		if err != nil {
+			log.Fatalf("server: error loading server cert: %v", err)
+		}
+
+		tlsConf, err := tlsconfig.ServerTLSConfig(conf.TLS, certs)
+		if err != nil {
+			log.Fatalf("server: error getting server TLS config: %v", err)
+		}
+		// after ServerTLSConfig, which hands it the CRL
+		wg.Add(1)
+		go certs.Watch(cancelCtx, &wg, errCh)
+
+		if conf.Listeners.TLS.Enabled {
+			wg.Add(1)
+			go tcp.ListenAndServeWithTLS(cancelCtx, errCh, &wg, conf.Listeners.TLS, registry, authenticator, tlsConf)
+		}
+
+		if conf.Listeners.Quic.Enabled {
+			wg.Add(1)
+			go quic.QuicServer(cancelCtx, errCh, &wg, conf.Listeners.Quic, tlsConf, conf.Quic.QuicConfig(), registry, authenticator, tunSwitch, conf.UDPIdleTimeout)
+		}
+	}
+
+	if conf.Admin.Socket != "" {
+		api := &admin.API{Live: registry.Live, Ring: ring, Reload: func() ([]string, error) {
+			return reload(loadConfig, registry, certs)
+		}}
+		wg.Add(1)
+		go admin.ListenAndServe(cancelCtx, errCh, &wg, conf.Admin.Socket, api)
+	}
 
 	wg.Wait()
 	close(errCh)
@@ -43,6 +217,154 @@ func main(){
 		This way, the errors eminating from the server functions are all logged in order(!) before we exit
 	*/
 	<-done
-	log.Println("server: All servers closed. Exiting...")
+	logger.Info("all servers closed, exiting")
 }
 
+/*
+	Shutdown, once the listeners have stopped accepting: QUIC clients are told to go away as soon as
+	nothing's running on their connection, and whatever is still running after timeout is cut.
+	See session.Table.Shutdown. The tunnels are all in the wait group, main exits after the last one's record is written
+*/
+func drain(ctx context.Context, wg *sync.WaitGroup, live *session.Table, timeout time.Duration) {
+	defer wg.Done()
+	<-ctx.Done()
+	logger.Info("draining connections", "conns", len(live.Conns()), "timeout", timeout)
+	tunnels, conns := live.Shutdown(timeout)
+	if tunnels > 0 || conns > 0 {
+		logger.Warn("drain timeout passed, cut what was still running", "tunnels", tunnels, "conns", conns)
+		return
+	}
+	logger.Info("connections drained")
+}
+
+/*
+	What the admin API's reload does: the parts of the config a running server can take without a restart.
+	Services, virtual hosts and log levels from the file, and the certs (and client CRL) off disk. Listeners, policy, auth and the rest need a restart.
+	Certs go first, they're the only thing which can still fail, and then nothing's changed
+*/
+func reload(loadConfig func() (*config.Server, error), registry *services.Registry, certs *tlsconfig.CertReloader) ([]string, error) {
+	conf, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	var reloaded []string
+	if certs != nil {
+		if err := certs.Reload(); err != nil {
+			return nil, err
+		}
+		reloaded = append(reloaded, "certs")
+	}
+	registry.Replace(conf.Services)
+	registry.ReplaceVirtualHosts(conf.VirtualHosts)
+	// Validate checked the levels
+	logging.SetLevels(conf.Logging.Level, conf.Logging.Subsystems)
+	return append(reloaded, "services", "virtual_hosts", "log_levels"), nil
+}
+
+// One sink per configured destination, plus the byte counters when metrics are served. The ring is nil when sessions.ring is 0
+func setupSessions(conf config.Sessions, withMetrics bool) (*session.Recorder, *session.Ring, error) {
+	var sinks []session.Sink
+	if withMetrics {
+		sinks = append(sinks, metrics.SessionSink{})
+	}
+	if conf.Log {
+		sinks = append(sinks, session.LogSink{})
+	}
+	if conf.File != "" {
+		file, err := session.OpenFile(conf.File)
+		if err != nil {
+			return nil, nil, err
+		}
+		sinks = append(sinks, file)
+		logger.Info("session records go to a file", "path", conf.File)
+	}
+	var ring *session.Ring
+	if conf.Ring > 0 {
+		ring = session.NewRing(conf.Ring)
+		sinks = append(sinks, ring)
+	}
+	return session.NewRecorder(sinks...), ring, nil
+}
+
+/*
+	Opens the server's TUN device and the lease pool behind it, and the masquerade rules if asked for.
+	The switch (reading the device) and the pool (expiring leases) run in the background until ctx is cancelled, then the rules are removed
+*/
+func setupTUN(ctx context.Context, errCh chan<- error, wg *sync.WaitGroup, conf config.ServerTUN, pol *policy.Engine) (*tun.Switch, error) {
+	// all checked by Validate
+	var v4, v6 netip.Prefix
+	if conf.Address != "" {
+		v4, _ = config.ParseTUNAddress(conf.Address)
+	}
+	if conf.Address6 != "" {
+		v6, _ = config.ParseTUNAddress(conf.Address6)
+	}
+	pool, err := tun.NewPool(v4, v6, conf.LeasesFile, conf.LeaseTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	dev, err := tun.Open(tun.Config{Name: conf.Name, Addresses: pool.Prefixes(), MTU: conf.MTU})
+	if err != nil {
+		return nil, err
+	}
+	var nat *tun.NAT
+	if conf.NAT {
+		if err := tun.EnableForwarding(v4.IsValid(), v6.IsValid()); err != nil {
+			logger.Warn("enabling IP forwarding", "err", err)
+		}
+		if nat, err = tun.EnableNAT(dev.Name(), pool.Prefixes()); err != nil {
+			dev.Close()
+			return nil, err
+		}
+	}
+	if (v4.IsValid() && !forwarding(true)) || (v6.IsValid() && !forwarding(false)) {
+		logger.Warn("IP forwarding is off, TUN clients will only reach this box (sysctl net.ipv4.ip_forward=1 / net.ipv6.conf.all.forwarding=1)")
+	}
+
+	sw := tun.NewSwitch(dev, pool)
+	sw.ClientToClient = conf.ClientToClient
+	sw.Identities = conf.Identities
+	sw.Policy = pol.CheckAddr
+	for _, route := range conf.Routes {
+		p, _ := config.ParsePrefix(route)
+		sw.Routes = append(sw.Routes, p)
+	}
+	for _, dns := range conf.DNS {
+		sw.DNS = append(sw.DNS, netip.MustParseAddr(dns))
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := sw.Run(ctx); err != nil {
+			errCh <- err
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		pool.Run(ctx)
+	}()
+	if nat != nil {
+		// the rules go with the server, not with the box
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-ctx.Done()
+			if err := nat.Close(); err != nil {
+				errCh <- err
+			}
+		}()
+	}
+	return sw, nil
+}
+
+// Whether the kernel routes packets between interfaces, which TUN clients need to get past the server
+func forwarding(ipv4 bool) bool {
+	path := "/proc/sys/net/ipv6/conf/all/forwarding"
+	if ipv4 {
+		path = "/proc/sys/net/ipv4/ip_forward"
+	}
+	raw, err := os.ReadFile(path)
+	return err != nil || strings.TrimSpace(string(raw)) != "0"
+}
@@ -1,50 +1,528 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"net"
+	"net/netip"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/quic-go/quic-go"
+	"gopkg.in/yaml.v3"
 )
 
-// Server Specific
-var (
-	// Port for raw TCP listener
-	RawTcpServerPort = 9000
-	// Port for TCP+TLS listener
-	TcpTlsServerPort = 9001
-	// Port for QUIC listener
-	QuicServerPort	 = 9002
-	// Used in QUIC configs to adjust connection timeouts
-	TimeOutDuration  = time.Second * 15
+/*
+	Everything used to live in package-level vars, which meant a recompile every time a port moved.
+	Now the server and client each load a YAML file (see server.example.yaml and client.example.yaml)
+	and anything not set in the file falls back to the defaults below.
+
+	Precedence, lowest to highest:
+		1. built-in defaults (DefaultServer(), DefaultClient())
+		2. the config file passed with -config
+		3. env vars (SERVER_PEM, SERVER_KEY, CA_CERT_LOC)
+		4. command line flags which were explicitly set
+*/
+
+// Used in QUIC configs to adjust connection timeouts
+const TimeOutDuration = time.Second * 15
+
+/*
+	MTU of the TUN interfaces. The smallest IPv6 allows.
+	Most full sized packets are still too big for one QUIC datagram and go on the link's stream instead
+*/
+const DefaultTUNMTU = 1280
+
+/*
+	How long a UDP flow lives without a packet either way. Kept shorter on the client,
+	so it normally lets a flow go before the server times it out from under it
+*/
+const (
+	DefaultUDPIdleTimeout       = time.Minute
+	DefaultServerUDPIdleTimeout = 2 * time.Minute
 )
 
-// QUIC config for server
-var	ServerQuicConf = quic.Config{
-	EnableDatagrams: true,
-	MaxIdleTimeout: TimeOutDuration,
-	Allow0RTT: true,
+// How long the server waits at shutdown for the tunnels still running, before it cuts them
+const DefaultDrainTimeout = 30 * time.Second
+
+// Top level server config file
+type Server struct {
+	Listeners ServerListeners    `yaml:"listeners"`
+	Services  map[string]Service `yaml:"services"`
+	TLS       ServerTLS          `yaml:"tls"`
+	Quic      Quic               `yaml:"quic"`
+	// Service sets picked by the server name (TLS SNI) the client asked for, see VirtualHost
+	VirtualHosts map[string]VirtualHost `yaml:"virtual_hosts"`
+	// Lets clients name any host:port instead of a service (SOCKS, HTTP proxy). Off by default
+	AllowDynamicTargets bool `yaml:"allow_dynamic_targets"`
+	// What clients may reach, checked before every dial and on every packet from a TUN client. See policy.go
+	Policy Policy `yaml:"policy"`
+	// Token auth. Empty means clients don't need a token
+	Auth ServerAuth `yaml:"auth"`
+	// Layer 3 mode, IP packets from clients' TUN interfaces. Off by default
+	TUN ServerTUN `yaml:"tun"`
+	// UDP associations (UDP forwards, SOCKS UDP) nothing has gone through for this long are closed
+	UDPIdleTimeout time.Duration `yaml:"udp_idle_timeout"`
+	// At shutdown, how long tunnels get to finish once the listeners have stopped. 0 cuts them straight away
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+	// Ports clients may have the server listen on for them (reverse forwards). Off by default
+	Reverse ServerReverse `yaml:"reverse"`
+	// Where the record of each finished tunnel goes (bytes each way, how long, why it ended)
+	Sessions Sessions `yaml:"sessions"`
+	Metrics  Metrics  `yaml:"metrics"`
+	Logging  Logging  `yaml:"logging"`
+	Admin    Admin    `yaml:"admin"`
+
+	// the parsed file, kept around so validation errors can point at a line
+	doc *document
+}
+
+// One entry per transport the server knows about
+type ServerListeners struct {
+	TCP  Listener `yaml:"tcp"`
+	TLS  Listener `yaml:"tls"`
+	Quic Listener `yaml:"quic"`
+}
+
+// Every transport reads the stream header, so the client picks the backend service, not the listener
+type Listener struct {
+	Enabled bool   `yaml:"enabled"`
+	Bind    string `yaml:"bind"`
+	Port    int    `yaml:"port"`
+}
+
+// Addr returns the bind address of the listener as host:port
+func (l Listener) Addr() string {
+	return net.JoinHostPort(l.Bind, strconv.Itoa(l.Port))
 }
 
-// QUIC config for client
-var ClientQuicConfig = quic.Config{
-	EnableDatagrams: true,
+/*
+	A backend service the server is able to dial.
+	In the config file it can be written as a plain "host:port" string,
+	or as a mapping when more than the address is needed.
+*/
+type Service struct {
+	Addr    string `yaml:"addr"`
+	Network string `yaml:"network"`
 }
 
-// Server Endpoint Services
-var (
-	HTTPEndpointService = net.TCPAddr{
-		IP: net.ParseIP("127.0.0.1"),
-		Port: 8080,
+func (s *Service) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		s.Addr = node.Value
+		return nil
 	}
-	SSHEndpointService = net.TCPAddr{
-		IP: net.ParseIP("127.0.0.1"),
-		Port: 22,
+	type plain Service
+	return node.Decode((*plain)(s))
+}
+
+/*
+	One server, several names.
+	A client which asks for this name (-server-name, sent as SNI) on the TLS or QUIC listener
+	gets these services instead of the top level ones. Its cert comes from tls.cert_dir.
+*/
+type VirtualHost struct {
+	Services map[string]Service `yaml:"services"`
+}
+
+/*
+	Clients prove who they are with a token before any tunnel is set up.
+	Any of the methods below can be used, a token which passes one of them is in.
+*/
+type ServerAuth struct {
+	// Pre-shared tokens, identity -> token
+	Tokens map[string]string `yaml:"tokens"`
+	JWT    JWTAuth           `yaml:"jwt"`
+}
+
+// JWTs, eg. from the jwt-auth service. The sub claim is the identity
+type JWTAuth struct {
+	// File holding the HS256/384/512 secret (at least 32 bytes)
+	HMACSecretFile string `yaml:"hmac_secret_file"`
+	// JWKS document with the public keys (RS*, PS*, ES*, EdDSA) or "oct" secrets. Every kid has to be different,
+	// and an "oct" key needs one when hmac_secret_file is set too (a token without a kid is checked with that)
+	JWKSFile string `yaml:"jwks_file"`
+	// When set, the iss / aud claims have to match
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	// Clock skew allowed on exp and nbf
+	Leeway time.Duration `yaml:"leeway"`
+}
+
+/*
+	Reverse forwards: a client asks the server to listen on a port, and gets every connection to it sent back
+	over its QUIC connection. That's how a box at home gets reached without a port forward on the router.
+	A registration needs an allow rule matching the client's identity and the port, nothing is allowed without one.
+*/
+type ServerReverse struct {
+	Enabled bool `yaml:"enabled"`
+	// Address the listeners are opened on
+	Bind  string        `yaml:"bind"`
+	Allow []ReverseRule `yaml:"allow"`
+}
+
+type ReverseRule struct {
+	// Client identities (cert or token). Empty matches every client, even ones without an identity
+	Identities []string `yaml:"identities"`
+	// eg. "8443" or "8000-8999"
+	Ports []string `yaml:"ports"`
+}
+
+// The Prometheus endpoint, for the server and the client. See internal/metrics
+type Metrics struct {
+	// host:port /metrics is served on. Empty means no endpoint
+	Listen string `yaml:"listen"`
+}
+
+// The server's admin API, see internal/admin. Off by default
+type Admin struct {
+	// Unix socket it's served on, eg. /run/custom_vpn/admin.sock. Empty means no API
+	Socket string `yaml:"socket"`
+}
+
+/*
+	Log output, see internal/logging. The levels (not the format) are read again on SIGHUP,
+	so one subsystem can be turned up to debug on a running server
+*/
+type Logging struct {
+	// debug, info, warn or error
+	Level string `yaml:"level"`
+	// "text" (key=value) or "json", one object per line
+	Format string `yaml:"format"`
+	// Levels of single subsystems (quic, tcp, tun...), over level. See logging.Subsystems for the list
+	Subsystems map[string]string `yaml:"subsystems"`
+}
+
+// Session record sinks, see internal/session. Any number of them at once
+type Sessions struct {
+	// A log line per tunnel
+	Log bool `yaml:"log"`
+	// JSON lines file records are appended to. Empty means no file
+	File string `yaml:"file"`
+	// How many of the latest records are kept in memory, for the admin API. 0 keeps none
+	Ring int `yaml:"ring"`
+}
+
+/*
+	The server's end of TUN mode. One interface for every client.
+	Packets from clients are handed to the kernel, so reaching the LAN needs net.ipv4.ip_forward=1
+	and a route back to the tunnel subnet (or NAT) on the LAN's router.
+*/
+type ServerTUN struct {
+	Enabled bool   `yaml:"enabled"`
+	Name    string `yaml:"name"`
+	// The server's tunnel addresses, and the pools clients are leased addresses from. Either or both,
+	// eg. 10.99.0.1/24 and fd00:99::1/64
+	Address  string `yaml:"address"`
+	Address6 string `yaml:"address6"`
+	MTU      int    `yaml:"mtu"`
+	// Pushed to clients along with their addresses: subnets to route through the tunnel (eg. the LAN), and DNS servers
+	Routes []string `yaml:"routes"`
+	DNS    []string `yaml:"dns"`
+	// Where leases are kept across restarts. Empty keeps them in memory only
+	LeasesFile string `yaml:"leases_file"`
+	// How long a lease outlives its client's last link before the address goes back in the pool
+	LeaseTimeout time.Duration `yaml:"lease_timeout"`
+	// Masquerade client traffic leaving through other interfaces (nftables), so the LAN needs no route back to the pools.
+	// Turns on IP forwarding too
+	NAT bool `yaml:"nat"`
+	// Let clients reach each other's tunnel addresses. Off, packets between clients are dropped
+	ClientToClient bool `yaml:"client_to_client"`
+	// Client identities allowed to bring a TUN link up. Empty allows every client the listener lets in.
+	// What they may reach through it is up to the policy, checked on every packet they send
+	Identities []string `yaml:"identities"`
+}
+
+type ServerTLS struct {
+	// The default keypair, for clients whose server name has no cert in CertDir
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// Directory of <name>.pem / <name>.key pairs, each presented to clients asking for one of its DNS names
+	CertDir string `yaml:"cert_dir"`
+	// CA for client certs. When set, TLS and QUIC clients must present a cert it signed (mutual TLS)
+	ClientCA string `yaml:"client_ca"`
+	// Revoked client certs (`custom_vpn pki revoke` writes one). Only used with ClientCA
+	ClientCRL string `yaml:"client_crl"`
+}
+
+// QUIC tunables, shared by client and server
+type Quic struct {
+	MaxIdleTimeout     time.Duration `yaml:"max_idle_timeout"`
+	KeepAlivePeriod    time.Duration `yaml:"keep_alive_period"`
+	HandshakeTimeout   time.Duration `yaml:"handshake_idle_timeout"`
+	MaxIncomingStreams int64         `yaml:"max_incoming_streams"`
+	EnableDatagrams    bool          `yaml:"enable_datagrams"`
+	Allow0RTT          bool          `yaml:"allow_0rtt"`
+}
+
+// Converts the tunables into a quic-go config. Zero values are left for quic-go to default
+func (q Quic) QuicConfig() *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:       q.MaxIdleTimeout,
+		KeepAlivePeriod:      q.KeepAlivePeriod,
+		HandshakeIdleTimeout: q.HandshakeTimeout,
+		MaxIncomingStreams:   q.MaxIncomingStreams,
+		EnableDatagrams:      q.EnableDatagrams,
+		Allow0RTT:            q.Allow0RTT,
 	}
-)
+}
 
-// Client Specifc
-var (
+// Top level client config file
+type Client struct {
+	// IP of the remote server
+	Server string `yaml:"server"`
+	// Ports the server listens on, per transport
+	ServerPorts ServerPorts `yaml:"server_ports"`
+	// Local listeners, each one bound to a service on the server
+	Forwards []Forward `yaml:"forwards"`
+	// Optional SOCKS5 front-end for dynamic destinations
+	Socks Socks `yaml:"socks"`
+	// Optional HTTP proxy front-end (CONNECT and absolute-URI requests)
+	HTTPProxy HTTPProxy `yaml:"http_proxy"`
+	/*
+		The single forward shorthand, what the client did before it could take a list.
+		When no forwards are given (and there's no SOCKS, HTTP proxy, reverse forward or TUN mode), one is made from these:
+		0.0.0.0:<listen_port> -> service via mode.
+		Mode is also the transport for any forward which doesn't name one.
+	*/
 	// Port on which the client app recieves requests
-	ClientListnerPort = 2022
-)
\ No newline at end of file
+	ListenPort int `yaml:"listen_port"`
+	// Connection mode. "tcp", "tls", "quic", or "tun" (layer 3, over QUIC. Forwards default to quic then)
+	Mode string `yaml:"mode"`
+	// Name of the server side service to reach (see the server's services list)
+	Service string     `yaml:"service"`
+	TLS     ClientTLS  `yaml:"tls"`
+	Quic    Quic       `yaml:"quic"`
+	Auth    ClientAuth `yaml:"auth"`
+	// The interface for mode "tun"
+	TUN ClientTUN `yaml:"tun"`
+	// Ports on the server sent back to local addresses, over QUIC
+	Reverse []ReverseForward `yaml:"reverse"`
+	Metrics Metrics          `yaml:"metrics"`
+	Logging Logging          `yaml:"logging"`
+
+	doc *document
+}
+
+// A local listener on the client, and where its connections end up
+type Forward struct {
+	// Local address to listen on, eg. "127.0.0.1:2022" or ":2024"
+	Local string `yaml:"local"`
+	// Service on the server
+	Service string `yaml:"service"`
+	// "tcp", "tls", or "quic"
+	Transport string `yaml:"transport"`
+	// "tcp" (the default) or "udp". UDP forwards go to a udp service, over QUIC datagrams
+	Network string `yaml:"network"`
+	// UDP only. Each local sender gets its own flow to the server, dropped after this long without a packet
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+}
+
+func (f Forward) String() string {
+	if f.Network == "udp" {
+		return fmt.Sprintf("udp %s -> %s via %s", f.Local, f.Service, f.Transport)
+	}
+	return fmt.Sprintf("%s -> %s via %s", f.Local, f.Service, f.Transport)
+}
+
+/*
+	Parses a forward given on the command line, written as [udp:]local=service[/transport]
+	eg. "127.0.0.1:2022=http/quic", ":2024=ssh/tls" or "udp:127.0.0.1:5353=dns"
+	Transport is left empty when not given, the client's mode fills it in later
+*/
+func ParseForward(s string) (Forward, error) {
+	var fwd Forward
+	rest := s
+	if after, ok := strings.CutPrefix(s, "udp:"); ok {
+		fwd.Network, rest = "udp", after
+	}
+	local, target, ok := strings.Cut(rest, "=")
+	if !ok || local == "" || target == "" {
+		return Forward{}, fmt.Errorf("forward %q: want [udp:]local=service[/transport]", s)
+	}
+	fwd.Local = local
+	fwd.Service, fwd.Transport, _ = strings.Cut(target, "/")
+	return fwd, nil
+}
+
+// A port on the server (on its reverse.bind address) whose connections the client sends to Local
+type ReverseForward struct {
+	Remote int    `yaml:"remote"`
+	Local  string `yaml:"local"`
+}
+
+func (r ReverseForward) String() string {
+	return fmt.Sprintf("server :%d -> %s", r.Remote, r.Local)
+}
+
+// Parses a reverse forward given on the command line, written as [:]remote=local, eg. ":8443=127.0.0.1:3000"
+func ParseReverseForward(s string) (ReverseForward, error) {
+	remote, local, ok := strings.Cut(s, "=")
+	port, err := strconv.Atoi(strings.TrimPrefix(remote, ":"))
+	if !ok || err != nil || local == "" {
+		return ReverseForward{}, fmt.Errorf("reverse forward %q: want [:]remote port=local address", s)
+	}
+	return ReverseForward{Remote: port, Local: local}, nil
+}
+
+// The client's end of TUN mode. Its addresses are leased from the server
+type ClientTUN struct {
+	Name string `yaml:"name"`
+	MTU  int    `yaml:"mtu"`
+	/*
+		Split tunnelling. Routes are subnets to send through the tunnel on top of the ones the server pushes,
+		0.0.0.0/0 or ::/0 for everything. The tunnel subnet always goes through it.
+		Exclude keeps subnets on the way they went before the tunnel came up, where it's more specific than a route above.
+		The server itself is always kept off the tunnel.
+		Domains and ExcludeDomains do the same for hostnames' addresses, looked up once when the client starts
+	*/
+	Routes         []string `yaml:"routes"`
+	Exclude        []string `yaml:"exclude"`
+	Domains        []string `yaml:"domains"`
+	ExcludeDomains []string `yaml:"exclude_domains"`
+	// Where the routes the client added are noted, so they can be taken out again after a crash.
+	// Defaults to custom_vpn-<name>.routes.json in the temp dir
+	StateFile string `yaml:"state_file"`
+}
+
+/*
+	Parses an interface address, written as address/prefix length, eg. 10.99.0.1/24.
+	Unlike ParsePrefix the host bits are kept, and there has to be room in the subnet for the other end
+*/
+func ParseTUNAddress(s string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("bad address %q, want address/prefix length like 10.99.0.1/24", s)
+	}
+	if prefix.Bits() >= prefix.Addr().BitLen()-1 {
+		return netip.Prefix{}, fmt.Errorf("%q leaves no room for the other end of the tunnel", s)
+	}
+	return prefix, nil
+}
+
+// SOCKS5 listener on the client. The server must have allow_dynamic_targets set
+type Socks struct {
+	// Local address to listen on, eg. "127.0.0.1:1080". Empty means no SOCKS listener
+	Listen string `yaml:"listen"`
+	// Transport for CONNECT. UDP ASSOCIATE always goes over QUIC
+	Transport string `yaml:"transport"`
+}
+
+// HTTP proxy listener on the client. Like SOCKS, the server must have allow_dynamic_targets set
+type HTTPProxy struct {
+	// Local address to listen on, eg. "127.0.0.1:8888". Empty means no HTTP proxy
+	Listen string `yaml:"listen"`
+	// "tcp", "tls", or "quic"
+	Transport string `yaml:"transport"`
+}
+
+type ServerPorts struct {
+	TCP  int `yaml:"tcp"`
+	TLS  int `yaml:"tls"`
+	Quic int `yaml:"quic"`
+}
+
+// Server port for the given transport
+func (p ServerPorts) For(transport string) int {
+	switch transport {
+	case "tcp":
+		return p.TCP
+	case "tls":
+		return p.TLS
+	}
+	return p.Quic
+}
+
+// The token the client authenticates with, for servers which have auth set up
+type ClientAuth struct {
+	// A pre-shared token or a JWT
+	Token string `yaml:"token"`
+	// Read the token from a file instead, eg. one the jwt-auth service keeps fresh. Wins over Token
+	TokenFile string `yaml:"token_file"`
+}
+
+type ClientTLS struct {
+	CA string `yaml:"ca"`
+	// Name the server's cert is checked against, and sent as SNI. Picks the server's virtual host
+	ServerName string `yaml:"server_name"`
+	// Client cert and key, for servers which require mutual TLS. Both or neither
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	/*
+		SPKI pins for the server's cert, as "sha256/<base64>" (`client fingerprint server.pem` prints them).
+		With a CA the server cert has to chain to it *and* match a pin. Without one, matching a pin is enough,
+		so a road warrior only needs the pin, not the CA file.
+	*/
+	Pins []string `yaml:"pins"`
+}
+
+/*
+	Decodes a pin into the SHA-256 of a SubjectPublicKeyInfo.
+	Takes "sha256/<base64>", or the 64 hex characters (colons allowed) some tools print.
+*/
+func ParsePin(pin string) ([]byte, error) {
+	var sum []byte
+	var err error
+	if b64, ok := strings.CutPrefix(pin, "sha256/"); ok {
+		sum, err = base64.StdEncoding.DecodeString(b64)
+	} else {
+		sum, err = hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+	}
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("bad pin %q, want sha256/<base64> or 64 hex characters", pin)
+	}
+	return sum, nil
+}
+
+// Returns the config the server ran with back when everything was hardcoded
+func DefaultServer() *Server {
+	return &Server{
+		Listeners: ServerListeners{
+			TCP:  Listener{Enabled: true, Bind: "0.0.0.0", Port: 9000},
+			TLS:  Listener{Enabled: true, Bind: "0.0.0.0", Port: 9001},
+			Quic: Listener{Enabled: true, Bind: "0.0.0.0", Port: 9002},
+		},
+		Quic: Quic{
+			MaxIdleTimeout:  TimeOutDuration,
+			EnableDatagrams: true,
+			Allow0RTT:       true,
+		},
+		TUN:            ServerTUN{Name: "cvpn0", MTU: DefaultTUNMTU, LeaseTimeout: 24 * time.Hour},
+		UDPIdleTimeout: DefaultServerUDPIdleTimeout,
+		DrainTimeout:   DefaultDrainTimeout,
+		Reverse:        ServerReverse{Bind: "0.0.0.0"},
+		Sessions:       Sessions{Log: true, Ring: 1000},
+		Logging:        Logging{Level: "info", Format: "text"},
+	}
+}
+
+// Services used when the config file doesn't declare any
+func DefaultServices() map[string]Service {
+	return map[string]Service{
+		"http": {Addr: "127.0.0.1:8080", Network: "tcp"},
+		"ssh":  {Addr: "127.0.0.1:22", Network: "tcp"},
+	}
+}
+
+// Returns the config the client ran with back when everything was hardcoded
+func DefaultClient() *Client {
+	return &Client{
+		Server:      "127.0.0.1",
+		ServerPorts: ServerPorts{TCP: 9000, TLS: 9001, Quic: 9002},
+		ListenPort:  2022,
+		Mode:        "quic",
+		Service:     "http",
+		// what the client always checked the server cert against
+		TLS: ClientTLS{ServerName: "localhost"},
+		Quic: Quic{
+			// keeps the shared connection from idling out between requests.
+			// quic-go caps this at half the negotiated idle timeout
+			KeepAlivePeriod: 10 * time.Second,
+			EnableDatagrams: true,
+		},
+		TUN:     ClientTUN{Name: "cvpn0", MTU: DefaultTUNMTU},
+		Logging: Logging{Level: "info", Format: "text"},
+	}
+}
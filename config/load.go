@@ -0,0 +1,583 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"custom_vpn/internal/logging"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+	A parsed config file.
+	We hold on to the yaml node tree so that validation (which happens after env vars and flags are layered on)
+	can still say which line of the file a bad value came from.
+*/
+type document struct {
+	path string
+	root *yaml.Node
+}
+
+// Reads the file at path into out. Unknown keys are an error.
+func decodeFile(path string, out any) (*document, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config: %v", err)
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(raw, &root); err != nil {
+		return nil, fmt.Errorf("config: %s: %v", path, err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(out); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("config: %s: %v", path, err)
+	}
+
+	doc := &document{path: path}
+	if len(root.Content) > 0 {
+		doc.root = root.Content[0]
+	}
+	return doc, nil
+}
+
+/*
+	Walks the mapping (and sequence) nodes following path and returns the line of the last key it could find.
+	If a key isn't in the file at all (ie. the value came from a default, env var or flag) we get 0 back.
+*/
+func (d *document) line(path ...string) int {
+	if d == nil || d.root == nil {
+		return 0
+	}
+	node := d.root
+	line := 0
+	for _, key := range path {
+		// lists are walked by index, eg. forwards.1.local
+		if node.Kind == yaml.SequenceNode {
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node.Content) {
+				return line
+			}
+			node = node.Content[i]
+			line = node.Line
+			continue
+		}
+		if node.Kind != yaml.MappingNode {
+			return line
+		}
+		var next *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				line = node.Content[i].Line
+				next = node.Content[i+1]
+				break
+			}
+		}
+		if next == nil {
+			return line
+		}
+		node = next
+	}
+	return line
+}
+
+// Builds a validation error naming the key, and the line when the key came from the file
+func (d *document) errorf(path []string, format string, args ...any) error {
+	key := strings.Join(path, ".")
+	msg := fmt.Sprintf(format, args...)
+	if line := d.line(path...); line > 0 {
+		return fmt.Errorf("config: %s:%d: %s: %s", d.path, line, key, msg)
+	}
+	return fmt.Errorf("config: %s: %s", key, msg)
+}
+
+// Loads the server config. An empty path means defaults only.
+func LoadServer(path string) (*Server, error) {
+	conf := DefaultServer()
+	if path != "" {
+		doc, err := decodeFile(path, conf)
+		if err != nil {
+			return nil, err
+		}
+		conf.doc = doc
+	}
+	if len(conf.Services) == 0 {
+		conf.Services = DefaultServices()
+	}
+	return conf, nil
+}
+
+// Loads the client config. An empty path means defaults only.
+func LoadClient(path string) (*Client, error) {
+	conf := DefaultClient()
+	if path != "" {
+		doc, err := decodeFile(path, conf)
+		if err != nil {
+			return nil, err
+		}
+		conf.doc = doc
+	}
+	return conf, nil
+}
+
+// Env vars sit above the file, but below flags
+func (s *Server) ApplyEnv() {
+	if v := os.Getenv("SERVER_PEM"); v != "" {
+		s.TLS.Cert = v
+	}
+	if v := os.Getenv("SERVER_KEY"); v != "" {
+		s.TLS.Key = v
+	}
+}
+
+func (c *Client) ApplyEnv() {
+	if v := os.Getenv("CA_CERT_LOC"); v != "" {
+		c.TLS.CA = v
+	}
+}
+
+// Checks the final (file + env + flags) server config
+func (s *Server) Validate() error {
+	d := s.doc
+	listeners := []struct {
+		name string
+		l    Listener
+	}{
+		{"tcp", s.Listeners.TCP},
+		{"tls", s.Listeners.TLS},
+		{"quic", s.Listeners.Quic},
+	}
+	for _, entry := range listeners {
+		if !entry.l.Enabled {
+			continue
+		}
+		if err := checkPort(d, entry.l.Port, "listeners", entry.name, "port"); err != nil {
+			return err
+		}
+		if net.ParseIP(entry.l.Bind) == nil {
+			return d.errorf([]string{"listeners", entry.name, "bind"}, "%q is not an IP address", entry.l.Bind)
+		}
+	}
+
+	if err := checkServices(d, s.Services, "services"); err != nil {
+		return err
+	}
+	for host, vhost := range s.VirtualHosts {
+		if host == "" || host != strings.ToLower(host) {
+			return d.errorf([]string{"virtual_hosts", host}, "server names have to be lower case")
+		}
+		if len(vhost.Services) == 0 {
+			return d.errorf([]string{"virtual_hosts", host, "services"}, "a virtual host needs at least one service")
+		}
+		if err := checkServices(d, vhost.Services, "virtual_hosts", host, "services"); err != nil {
+			return err
+		}
+	}
+
+	if s.Listeners.TLS.Enabled || s.Listeners.Quic.Enabled {
+		if s.TLS.Cert == "" {
+			return d.errorf([]string{"tls", "cert"}, "not set (use the config file, SERVER_PEM or -cert)")
+		}
+		if s.TLS.Key == "" {
+			return d.errorf([]string{"tls", "key"}, "not set (use the config file, SERVER_KEY or -key)")
+		}
+	}
+	for identity, token := range s.Auth.Tokens {
+		if identity == "" || token == "" {
+			return d.errorf([]string{"auth", "tokens", identity}, "identities and tokens can't be empty")
+		}
+	}
+	if s.Auth.JWT.Leeway < 0 {
+		return d.errorf([]string{"auth", "jwt", "leeway"}, "can't be negative")
+	}
+	if s.TLS.ClientCRL != "" && s.TLS.ClientCA == "" {
+		return d.errorf([]string{"tls", "client_crl"}, "only makes sense with tls.client_ca set")
+	}
+	if err := s.Policy.validate(d); err != nil {
+		return err
+	}
+	if s.TUN.Enabled {
+		if !s.Listeners.Quic.Enabled {
+			return d.errorf([]string{"tun", "enabled"}, "TUN mode needs the QUIC listener")
+		}
+		if err := checkTUN(d, s.TUN.Name, s.TUN.MTU); err != nil {
+			return err
+		}
+		if s.TUN.Address == "" && s.TUN.Address6 == "" {
+			return d.errorf([]string{"tun", "address"}, "set address, address6 or both, eg. 10.99.0.1/24")
+		}
+		addresses := []struct {
+			key, value string
+			v4         bool
+		}{
+			{"address", s.TUN.Address, true},
+			{"address6", s.TUN.Address6, false},
+		}
+		for _, a := range addresses {
+			if a.value == "" {
+				continue
+			}
+			prefix, err := ParseTUNAddress(a.value)
+			if err != nil {
+				return d.errorf([]string{"tun", a.key}, "%v", err)
+			}
+			if prefix.Addr().Is4() != a.v4 {
+				return d.errorf([]string{"tun", a.key}, "address is for IPv4, address6 for IPv6")
+			}
+		}
+		if s.TUN.Address6 != "" && s.TUN.MTU < 1280 {
+			return d.errorf([]string{"tun", "mtu"}, "IPv6 needs an MTU of at least 1280")
+		}
+		for i, route := range s.TUN.Routes {
+			if _, err := ParsePrefix(route); err != nil {
+				return d.errorf([]string{"tun", "routes", strconv.Itoa(i)}, "%v", err)
+			}
+		}
+		for i, dns := range s.TUN.DNS {
+			if _, err := netip.ParseAddr(dns); err != nil {
+				return d.errorf([]string{"tun", "dns", strconv.Itoa(i)}, "%q is not an IP address", dns)
+			}
+		}
+		if s.TUN.LeaseTimeout <= 0 {
+			return d.errorf([]string{"tun", "lease_timeout"}, "has to be positive")
+		}
+		for i, identity := range s.TUN.Identities {
+			if identity == "" {
+				return d.errorf([]string{"tun", "identities", strconv.Itoa(i)}, "identities can't be empty")
+			}
+		}
+	}
+	if s.UDPIdleTimeout <= 0 {
+		return d.errorf([]string{"udp_idle_timeout"}, "has to be positive")
+	}
+	if s.DrainTimeout < 0 {
+		return d.errorf([]string{"drain_timeout"}, "can't be negative")
+	}
+	if err := checkMetrics(d, s.Metrics); err != nil {
+		return err
+	}
+	if err := checkLogging(d, s.Logging); err != nil {
+		return err
+	}
+	if s.Sessions.Ring < 0 {
+		return d.errorf([]string{"sessions", "ring"}, "can't be negative")
+	}
+	// sun_path is 108 bytes, with the terminating nul
+	if len(s.Admin.Socket) > 107 {
+		return d.errorf([]string{"admin", "socket"}, "socket paths are at most 107 bytes, %q isn't", s.Admin.Socket)
+	}
+	if s.Reverse.Enabled {
+		if !s.Listeners.Quic.Enabled {
+			return d.errorf([]string{"reverse", "enabled"}, "reverse forwards need the QUIC listener")
+		}
+		if net.ParseIP(s.Reverse.Bind) == nil {
+			return d.errorf([]string{"reverse", "bind"}, "%q is not an IP address", s.Reverse.Bind)
+		}
+		for i, rule := range s.Reverse.Allow {
+			if len(rule.Ports) == 0 {
+				return d.errorf([]string{"reverse", "allow", strconv.Itoa(i)}, "a rule needs ports")
+			}
+			for j, ports := range rule.Ports {
+				if _, _, err := ParsePortRange(ports); err != nil {
+					return d.errorf([]string{"reverse", "allow", strconv.Itoa(i), "ports", strconv.Itoa(j)}, "%v", err)
+				}
+			}
+		}
+	}
+	return checkQuic(d, s.Quic)
+}
+
+// Checks the final (file + env + flags) client config
+func (c *Client) Validate() error {
+	d := c.doc
+	if net.ParseIP(c.Server) == nil {
+		return d.errorf([]string{"server"}, "%q is not an IP address", c.Server)
+	}
+	for key, port := range map[string]int{"tcp": c.ServerPorts.TCP, "tls": c.ServerPorts.TLS, "quic": c.ServerPorts.Quic} {
+		if err := checkPort(d, port, "server_ports", key); err != nil {
+			return err
+		}
+	}
+	switch c.Mode {
+	case "tcp", "tls", "quic", "tun":
+	default:
+		return d.errorf([]string{"mode"}, "must be one of \"tcp\", \"tls\", \"quic\" or \"tun\", got %q", c.Mode)
+	}
+	// for forwards, SOCKS and the HTTP proxy when they don't name a transport. TUN mode rides on QUIC
+	defaultTransport := c.Mode
+	if c.Mode == "tun" {
+		defaultTransport = "quic"
+	}
+
+	// no forwards means the single forward shorthand. TUN mode, the proxies and clients with only reverse forwards don't need any
+	if len(c.Forwards) == 0 && c.Mode != "tun" && len(c.Reverse) == 0 && c.Socks.Listen == "" && c.HTTPProxy.Listen == "" {
+		if err := checkPort(d, c.ListenPort, "listen_port"); err != nil {
+			return err
+		}
+		c.Forwards = []Forward{{
+			Local:   net.JoinHostPort("0.0.0.0", strconv.Itoa(c.ListenPort)),
+			Service: c.Service,
+		}}
+	}
+
+	needsCA := false
+	seen := make(map[string]bool)
+	for i := range c.Forwards {
+		fwd := &c.Forwards[i]
+		path := []string{"forwards", strconv.Itoa(i)}
+		switch fwd.Network {
+		case "", "tcp":
+			fwd.Network = "tcp"
+			if fwd.Transport == "" {
+				fwd.Transport = defaultTransport
+			}
+		case "udp":
+			// datagrams only exist on QUIC
+			if fwd.Transport == "" {
+				fwd.Transport = "quic"
+			}
+			if fwd.Transport != "quic" {
+				return d.errorf(append(path, "transport"), "UDP forwards only work over quic, got %q", fwd.Transport)
+			}
+			if fwd.IdleTimeout == 0 {
+				fwd.IdleTimeout = DefaultUDPIdleTimeout
+			}
+			if fwd.IdleTimeout < 0 {
+				return d.errorf(append(path, "idle_timeout"), "has to be positive")
+			}
+		default:
+			return d.errorf(append(path, "network"), "must be \"tcp\" or \"udp\", got %q", fwd.Network)
+		}
+		if err := checkTransport(d, fwd.Transport, append(path, "transport")...); err != nil {
+			return err
+		}
+		needsCA = needsCA || fwd.Transport != "tcp"
+
+		_, port, err := net.SplitHostPort(fwd.Local)
+		if err != nil {
+			return d.errorf(append(path, "local"), "bad address %q: %v", fwd.Local, err)
+		}
+		portNum, err := strconv.Atoi(port)
+		if err != nil {
+			return d.errorf(append(path, "local"), "bad port %q", port)
+		}
+		if err := checkPort(d, portNum, append(path, "local")...); err != nil {
+			return err
+		}
+		// a TCP and a UDP forward can share a port
+		if seen[fwd.Network+" "+fwd.Local] {
+			return d.errorf(append(path, "local"), "%q is already used by another %s forward", fwd.Local, fwd.Network)
+		}
+		seen[fwd.Network+" "+fwd.Local] = true
+
+		if fwd.Service == "" || len(fwd.Service) > maxServiceNameLen {
+			return d.errorf(append(path, "service"), "service names must be 1-%d bytes long", maxServiceNameLen)
+		}
+	}
+	if c.Socks.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Socks.Listen); err != nil {
+			return d.errorf([]string{"socks", "listen"}, "bad address %q: %v", c.Socks.Listen, err)
+		}
+		if c.Socks.Transport == "" {
+			c.Socks.Transport = defaultTransport
+		}
+		if err := checkTransport(d, c.Socks.Transport, "socks", "transport"); err != nil {
+			return err
+		}
+		// UDP ASSOCIATE uses QUIC no matter what
+		needsCA = true
+	}
+	if c.HTTPProxy.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.HTTPProxy.Listen); err != nil {
+			return d.errorf([]string{"http_proxy", "listen"}, "bad address %q: %v", c.HTTPProxy.Listen, err)
+		}
+		if c.HTTPProxy.Transport == "" {
+			c.HTTPProxy.Transport = defaultTransport
+		}
+		if err := checkTransport(d, c.HTTPProxy.Transport, "http_proxy", "transport"); err != nil {
+			return err
+		}
+		needsCA = needsCA || c.HTTPProxy.Transport != "tcp"
+	}
+	remotes := make(map[int]bool)
+	for i, rev := range c.Reverse {
+		path := []string{"reverse", strconv.Itoa(i)}
+		if err := checkPort(d, rev.Remote, append(path, "remote")...); err != nil {
+			return err
+		}
+		if remotes[rev.Remote] {
+			return d.errorf(append(path, "remote"), "port %d is already used by another reverse forward", rev.Remote)
+		}
+		remotes[rev.Remote] = true
+		if _, _, err := net.SplitHostPort(rev.Local); err != nil {
+			return d.errorf(append(path, "local"), "bad address %q: %v", rev.Local, err)
+		}
+		// registered over the QUIC connection
+		needsCA = true
+	}
+	if err := checkMetrics(d, c.Metrics); err != nil {
+		return err
+	}
+	if err := checkLogging(d, c.Logging); err != nil {
+		return err
+	}
+	if c.Mode == "tun" {
+		if err := checkTUN(d, c.TUN.Name, c.TUN.MTU); err != nil {
+			return err
+		}
+		lists := []struct {
+			key    string
+			values []string
+			domain bool
+		}{
+			{"routes", c.TUN.Routes, false},
+			{"exclude", c.TUN.Exclude, false},
+			{"domains", c.TUN.Domains, true},
+			{"exclude_domains", c.TUN.ExcludeDomains, true},
+		}
+		for _, l := range lists {
+			for i, v := range l.values {
+				path := []string{"tun", l.key, strconv.Itoa(i)}
+				if !l.domain {
+					if _, err := ParsePrefix(v); err != nil {
+						return d.errorf(path, "%v", err)
+					}
+					continue
+				}
+				if _, err := netip.ParseAddr(v); err == nil {
+					return d.errorf(path, "%q is an address, that goes in routes or exclude", v)
+				}
+				if v == "" || strings.ContainsAny(v, "/: ") {
+					return d.errorf(path, "%q is not a hostname", v)
+				}
+			}
+		}
+		if c.TUN.StateFile == "" {
+			c.TUN.StateFile = filepath.Join(os.TempDir(), "custom_vpn-"+c.TUN.Name+".routes.json")
+		}
+		needsCA = true
+	}
+	for _, pin := range c.TLS.Pins {
+		if _, err := ParsePin(pin); err != nil {
+			return d.errorf([]string{"tls", "pins"}, "%v", err)
+		}
+	}
+	if needsCA && c.TLS.CA == "" && len(c.TLS.Pins) == 0 {
+		return d.errorf([]string{"tls", "ca"}, "not set (use the config file, CA_CERT_LOC or -ca, or pin the server with -pin)")
+	}
+	if c.TLS.ServerName == "" {
+		return d.errorf([]string{"tls", "server_name"}, "can't be empty")
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return d.errorf([]string{"tls", "cert"}, "the client cert and key have to be set together (-cert and -key)")
+	}
+	return checkQuic(d, c.Quic)
+}
+
+// Checks a set of services, and fills in the default network
+func checkServices(d *document, services map[string]Service, path ...string) error {
+	for name, svc := range services {
+		svcPath := append(append([]string{}, path...), name)
+		if name == "" || len(name) > maxServiceNameLen {
+			return d.errorf(svcPath, "service names must be 1-%d bytes long", maxServiceNameLen)
+		}
+		if _, _, err := net.SplitHostPort(svc.Addr); err != nil {
+			return d.errorf(svcPath, "bad address %q: %v", svc.Addr, err)
+		}
+		switch svc.Network {
+		case "":
+			svc.Network = "tcp"
+			services[name] = svc
+		case "tcp", "udp":
+		default:
+			return d.errorf(append(svcPath, "network"), "must be \"tcp\" or \"udp\", got %q", svc.Network)
+		}
+	}
+	return nil
+}
+
+// Keeps service names readable in logs. The stream header itself would take up to 64KiB
+const maxServiceNameLen = 255
+
+func checkTransport(d *document, transport string, path ...string) error {
+	switch transport {
+	case "tcp", "tls", "quic":
+		return nil
+	}
+	return d.errorf(path, "must be one of \"tcp\", \"tls\" or \"quic\", got %q", transport)
+}
+
+func checkMetrics(d *document, m Metrics) error {
+	if m.Listen == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(m.Listen); err != nil {
+		return d.errorf([]string{"metrics", "listen"}, "bad address %q: %v", m.Listen, err)
+	}
+	return nil
+}
+
+func checkLogging(d *document, l Logging) error {
+	if _, err := logging.ParseLevel(l.Level); err != nil {
+		return d.errorf([]string{"logging", "level"}, "%v", err)
+	}
+	if l.Format != "text" && l.Format != "json" {
+		return d.errorf([]string{"logging", "format"}, "must be \"text\" or \"json\", got %q", l.Format)
+	}
+	for name, level := range l.Subsystems {
+		path := []string{"logging", "subsystems", name}
+		if !logging.KnownSubsystem(name) {
+			return d.errorf(path, "no log subsystem %q, there's %s", name, strings.Join(logging.Subsystems, ", "))
+		}
+		if _, err := logging.ParseLevel(level); err != nil {
+			return d.errorf(path, "%v", err)
+		}
+	}
+	return nil
+}
+
+// Interface settings shared by the server's and client's tun sections
+func checkTUN(d *document, name string, mtu int) error {
+	// IFNAMSIZ, less the terminating nul
+	if len(name) > 15 {
+		return d.errorf([]string{"tun", "name"}, "interface names are at most 15 bytes, %q isn't", name)
+	}
+	if mtu < 576 || mtu > 65535 {
+		return d.errorf([]string{"tun", "mtu"}, "%d out of range (576-65535)", mtu)
+	}
+	return nil
+}
+
+func checkPort(d *document, port int, path ...string) error {
+	if port < 1 || port > 65535 {
+		return d.errorf(path, "port %d out of range", port)
+	}
+	return nil
+}
+
+func checkQuic(d *document, q Quic) error {
+	if q.MaxIdleTimeout < 0 {
+		return d.errorf([]string{"quic", "max_idle_timeout"}, "can't be negative")
+	}
+	if q.KeepAlivePeriod < 0 {
+		return d.errorf([]string{"quic", "keep_alive_period"}, "can't be negative")
+	}
+	if q.HandshakeTimeout < 0 {
+		return d.errorf([]string{"quic", "handshake_idle_timeout"}, "can't be negative")
+	}
+	if q.MaxIncomingStreams < 0 {
+		return d.errorf([]string{"quic", "max_incoming_streams"}, "can't be negative")
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Writes yaml to a file in a temp dir and returns its path
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func loadClient(t *testing.T, yaml string) *Client {
+	t.Helper()
+	c, err := LoadClient(writeConfig(t, yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// The single forward shorthand only kicks in when the client has nothing else to do
+func TestClientDefaultForward(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		forwards int
+	}{
+		{name: "nothing configured", yaml: "tls: {ca: ca.pem}\n", forwards: 1},
+		{name: "SOCKS only", yaml: "tls: {ca: ca.pem}\nsocks: {listen: 127.0.0.1:1080}\n"},
+		{name: "HTTP proxy only", yaml: "tls: {ca: ca.pem}\nhttp_proxy: {listen: 127.0.0.1:8888}\n"},
+		{name: "reverse only", yaml: "tls: {ca: ca.pem}\nreverse: [{remote: 8443, local: 127.0.0.1:3000}]\n"},
+		{name: "TUN mode", yaml: "tls: {ca: ca.pem}\nmode: tun\n"},
+		{name: "forwards given", yaml: "tls: {ca: ca.pem}\nforwards: [{local: 127.0.0.1:2000, service: ssh}, {local: 127.0.0.1:2001, service: web}]\n", forwards: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := loadClient(t, tt.yaml)
+			if len(c.Forwards) != tt.forwards {
+				t.Errorf("got forwards %+v, want %d", c.Forwards, tt.forwards)
+			}
+		})
+	}
+}
+
+func TestStrictLoading(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{name: "unknown key", yaml: "server: 10.0.0.1\nserver_portz:\n  tcp: 9000\n", want: "line 2: field server_portz not found"},
+		{name: "unknown nested key", yaml: "server: 10.0.0.1\ntls:\n  ca: ca.pem\n  cafile: ca.pem\n", want: "line 4: field cafile not found"},
+		{name: "type error", yaml: "server: 10.0.0.1\nlisten_port: lots\n", want: "line 2: cannot unmarshal !!str `lots` into int"},
+		{name: "type error in a list", yaml: "forwards:\n  - local: 127.0.0.1:2000\n    service: [ssh]\n", want: "line 3: cannot unmarshal !!seq into string"},
+		{name: "not yaml", yaml: "server: [10.0.0.1\n", want: "did not find expected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, tt.yaml)
+			_, err := LoadClient(path)
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if !strings.Contains(err.Error(), tt.want) || !strings.Contains(err.Error(), path) {
+				t.Errorf("err = %v, want it to name %s and say %q", err, path, tt.want)
+			}
+		})
+	}
+}
+
+// Validation happens after env vars and flags, and still says which line of the file a bad value is on
+func TestValidateErrorLines(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{name: "from the file", yaml: "tls: {ca: ca.pem}\n\nlisten_port: 70000\n", want: ":3: listen_port:"},
+		{name: "in a list", yaml: "tls: {ca: ca.pem}\nforwards:\n  - {local: 127.0.0.1:2000, service: ssh}\n  - {local: 127.0.0.1:2000, service: web}\n", want: ":4: forwards.1.local:"},
+		{name: "not in the file", yaml: "mode: tun\n", want: "config: tls.ca: not set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := LoadClient(writeConfig(t, tt.yaml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want it to say %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// Defaults, then the file, then env vars, then flags. The cmd packages set flags after ApplyEnv, as done here
+func TestPrecedence(t *testing.T) {
+	file := writeConfig(t, "listen_port: 3000\ntls:\n  ca: /from/file.pem\n")
+	tests := []struct {
+		name   string
+		path   string
+		env    string
+		flag   string
+		wantCA string
+		port   int
+	}{
+		{name: "defaults", wantCA: "", port: 2022},
+		{name: "file over defaults", path: file, wantCA: "/from/file.pem", port: 3000},
+		{name: "env over file", path: file, env: "/from/env.pem", wantCA: "/from/env.pem", port: 3000},
+		{name: "env over defaults", env: "/from/env.pem", wantCA: "/from/env.pem", port: 2022},
+		{name: "flag over env", path: file, env: "/from/env.pem", flag: "/from/flag.pem", wantCA: "/from/flag.pem", port: 3000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CA_CERT_LOC", tt.env)
+			c, err := LoadClient(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.ApplyEnv()
+			if tt.flag != "" {
+				c.TLS.CA = tt.flag
+			}
+			if c.TLS.CA != tt.wantCA || c.ListenPort != tt.port {
+				t.Errorf("got ca %q port %d, want %q %d", c.TLS.CA, c.ListenPort, tt.wantCA, tt.port)
+			}
+		})
+	}
+}
+
+func TestServerPrecedence(t *testing.T) {
+	file := writeConfig(t, "tls:\n  cert: /from/file.pem\n  key: /from/file.key\n")
+	t.Setenv("SERVER_PEM", "/from/env.pem")
+	t.Setenv("SERVER_KEY", "")
+	s, err := LoadServer(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ApplyEnv()
+	// an env var that's set wins, an empty one leaves the file alone
+	if s.TLS.Cert != "/from/env.pem" || s.TLS.Key != "/from/file.key" {
+		t.Errorf("got cert %q key %q", s.TLS.Cert, s.TLS.Key)
+	}
+	// with no services in the file, the defaults are offered
+	if len(s.Services) != len(DefaultServices()) {
+		t.Errorf("got services %v", s.Services)
+	}
+}
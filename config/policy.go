@@ -0,0 +1,110 @@
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+/*
+	Destination policy for the server: who may reach what.
+	Rules are checked in order and the first rule that matches decides. Requests no rule matches get Default.
+	Every field of a rule is optional, a rule matches when all the fields it does set match.
+
+	CIDRs are checked against the addresses a host actually resolves to (and those are the addresses that get dialed),
+	so a name that rebinds to 10.0.0.5 is still caught by a deny on 10.0.0.0/8.
+*/
+type Policy struct {
+	// "allow" or "deny". Empty means allow, which is how the server behaved before there was a policy
+	Default string `yaml:"default"`
+	Rules   []Rule `yaml:"rules"`
+}
+
+type Rule struct {
+	// "allow" or "deny"
+	Action string `yaml:"action"`
+	// Client identities: the common name (or first SAN) of the client's cert, see tls.client_ca.
+	// A rule naming identities never matches a client without one
+	Identities []string `yaml:"identities"`
+	// Named services from the services list. A dynamic target (SOCKS, HTTP proxy) has no service name
+	Services []string `yaml:"services"`
+	// Destination networks, eg. "10.0.0.0/8" or a single address "192.168.1.20"
+	CIDRs []string `yaml:"cidrs"`
+	// Destination ports, eg. "443" or "8000-8999"
+	Ports []string `yaml:"ports"`
+	// Destination names as the client gave them, eg. "example.com" or "*.example.com" (subdomains only)
+	Hosts []string `yaml:"hosts"`
+}
+
+// Parses "80" or "8000-8999" into an inclusive range
+func ParsePortRange(s string) (lo, hi uint16, err error) {
+	first, last, isRange := strings.Cut(s, "-")
+	if !isRange {
+		last = first
+	}
+	l, err := strconv.ParseUint(strings.TrimSpace(first), 10, 16)
+	if err != nil || l == 0 {
+		return 0, 0, fmt.Errorf("bad port range %q", s)
+	}
+	h, err := strconv.ParseUint(strings.TrimSpace(last), 10, 16)
+	if err != nil || h < l {
+		return 0, 0, fmt.Errorf("bad port range %q", s)
+	}
+	return uint16(l), uint16(h), nil
+}
+
+// Parses a CIDR, or a bare address as a single host prefix
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("bad CIDR %q", s)
+		}
+		return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("bad CIDR %q", s)
+	}
+	return prefix.Masked(), nil
+}
+
+func checkAction(d *document, action string, path ...string) error {
+	switch action {
+	case "allow", "deny":
+		return nil
+	}
+	return d.errorf(path, "must be \"allow\" or \"deny\", got %q", action)
+}
+
+func (p *Policy) validate(d *document) error {
+	if p.Default == "" {
+		p.Default = "allow"
+	}
+	if err := checkAction(d, p.Default, "policy", "default"); err != nil {
+		return err
+	}
+	for i, rule := range p.Rules {
+		path := []string{"policy", "rules", strconv.Itoa(i)}
+		if err := checkAction(d, rule.Action, append(path, "action")...); err != nil {
+			return err
+		}
+		for _, cidr := range rule.CIDRs {
+			if _, err := ParsePrefix(cidr); err != nil {
+				return d.errorf(append(path, "cidrs"), "%v", err)
+			}
+		}
+		for _, ports := range rule.Ports {
+			if _, _, err := ParsePortRange(ports); err != nil {
+				return d.errorf(append(path, "ports"), "%v", err)
+			}
+		}
+		for _, host := range rule.Hosts {
+			if strings.TrimPrefix(host, "*.") == "" || strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+				return d.errorf(append(path, "hosts"), "bad host pattern %q, want \"name\" or \"*.name\"", host)
+			}
+		}
+	}
+	return nil
+}
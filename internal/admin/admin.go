@@ -0,0 +1,241 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"custom_vpn/internal/logging"
+	"custom_vpn/internal/session"
+)
+
+/*
+	The server's admin API: JSON over HTTP, on a Unix socket. Who gets to use it is down to the socket's permissions,
+	it's 0600, so root (or whoever runs the server). `custom_vpn ctl` is the client.
+
+		GET  /conns                              connections, and the tunnels on them
+		GET  /conns/{id}                         one of them, a prefix of the ID does
+		POST /conns/{id}/kill                    closes a connection, and every tunnel on it
+		POST /conns/{id}/streams/{stream}/kill   ends one tunnel, the connection stays up (-1 is a TCP/TLS connection's)
+		GET  /listeners
+		POST /listeners/{name}/drain             stops tcp, tls or quic accepting, the connections it has keep going
+		POST /reload                             reads the config file again
+		GET  /sessions?n=20                      the latest session records, from the ring (sessions.ring)
+		GET  /log-levels
+		POST /log-levels                         {"subsystem": "quic", "level": "debug"}, no subsystem sets the default
+
+	Errors come back as {"error": "..."}, with a 404 for anything that isn't there (anymore).
+*/
+
+var logger = logging.For("admin")
+
+// Where `custom_vpn ctl` looks for the socket when it isn't told
+const DefaultSocket = "/run/custom_vpn/admin.sock"
+
+type API struct {
+	Live *session.Table
+	// nil when sessions.ring is 0
+	Ring *session.Ring
+	// reads the config file again and applies what can be applied to a running server, returns what that was
+	Reload func() ([]string, error)
+}
+
+// What POST /log-levels takes
+type LevelChange struct {
+	Subsystem string `json:"subsystem,omitempty"`
+	Level     string `json:"level"`
+}
+
+// Serves api on a Unix socket at path until ctx is cancelled
+func ListenAndServe(ctx context.Context, errCh chan<- error, wg *sync.WaitGroup, path string, api *API) {
+	defer wg.Done()
+
+	listener, err := listen(path)
+	if err != nil {
+		errCh <- fmt.Errorf("admin: %v", err)
+		return
+	}
+	logger.Info("serving", "socket", path)
+
+	server := &http.Server{Handler: api.routes(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		// closing the listener takes the socket file with it
+		server.Close()
+	}()
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		errCh <- fmt.Errorf("admin: %v", err)
+	}
+}
+
+func listen(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, err
+	}
+	// a socket left behind by a server that was killed is in the way. One that answers belongs to a server that's running
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use, is another server running?", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (api *API) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /conns", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, api.Live.Conns(), nil)
+	})
+	mux.HandleFunc("GET /conns/{id}", func(w http.ResponseWriter, r *http.Request) {
+		info, err := api.Live.Conn(r.PathValue("id"))
+		reply(w, info, err)
+	})
+	mux.HandleFunc("POST /conns/{id}/kill", api.killConn)
+	mux.HandleFunc("POST /conns/{id}/streams/{stream}/kill", api.killStream)
+	mux.HandleFunc("GET /listeners", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, api.Live.Listeners(), nil)
+	})
+	mux.HandleFunc("POST /listeners/{name}/drain", api.drain)
+	mux.HandleFunc("POST /reload", api.reload)
+	mux.HandleFunc("GET /sessions", api.sessions)
+	mux.HandleFunc("GET /log-levels", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, logging.Levels(), nil)
+	})
+	mux.HandleFunc("POST /log-levels", api.setLevel)
+	return mux
+}
+
+func (api *API) killConn(w http.ResponseWriter, r *http.Request) {
+	// the full ID, for the log and the reply
+	info, err := api.Live.Conn(r.PathValue("id"))
+	if err == nil {
+		err = api.Live.KillConn(info.ConnID)
+	}
+	if err != nil {
+		reply(w, nil, err)
+		return
+	}
+	logger.Info("killing a connection", "conn_id", info.ConnID, "client", info.Client, "identity", info.Identity)
+	reply(w, info, nil)
+}
+
+func (api *API) killStream(w http.ResponseWriter, r *http.Request) {
+	stream, err := strconv.ParseInt(r.PathValue("stream"), 10, 64)
+	if err != nil {
+		reply(w, nil, badRequest("stream IDs are numbers, got %q", r.PathValue("stream")))
+		return
+	}
+	info, err := api.Live.Conn(r.PathValue("id"))
+	if err == nil {
+		err = api.Live.KillTunnel(info.ConnID, stream)
+	}
+	if err != nil {
+		reply(w, nil, err)
+		return
+	}
+	logger.Info("killing a tunnel", "conn_id", info.ConnID, "stream", stream)
+	reply(w, info, nil)
+}
+
+func (api *API) drain(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	conns, err := api.Live.Drain(name)
+	if err != nil {
+		reply(w, nil, err)
+		return
+	}
+	logger.Info("draining a listener", "listener", name, "conns", conns)
+	reply(w, map[string]any{"listener": name, "conns": conns}, nil)
+}
+
+func (api *API) reload(w http.ResponseWriter, r *http.Request) {
+	reloaded, err := api.Reload()
+	if err != nil {
+		logger.Warn("reload failed, nothing changed", "err", err)
+		reply(w, nil, err)
+		return
+	}
+	logger.Info("config reloaded", "reloaded", reloaded)
+	reply(w, map[string]any{"reloaded": reloaded}, nil)
+}
+
+// The last n records (all of them without n), oldest first
+func (api *API) sessions(w http.ResponseWriter, r *http.Request) {
+	if api.Ring == nil {
+		reply(w, nil, &session.NotFoundError{What: "session records kept, sessions.ring is 0"})
+		return
+	}
+	recs := api.Ring.Records()
+	if s := r.URL.Query().Get("n"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			reply(w, nil, badRequest("n has to be a positive number, got %q", s))
+			return
+		}
+		recs = recs[max(len(recs)-n, 0):]
+	}
+	reply(w, recs, nil)
+}
+
+func (api *API) setLevel(w http.ResponseWriter, r *http.Request) {
+	var change LevelChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		reply(w, nil, badRequest("%v", err))
+		return
+	}
+	if err := logging.SetLevel(change.Subsystem, change.Level); err != nil {
+		reply(w, nil, badRequest("%v", err))
+		return
+	}
+	logger.Info("log level set", "for", change.Subsystem, "level", change.Level)
+	reply(w, logging.Levels(), nil)
+}
+
+type badRequestError struct {
+	msg string
+}
+
+func (e *badRequestError) Error() string { return e.msg }
+
+func badRequest(format string, args ...any) error {
+	return &badRequestError{msg: fmt.Sprintf(format, args...)}
+}
+
+// Writes v as JSON, or err as {"error": ...} with a status that fits it
+func reply(w http.ResponseWriter, v any, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		var notFound *session.NotFoundError
+		var bad *badRequestError
+		switch {
+		case errors.As(err, &notFound):
+			w.WriteHeader(http.StatusNotFound)
+		case errors.As(err, &bad):
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		v = map[string]string{"error": err.Error()}
+	}
+	json.NewEncoder(w).Encode(v)
+}
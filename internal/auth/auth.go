@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"custom_vpn/config"
+	"custom_vpn/internal/wire"
+)
+
+/*
+	Token auth for clients, on top of (or instead of) client certs.
+	The client sends its token in an auth exchange (a header with wire.FlagAuth) before anything else:
+	on the first stream of a QUIC connection, or first thing on a TLS/TCP conn.
+	The server checks it with an Authenticator, and a failure ends the connection before any tunnel is set up.
+*/
+type Authenticator interface {
+	// Checks a token and returns who it belongs to. The identity ends up in the policy and the logs
+	Authenticate(ctx context.Context, token string) (identity string, err error)
+}
+
+var (
+	ErrNoToken      = errors.New("no token")
+	ErrInvalidToken = errors.New("invalid token")
+)
+
+// Tries each Authenticator in turn, the first one to accept the token wins
+type Chain []Authenticator
+
+func (c Chain) Authenticate(ctx context.Context, token string) (string, error) {
+	err := ErrInvalidToken
+	for _, a := range c {
+		identity, aErr := a.Authenticate(ctx, token)
+		if aErr == nil {
+			return identity, nil
+		}
+		// keep the most specific reason, "invalid token" says nothing
+		if !errors.Is(aErr, ErrInvalidToken) {
+			err = aErr
+		}
+	}
+	return "", err
+}
+
+// Builds the server's Authenticator from its config. nil when auth isn't configured, ie. clients don't need a token
+func New(conf config.ServerAuth) (Authenticator, error) {
+	var chain Chain
+	if len(conf.Tokens) > 0 {
+		chain = append(chain, NewStaticTokens(conf.Tokens))
+	}
+	if conf.JWT.HMACSecretFile != "" || conf.JWT.JWKSFile != "" {
+		verifier, err := NewJWTVerifier(conf.JWT)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, verifier)
+	}
+	switch len(chain) {
+	case 0:
+		return nil, nil
+	case 1:
+		return chain[0], nil
+	}
+	return chain, nil
+}
+
+/*
+	Server side of the auth exchange: reads the client's auth header off rw, checks the token and answers.
+	A client which skips the exchange (sends a tunnel header straight away) is refused.
+	The client has been told the outcome either way, on failure the caller only needs to close the connection.
+*/
+func Accept(ctx context.Context, rw io.ReadWriter, a Authenticator) (string, error) {
+	hdr, err := wire.ReadHeader(rw)
+	if err != nil {
+		return "", fmt.Errorf("auth: %v", err)
+	}
+	if hdr.Flags&wire.FlagAuth == 0 {
+		err := fmt.Errorf("auth: client didn't authenticate: %w", ErrNoToken)
+		return "", reply(rw, "this server needs a token", err)
+	}
+	if hdr.AuthToken == "" {
+		err := fmt.Errorf("auth: %w", ErrNoToken)
+		return "", reply(rw, "this server needs a token", err)
+	}
+	identity, err := a.Authenticate(ctx, hdr.AuthToken)
+	if err != nil {
+		// the reason stays in the server log, the client just hears no
+		return "", reply(rw, "token rejected", fmt.Errorf("auth: %w", err))
+	}
+	if err := wire.WriteResponse(rw, wire.Response{Status: wire.StatusOK}); err != nil {
+		return "", err
+	}
+	return identity, nil
+}
+
+func reply(w io.Writer, reason string, cause error) error {
+	if err := wire.WriteResponse(w, wire.Response{Status: wire.StatusAuthFailed, Reason: reason}); err != nil {
+		return fmt.Errorf("%v (and failed to tell the client: %v)", cause, err)
+	}
+	return cause
+}
+
+// Where the client gets its token from. Called for every new connection, so a token file can be refreshed underneath us
+type TokenSource func() (string, error)
+
+// The client's TokenSource, nil when it has no token
+func ClientToken(conf config.ClientAuth) TokenSource {
+	switch {
+	case conf.TokenFile != "":
+		return func() (string, error) {
+			raw, err := os.ReadFile(conf.TokenFile)
+			if err != nil {
+				return "", fmt.Errorf("auth: reading token: %v", err)
+			}
+			return strings.TrimSpace(string(raw)), nil
+		}
+	case conf.Token != "":
+		return func() (string, error) { return conf.Token, nil }
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"custom_vpn/config"
+)
+
+/*
+	Verifies JWTs (the kind the jwt-auth service hands out) against keys read from files:
+		- an HMAC secret, for HS256/HS384/HS512
+		- a JWKS (RFC 7517) document, for RS*, PS*, ES* and EdDSA, plus HS* with "oct" keys
+	The alg in the token has to fit the key it's checked with, so a token can't pick HS256 and get checked against
+	an RSA public key used as an HMAC secret. "none" is never accepted.
+	The sub claim is the identity. exp is required, nbf, iss and aud are checked when present/configured.
+*/
+type JWTVerifier struct {
+	hmacKeys map[string][]byte
+	pubKeys  map[string]crypto.PublicKey
+	issuer   string
+	audience string
+	leeway   time.Duration
+	now      func() time.Time
+}
+
+var ErrTokenExpired = errors.New("token expired")
+
+// Loads the keys named in the config
+func NewJWTVerifier(conf config.JWTAuth) (*JWTVerifier, error) {
+	v := &JWTVerifier{
+		hmacKeys: make(map[string][]byte),
+		pubKeys:  make(map[string]crypto.PublicKey),
+		issuer:   conf.Issuer,
+		audience: conf.Audience,
+		leeway:   conf.Leeway,
+		now:      time.Now,
+	}
+	if conf.HMACSecretFile != "" {
+		secret, err := os.ReadFile(conf.HMACSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("auth: %v", err)
+		}
+		secret = bytes.TrimSpace(secret)
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("auth: %s: HMAC secret is shorter than 32 bytes", conf.HMACSecretFile)
+		}
+		// no kid, the secret is used for tokens which don't name a key
+		v.hmacKeys[""] = secret
+	}
+	if conf.JWKSFile != "" {
+		if err := v.loadJWKS(conf.JWKSFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(v.hmacKeys)+len(v.pubKeys) == 0 {
+		return nil, fmt.Errorf("auth: no JWT keys configured")
+	}
+	return v, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+func (v *JWTVerifier) Authenticate(_ context.Context, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrInvalidToken
+	}
+	var hdr jwtHeader
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return "", ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	if err := v.verify(hdr, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return "", err
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", ErrInvalidToken
+	}
+	now := v.now()
+	if claims.ExpiresAt == nil {
+		return "", fmt.Errorf("%w: no exp claim", ErrInvalidToken)
+	}
+	if now.After(unixTime(*claims.ExpiresAt).Add(v.leeway)) {
+		return "", ErrTokenExpired
+	}
+	if claims.NotBefore != nil && now.Add(v.leeway).Before(unixTime(*claims.NotBefore)) {
+		return "", fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return "", fmt.Errorf("%w: issuer %q", ErrInvalidToken, claims.Issuer)
+	}
+	if v.audience != "" && !hasAudience(claims.Audience, v.audience) {
+		return "", fmt.Errorf("%w: not for audience %q", ErrInvalidToken, v.audience)
+	}
+	if claims.Subject == "" {
+		return "", fmt.Errorf("%w: no sub claim", ErrInvalidToken)
+	}
+	return claims.Subject, nil
+}
+
+// Checks the signature with the key the header points at
+func (v *JWTVerifier) verify(hdr jwtHeader, signed, sig []byte) error {
+	hash, ok := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[strings.TrimLeft(hdr.Alg, "HRPES")]
+	family := strings.TrimRight(hdr.Alg, "0123456789")
+
+	switch {
+	case hdr.Alg == "EdDSA":
+		key, ok := v.pubKey(hdr.Kid).(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(key, signed, sig) {
+			return ErrInvalidToken
+		}
+		return nil
+	case !ok:
+		return fmt.Errorf("%w: unsupported alg %q", ErrInvalidToken, hdr.Alg)
+	case family == "HS":
+		secret, found := v.hmacKeys[hdr.Kid]
+		if !found {
+			return ErrInvalidToken
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return ErrInvalidToken
+		}
+		return nil
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch family {
+	case "RS":
+		key, ok := v.pubKey(hdr.Kid).(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(key, hash, digest, sig) != nil {
+			return ErrInvalidToken
+		}
+	case "PS":
+		key, ok := v.pubKey(hdr.Kid).(*rsa.PublicKey)
+		if !ok || rsa.VerifyPSS(key, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) != nil {
+			return ErrInvalidToken
+		}
+	case "ES":
+		// the alg names the curve as well as the hash, ES256 with a P-384 key isn't ES256
+		curve := map[string]elliptic.Curve{"ES256": elliptic.P256(), "ES384": elliptic.P384(), "ES512": elliptic.P521()}[hdr.Alg]
+		key, ok := v.pubKey(hdr.Kid).(*ecdsa.PublicKey)
+		if !ok || key.Curve != curve {
+			return ErrInvalidToken
+		}
+		// r and s, each padded to the curve size
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return ErrInvalidToken
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return ErrInvalidToken
+		}
+	default:
+		return fmt.Errorf("%w: unsupported alg %q", ErrInvalidToken, hdr.Alg)
+	}
+	return nil
+}
+
+// The key for kid. A token without a kid works when there's only one key to pick
+func (v *JWTVerifier) pubKey(kid string) crypto.PublicKey {
+	if key, ok := v.pubKeys[kid]; ok {
+		return key
+	}
+	if kid == "" && len(v.pubKeys) == 1 {
+		for _, key := range v.pubKeys {
+			return key
+		}
+	}
+	return nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// Reads a JWKS document. Keys marked for anything but signing are skipped
+func (v *JWTVerifier) loadJWKS(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("auth: %v", err)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return fmt.Errorf("auth: %s: %v", path, err)
+	}
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if k.Kty == "oct" {
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil {
+				return fmt.Errorf("auth: %s: key %d: %v", path, i, err)
+			}
+			// same floor as hmac_secret_file
+			if len(secret) < 32 {
+				return fmt.Errorf("auth: %s: key %d: HMAC secret is shorter than 32 bytes", path, i)
+			}
+			// one without a kid would replace hmac_secret_file's key, which is stored under ""
+			if _, dup := v.hmacKeys[k.Kid]; dup {
+				if k.Kid == "" {
+					return fmt.Errorf("auth: %s: key %d: an oct key needs a kid when hmac_secret_file is set too", path, i)
+				}
+				return fmt.Errorf("auth: %s: key %d: kid %q is used twice", path, i, k.Kid)
+			}
+			v.hmacKeys[k.Kid] = secret
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return fmt.Errorf("auth: %s: key %d: %v", path, i, err)
+		}
+		if _, dup := v.pubKeys[k.Kid]; dup {
+			return fmt.Errorf("auth: %s: key %d: kid %q is used twice", path, i, k.Kid)
+		}
+		v.pubKeys[k.Kid] = key
+	}
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := func(s string) []byte {
+		b, _ := base64.RawURLEncoding.DecodeString(s)
+		return b
+	}
+	switch k.Kty {
+	case "RSA":
+		n, e := b64(k.N), b64(k.E)
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("bad RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(b64(k.X)), Y: new(big.Int).SetBytes(b64(k.Y))}
+		if _, err := key.ECDH(); err != nil {
+			return nil, fmt.Errorf("bad EC key: %v", err)
+		}
+		return key, nil
+	case "OKP":
+		x := b64(k.X)
+		if k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("bad OKP key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeSegment(seg string, out any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, out)
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// aud is either a string or a list of them
+func hasAudience(raw json.RawMessage, want string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == want
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		return slices.Contains(list, want)
+	}
+	return false
+}
@@ -0,0 +1,244 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"custom_vpn/config"
+)
+
+var (
+	testNow    = time.Unix(1_700_000_000, 0)
+	fileSecret = []byte(strings.Repeat("f", 32))
+	octSecret  = []byte(strings.Repeat("o", 48))
+)
+
+type testKeys struct {
+	rsa, rsa2  *rsa.PrivateKey
+	p256, p384 *ecdsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	t.Helper()
+	var k testKeys
+	var err error
+	for _, key := range []**rsa.PrivateKey{&k.rsa, &k.rsa2} {
+		if *key, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if k.p256, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	if k.p384, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func rsaJWK(kid string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": kid, "n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())}
+}
+
+func ecJWK(kid, crv string, key *ecdsa.PrivateKey) map[string]string {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return map[string]string{"kty": "EC", "kid": kid, "crv": crv, "x": b64(key.X.FillBytes(make([]byte, size))), "y": b64(key.Y.FillBytes(make([]byte, size)))}
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func writeJWKS(t *testing.T, keys ...map[string]string) string {
+	t.Helper()
+	raw, err := json.Marshal(map[string]any{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeFile(t, "jwks.json", raw)
+}
+
+// Builds a token signed with key: an HMAC secret, an RSA or EC private key, or nil for no signature
+func sign(t *testing.T, alg, kid string, claims map[string]any, key any) string {
+	t.Helper()
+	hdr := map[string]string{"alg": alg}
+	if kid != "" {
+		hdr["kid"] = kid
+	}
+	rawHdr, _ := json.Marshal(hdr)
+	rawClaims, _ := json.Marshal(claims)
+	signed := b64(rawHdr) + "." + b64(rawClaims)
+
+	hash := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[len(alg)-3:]]
+	var sig []byte
+	switch key := key.(type) {
+	case nil:
+	case []byte:
+		mac := hmac.New(hash.New, key)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		h := hash.New()
+		h.Write([]byte(signed))
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, hash, h.Sum(nil)); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		h := hash.New()
+		h.Write([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		sig = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	default:
+		t.Fatalf("can't sign with %T", key)
+	}
+	return signed + "." + b64(sig)
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	keys := newTestKeys(t)
+	v, err := NewJWTVerifier(config.JWTAuth{
+		HMACSecretFile: writeFile(t, "secret", fileSecret),
+		JWKSFile: writeJWKS(t,
+			rsaJWK("rsa", keys.rsa), rsaJWK("rsa2", keys.rsa2),
+			ecJWK("p256", "P-256", keys.p256), ecJWK("p384", "P-384", keys.p384),
+			map[string]string{"kty": "oct", "kid": "oct", "k": b64(octSecret)},
+		),
+		Issuer:   "jwt-auth",
+		Audience: "vpn",
+		Leeway:   30 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.now = func() time.Time { return testNow }
+
+	// the HS* key an attacker would try: the RSA public key, which is no secret
+	rsaPub, err := x509.MarshalPKIXPublicKey(&keys.rsa.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := func(edit func(map[string]any)) map[string]any {
+		c := map[string]any{"sub": "alice", "iss": "jwt-auth", "aud": "vpn", "exp": testNow.Add(time.Hour).Unix()}
+		if edit != nil {
+			edit(c)
+		}
+		return c
+	}
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{name: "HS256 with the secret file", token: sign(t, "HS256", "", claims(nil), fileSecret)},
+		{name: "HS512 with an oct key", token: sign(t, "HS512", "oct", claims(nil), octSecret)},
+		{name: "RS256", token: sign(t, "RS256", "rsa", claims(nil), keys.rsa)},
+		{name: "ES256", token: sign(t, "ES256", "p256", claims(nil), keys.p256)},
+		{name: "ES384", token: sign(t, "ES384", "p384", claims(nil), keys.p384)},
+
+		{name: "alg none", token: sign(t, "none", "", claims(nil), nil), err: ErrInvalidToken},
+		{name: "alg none with a kid", token: sign(t, "none", "rsa", claims(nil), nil), err: ErrInvalidToken},
+		{name: "HS256 keyed with the RSA public key", token: sign(t, "HS256", "rsa", claims(nil), rsaPub), err: ErrInvalidToken},
+		{name: "HS256 keyed with the RSA public key, no kid", token: sign(t, "HS256", "", claims(nil), rsaPub), err: ErrInvalidToken},
+		{name: "RS256 naming an HMAC key", token: sign(t, "RS256", "oct", claims(nil), keys.rsa), err: ErrInvalidToken},
+		{name: "ES256 with a P-384 key", token: sign(t, "ES256", "p384", claims(nil), keys.p384), err: ErrInvalidToken},
+		{name: "ES384 with a P-256 key", token: sign(t, "ES384", "p256", claims(nil), keys.p256), err: ErrInvalidToken},
+		{name: "unsupported alg", token: sign(t, "XX256", "rsa", claims(nil), keys.rsa), err: ErrInvalidToken},
+		{name: "bad signature", token: sign(t, "HS256", "", claims(nil), octSecret), err: ErrInvalidToken},
+		{name: "not a JWT", token: "abc.def", err: ErrInvalidToken},
+
+		{name: "kid picks the key", token: sign(t, "RS256", "rsa2", claims(nil), keys.rsa2)},
+		{name: "kid names a different key", token: sign(t, "RS256", "rsa", claims(nil), keys.rsa2), err: ErrInvalidToken},
+		{name: "no kid with several public keys", token: sign(t, "RS256", "", claims(nil), keys.rsa), err: ErrInvalidToken},
+		{name: "unknown kid", token: sign(t, "RS256", "nope", claims(nil), keys.rsa), err: ErrInvalidToken},
+		{name: "unknown HMAC kid", token: sign(t, "HS256", "nope", claims(nil), fileSecret), err: ErrInvalidToken},
+
+		{name: "expired inside the leeway", token: sign(t, "HS256", "", claims(func(c map[string]any) { c["exp"] = testNow.Add(-20 * time.Second).Unix() }), fileSecret)},
+		{name: "expired", token: sign(t, "HS256", "", claims(func(c map[string]any) { c["exp"] = testNow.Add(-40 * time.Second).Unix() }), fileSecret), err: ErrTokenExpired},
+		{name: "no exp", token: sign(t, "HS256", "", claims(func(c map[string]any) { delete(c, "exp") }), fileSecret), err: ErrInvalidToken},
+		{name: "nbf inside the leeway", token: sign(t, "HS256", "", claims(func(c map[string]any) { c["nbf"] = testNow.Add(20 * time.Second).Unix() }), fileSecret)},
+		{name: "not valid yet", token: sign(t, "HS256", "", claims(func(c map[string]any) { c["nbf"] = testNow.Add(40 * time.Second).Unix() }), fileSecret), err: ErrInvalidToken},
+		{name: "aud list", token: sign(t, "HS256", "", claims(func(c map[string]any) { c["aud"] = []string{"other", "vpn"} }), fileSecret)},
+		{name: "aud mismatch", token: sign(t, "HS256", "", claims(func(c map[string]any) { c["aud"] = "other" }), fileSecret), err: ErrInvalidToken},
+		{name: "aud list without us", token: sign(t, "HS256", "", claims(func(c map[string]any) { c["aud"] = []string{"other"} }), fileSecret), err: ErrInvalidToken},
+		{name: "no aud", token: sign(t, "HS256", "", claims(func(c map[string]any) { delete(c, "aud") }), fileSecret), err: ErrInvalidToken},
+		{name: "iss mismatch", token: sign(t, "HS256", "", claims(func(c map[string]any) { c["iss"] = "someone" }), fileSecret), err: ErrInvalidToken},
+		{name: "no sub", token: sign(t, "HS256", "", claims(func(c map[string]any) { delete(c, "sub") }), fileSecret), err: ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := v.Authenticate(context.Background(), tt.token)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && identity != "alice" {
+				t.Errorf("identity = %q", identity)
+			}
+		})
+	}
+}
+
+func TestNewJWTVerifierKeys(t *testing.T) {
+	keys := newTestKeys(t)
+	oct := func(kid string, secret []byte) map[string]string {
+		return map[string]string{"kty": "oct", "kid": kid, "k": b64(secret)}
+	}
+	tests := []struct {
+		name   string
+		secret bool
+		jwks   []map[string]string
+		want   string
+	}{
+		{name: "oct key without a kid next to the secret file", secret: true, jwks: []map[string]string{oct("", octSecret)}, want: "needs a kid"},
+		{name: "oct key without a kid on its own", jwks: []map[string]string{oct("", octSecret)}},
+		{name: "oct key with a kid next to the secret file", secret: true, jwks: []map[string]string{oct("oct", octSecret)}},
+		{name: "two oct keys with one kid", jwks: []map[string]string{oct("a", octSecret), oct("a", fileSecret)}, want: "used twice"},
+		{name: "two public keys with one kid", jwks: []map[string]string{rsaJWK("a", keys.rsa), ecJWK("a", "P-256", keys.p256)}, want: "used twice"},
+		{name: "short oct key", jwks: []map[string]string{oct("a", []byte("short"))}, want: "shorter than 32 bytes"},
+		{name: "unknown curve", jwks: []map[string]string{ecJWK("a", "P-224", keys.p256)}, want: "unsupported curve"},
+		{name: "point not on the curve", jwks: []map[string]string{ecJWK("a", "P-384", keys.p256)}, want: "bad EC key"},
+		{name: "encryption keys are skipped", jwks: []map[string]string{{"kty": "RSA", "use": "enc"}}, want: "no JWT keys"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := config.JWTAuth{JWKSFile: writeJWKS(t, tt.jwks...)}
+			if tt.secret {
+				conf.HMACSecretFile = writeFile(t, "secret", fileSecret)
+			}
+			_, err := NewJWTVerifier(conf)
+			if tt.want == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+				t.Errorf("err = %v, want it to say %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -4,8 +4,7 @@ import (
 	"context"
 	"crypto/rand"
 	"fmt"
-	"log"
-	"net"
+	"log/slog"
 	"os"
 	"os/signal"
 	"sync"
@@ -30,12 +29,13 @@ type CloseableListener interface {
 	This function blocks, waiting for a cancel signal. Upon receving a signal, it closes the passed listener
 	Doesn't matter if its a TCP listener or a QUIC listener. See CloseableListener interface.
 	port is the port which the lister is bound to
+	Closing on a signal is how we're meant to stop, so it's logged and not sent down errCh as an error
 */
 func CaptureCancel(ctx context.Context, wg *sync.WaitGroup, errCh chan<- error, port int, listener CloseableListener){
 	defer wg.Done()
 	<-ctx.Done()			// block here until cancel()
 	listener.Close()		// call our closeable listeners close() function
-	errCh <-fmt.Errorf("listener closed on port-%d due to SIGTERM", port)
+	slog.Info("listener closed, shutting down", "port", port)
 }
 
 /*
@@ -59,6 +59,7 @@ func SetupShutdownHelper() context.Context {
 
 /*
 	Sole purpore of this collector func is to print errors as they come down the err channel
+	They're logged at error level, see internal/logging. The level says it, no need for an "ERROR:" prefix
 */
 func ErrorCollector(errCh <-chan error, done chan struct{}){
 	/*
@@ -68,7 +69,7 @@ func ErrorCollector(errCh <-chan error, done chan struct{}){
 	*/
 	defer close(done)
 	for err := range errCh{
-		log.Printf("ERROR: %v\n", err)
+		slog.Error(err.Error())
 	}
 }
 
@@ -78,6 +79,28 @@ func ErrorCollector(errCh <-chan error, done chan struct{}){
 type CtxKey string
 const ConnId CtxKey = "ConnId"
 
+/*
+	The identity from the client's verified cert (see tlsconfig.PeerIdentity), stored as a string.
+	Empty for clients without one. The destination policy matches on it.
+*/
+const Peer CtxKey = "Peer"
+
+// The server name (TLS SNI) the client connected to, picks the virtual host. Empty on the raw TCP listener
+const ServerName CtxKey = "ServerName"
+
+/*
+	The rest are only there for the logs, internal/logging adds them to every line logged with the ctx.
+	Listener is the local address the conn came in on (the listener's bind address for QUIC), Transport is "tcp", "tls" or "quic",
+	Client the remote address (a string), Stream the QUIC stream ID (an int64) and Service the service asked for
+*/
+const (
+	Listener  CtxKey = "Listener"
+	Transport CtxKey = "Transport"
+	Client    CtxKey = "Client"
+	Stream    CtxKey = "Stream"
+	Service   CtxKey = "Service"
+)
+
 
 /*
 	Returns a UUID.
@@ -94,10 +117,3 @@ func GenUUID() (string, error){
 	return fmt.Sprintf("%08x-%04x-%04x-%04x-%012x",
 			b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
 }
-
-// header should be: Type (4byte), IP (4bytes for ipv4, 16bytes for ipv6), and Port (1byte)
-type StreamHeader struct{
-	Proto [4]byte
-	IP 	  net.IP
-	Port  uint16   // port could be anywhere from 0-5digits long int. uint16 (16bit, positive ints) work perfectly since ports only get up to 65535
-}
\ No newline at end of file
@@ -0,0 +1,141 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"sync"
+
+	"custom_vpn/internal/logging"
+	"custom_vpn/internal/transport"
+	"custom_vpn/internal/wire"
+	"custom_vpn/tunnel"
+)
+
+/*
+	An HTTP/1.1 proxy front-end for the client, for tooling that can't speak SOCKS (point HTTPS_PROXY at it).
+		- CONNECT host:port gets a tunnel to host:port, then the conn is piped through it
+		- absolute-URI requests (GET http://host/path) are sent to host over a fresh tunnel
+	Every request gets its own tunnel, the server does the dialing.
+*/
+var logger = logging.For("httpproxy")
+
+type Server struct {
+	Opener transport.Opener
+}
+
+// Accepts proxy clients on addr until ctx is cancelled
+func (s *Server) ListenAndServe(ctx context.Context, errCh chan<- error, wg *sync.WaitGroup, addr string) {
+	defer wg.Done()
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		errCh <- fmt.Errorf("HTTP proxy: error creating listener: %v", err)
+		return
+	}
+	logger.Info("listening", "addr", listener.Addr().String())
+
+	proxy := &httputil.ReverseProxy{
+		// the request already names where it's going, just strip it down to what the origin expects
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = r.In.URL.Host
+			r.Out.Host = r.In.Host
+		},
+		Transport: &http.Transport{
+			DialContext: s.dial,
+			// one tunnel per request
+			DisableKeepAlives: true,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			errCh <- fmt.Errorf("HTTP proxy: %s %s: %v", r.Method, r.URL, err)
+			w.WriteHeader(statusFor(err))
+		},
+	}
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodConnect:
+				s.connect(errCh, w, r)
+			case r.URL.IsAbs() && r.URL.Scheme == "http":
+				proxy.ServeHTTP(w, r)
+			default:
+				http.Error(w, "this is a proxy: send CONNECT, or an absolute http:// URI", http.StatusBadRequest)
+			}
+		}),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+		logger.Info("listener closed, shutting down", "port", listener.Addr().(*net.TCPAddr).Port)
+	}()
+
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		errCh <- fmt.Errorf("HTTP proxy: %v", err)
+	}
+}
+
+// Opens a tunnel to addr. Used as the DialContext of the proxy's transport
+func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad port %q", portStr)
+	}
+	return s.Opener.OpenTunnel(ctx, wire.Header{TargetHost: host, TargetPort: uint16(port)})
+}
+
+// CONNECT: reply 200 once the server has dialed the target, then get out of the way
+func (s *Server) connect(errCh chan<- error, w http.ResponseWriter, r *http.Request) {
+	if _, _, err := net.SplitHostPort(r.Host); err != nil {
+		http.Error(w, "CONNECT needs host:port", http.StatusBadRequest)
+		return
+	}
+	remote, err := s.dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		errCh <- fmt.Errorf("HTTP proxy: CONNECT %s: %v", r.Host, err)
+		http.Error(w, err.Error(), statusFor(err))
+		return
+	}
+
+	conn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		remote.Close()
+		http.Error(w, "proxy can't hijack the connection", http.StatusInternalServerError)
+		return
+	}
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		remote.Close()
+		conn.Close()
+		return
+	}
+	// anything the client sent after the CONNECT headers is already sitting in the buffer
+	if n := buffered.Reader.Buffered(); n > 0 {
+		early, _ := buffered.Reader.Peek(n)
+		if _, err := remote.Write(early); err != nil {
+			remote.Close()
+			conn.Close()
+			return
+		}
+	}
+	tunnel.Pipe(remote, conn)
+}
+
+// Maps the server's refusal onto a status code for the proxy client
+func statusFor(err error) int {
+	var rejected *wire.RejectedError
+	if errors.As(err, &rejected) && rejected.Status == wire.StatusUnauthorized {
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
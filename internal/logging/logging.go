@@ -0,0 +1,271 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"custom_vpn/internal/helpers"
+)
+
+/*
+	Leveled logging on log/slog. Every package logs through its own subsystem's logger (see For),
+	and every subsystem has its own level, so the QUIC server can be turned up to debug without the TUN switch drowning it out.
+	The loggers are made at package init, long before the config's been read, so they don't hold a handler of their own:
+	they go through whatever Setup installed last, and look their level up on every record.
+
+	Which connection a line is about comes from the ctx passed to the *Context methods, see ctxAttrs.
+	Call sites don't repeat the conn ID in every message anymore, the handler adds it.
+*/
+
+// Every subsystem with a logger. Levels can be set for these and nothing else
+var Subsystems = []string{
+	"server",    // cmd/server
+	"client",    // cmd/client
+	"tcp",       // TCP and TLS listeners, and their client side
+	"quic",      // QUIC server, and the client's connection manager
+	"tls",       // cert reloading
+	"tun",       // TUN devices, the switch, the lease pool
+	"socks",     // the client's SOCKS5 proxy
+	"httpproxy", // the client's HTTP proxy
+	"udp",       // the client's UDP forwards
+	"session",   // session records
+	"metrics",   // the /metrics endpoint
+	"admin",     // the server's admin API
+}
+
+var (
+	root atomic.Pointer[slog.Handler]
+	// what slog.Default() logs at (the error collector, anything still on the log package), and every subsystem without a level of its own
+	defaultLevel slog.LevelVar
+	levels       = map[string]*slog.LevelVar{}
+	// subsystems with a level of their own, which a new default level leaves alone
+	overridden = map[string]*atomic.Bool{}
+)
+
+func init() {
+	for _, name := range Subsystems {
+		levels[name] = new(slog.LevelVar)
+		overridden[name] = new(atomic.Bool)
+	}
+	var h slog.Handler = slog.NewTextHandler(os.Stderr, nil)
+	root.Store(&h)
+}
+
+// The logger for one of Subsystems. Meant for package level vars
+func For(subsystem string) *slog.Logger {
+	level, ok := levels[subsystem]
+	if !ok {
+		panic(fmt.Sprintf("logging: no subsystem %q", subsystem))
+	}
+	return slog.New(&handler{subsystem: subsystem, level: level})
+}
+
+/*
+	Installs a text or JSON handler writing to w, and makes it slog's (and the log package's) default.
+	Whatever's still logged with the log package is mostly log.Fatalf, so it comes out at error level.
+*/
+func Setup(w io.Writer, format string) error {
+	var h slog.Handler
+	switch format {
+	case "", "text":
+		h = slog.NewTextHandler(w, nil)
+	case "json":
+		h = slog.NewJSONHandler(w, nil)
+	default:
+		return fmt.Errorf("logging: unknown format %q", format)
+	}
+	root.Store(&h)
+	slog.SetDefault(slog.New(&handler{level: &defaultLevel}))
+	slog.SetLogLoggerLevel(slog.LevelError)
+	return nil
+}
+
+/*
+	Sets the levels again on every SIGHUP, from what load returns (the config file's logging section, read again).
+	A bad level in the file is reported on errCh and the old levels stay.
+*/
+func ReloadOnSIGHUP(ctx context.Context, wg *sync.WaitGroup, errCh chan<- error, load func() (level string, subsystems map[string]string, err error)) {
+	defer wg.Done()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		level, subsystems, err := load()
+		if err == nil {
+			err = SetLevels(level, subsystems)
+		}
+		if err != nil {
+			errCh <- fmt.Errorf("logging: keeping the old levels: %v", err)
+			continue
+		}
+		slog.Info("log levels reloaded", "level", level, "subsystems", subsystems)
+	}
+}
+
+/*
+	Sets the default level, and the levels of the subsystems in subsystems (the rest follow the default).
+	Called at startup, and again on SIGHUP with what's in the config file by then
+*/
+func SetLevels(level string, subsystems map[string]string) error {
+	def, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	parsed := map[string]slog.Level{}
+	for name, l := range subsystems {
+		if _, ok := levels[name]; !ok {
+			return unknownSubsystem(name)
+		}
+		if parsed[name], err = ParseLevel(l); err != nil {
+			return err
+		}
+	}
+
+	defaultLevel.Set(def)
+	for name, lv := range levels {
+		l, ok := parsed[name]
+		if !ok {
+			l = def
+		}
+		lv.Set(l)
+		overridden[name].Store(ok)
+	}
+	return nil
+}
+
+/*
+	Changes the level of one subsystem, or the default one when subsystem is "".
+	A new default carries over to the subsystems which don't have a level of their own
+*/
+func SetLevel(subsystem, level string) error {
+	l, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	if subsystem == "" {
+		defaultLevel.Set(l)
+		for name, lv := range levels {
+			if !overridden[name].Load() {
+				lv.Set(l)
+			}
+		}
+		return nil
+	}
+	lv, ok := levels[subsystem]
+	if !ok {
+		return unknownSubsystem(subsystem)
+	}
+	lv.Set(l)
+	overridden[subsystem].Store(true)
+	return nil
+}
+
+// The current levels: "" is the default one
+func Levels() map[string]string {
+	out := map[string]string{"": defaultLevel.Level().String()}
+	for name, lv := range levels {
+		out[name] = lv.Level().String()
+	}
+	return out
+}
+
+// debug, info, warn or error, any case. slog's offsets work too (debug+2)
+func ParseLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q, want debug, info, warn or error", s)
+	}
+	return l, nil
+}
+
+func KnownSubsystem(name string) bool {
+	return slices.Contains(Subsystems, name)
+}
+
+func unknownSubsystem(name string) error {
+	return fmt.Errorf("no log subsystem %q, there's %s", name, strings.Join(Subsystems, ", "))
+}
+
+type handler struct {
+	subsystem string
+	level     *slog.LevelVar
+	// WithAttrs and WithGroup calls, replayed on the root handler for every record, it may have been swapped since
+	with []func(slog.Handler) slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	attrs := ctxAttrs(ctx)
+	if h.subsystem != "" {
+		attrs = append([]slog.Attr{slog.String("subsystem", h.subsystem)}, attrs...)
+	}
+	out := *root.Load()
+	if len(attrs) > 0 {
+		out = out.WithAttrs(attrs)
+	}
+	for _, with := range h.with {
+		out = with(out)
+	}
+	return out.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.plus(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.plus(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+func (h *handler) plus(with func(slog.Handler) slog.Handler) *handler {
+	return &handler{subsystem: h.subsystem, level: h.level, with: append(slices.Clip(h.with), with)}
+}
+
+// The attributes a ctx carries, see the keys in helpers. In the order a reader narrows down to a tunnel
+var ctxKeys = []struct {
+	key  helpers.CtxKey
+	name string
+}{
+	{helpers.Listener, "listener"},
+	{helpers.Transport, "transport"},
+	{helpers.ConnId, "conn_id"},
+	{helpers.Stream, "stream"},
+	{helpers.Client, "client"},
+	{helpers.Peer, "identity"},
+	{helpers.Service, "service"},
+}
+
+func ctxAttrs(ctx context.Context) []slog.Attr {
+	if ctx == nil {
+		return nil
+	}
+	var attrs []slog.Attr
+	for _, k := range ctxKeys {
+		v := ctx.Value(k.key)
+		// an empty identity (no client cert) or service (a dynamic target) says nothing
+		if v == nil || v == "" {
+			continue
+		}
+		attrs = append(attrs, slog.Any(k.name, v))
+	}
+	return attrs
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"custom_vpn/internal/session"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// Sorts a failed TLS handshake (TLS listener) into timeout, tls or other
+func TLSFailureReason(err error) string {
+	var netErr net.Error
+	var alert tls.AlertError
+	var recordErr tls.RecordHeaderError
+	var verifyErr *tls.CertificateVerificationError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &alert), errors.As(err, &recordErr), errors.As(err, &verifyErr):
+		return "tls"
+	}
+	return "other"
+}
+
+/*
+	QUIC handshakes happen inside quic-go, a client that fails one never comes out of Accept for us to count.
+	This tracer watches every connection the listener starts, and counts the ones that close
+	before the handshake keys are dropped (which is when the handshake is done).
+*/
+func QuicHandshakeTracer(ctx context.Context, p logging.Perspective, id quic.ConnectionID) *logging.ConnectionTracer {
+	var done atomic.Bool
+	return &logging.ConnectionTracer{
+		DroppedEncryptionLevel: func(level logging.EncryptionLevel) {
+			if level == logging.EncryptionHandshake {
+				done.Store(true)
+			}
+		},
+		ClosedConnection: func(err error) {
+			if !done.Load() {
+				HandshakeFailures.WithLabelValues("quic", quicFailureReason(err)).Inc()
+			}
+		},
+	}
+}
+
+func quicFailureReason(err error) string {
+	var timeoutErr *quic.HandshakeTimeoutError
+	var idleErr *quic.IdleTimeoutError
+	var transportErr *quic.TransportError
+	switch {
+	case errors.As(err, &timeoutErr), errors.As(err, &idleErr):
+		return "timeout"
+	// TLS alerts (bad certificate, no matching ALPN...) travel as crypto errors
+	case errors.As(err, &transportErr) && transportErr.ErrorCode.IsCryptoError():
+		return "tls"
+	}
+	return "other"
+}
+
+// Counts finished tunnels and their bytes, from their session records
+type SessionSink struct{}
+
+func (SessionSink) Write(rec session.Record) error {
+	service := ServiceLabel(rec.Service)
+	// the services a TUN link or a reverse forward goes to aren't ours to name
+	if rec.Kind == session.KindTUN || rec.Kind == session.KindReverse {
+		service = string(rec.Kind)
+	}
+	Bytes.WithLabelValues(service, "from_client").Add(float64(rec.FromClient))
+	Bytes.WithLabelValues(service, "to_client").Add(float64(rec.ToClient))
+	Tunnels.WithLabelValues(string(rec.Kind)).Inc()
+	return nil
+}
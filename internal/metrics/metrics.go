@@ -0,0 +1,162 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"custom_vpn/internal/logging"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+/*
+	Prometheus metrics, for a server on a Pi in a cupboard that nobody's going to tail the logs of.
+	The instrumented code just bumps the vars below. They're always counted (it's cheap),
+	and only served when metrics.listen (or -metrics) is set. The server and client register their own sets,
+	so neither one's /metrics is full of the other's zeroes. See ServerRegistry and ClientRegistry.
+*/
+
+var logger = logging.For("metrics")
+
+const namespace = "custom_vpn"
+
+// Server
+var (
+	// listener is tcp, tls or quic
+	Accepted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "server", Name: "connections_accepted_total",
+		Help: "Connections accepted, per listener.",
+	}, []string{"listener", "port"})
+
+	QuicConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "server", Name: "quic_connections_active",
+		Help: "QUIC connections past the handshake, and not yet closed.",
+	})
+
+	QuicStreams = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace, Subsystem: "server", Name: "quic_streams_active",
+		Help: "QUIC streams being served: tunnels, UDP associations, TUN links, reverse forward registrations.",
+	})
+
+	// reason is one of timeout, tls, auth, other
+	HandshakeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "server", Name: "handshake_failures_total",
+		Help: "Clients that didn't make it past the TLS/QUIC handshake or the token check.",
+	}, []string{"listener", "reason"})
+
+	// service is the service name, or "dynamic" for client-chosen destinations
+	DialSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace, Subsystem: "server", Name: "backend_dial_seconds",
+		Help:    "How long dialing a backend took, successful dials only.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2.5, 10),
+	}, []string{"service"})
+
+	// reason is one of unknown_service, denied, bad_request, resolve, dial
+	DialFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "server", Name: "backend_dial_failures_total",
+		Help: "Tunnels that never got to their backend.",
+	}, []string{"service", "reason"})
+
+	// direction is from_client or to_client. Added when a tunnel ends, from its session record
+	Bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "server", Name: "bytes_total",
+		Help: "Payload bytes moved by finished tunnels, per service.",
+	}, []string{"service", "direction"})
+
+	Tunnels = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "server", Name: "tunnels_total",
+		Help: "Finished tunnels, per kind (tcp, reverse, udp, tun).",
+	}, []string{"kind"})
+
+	// reason is malformed, unknown_flow, or for dynamic UDP associations: denied, rate_limited (too many new destinations)
+	// and queue_full (too many payloads waiting on a lookup)
+	ServerDatagramDrops = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "server", Name: "datagrams_dropped_total",
+		Help: "Datagrams from clients that went nowhere.",
+	}, []string{"reason"})
+)
+
+// Client
+var (
+	// transport is tcp, tls or quic, result is ok or error. QUIC counts connections, not streams
+	Dials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "client", Name: "dials_total",
+		Help: "Connections to the server the client dialed.",
+	}, []string{"transport", "result"})
+
+	Reconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "client", Name: "reconnects_total",
+		Help: "QUIC connections dialed to replace one that died.",
+	})
+
+	// reason is malformed, unknown_flow or queue_full
+	ClientDatagramDrops = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace, Subsystem: "client", Name: "datagrams_dropped_total",
+		Help: "Datagrams from the server that went nowhere.",
+	}, []string{"reason"})
+)
+
+func ServerRegistry() *prometheus.Registry {
+	reg := newRegistry()
+	reg.MustRegister(Accepted, QuicConnections, QuicStreams, HandshakeFailures, DialSeconds, DialFailures, Bytes, Tunnels, ServerDatagramDrops)
+	return reg
+}
+
+func ClientRegistry() *prometheus.Registry {
+	reg := newRegistry()
+	reg.MustRegister(Dials, Reconnects, ClientDatagramDrops)
+	return reg
+}
+
+// the usual go_* and process_* metrics come along with ours
+func newRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return reg
+}
+
+// The label for a service. Client-chosen destinations all go under one, they'd be a new series per host otherwise
+func ServiceLabel(service string) string {
+	if service == "" {
+		return "dynamic"
+	}
+	return service
+}
+
+func Result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// Serves reg on http://addr/metrics until ctx is cancelled
+func ListenAndServe(ctx context.Context, errCh chan<- error, wg *sync.WaitGroup, addr string, reg *prometheus.Registry) {
+	defer wg.Done()
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		errCh <- fmt.Errorf("metrics: error creating listener: %v", err)
+		return
+	}
+	logger.Info("serving", "url", fmt.Sprintf("http://%v/metrics", listener.Addr()))
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		errCh <- fmt.Errorf("metrics: %v", err)
+	}
+}
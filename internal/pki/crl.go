@@ -0,0 +1,75 @@
+package pki
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// How long a CRL is good for. Revoking anything rewrites it, so this only matters for a CA that sits idle
+const crlValidity = 30 * 24 * time.Hour
+
+var ErrNotFound = errors.New("no such cert")
+
+/*
+	Revokes a cert, by serial or by name, and rewrites the CRL.
+	A name picks the newest cert with that name which isn't revoked yet.
+*/
+func (ca *CA) Revoke(ref string) (Entry, error) {
+	match := -1
+	for i, entry := range ca.index.Entries {
+		if entry.Serial == ref {
+			match = i
+			break
+		}
+		if entry.Name == ref && !entry.Revoked() {
+			match = i
+		}
+	}
+	if match < 0 {
+		return Entry{}, fmt.Errorf("pki: %q: %w", ref, ErrNotFound)
+	}
+	entry := &ca.index.Entries[match]
+	if entry.Revoked() {
+		return *entry, fmt.Errorf("pki: %s was already revoked at %v", entry.Serial, entry.RevokedAt)
+	}
+	entry.RevokedAt = time.Now().UTC()
+	if err := ca.WriteCRL(); err != nil {
+		return *entry, err
+	}
+	return *entry, nil
+}
+
+// Writes a fresh CRL with every revoked cert to CRLPath(), and saves the bumped CRL number
+func (ca *CA) WriteCRL() error {
+	var revoked []x509.RevocationListEntry
+	for _, entry := range ca.index.Entries {
+		if !entry.Revoked() {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(entry.Serial, 16)
+		if !ok {
+			return fmt.Errorf("pki: bad serial %q in the index", entry.Serial)
+		}
+		revoked = append(revoked, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: entry.RevokedAt})
+	}
+
+	ca.index.CRLNumber++
+	now := time.Now()
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(ca.index.CRLNumber),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(crlValidity),
+		RevokedCertificateEntries: revoked,
+	}, ca.cert, ca.key)
+	if err != nil {
+		return fmt.Errorf("pki: creating CRL: %v", err)
+	}
+	if err := writePEM(ca.CRLPath(), "X509 CRL", der, 0o644); err != nil {
+		return err
+	}
+	return ca.index.save(ca.indexPath())
+}
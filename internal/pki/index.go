@@ -0,0 +1,72 @@
+package pki
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+/*
+	The CA's record of what it has issued. The Go replacement for openssl's index.txt and serial.txt.
+	Kept as JSON so it's easy to read (or fix) by hand.
+*/
+type index struct {
+	// bumped every time the CRL is rewritten, CRLs need an increasing number
+	CRLNumber int64   `json:"crl_number"`
+	Entries   []Entry `json:"entries"`
+}
+
+// One issued cert
+type Entry struct {
+	Serial    string    `json:"serial"`
+	Kind      Kind      `json:"kind"`
+	Name      string    `json:"name"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+	IPs       []string  `json:"ips,omitempty"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	CertFile  string    `json:"cert_file"`
+	KeyFile   string    `json:"key_file"`
+	// zero when the cert hasn't been revoked
+	RevokedAt time.Time `json:"revoked_at,omitzero"`
+}
+
+func (e Entry) Revoked() bool {
+	return !e.RevokedAt.IsZero()
+}
+
+// "valid", "revoked" or "expired"
+func (e Entry) Status(now time.Time) string {
+	switch {
+	case e.Revoked():
+		return "revoked"
+	case now.After(e.NotAfter):
+		return "expired"
+	}
+	return "valid"
+}
+
+func loadIndex(path string) (*index, error) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &index{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("pki: %v", err)
+	}
+	var idx index
+	if err := json.Unmarshal(raw, &idx); err != nil {
+		return nil, fmt.Errorf("pki: %s: %v", path, err)
+	}
+	return &idx, nil
+}
+
+func (idx *index) save(path string) error {
+	raw, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return fmt.Errorf("pki: %v", err)
+	}
+	return writeFileAtomic(path, append(raw, '\n'), 0o600)
+}
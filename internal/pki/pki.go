@@ -0,0 +1,372 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+	A small CA for custom_vpn, so nobody has to go through the openssl steps in ssl/README.MD again.
+	Everything lives under one directory, laid out like env_setup.sh had it:
+
+		<dir>/ca/ca.pem, ca.key        the CA (CA_CERT_LOC, tls.ca, tls.client_ca)
+		<dir>/ca/index.json            every cert the CA has issued, and which were revoked
+		<dir>/ca/crl.pem               revoked certs, rewritten on every revoke (tls.client_crl)
+		<dir>/ca/signed_certs/<serial>.pem
+		<dir>/<name>.pem, <name>.key   server certs (SERVER_PEM, SERVER_KEY)
+		<dir>/clients/<name>.pem, .key client certs for mutual TLS
+
+	Keys are ECDSA P-256 in PKCS#8, which is what tls.LoadX509KeyPair (and so tlsconfig) reads.
+*/
+type CA struct {
+	dir   string
+	cert  *x509.Certificate
+	key   crypto.Signer
+	index *index
+}
+
+type Kind string
+
+const (
+	KindServer Kind = "server"
+	KindClient Kind = "client"
+)
+
+var ErrExists = errors.New("a CA already exists there")
+
+// How long things are valid for when the caller doesn't say
+const (
+	DefaultCAValidity   = 10 * 365 * 24 * time.Hour
+	DefaultCertValidity = 365 * 24 * time.Hour
+)
+
+// The default PKI directory, where env_setup.sh used to put things
+func DefaultDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".custom_vpn", "ssl")
+	}
+	return filepath.Join(home, ".custom_vpn", "ssl")
+}
+
+func (ca *CA) CertPath() string { return filepath.Join(ca.dir, "ca", "ca.pem") }
+func (ca *CA) KeyPath() string  { return filepath.Join(ca.dir, "ca", "ca.key") }
+func (ca *CA) CRLPath() string  { return filepath.Join(ca.dir, "ca", "crl.pem") }
+func (ca *CA) indexPath() string {
+	return filepath.Join(ca.dir, "ca", "index.json")
+}
+
+// Creates a new CA (and an empty CRL) in dir. Refuses to touch an existing one
+func Init(dir, commonName string, validity time.Duration) (*CA, error) {
+	ca := &CA{dir: dir, index: &index{}}
+	if _, err := os.Stat(ca.KeyPath()); err == nil {
+		return nil, fmt.Errorf("pki: %s: %w", ca.KeyPath(), ErrExists)
+	}
+	if validity <= 0 {
+		validity = DefaultCAValidity
+	}
+	for _, sub := range []string{"ca", filepath.Join("ca", "signed_certs"), "clients"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return nil, fmt.Errorf("pki: %v", err)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("pki: generating CA key: %v", err)
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"custom_vpn"}},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("pki: creating CA cert: %v", err)
+	}
+	ca.cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("pki: %v", err)
+	}
+	ca.key = key
+
+	if err := writeKey(ca.KeyPath(), key); err != nil {
+		return nil, err
+	}
+	if err := writeCert(ca.CertPath(), der); err != nil {
+		return nil, err
+	}
+	if err := ca.index.save(ca.indexPath()); err != nil {
+		return nil, err
+	}
+	if err := ca.WriteCRL(); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// Loads the CA in dir
+func Open(dir string) (*CA, error) {
+	ca := &CA{dir: dir}
+	certs, err := readCerts(ca.CertPath())
+	if err != nil {
+		return nil, err
+	}
+	ca.cert = certs[0]
+
+	raw, err := os.ReadFile(ca.KeyPath())
+	if err != nil {
+		return nil, fmt.Errorf("pki: %v", err)
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("pki: %s: no PEM data", ca.KeyPath())
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("pki: %s: %v", ca.KeyPath(), err)
+	}
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("pki: %s: key can't sign", ca.KeyPath())
+	}
+	ca.key = signer
+
+	ca.index, err = loadIndex(ca.indexPath())
+	if err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// What to put in a new cert
+type Request struct {
+	Kind Kind
+	// Subject common name. For clients this is the identity the server sees (policy identities)
+	Name     string
+	DNSNames []string
+	IPs      []net.IP
+	Validity time.Duration
+}
+
+/*
+	Issues a cert and key, writes both next to the CA (see the layout at the top) and records the cert in the index.
+	Server certs always get localhost and 127.0.0.1 on top of what was asked for,
+	the client verifies against ServerName "localhost" (see tlsconfig.ClientTLSConfig)
+*/
+func (ca *CA) Issue(req Request) (Entry, error) {
+	if req.Name == "" {
+		return Entry{}, fmt.Errorf("pki: a cert needs a name")
+	}
+	if filepath.Base(req.Name) != req.Name {
+		return Entry{}, fmt.Errorf("pki: %q can't be used as a file name", req.Name)
+	}
+	if req.Validity <= 0 {
+		req.Validity = DefaultCertValidity
+	}
+
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: req.Name, Organization: []string{"custom_vpn"}},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	var certPath, keyPath string
+	switch req.Kind {
+	case KindServer:
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.DNSNames = appendMissing(req.DNSNames, "localhost")
+		template.IPAddresses = req.IPs
+		if !containsIP(req.IPs, net.IPv4(127, 0, 0, 1)) {
+			template.IPAddresses = append(template.IPAddresses, net.IPv4(127, 0, 0, 1))
+		}
+		certPath = filepath.Join(ca.dir, req.Name+".pem")
+		keyPath = filepath.Join(ca.dir, req.Name+".key")
+	case KindClient:
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		template.DNSNames = req.DNSNames
+		template.IPAddresses = req.IPs
+		certPath = filepath.Join(ca.dir, "clients", req.Name+".pem")
+		keyPath = filepath.Join(ca.dir, "clients", req.Name+".key")
+	default:
+		return Entry{}, fmt.Errorf("pki: unknown cert kind %q", req.Kind)
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return Entry{}, err
+	}
+	now := time.Now()
+	template.SerialNumber = serial
+	template.NotBefore = now.Add(-time.Minute)
+	template.NotAfter = now.Add(req.Validity)
+	if template.NotAfter.After(ca.cert.NotAfter) {
+		template.NotAfter = ca.cert.NotAfter
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return Entry{}, fmt.Errorf("pki: generating key: %v", err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return Entry{}, fmt.Errorf("pki: signing cert: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certPath), 0o700); err != nil {
+		return Entry{}, fmt.Errorf("pki: %v", err)
+	}
+	if err := writeKey(keyPath, key); err != nil {
+		return Entry{}, err
+	}
+	if err := writeCert(certPath, der); err != nil {
+		return Entry{}, err
+	}
+	if err := writeCert(filepath.Join(ca.dir, "ca", "signed_certs", serialString(serial)+".pem"), der); err != nil {
+		return Entry{}, err
+	}
+
+	entry := Entry{
+		Serial:    serialString(serial),
+		Kind:      req.Kind,
+		Name:      req.Name,
+		DNSNames:  template.DNSNames,
+		NotBefore: template.NotBefore.UTC(),
+		NotAfter:  template.NotAfter.UTC(),
+		CertFile:  certPath,
+		KeyFile:   keyPath,
+	}
+	for _, ip := range template.IPAddresses {
+		entry.IPs = append(entry.IPs, ip.String())
+	}
+	ca.index.Entries = append(ca.index.Entries, entry)
+	if err := ca.index.save(ca.indexPath()); err != nil {
+		return Entry{}, err
+	}
+	return entry, nil
+}
+
+// Every cert the CA has issued, oldest first
+func (ca *CA) Entries() []Entry {
+	return append([]Entry(nil), ca.index.Entries...)
+}
+
+// 128 random bits, as RFC 5280 allows up to 20 bytes and wants them unpredictable
+func newSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("pki: generating serial: %v", err)
+	}
+	return serial, nil
+}
+
+func serialString(serial *big.Int) string {
+	return fmt.Sprintf("%x", serial)
+}
+
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("pki: %v", err)
+	}
+	return writePEM(path, "PRIVATE KEY", der, 0o600)
+}
+
+func writeCert(path string, der []byte) error {
+	return writePEM(path, "CERTIFICATE", der, 0o644)
+}
+
+// Writes to a temp file and renames it over path, so a crash never leaves half a key behind
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	return writeFileAtomic(path, data, perm)
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("pki: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("pki: %v", err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("pki: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("pki: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("pki: %v", err)
+	}
+	return nil
+}
+
+func readCerts(path string) ([]*x509.Certificate, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("pki: %v", err)
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, raw = pem.Decode(raw)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("pki: %s: %v", path, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("pki: %s: no certificates", path)
+	}
+	return certs, nil
+}
+
+func appendMissing(list []string, s string) []string {
+	for _, item := range list {
+		if item == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, candidate := range ips {
+		if candidate.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,219 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"custom_vpn/config"
+)
+
+/*
+	The server's destination policy, compiled from the policy section of the config (see config/policy.go).
+	Check() resolves the destination itself and hands back the addresses which passed,
+	the caller dials those and never the name, so DNS can't swap in a different address after the check.
+*/
+type Engine struct {
+	allowByDefault bool
+	rules          []rule
+}
+
+type rule struct {
+	allow      bool
+	identities []string
+	services   []string
+	prefixes   []netip.Prefix
+	ports      [][2]uint16
+	hosts      []string
+}
+
+// What a client asked for
+type Request struct {
+	// Who's asking, from the client's cert. Empty without mutual TLS
+	Identity string
+	// The named service, empty for dynamic targets
+	Service string
+	// Destination as the client (or the service's config) gave it, a name or an address
+	Host string
+	Port uint16
+}
+
+func (r Request) String() string {
+	dst := net.JoinHostPort(r.Host, fmt.Sprint(r.Port))
+	if r.Service != "" {
+		dst = fmt.Sprintf("service %q (%s)", r.Service, dst)
+	}
+	if r.Identity != "" {
+		return fmt.Sprintf("%s for %q", dst, r.Identity)
+	}
+	return dst
+}
+
+// Returned when the policy refuses a request. Rule is the index of the deciding rule, -1 for the default
+type DeniedError struct {
+	Request Request
+	Addr    netip.Addr
+	Rule    int
+}
+
+func (e *DeniedError) Error() string {
+	by := "the default policy"
+	if e.Rule >= 0 {
+		by = fmt.Sprintf("policy rule %d", e.Rule)
+	}
+	if e.Addr.IsValid() && e.Addr.String() != e.Request.Host {
+		return fmt.Sprintf("%v (resolved to %v) denied by %s", e.Request, e.Addr, by)
+	}
+	return fmt.Sprintf("%v denied by %s", e.Request, by)
+}
+
+// Compiles the policy. The config has been validated already, errors here mean it wasn't
+func New(conf config.Policy) (*Engine, error) {
+	e := &Engine{allowByDefault: conf.Default != "deny"}
+	for i, rc := range conf.Rules {
+		r := rule{
+			allow:      rc.Action == "allow",
+			identities: rc.Identities,
+			services:   rc.Services,
+		}
+		for _, cidr := range rc.CIDRs {
+			prefix, err := config.ParsePrefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("policy rule %d: %v", i, err)
+			}
+			r.prefixes = append(r.prefixes, prefix)
+		}
+		for _, ports := range rc.Ports {
+			lo, hi, err := config.ParsePortRange(ports)
+			if err != nil {
+				return nil, fmt.Errorf("policy rule %d: %v", i, err)
+			}
+			r.ports = append(r.ports, [2]uint16{lo, hi})
+		}
+		for _, host := range rc.Hosts {
+			r.hosts = append(r.hosts, strings.ToLower(strings.TrimSuffix(host, ".")))
+		}
+		e.rules = append(e.rules, r)
+	}
+	return e, nil
+}
+
+/*
+	Resolves req.Host and runs every resulting address through the rules.
+	All of them have to pass, otherwise a name with one good and one bad address could be dialed at the bad one.
+	A nil Engine allows everything, but still resolves.
+*/
+func (e *Engine) Check(ctx context.Context, req Request) ([]netip.AddrPort, error) {
+	addrs, err := resolve(ctx, req.Host)
+	if err != nil {
+		return nil, err
+	}
+	allowed := make([]netip.AddrPort, 0, len(addrs))
+	for _, addr := range addrs {
+		if ok, ruleIdx := e.decide(req, addr); !ok {
+			return nil, &DeniedError{Request: req, Addr: addr, Rule: ruleIdx}
+		}
+		allowed = append(allowed, netip.AddrPortFrom(addr, req.Port))
+	}
+	return allowed, nil
+}
+
+/*
+	Runs a destination that needs no resolving through the rules: a packet from a TUN client.
+	There's no service or host name to go on, so rules naming those never match.
+*/
+func (e *Engine) CheckAddr(identity string, dst netip.AddrPort) error {
+	req := Request{Identity: identity, Host: dst.Addr().String(), Port: dst.Port()}
+	if ok, ruleIdx := e.decide(req, dst.Addr()); !ok {
+		return &DeniedError{Request: req, Addr: dst.Addr(), Rule: ruleIdx}
+	}
+	return nil
+}
+
+// First matching rule wins
+func (e *Engine) decide(req Request, addr netip.Addr) (bool, int) {
+	if e == nil {
+		return true, -1
+	}
+	for i, r := range e.rules {
+		if r.matches(req, addr) {
+			return r.allow, i
+		}
+	}
+	return e.allowByDefault, -1
+}
+
+func (r rule) matches(req Request, addr netip.Addr) bool {
+	if len(r.identities) > 0 && (req.Identity == "" || !slices.Contains(r.identities, req.Identity)) {
+		return false
+	}
+	if len(r.services) > 0 && (req.Service == "" || !slices.Contains(r.services, req.Service)) {
+		return false
+	}
+	if len(r.prefixes) > 0 && !r.inPrefixes(addr) {
+		return false
+	}
+	if len(r.ports) > 0 && !r.inPorts(req.Port) {
+		return false
+	}
+	if len(r.hosts) > 0 && !r.matchesHost(req.Host) {
+		return false
+	}
+	return true
+}
+
+func (r rule) inPrefixes(addr netip.Addr) bool {
+	for _, prefix := range r.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r rule) inPorts(port uint16) bool {
+	for _, pr := range r.ports {
+		if port >= pr[0] && port <= pr[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func (r rule) matchesHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range r.hosts {
+		if suffix, wild := strings.CutPrefix(pattern, "*."); wild {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Swapped out by the tests
+var lookupNetIP = net.DefaultResolver.LookupNetIP
+
+// Addresses for host. Literals aren't looked up. IPv4-mapped IPv6 is unmapped so it matches v4 CIDRs
+func resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+	addrs, err := lookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses for %q", host)
+	}
+	for i := range addrs {
+		addrs[i] = addrs[i].Unmap()
+	}
+	return addrs, nil
+}
@@ -0,0 +1,301 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"custom_vpn/config"
+)
+
+// Answers lookups from a fixed table instead of DNS
+func fakeDNS(t *testing.T, names map[string][]string) {
+	t.Helper()
+	old := lookupNetIP
+	lookupNetIP = func(_ context.Context, _, host string) ([]netip.Addr, error) {
+		var addrs []netip.Addr
+		for _, a := range names[host] {
+			addrs = append(addrs, netip.MustParseAddr(a))
+		}
+		if addrs == nil {
+			return nil, fmt.Errorf("no such host %q", host)
+		}
+		return addrs, nil
+	}
+	t.Cleanup(func() { lookupNetIP = old })
+}
+
+func TestCheck(t *testing.T) {
+	fakeDNS(t, map[string][]string{
+		"db.internal":       {"10.1.0.5"},
+		"web.example.com":   {"192.0.2.10"},
+		"example.com":       {"192.0.2.20"},
+		"Example.COM.":      {"192.0.2.20"},
+		"split.example.net": {"192.0.2.30", "10.1.0.6"},
+		"mapped.example":    {"::ffff:10.1.0.7"},
+	})
+	tests := []struct {
+		name   string
+		policy config.Policy
+		req    Request
+		// index of the deciding rule, -1 for the default, unused when allowed
+		rule  int
+		allow bool
+	}{
+		{
+			name:  "no rules, default allow",
+			req:   Request{Host: "10.1.0.5", Port: 22},
+			allow: true,
+		},
+		{
+			name:   "no rules, default deny",
+			policy: config.Policy{Default: "deny"},
+			req:    Request{Host: "10.1.0.5", Port: 22},
+			rule:   -1,
+		},
+		{
+			name: "nothing matches, default deny",
+			policy: config.Policy{Default: "deny", Rules: []config.Rule{
+				{Action: "allow", CIDRs: []string{"172.16.0.0/12"}},
+			}},
+			req:  Request{Host: "10.1.0.5", Port: 22},
+			rule: -1,
+		},
+		{
+			name: "first match wins over a later allow",
+			policy: config.Policy{Rules: []config.Rule{
+				{Action: "deny", CIDRs: []string{"10.0.0.0/8"}},
+				{Action: "allow", CIDRs: []string{"10.1.0.0/16"}},
+			}},
+			req:  Request{Host: "10.1.0.5", Port: 22},
+			rule: 0,
+		},
+		{
+			name: "first match wins over a later deny",
+			policy: config.Policy{Rules: []config.Rule{
+				{Action: "allow", CIDRs: []string{"10.1.0.0/16"}},
+				{Action: "deny", CIDRs: []string{"10.0.0.0/8"}},
+			}},
+			req:   Request{Host: "10.1.0.5", Port: 22},
+			allow: true,
+		},
+		{
+			name: "identity matches",
+			policy: config.Policy{Default: "deny", Rules: []config.Rule{
+				{Action: "allow", Identities: []string{"alice"}},
+			}},
+			req:   Request{Identity: "alice", Host: "10.1.0.5", Port: 22},
+			allow: true,
+		},
+		{
+			name: "other identity",
+			policy: config.Policy{Default: "deny", Rules: []config.Rule{
+				{Action: "allow", Identities: []string{"alice"}},
+			}},
+			req:  Request{Identity: "bob", Host: "10.1.0.5", Port: 22},
+			rule: -1,
+		},
+		{
+			name: "no identity never matches a rule naming them",
+			policy: config.Policy{Rules: []config.Rule{
+				{Action: "allow", Identities: []string{"alice"}},
+				{Action: "deny"},
+			}},
+			req:  Request{Host: "10.1.0.5", Port: 22},
+			rule: 1,
+		},
+		{
+			name: "service matches",
+			policy: config.Policy{Default: "deny", Rules: []config.Rule{
+				{Action: "allow", Services: []string{"ssh"}},
+			}},
+			req:   Request{Service: "ssh", Host: "db.internal", Port: 22},
+			allow: true,
+		},
+		{
+			name: "dynamic target has no service",
+			policy: config.Policy{Default: "deny", Rules: []config.Rule{
+				{Action: "allow", Services: []string{"ssh"}},
+			}},
+			req:  Request{Host: "db.internal", Port: 22},
+			rule: -1,
+		},
+		{
+			name: "CIDR on a resolved name",
+			policy: config.Policy{Rules: []config.Rule{
+				{Action: "deny", CIDRs: []string{"10.0.0.0/8"}},
+			}},
+			req:  Request{Host: "db.internal", Port: 5432},
+			rule: 0,
+		},
+		{
+			name: "single address CIDR",
+			policy: config.Policy{Default: "deny", Rules: []config.Rule{
+				{Action: "allow", CIDRs: []string{"192.0.2.10"}},
+			}},
+			req:   Request{Host: "192.0.2.10", Port: 80},
+			allow: true,
+		},
+		{
+			name: "IPv4-mapped answers match v4 CIDRs",
+			policy: config.Policy{Rules: []config.Rule{
+				{Action: "deny", CIDRs: []string{"10.0.0.0/8"}},
+			}},
+			req:  Request{Host: "mapped.example", Port: 80},
+			rule: 0,
+		},
+		{
+			name: "port range, inside",
+			policy: config.Policy{Default: "deny", Rules: []config.Rule{
+				{Action: "allow", Ports: []string{"22", "8000-8999"}},
+			}},
+			req:   Request{Host: "10.1.0.5", Port: 8999},
+			allow: true,
+		},
+		{
+			name: "port range, just outside",
+			policy: config.Policy{Default: "deny", Rules: []config.Rule{
+				{Action: "allow", Ports: []string{"22", "8000-8999"}},
+			}},
+			req:  Request{Host: "10.1.0.5", Port: 9000},
+			rule: -1,
+		},
+		{
+			name: "exact host",
+			policy: config.Policy{Default: "deny", Rules: []config.Rule{
+				{Action: "allow", Hosts: []string{"example.com"}},
+			}},
+			req:   Request{Host: "Example.COM.", Port: 443},
+			allow: true,
+		},
+		{
+			name: "wildcard host matches a subdomain",
+			policy: config.Policy{Default: "deny", Rules: []config.Rule{
+				{Action: "allow", Hosts: []string{"*.example.com"}},
+			}},
+			req:   Request{Host: "web.example.com", Port: 443},
+			allow: true,
+		},
+		{
+			name: "wildcard host doesn't match the domain itself",
+			policy: config.Policy{Default: "deny", Rules: []config.Rule{
+				{Action: "allow", Hosts: []string{"*.example.com"}},
+			}},
+			req:  Request{Host: "example.com", Port: 443},
+			rule: -1,
+		},
+		{
+			name: "every part of a rule has to match",
+			policy: config.Policy{Default: "deny", Rules: []config.Rule{
+				{Action: "allow", Identities: []string{"alice"}, CIDRs: []string{"10.0.0.0/8"}, Ports: []string{"22"}},
+			}},
+			req:  Request{Identity: "alice", Host: "10.1.0.5", Port: 23},
+			rule: -1,
+		},
+		{
+			name: "one allowed and one denied address",
+			policy: config.Policy{Rules: []config.Rule{
+				{Action: "deny", CIDRs: []string{"10.0.0.0/8"}},
+			}},
+			req:  Request{Host: "split.example.net", Port: 443},
+			rule: 0,
+		},
+		{
+			name: "a host rule can't allow past the addresses",
+			policy: config.Policy{Rules: []config.Rule{
+				{Action: "deny", CIDRs: []string{"10.0.0.0/8"}},
+				{Action: "allow", Hosts: []string{"split.example.net"}},
+			}},
+			req:  Request{Host: "split.example.net", Port: 443},
+			rule: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := New(tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addrs, err := e.Check(context.Background(), tt.req)
+			if tt.allow {
+				if err != nil {
+					t.Fatalf("denied: %v", err)
+				}
+				if len(addrs) == 0 || addrs[0].Port() != tt.req.Port {
+					t.Errorf("got addresses %v", addrs)
+				}
+				return
+			}
+			var denied *DeniedError
+			if !errors.As(err, &denied) {
+				t.Fatalf("err = %v, want a DeniedError", err)
+			}
+			if denied.Rule != tt.rule {
+				t.Errorf("denied by rule %d, want %d", denied.Rule, tt.rule)
+			}
+			if addrs != nil {
+				t.Errorf("denied but got addresses %v", addrs)
+			}
+		})
+	}
+}
+
+func TestCheckAllAddresses(t *testing.T) {
+	fakeDNS(t, map[string][]string{"split.example.net": {"192.0.2.30", "10.1.0.6"}})
+	e, err := New(config.Policy{Default: "deny", Rules: []config.Rule{
+		{Action: "allow", CIDRs: []string{"192.0.2.0/24", "10.0.0.0/8"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := e.Check(context.Background(), Request{Host: "split.example.net", Port: 443})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.AddrPort{netip.MustParseAddrPort("192.0.2.30:443"), netip.MustParseAddrPort("10.1.0.6:443")}
+	if !slices.Equal(addrs, want) {
+		t.Errorf("got %v, want %v", addrs, want)
+	}
+
+	// and the error names the address that failed
+	e, _ = New(config.Policy{Rules: []config.Rule{{Action: "deny", CIDRs: []string{"10.0.0.0/8"}}}})
+	_, err = e.Check(context.Background(), Request{Host: "split.example.net", Port: 443})
+	var denied *DeniedError
+	if !errors.As(err, &denied) || denied.Addr != netip.MustParseAddr("10.1.0.6") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestCheckLookupFails(t *testing.T) {
+	fakeDNS(t, nil)
+	var e *Engine
+	if _, err := e.Check(context.Background(), Request{Host: "nowhere.invalid", Port: 80}); err == nil {
+		t.Error("no error for a name that doesn't resolve")
+	}
+	// a nil Engine allows everything
+	if addrs, err := e.Check(context.Background(), Request{Host: "10.1.0.5", Port: 80}); err != nil || len(addrs) != 1 {
+		t.Errorf("nil engine: %v, %v", addrs, err)
+	}
+}
+
+func TestCheckAddr(t *testing.T) {
+	e, err := New(config.Policy{Default: "deny", Rules: []config.Rule{
+		{Action: "allow", Services: []string{"ssh"}},
+		{Action: "allow", Hosts: []string{"*"}},
+		{Action: "allow", Identities: []string{"alice"}, CIDRs: []string{"10.0.0.0/8"}, Ports: []string{"22"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.CheckAddr("alice", netip.MustParseAddrPort("10.1.0.5:22")); err != nil {
+		t.Error(err)
+	}
+	// service and host rules never match a packet
+	var denied *DeniedError
+	if err := e.CheckAddr("bob", netip.MustParseAddrPort("10.1.0.5:22")); !errors.As(err, &denied) || denied.Rule != -1 {
+		t.Errorf("bob: err = %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package policy
+
+import (
+	"fmt"
+	"slices"
+
+	"custom_vpn/config"
+)
+
+// Who may have the server listen on which port (reverse forwards), compiled from the reverse section of the config
+type Reverse struct {
+	Bind  string
+	rules []reverseRule
+}
+
+type reverseRule struct {
+	identities []string
+	ports      [][2]uint16
+}
+
+// Returned when no allow rule covers a registration
+type ReverseDeniedError struct {
+	Identity string
+	Port     uint16
+}
+
+func (e *ReverseDeniedError) Error() string {
+	if e.Identity == "" {
+		return fmt.Sprintf("no reverse.allow rule lets a client without an identity listen on port %d", e.Port)
+	}
+	return fmt.Sprintf("no reverse.allow rule lets %q listen on port %d", e.Identity, e.Port)
+}
+
+// The config has been validated already, errors here mean it wasn't
+func NewReverse(conf config.ServerReverse) (*Reverse, error) {
+	r := &Reverse{Bind: conf.Bind}
+	for i, rc := range conf.Allow {
+		rule := reverseRule{identities: rc.Identities}
+		for _, ports := range rc.Ports {
+			lo, hi, err := config.ParsePortRange(ports)
+			if err != nil {
+				return nil, fmt.Errorf("reverse rule %d: %v", i, err)
+			}
+			rule.ports = append(rule.ports, [2]uint16{lo, hi})
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+// nil when some rule lets identity listen on port
+func (r *Reverse) Check(identity string, port uint16) error {
+	for _, rule := range r.rules {
+		if len(rule.identities) > 0 && (identity == "" || !slices.Contains(rule.identities, identity)) {
+			continue
+		}
+		for _, pr := range rule.ports {
+			if port >= pr[0] && port <= pr[1] {
+				return nil
+			}
+		}
+	}
+	return &ReverseDeniedError{Identity: identity, Port: port}
+}
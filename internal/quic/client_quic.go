@@ -2,89 +2,165 @@ package quic
 
 import (
 	"context"
-	"custom_vpn/config"
-	"custom_vpn/tlsconfig"
-	"custom_vpn/tunnel"
-	"encoding/binary"
-	"fmt"
-	"log"
+	"errors"
 	"net"
 	"sync"
 
+	"custom_vpn/internal/metrics"
+	"custom_vpn/internal/transport"
+	"custom_vpn/internal/wire"
+
 	"github.com/quic-go/quic-go"
 )
 
-func ConnectRemoteQuic(ctx context.Context, wg *sync.WaitGroup, errCh chan<- error, remoteAddr *net.UDPAddr, caCertLoc string, conn net.Conn) {
-	defer wg.Done()
+/*
+	A quic.Stream already reads, writes, closes and takes deadlines like a net.Conn.
+	All it's missing are the addresses, which live on the connection.
+	Wrapping it lets the rest of the client treat every transport as a net.Conn.
+*/
+type StreamConn struct {
+	quic.Stream
+	conn quic.Connection
+}
 
-	tlsConf, err := tlsconfig.ClientTLSConfig(caCertLoc)
-	if err != nil{
-		errCh <- fmt.Errorf("QUIC Client: %v. Will not initiate quic connection", err)
-		return
-	}
-	
-	// UDP Addr for a local bind
-	// no port val means one is randomly choosen, but it can't be accessed
-	udpAddrForRemoteComms := net.UDPAddr{
-		IP: net.ParseIP("0.0.0.0"),
-		Port: 0,
+func (s *StreamConn) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s *StreamConn) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+// Closing a quic.Stream only closes our sending side. We're done reading too
+func (s *StreamConn) Close() error {
+	s.Stream.CancelRead(0)
+	return s.Stream.Close()
+}
+
+// What a quic.Stream's Close does on its own: a FIN, and we keep reading. See tunnel.Pipe
+func (s *StreamConn) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+var ErrFlowClosed = errors.New("QUIC client: flow closed")
+
+/*
+	Client side of a UDP association (or a TUN link, the same thing carrying IP packets), see transport.Flow.
+	The ConnManager's datagram loop pushes payloads for our flow ID into in.
+	Payloads too big for a datagram travel framed on the control stream, both ways.
+*/
+type clientFlow struct {
+	id      uint32
+	conn    quic.Connection
+	stream  quic.Stream
+	packets *packetSender
+	in      chan []byte
+	done    chan struct{}
+	once    sync.Once
+	// why the flow ended, when it's more than just closed. Set before done is closed
+	err     error
+	release func()
+}
+
+// How many datagrams a flow buffers before new ones get dropped
+const flowQueueLen = 64
+
+func newClientFlow(id uint32, conn quic.Connection, stream quic.Stream, release func()) *clientFlow {
+	f := &clientFlow{
+		id:      id,
+		conn:    conn,
+		stream:  stream,
+		packets: &packetSender{conn: conn, stream: stream, id: id},
+		in:      make(chan []byte, flowQueueLen),
+		done:    make(chan struct{}),
+		release: release,
 	}
-	
-	udpConn, err := net.ListenUDP("udp4", &udpAddrForRemoteComms)
-	if err != nil {
-		errCh <- fmt.Errorf("QUIC Client: %v", err)
-		return
+	// the control stream ends when the association does (we closed it, the server timed it out, or the connection died)
+	go func() {
+		for {
+			pkt, err := wire.ReadPacket(stream)
+			if err != nil {
+				var streamErr *quic.StreamError
+				if errors.As(err, &streamErr) && streamErr.Remote && streamErr.ErrorCode == TUNReplacedCode {
+					f.closeWithErr(transport.ErrFlowReplaced)
+				}
+				f.Close()
+				return
+			}
+			f.deliver(pkt)
+		}
+	}()
+	return f
+}
+
+func (f *clientFlow) Send(payload []byte) error {
+	select {
+	case <-f.done:
+		return ErrFlowClosed
+	default:
 	}
+	return f.packets.send(payload)
+}
 
-	// wrap UDP conn in quic
-	tr := quic.Transport{Conn: udpConn}
+func (f *clientFlow) Receive(ctx context.Context) ([]byte, error) {
+	select {
+	case payload := <-f.in:
+		return payload, nil
+	case <-f.done:
+		if f.err != nil {
+			return nil, f.err
+		}
+		return nil, ErrFlowClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
 
-	qConn, err := tr.Dial(ctx, remoteAddr, tlsConf, &config.ClientQuicConfig)
-	if err != nil {
-		errCh <- fmt.Errorf("quic client died while dialing remote: %v", err)
-		return
-	}else{
-		log.Printf("established QUIC conn to remote")
+// called by the datagram loop. Drops the payload when the reader can't keep up, like a full socket buffer would
+func (f *clientFlow) deliver(payload []byte) {
+	select {
+	case f.in <- payload:
+	default:
+		metrics.ClientDatagramDrops.WithLabelValues("queue_full").Inc()
 	}
+}
 
-	// handle streams
-	createStream(errCh, qConn, conn, config.ClientListnerPort, remoteAddr)
+func (f *clientFlow) Done() <-chan struct{} {
+	return f.done
+}
 
+func (f *clientFlow) Close() error {
+	return f.closeWithErr(nil)
 }
 
-func createStream(errCh chan<- error, qConn quic.Connection, conn net.Conn, clientListenerPort int, remoteAddr *net.UDPAddr){
-	// add a header based on local port num use incomming port to determing header
+func (f *clientFlow) closeWithErr(err error) error {
+	f.once.Do(func() {
+		f.err = err
+		close(f.done)
+		f.release()
+		f.stream.CancelRead(0)
+		f.stream.Close()
+	})
+	return nil
+}
 
-	// Determine protocol based on which port the client is listening on
-	proto, err := determineProto(clientListenerPort)
-	if err != nil{
-		errCh <- err
-		return
-	}
+/*
+	Sends the payloads of a flow (UDP association or TUN link), from either end.
+	A payload goes as a datagram when it fits, and framed on the control stream when it doesn't
+	(or when the connection has no datagram support at all).
+*/
+type packetSender struct {
+	conn   quic.Connection
+	stream quic.Stream
+	id     uint32
+	// stream writes of concurrent senders can't interleave
+	mu sync.Mutex
+}
 
-	str, err := qConn.OpenStream()
-	if err != nil{
-		errCh <- fmt.Errorf("createStream: %v", err)
-		return
+func (p *packetSender) send(pkt []byte) error {
+	if p.conn.ConnectionState().SupportsDatagrams {
+		err := p.conn.SendDatagram(wire.AppendDatagram(nil, p.id, pkt))
+		var tooLarge *quic.DatagramTooLargeError
+		if !errors.As(err, &tooLarge) {
+			return err
+		}
 	}
-	
-	// Write a Header to the stream before piping the conn
-	// These IPs and Ports are useless. They mean nothing, and tell the end user nothing
-	str.Write(proto)
-	str.Write(remoteAddr.IP.To16())
-	binary.Write(str, binary.BigEndian, uint16(qConn.LocalAddr().(*net.UDPAddr).Port))
-
-	tunnel.QuicTcpTunnel(conn, str)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return wire.WritePacket(p.stream, pkt)
 }
-
-// This is not effective validation.
-// Values defining protocols should be constants shared across client and server
-// and should live in a helper
-func determineProto(port int) ([]byte,error) {
-	if port == 2022{
-		return []byte("HTTP"), nil			// these values should be consts/enums
-	} else if port == 2024{
-		return []byte("SSH"), nil
-	} 
-	return nil, fmt.Errorf("unsupported protocol")
-}
\ No newline at end of file
@@ -0,0 +1,399 @@
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"custom_vpn/internal/auth"
+	"custom_vpn/internal/metrics"
+	"custom_vpn/internal/session"
+	"custom_vpn/internal/transport"
+	"custom_vpn/internal/wire"
+
+	"github.com/quic-go/quic-go"
+)
+
+/*
+	The client used to create a new UDP socket, transport and handshake for every local TCP conn.
+	That threw away the whole point of QUIC (multiplexing streams over one conn), and leaked sockets.
+
+	The ConnManager holds one UDP socket and transport for the lifetime of the client, and one long-lived
+	quic.Connection to the server. Every local conn gets a new stream on that connection.
+	When the connection dies (idle timeout, server went away, etc...) the next stream request redials,
+	backing off between attempts. No more restarting the client after a timeout.
+*/
+type ConnManager struct {
+	remoteAddr *net.UDPAddr
+	tlsConf    *tls.Config
+	quicConf   *quic.Config
+
+	udpConn *net.UDPConn
+	tr      *quic.Transport
+
+	// the client's token, sent on every new connection. nil means the server doesn't want one
+	Token auth.TokenSource
+
+	mu     sync.Mutex
+	conn   quic.Connection
+	closed bool
+	// the dial in progress, if there is one. Concurrent callers share it, and wait for it without holding mu
+	dialing *pendingDial
+	// the server's shutting down and refused a stream on conn. What's on it can finish there, new streams go on a new connection
+	goingAway bool
+
+	// UDP associations and reverse forwards, by flow ID. Flow IDs are never reused for the life of the manager
+	flowsMu    sync.Mutex
+	flows      map[uint32]*clientFlow
+	reverse    map[uint32]ReverseDialer
+	lastFlowID uint32
+}
+
+// Backoff between redial attempts
+const (
+	minRedialBackoff = 250 * time.Millisecond
+	maxRedialBackoff = 10 * time.Second
+)
+
+var ErrManagerClosed = errors.New("QUIC client: connection manager closed")
+
+// A dial (with its redials) that Connection() callers are waiting on. conn and err are set before done is closed
+type pendingDial struct {
+	done chan struct{}
+	conn quic.Connection
+	err  error
+	// callers still waiting, under m.mu. When the last one gives up, so does the dial
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// Binds the local UDP socket. Doesn't dial until the first stream is needed
+func NewConnManager(remoteAddr *net.UDPAddr, tlsConf *tls.Config, quicConf *quic.Config) (*ConnManager, error) {
+	// UDP Addr for a local bind
+	// no port val means one is randomly choosen
+	udpAddrForRemoteComms := net.UDPAddr{
+		IP:   net.ParseIP("0.0.0.0"),
+		Port: 0,
+	}
+	udpConn, err := net.ListenUDP("udp4", &udpAddrForRemoteComms)
+	if err != nil {
+		return nil, fmt.Errorf("QUIC Client: %v", err)
+	}
+
+	return &ConnManager{
+		remoteAddr: remoteAddr,
+		tlsConf:    tlsConf,
+		quicConf:   quicConf,
+		udpConn:    udpConn,
+		// wrap UDP conn in quic
+		tr:      &quic.Transport{Conn: udpConn},
+		flows:   make(map[uint32]*clientFlow),
+		reverse: make(map[uint32]ReverseDialer),
+	}, nil
+}
+
+/*
+	Returns the live connection to the server, dialing (or redialing) if there isn't one.
+	Callers arriving while a dial is under way wait for that one, each giving up when its ctx is done.
+	m.mu isn't held across the dial, so Close() and the rest of the manager don't wait on a server that's down
+*/
+func (m *ConnManager) Connection(ctx context.Context) (quic.Connection, error) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, ErrManagerClosed
+	}
+	// a dead connection has its context cancelled
+	if m.conn != nil && m.conn.Context().Err() == nil && !m.goingAway {
+		defer m.mu.Unlock()
+		return m.conn, nil
+	}
+	d := m.dialing
+	if d == nil {
+		dialCtx, cancel := context.WithCancel(context.Background())
+		d = &pendingDial{done: make(chan struct{}), cancel: cancel}
+		m.dialing = d
+		go m.dial(dialCtx, d)
+	}
+	d.waiters++
+	m.mu.Unlock()
+
+	select {
+	case <-d.done:
+		return d.conn, d.err
+	case <-ctx.Done():
+		m.mu.Lock()
+		d.waiters--
+		// nobody's left to dial for. The next caller starts over
+		if d.waiters == 0 && m.dialing == d {
+			m.dialing = nil
+			d.cancel()
+		}
+		m.mu.Unlock()
+		return nil, fmt.Errorf("QUIC Client: giving up dialing %v: %v", m.remoteAddr, context.Cause(ctx))
+	}
+}
+
+// Dials until it gets a connection, the token is refused, or ctx is done. Then hands the result to d's waiters
+func (m *ConnManager) dial(ctx context.Context, d *pendingDial) {
+	defer close(d.done)
+	defer d.cancel()
+
+	backoff := minRedialBackoff
+	for {
+		qConn, err := m.tr.Dial(ctx, m.remoteAddr, m.tlsConf, m.quicConf)
+		metrics.Dials.WithLabelValues("quic", metrics.Result(err)).Inc()
+		if err == nil && m.Token != nil {
+			// a refused token won't get better by redialing, give up straight away
+			if err := m.authenticate(ctx, qConn); err != nil {
+				qConn.CloseWithError(0, "authentication failed")
+				m.dialDone(d, nil, err)
+				return
+			}
+		}
+		if err == nil {
+			m.dialDone(d, qConn, nil)
+			return
+		}
+		logger.Warn("dialing failed, retrying", "server", m.remoteAddr.String(), "backoff", backoff, "err", err)
+
+		select {
+		case <-ctx.Done():
+			m.dialDone(d, nil, fmt.Errorf("QUIC Client: giving up dialing %v: %v", m.remoteAddr, err))
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxRedialBackoff)
+	}
+}
+
+// Publishes what a dial came to, taking the connection into use when it's still wanted
+func (m *ConnManager) dialDone(d *pendingDial, qConn quic.Connection, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dialing == d {
+		m.dialing = nil
+	}
+	switch {
+	case qConn == nil && m.closed:
+		err = ErrManagerClosed
+	case qConn == nil:
+	case m.closed:
+		qConn.CloseWithError(0, "client shutting down")
+		qConn, err = nil, ErrManagerClosed
+	case m.dialing != nil || m.conn != nil && m.conn.Context().Err() == nil && !m.goingAway:
+		// everyone gave up on this dial before it got through, and there's another connection (or dial) by now
+		qConn.CloseWithError(0, "not needed")
+		qConn, err = nil, errors.New("QUIC Client: dial abandoned")
+	default:
+		logger.Info("connected", "server", m.remoteAddr.String())
+		if m.conn != nil {
+			metrics.Reconnects.Inc()
+		}
+		m.conn = qConn
+		m.goingAway = false
+		go m.watch(qConn)
+		go m.acceptStreams(qConn)
+		if qConn.ConnectionState().SupportsDatagrams {
+			go m.receiveDatagrams(qConn)
+		}
+	}
+	d.conn, d.err = qConn, err
+}
+
+// Does the auth exchange on the first stream of a fresh connection
+func (m *ConnManager) authenticate(ctx context.Context, qConn quic.Connection) error {
+	token, err := m.Token()
+	if err != nil {
+		return err
+	}
+	str, err := qConn.OpenStreamSync(ctx)
+	if err == nil {
+		defer str.Close()
+		err = wire.Authenticate(str, token)
+	}
+	// the server may hang up before its answer makes it to us, the close code says why
+	var appErr *quic.ApplicationError
+	if err != nil && errors.As(context.Cause(qConn.Context()), &appErr) && appErr.Remote && appErr.ErrorCode == AuthFailedCode {
+		return fmt.Errorf("QUIC Client: server %v refused our token", m.remoteAddr)
+	}
+	if err != nil {
+		return fmt.Errorf("QUIC Client: authenticating to %v: %v", m.remoteAddr, err)
+	}
+	return nil
+}
+
+// Logs why a connection died. The next Connection() call will redial
+func (m *ConnManager) watch(qConn quic.Connection) {
+	<-qConn.Context().Done()
+	cause := context.Cause(qConn.Context())
+
+	var idleErr *quic.IdleTimeoutError
+	if errors.As(cause, &idleErr) {
+		logger.Info("connection idled out, will redial on next request", "server", m.remoteAddr.String())
+		return
+	}
+	var appErr *quic.ApplicationError
+	if errors.As(cause, &appErr) && appErr.Remote && appErr.ErrorCode == session.GoAwayCode {
+		logger.Info("server is going away, will redial on next request", "server", m.remoteAddr.String())
+		return
+	}
+	logger.Warn("connection closed", "server", m.remoteAddr.String(), "reason", cause)
+}
+
+/*
+	Opens a new stream on the shared connection and does the header exchange on it.
+	If the connection turns out to be dead (it idled out, or the server went away without us noticing yet)
+	it's redialed and we try once more. Nothing from the local conn has been sent yet, so retrying is safe.
+*/
+func (m *ConnManager) OpenTunnel(ctx context.Context, hdr wire.Header) (net.Conn, error) {
+	str, _, err := m.openStream(ctx, hdr)
+	if err != nil {
+		return nil, err
+	}
+	return str, nil
+}
+
+func (m *ConnManager) openStream(ctx context.Context, hdr wire.Header) (*StreamConn, quic.Connection, error) {
+	var lastErr error
+	for attempt := 0; attempt < 2; attempt++ {
+		qConn, err := m.Connection(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		str, err := qConn.OpenStreamSync(ctx)
+		if err == nil {
+			err = wire.Handshake(str, hdr)
+			if err == nil {
+				return &StreamConn{Stream: str, conn: qConn}, qConn, nil
+			}
+			str.CancelRead(0)
+			str.CancelWrite(0)
+		}
+		lastErr = err
+		// the server's shutting down, it wants new streams on a new connection (here after a restart, or elsewhere)
+		var streamErr *quic.StreamError
+		if errors.As(err, &streamErr) && streamErr.Remote && streamErr.ErrorCode == session.GoAwayCode {
+			m.leave(qConn)
+			continue
+		}
+		// the server refusing us, or a live connection refusing a stream, isn't something a redial fixes
+		if qConn.Context().Err() == nil {
+			break
+		}
+	}
+	return nil, nil, lastErr
+}
+
+// Stops handing out qConn, the next Connection() dials a new one. It's left open for the streams already on it
+func (m *ConnManager) leave(qConn quic.Connection) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn == qConn && !m.goingAway {
+		m.goingAway = true
+		logger.Info("server is going away, new streams go on a new connection", "server", m.remoteAddr.String())
+	}
+}
+
+/*
+	Starts a UDP association. The header goes out on a control stream (with FlagUDP and a fresh flow ID),
+	after that the payloads travel as datagrams on the same connection, or framed on the stream when too big for one.
+	If the connection dies, so does the association. Callers open a new one.
+*/
+func (m *ConnManager) OpenFlow(ctx context.Context, hdr wire.Header) (transport.Flow, error) {
+	hdr.Flags |= wire.FlagUDP
+	return m.openFlow(ctx, hdr, nil)
+}
+
+/*
+	Opens the link for TUN mode, and returns the addresses (and routes, DNS) the server leased us.
+	Works like a UDP association carrying whole IP packets. See wire/packet.go
+*/
+func (m *ConnManager) OpenTUN(ctx context.Context) (transport.Flow, wire.Lease, error) {
+	var lease wire.Lease
+	flow, err := m.openFlow(ctx, wire.Header{Flags: wire.FlagTUN}, &lease)
+	return flow, lease, err
+}
+
+// lease is read off the stream after the server's response, when it isn't nil
+func (m *ConnManager) openFlow(ctx context.Context, hdr wire.Header, lease *wire.Lease) (transport.Flow, error) {
+	m.flowsMu.Lock()
+	m.lastFlowID++
+	id := m.lastFlowID
+	m.flowsMu.Unlock()
+
+	hdr.FlowID = id
+	str, qConn, err := m.openStream(ctx, hdr)
+	if err != nil {
+		return nil, err
+	}
+	if lease != nil {
+		if *lease, err = wire.ReadLease(str); err != nil {
+			str.Close()
+			return nil, fmt.Errorf("QUIC Client: %v", err)
+		}
+	}
+	flow := newClientFlow(id, qConn, str.Stream, func() {
+		m.flowsMu.Lock()
+		delete(m.flows, id)
+		m.flowsMu.Unlock()
+	})
+	m.flowsMu.Lock()
+	m.flows[id] = flow
+	m.flowsMu.Unlock()
+
+	// the association can't outlive the connection it was made on
+	go func() {
+		select {
+		case <-qConn.Context().Done():
+			flow.Close()
+		case <-flow.Done():
+		}
+	}()
+	return flow, nil
+}
+
+// Hands incoming datagrams to their flow, until the connection dies
+func (m *ConnManager) receiveDatagrams(qConn quic.Connection) {
+	for {
+		msg, err := qConn.ReceiveDatagram(qConn.Context())
+		if err != nil {
+			return
+		}
+		id, payload, err := wire.ParseDatagram(msg)
+		if err != nil {
+			metrics.ClientDatagramDrops.WithLabelValues("malformed").Inc()
+			continue
+		}
+		m.flowsMu.Lock()
+		flow := m.flows[id]
+		m.flowsMu.Unlock()
+		if flow != nil {
+			flow.deliver(payload)
+		} else {
+			metrics.ClientDatagramDrops.WithLabelValues("unknown_flow").Inc()
+		}
+	}
+}
+
+// Closes the connection and the UDP socket underneath it
+func (m *ConnManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	if m.dialing != nil {
+		m.dialing.cancel()
+	}
+	if m.conn != nil {
+		m.conn.CloseWithError(0, "client shutting down")
+	}
+	m.tr.Close()
+	return m.udpConn.Close()
+}
@@ -0,0 +1,110 @@
+package quic
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+
+	"custom_vpn/config"
+	"custom_vpn/internal/wire"
+	"custom_vpn/tunnel"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Dials wherever a reverse forward's connections go. from is the address that connected to the server
+type ReverseDialer func(ctx context.Context, from netip.AddrPort) (net.Conn, error)
+
+/*
+	Registers a reverse forward: the server listens on port and sends every connection it gets back to us,
+	on a stream it opens. Each one is handed to dial, and piped to whatever that returns.
+	Blocks for as long as the registration lasts, which is until ctx is cancelled or the connection dies.
+	A registration the server refused comes back as a *wire.RejectedError.
+*/
+func (m *ConnManager) ServeReverse(ctx context.Context, port uint16, dial ReverseDialer) error {
+	m.flowsMu.Lock()
+	m.lastFlowID++
+	id := m.lastFlowID
+	// registered before the server knows about us, its first connection can come in straight after the response
+	m.reverse[id] = dial
+	m.flowsMu.Unlock()
+	defer func() {
+		m.flowsMu.Lock()
+		delete(m.reverse, id)
+		m.flowsMu.Unlock()
+	}()
+
+	str, qConn, err := m.openStream(ctx, wire.Header{Flags: wire.FlagReverse, FlowID: id, TargetPort: port})
+	if err != nil {
+		return err
+	}
+	defer str.Close()
+
+	// the server doesn't send anything else on the registration stream, it just ends it
+	ended := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, str)
+		close(ended)
+	}()
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-qConn.Context().Done():
+		return fmt.Errorf("QUIC Client: reverse forward for port %d: %v", port, context.Cause(qConn.Context()))
+	case <-ended:
+		return fmt.Errorf("QUIC Client: server ended the reverse forward for port %d", port)
+	}
+}
+
+// Takes the streams the server opens (reverse forward connections), until the connection dies
+func (m *ConnManager) acceptStreams(qConn quic.Connection) {
+	for {
+		str, err := qConn.AcceptStream(qConn.Context())
+		if err != nil {
+			return
+		}
+		go m.serveReverseConn(qConn, str)
+	}
+}
+
+func (m *ConnManager) serveReverseConn(qConn quic.Connection, str quic.Stream) {
+	stream := &StreamConn{Stream: str, conn: qConn}
+
+	str.SetReadDeadline(time.Now().Add(config.TimeOutDuration))
+	hdr, err := wire.ReadHeader(str)
+	str.SetReadDeadline(time.Time{})
+	if err != nil {
+		logger.Warn("bad stream from the server", "err", err)
+		stream.Close()
+		return
+	}
+
+	m.flowsMu.Lock()
+	dial := m.reverse[hdr.FlowID]
+	m.flowsMu.Unlock()
+	if hdr.Flags&wire.FlagReverse == 0 || dial == nil {
+		// a registration we just dropped, most likely
+		wire.WriteResponse(stream, wire.Response{Status: wire.StatusBadRequest, Reason: "no such reverse forward"})
+		stream.Close()
+		return
+	}
+
+	from, _ := netip.ParseAddr(hdr.TargetHost)
+	ctx, cancel := context.WithTimeout(qConn.Context(), config.TimeOutDuration)
+	local, err := dial(ctx, netip.AddrPortFrom(from, hdr.TargetPort))
+	cancel()
+	if err != nil {
+		wire.WriteResponse(stream, wire.Response{Status: wire.StatusDialFailed, Reason: "client can't reach its local address"})
+		stream.Close()
+		return
+	}
+	if err := wire.WriteResponse(stream, wire.Response{Status: wire.StatusOK}); err != nil {
+		local.Close()
+		stream.Close()
+		return
+	}
+	tunnel.Pipe(local, stream)
+}
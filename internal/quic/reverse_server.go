@@ -0,0 +1,109 @@
+package quic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"custom_vpn/config"
+	"custom_vpn/internal/helpers"
+	"custom_vpn/internal/services"
+	"custom_vpn/internal/session"
+	"custom_vpn/internal/wire"
+
+	"github.com/quic-go/quic-go"
+)
+
+/*
+	Server side of a reverse forward, for the lifetime of its registration stream.
+	We listen on the port the client asked for (if reverse.allow lets it), and every connection accepted there
+	goes to the client on a stream we open, headed with the registration's flow ID and where the connection came from.
+	The client dials its local address and answers with a response, then the stream carries the connection.
+	The listener closes when the registration stream ends, or the QUIC connection does, or the server starts shutting down.
+*/
+func serveReverse(ctx context.Context, conn quic.Connection, live *session.Conn, stream quic.Stream, hdr wire.Header, registry *services.Registry) {
+	if registry.Reverse == nil {
+		logger.WarnContext(ctx, "reverse forward refused", "err", services.Reply(stream, wire.StatusBadRequest, "reverse forwards are off on this server", errors.New("reverse isn't enabled")))
+		return
+	}
+	identity, _ := ctx.Value(helpers.Peer).(string)
+	if err := registry.Reverse.Check(identity, hdr.TargetPort); err != nil {
+		logger.WarnContext(ctx, "reverse forward refused", "err", services.Reply(stream, wire.StatusUnauthorized, fmt.Sprintf("port %d is not allowed", hdr.TargetPort), err))
+		return
+	}
+
+	addr := net.JoinHostPort(registry.Reverse.Bind, strconv.Itoa(int(hdr.TargetPort)))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.WarnContext(ctx, "reverse forward refused", "err", services.Reply(stream, wire.StatusDialFailed, fmt.Sprintf("server can't listen on port %d", hdr.TargetPort), err))
+		return
+	}
+	defer listener.Close()
+
+	if err := wire.WriteResponse(stream, wire.Response{Status: wire.StatusOK}); err != nil {
+		logger.WarnContext(ctx, "reverse forward", "flow", hdr.FlowID, "err", err)
+		return
+	}
+	logger.InfoContext(ctx, "reverse forward open", "flow", hdr.FlowID, "addr", listener.Addr().String())
+
+	go func() {
+		for {
+			public, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go sendReverse(ctx, conn, live, public, hdr.FlowID, registry.Sessions)
+		}
+	}()
+
+	// the registration lasts until the client closes its stream, or goes away. Shutting down, the forwarded connections can finish, no new ones
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-conn.Context().Done():
+		case <-live.Leaving():
+		case <-done:
+		}
+		listener.Close()
+	}()
+	io.Copy(io.Discard, stream)
+	close(done)
+	logger.InfoContext(ctx, "reverse forward closed", "flow", hdr.FlowID, "addr", listener.Addr().String())
+}
+
+// Hands one accepted connection to the client. ctx is the registration's
+func sendReverse(ctx context.Context, conn quic.Connection, live *session.Conn, public net.Conn, id uint32, sessions *session.Recorder) {
+	from, _ := netip.ParseAddrPort(public.RemoteAddr().String())
+
+	openCtx, cancel := context.WithTimeout(conn.Context(), config.TimeOutDuration)
+	defer cancel()
+	stream, err := conn.OpenStreamSync(openCtx)
+	if err != nil {
+		logger.WarnContext(ctx, "reverse forward: opening a stream", "flow", id, "from", from, "err", err)
+		public.Close()
+		return
+	}
+	stream.SetReadDeadline(time.Now().Add(config.TimeOutDuration))
+	err = wire.Handshake(stream, wire.Header{Flags: wire.FlagReverse, FlowID: id, TargetHost: from.Addr().Unmap().String(), TargetPort: from.Port()})
+	stream.SetReadDeadline(time.Time{})
+	if err != nil {
+		var rejected *wire.RejectedError
+		if !errors.As(err, &rejected) {
+			err = fmt.Errorf("client didn't take %v: %v", from, err)
+		}
+		logger.WarnContext(ctx, "reverse forward: connection not taken", "flow", id, "from", from, "err", err)
+		stream.CancelRead(0)
+		stream.Close()
+		public.Close()
+		return
+	}
+	rec := session.Begin(ctx, session.KindReverse, "quic", conn.RemoteAddr())
+	rec.StreamID = int64(stream.StreamID())
+	rec.Target = public.RemoteAddr().String()
+	sessions.Finish(rec, live.Pipe(rec, public, stream))
+}
@@ -2,18 +2,24 @@ package quic
 
 import (
 	"context"
-	"encoding/binary"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"io"
-	"log"
 	"net"
+	"strconv"
 	"sync"
+	"time"
 
 	"custom_vpn/config"
+	"custom_vpn/internal/auth"
 	"custom_vpn/internal/helpers"
+	"custom_vpn/internal/logging"
+	"custom_vpn/internal/metrics"
+	"custom_vpn/internal/services"
+	"custom_vpn/internal/session"
+	"custom_vpn/internal/tun"
+	"custom_vpn/internal/wire"
 	"custom_vpn/tlsconfig"
-	"custom_vpn/tunnel"
 
 	"github.com/quic-go/quic-go"
 )
@@ -27,148 +33,241 @@ import (
 	- handle streams
 */
 
-// start a QUIC listener on specified port
-func QuicServer(cancelCtx context.Context, errCh chan<- error, wg *sync.WaitGroup, port int){
+var logger = logging.For("quic")
+
+// Application error code the server closes a connection with when the client's token is refused (or never sent)
+const AuthFailedCode quic.ApplicationErrorCode = 0x41
+
+/*
+	start a QUIC listener on specified port. authenticator may be nil, then clients don't need a token.
+	tunSwitch may be nil too, then TUN links are refused. UDP associations idle for udpIdle are closed
+*/
+func QuicServer(cancelCtx context.Context, errCh chan<- error, wg *sync.WaitGroup, listenerConf config.Listener, tlsConf *tls.Config, quicConf *quic.Config, registry *services.Registry, authenticator auth.Authenticator, tunSwitch *tun.Switch, udpIdle time.Duration) {
 	defer wg.Done()
 
 	// Local binding. Bind on provided port
 	localAddr := net.UDPAddr{
-		IP: net.ParseIP("0.0.0.0"),
-		Port: port,
+		IP:   net.ParseIP(listenerConf.Bind),
+		Port: listenerConf.Port,
 	}
 
-	// Create a UPD conn on specified address 
+	// Create a UPD conn on specified address
 	udpConn, err := net.ListenUDP("udp", &localAddr)
-	if err != nil{
+	if err != nil {
 		errCh <- fmt.Errorf("QUIC server: %v", err)
 		return
 	}
 	defer udpConn.Close()
 
-	tlsConf, err := tlsconfig.ServerTLSConfig()
-	if err != nil{
-		errCh <- fmt.Errorf("QUIC server: %v", err)
-		return
-	}
-
 	/*
 		Transport is pretty central to QUIC-go.	
 		This is actually what "makes" the UDP Conn into a QUIC Conn.
 		The ConnContext function is whats used to assign a connId to a connection
 		The parent context is passed to the ConnContext func via the Lister.Accept() func
+		Everything else it puts in the ctx is for the logs
 	*/
+	listenAddr := localAddr.String()
 	tr := &quic.Transport{
-	 	Conn: udpConn,
+		Conn: udpConn,
 		ConnContext: func(ctx context.Context, ci *quic.ClientInfo) (context.Context, error) {
 			connId, _ := helpers.GenUUID()
-			return context.WithValue(ctx, helpers.ConnId, connId), nil
+			ctx = context.WithValue(ctx, helpers.ConnId, connId)
+			ctx = context.WithValue(ctx, helpers.Listener, listenAddr)
+			ctx = context.WithValue(ctx, helpers.Transport, "quic")
+			return context.WithValue(ctx, helpers.Client, ci.RemoteAddr.String()), nil
 		},
 	}
 	defer tr.Close()
 
+	// handshakes that fail never make it out of Accept, this is the only place to count them
+	quicConf = quicConf.Clone()
+	quicConf.Tracer = metrics.QuicHandshakeTracer
+
 	// start a QUIC listener
-	listener, err := tr.Listen(tlsConf, &config.ServerQuicConf)
+	listener, err := tr.Listen(tlsConf, quicConf)
 	if err != nil {
 		errCh <- fmt.Errorf("QUIC server: failed to start listener on %v: %v", localAddr.Port, err)
 		return
-	}else{
-		log.Printf("QUIC Server: listening on port %v", localAddr.Port)
+	} else {
+		logger.Info("listening", "addr", listenAddr, "port", localAddr.Port)
 	}
 	defer listener.Close()
 
 	wg.Add(1)
 	go helpers.CaptureCancel(cancelCtx, wg, errCh, localAddr.Port, listener)
 
+	// draining through the admin API closes the listener too, the connections we have keep going
+	drained := registry.Live.AddListener("quic", listenAddr, func() { listener.Close() })
+	defer drained.Done()
+	// the connections of this listener. They live on the transport, closing it would take them along
+	var conns sync.WaitGroup
+
 	// still not happy with the error handling on following
-	for{
+	for {
 		quicConn, err := listener.Accept(cancelCtx)
-		if err != nil{
+		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
-				break	// just because the listener is closed, doesn't mean that we should return. there could be active streams
+				break // just because the listener is closed, doesn't mean that we should return. there could be active streams
 			}
 			// some errors with the accepted conns are okay and can be continued past
 			// some errors must cause exit. How do i know which ones are which?
 			// should implement a isExitWorthy() function to properly identify the different errors and we ought to continue or exit.
 			continue
 		}
-		
+		metrics.Accepted.WithLabelValues("quic", strconv.Itoa(localAddr.Port)).Inc()
+
 		wg.Add(1)
-		go handleQuicConn(quicConn.Context(), quicConn, wg, errCh)
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			handleQuicConn(quicConn.Context(), quicConn, wg, registry, authenticator, tunSwitch, udpIdle)
+		}()
+	}
+
+	/*
+		The transport stays up until the connections are done: drained through the admin API, they finish when they finish.
+		Shutting down, they're drained too, and the ones still going at the deadline are cut (see session.Table.Shutdown)
+	*/
+	if drained.Draining() {
+		logger.Info("drained, not accepting anymore", "port", localAddr.Port)
+	}
+	conns.Wait()
+	if drained.Draining() && cancelCtx.Err() == nil {
+		logger.Info("drained listener's connections are all closed", "port", localAddr.Port)
 	}
 }
 
 /*
 	a quic conn has multiple streams, we need to separate those streams. and act on em
 */
-func handleQuicConn(ctx context.Context, conn quic.Connection, wg *sync.WaitGroup, errCh chan<- error){
+func handleQuicConn(ctx context.Context, conn quic.Connection, wg *sync.WaitGroup, registry *services.Registry, authenticator auth.Authenticator, tunSwitch *tun.Switch, udpIdle time.Duration) {
 	defer wg.Done()
+	metrics.QuicConnections.Inc()
+	defer metrics.QuicConnections.Dec()
 
-	log.Printf("Recieved a quic conn from %v\n", conn.RemoteAddr())
+	// the handshake is done by the time Accept() hands us the conn, so the client cert (if any) is verified
+	identity := tlsconfig.PeerIdentity(conn.ConnectionState().TLS)
+	serverName := conn.ConnectionState().TLS.ServerName
+	logger.InfoContext(context.WithValue(ctx, helpers.Peer, identity), "connection accepted", "server_name", serverName)
+
+	// with auth on, the first stream has to be the auth exchange. Nothing else is accepted until it passes
+	if authenticator != nil {
+		tokenIdentity, err := acceptAuth(ctx, conn, authenticator)
+		if err != nil {
+			metrics.HandshakeFailures.WithLabelValues("quic", "auth").Inc()
+			logger.WarnContext(ctx, "authentication failed", "err", err)
+			conn.CloseWithError(AuthFailedCode, "authentication failed")
+			return
+		}
+		// a client cert says more than a token, it wins when there's both
+		if identity == "" {
+			identity = tokenIdentity
+		}
+		logger.InfoContext(ctx, "authenticated", "token_identity", tokenIdentity)
+	}
+	ctx = context.WithValue(ctx, helpers.Peer, identity)
+	live := registry.Live.AddConn(ctx, func(code uint64, reason string) { conn.CloseWithError(quic.ApplicationErrorCode(code), reason) })
+	defer live.Done()
+
+	// UDP associations and TUN links on this connection send their data as datagrams
+	flows := newFlowTable()
+	if conn.ConnectionState().SupportsDatagrams {
+		go receiveDatagrams(conn, flows)
+	}
 
 	for {
 		stream, err := conn.AcceptStream(ctx)
 		if err != nil {
 			var idleErr *quic.IdleTimeoutError
-			if errors.As(err, &idleErr) || errors.Is(err, net.ErrClosed){
-				errCh <- fmt.Errorf("QUIC server: failed to accept stream: %v", err)
+			if errors.As(err, &idleErr) || errors.Is(err, net.ErrClosed) {
+				logger.InfoContext(ctx, "connection closed", "reason", session.Reason(err))
 				return
 			}
 			continue
 		}
+		// the server's shutting down, the client opens it again on a new connection (see ConnManager.openStream)
+		select {
+		case <-live.Leaving():
+			logger.DebugContext(ctx, "stream refused, going away", "stream", stream.StreamID())
+			cancelStream(stream, session.GoAwayCode)
+			continue
+		default:
+		}
 		wg.Add(1)
-		go handleStream(stream.Context(), stream, wg, errCh)
+		streamCtx := context.WithValue(context.WithValue(stream.Context(), helpers.Peer, identity), helpers.ServerName, serverName)
+		go handleStream(streamCtx, conn, live, stream, flows, wg, registry, tunSwitch, udpIdle)
 	}
 }
 
-
 // Reads the stream header and dials the appropriate backend service
-func handleStream(ctx context.Context, stream quic.Stream, wg *sync.WaitGroup, errCh chan<- error){
+func handleStream(ctx context.Context, conn quic.Connection, live *session.Conn, stream quic.Stream, flows *flowTable, wg *sync.WaitGroup, registry *services.Registry, tunSwitch *tun.Switch, udpIdle time.Duration) {
 	defer wg.Done()
 	defer stream.Close()
-	log.Printf("Recieved Stream. stream-id: %v. Conn-Id: %v", stream.StreamID(), ctx.Value(helpers.ConnId))
+	metrics.QuicStreams.Inc()
+	defer metrics.QuicStreams.Dec()
+	ctx = context.WithValue(ctx, helpers.Stream, int64(stream.StreamID()))
+	logger.DebugContext(ctx, "stream accepted")
+
+	streamHeader, err := wire.ReadHeader(stream)
+	if err != nil {
+		logger.WarnContext(ctx, "bad stream header", "err", services.Reply(stream, wire.StatusBadRequest, err.Error(), err))
+		return
+	}
+	ctx = context.WithValue(ctx, helpers.Service, streamHeader.Service)
+	logger.DebugContext(ctx, "stream header", "target_host", streamHeader.TargetHost, "target_port", streamHeader.TargetPort, "flags", fmt.Sprintf("%#x", streamHeader.Flags))
 
-	// buffers for reading from stream
-	var protoBuff [4]byte
-	var ipBuff [16]byte
-	var port uint16
+	// a client with a token, and a server without auth (or a second attempt on a conn which already passed). Nothing to check
+	if streamHeader.Flags&wire.FlagAuth != 0 {
+		if err := wire.WriteResponse(stream, wire.Response{Status: wire.StatusOK}); err != nil {
+			logger.WarnContext(ctx, "answering a repeated auth", "err", err)
+		}
+		return
+	}
 
-	// Deserialize by reading into buffers first
-	io.ReadFull(stream, protoBuff[:])
-	io.ReadFull(stream, ipBuff[:])
-	binary.Read(stream, binary.BigEndian, &port)
-	// read from stream into var-port. since port is a uint16, two bytes will be read
+	if streamHeader.Flags&wire.FlagTUN != 0 {
+		serveTUN(ctx, conn, live, stream, flows, streamHeader, tunSwitch, registry.Sessions)
+		return
+	}
 
-	streamHeader := helpers.StreamHeader{
-		Proto: protoBuff,
-		IP: net.IP(ipBuff[:]),
-		Port: port,
+	if streamHeader.Flags&wire.FlagReverse != 0 {
+		serveReverse(ctx, conn, live, stream, streamHeader, registry)
+		return
 	}
 
-	log.Printf("from stream header. Proto (%v), IP (%v), Port (%v)",
-		string(streamHeader.Proto[:]),
-		streamHeader.IP.String(),
-		streamHeader.Port)
+	if streamHeader.Flags&wire.FlagUDP != 0 {
+		target, err := registry.Target(ctx, streamHeader)
+		if err != nil {
+			logger.WarnContext(ctx, "UDP association refused", "err", services.Reply(stream, services.StatusFor(err), err.Error(), err))
+			return
+		}
+		serveUDPAssociation(ctx, conn, live, stream, flows, streamHeader, target, registry, udpIdle)
+		return
+	}
 
-	switch string(streamHeader.Proto[:]) {
-	case "HTTP":
-		backService := dialService(config.HTTPEndpointService, errCh)
-		tunnel.QuicTcpTunnel(backService, stream)
-	case "SSH":
-		backService := dialService(config.SSHEndpointService, errCh)
-		tunnel.QuicTcpTunnel(backService, stream)
-	default:
-		errCh <- fmt.Errorf("failed to identify stream protocol")
+	// unknown services, policy denials and dial failures are reported back to the client, not just logged and dropped
+	backService, err := registry.Connect(ctx, stream, streamHeader)
+	if err != nil {
+		logger.WarnContext(ctx, "tunnel refused", "err", err)
+		return
 	}
+	logger.InfoContext(ctx, "tunnel open", "target", backService.RemoteAddr().String())
 
+	rec := session.Begin(ctx, session.KindTCP, "quic", conn.RemoteAddr())
+	rec.StreamID = int64(stream.StreamID())
+	rec.Service = streamHeader.Service
+	rec.Target = backService.RemoteAddr().String()
+	registry.Sessions.Finish(rec, live.Pipe(rec, backService, stream))
 }
 
-// This functions dials some endpoint service and returns a net.conn
-func dialService(endpointService net.TCPAddr, errCh chan<- error) net.Conn {
-
-	targetConn, err := net.Dial("tcp", endpointService.String())
-	if err != nil{
-		errCh <- fmt.Errorf("error while connecting to ssh on server: %v", err)
-		return nil
+// Waits for the client's auth stream and checks the token on it
+func acceptAuth(ctx context.Context, conn quic.Connection, authenticator auth.Authenticator) (string, error) {
+	authCtx, cancel := context.WithTimeout(ctx, config.TimeOutDuration)
+	defer cancel()
+	stream, err := conn.AcceptStream(authCtx)
+	if err != nil {
+		return "", fmt.Errorf("auth: client never authenticated: %v", err)
 	}
-	return targetConn
-}
\ No newline at end of file
+	defer stream.Close()
+	stream.SetReadDeadline(time.Now().Add(config.TimeOutDuration))
+	return auth.Accept(authCtx, stream, authenticator)
+}
@@ -0,0 +1,126 @@
+package quic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"custom_vpn/internal/helpers"
+	"custom_vpn/internal/services"
+	"custom_vpn/internal/session"
+	"custom_vpn/internal/tun"
+	"custom_vpn/internal/wire"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Stream error code a TUN link is reset with when another link with the same identity takes its addresses
+const TUNReplacedCode quic.StreamErrorCode = 0x42
+
+/*
+	Server side of a TUN link, for the lifetime of its control stream.
+	The switch leases the client its addresses (by identity, see tun.Pool), which go back right after the OK response,
+	along with the routes and DNS servers to use. Packets for those addresses come back down this link.
+	Packets from the client arrive as datagrams under the flow ID, or framed on the stream when they were too big.
+*/
+func serveTUN(ctx context.Context, conn quic.Connection, live *session.Conn, stream quic.Stream, flows *flowTable, hdr wire.Header, sw *tun.Switch, sessions *session.Recorder) {
+	if sw == nil {
+		logger.WarnContext(ctx, "TUN link refused", "err", services.Reply(stream, wire.StatusBadRequest, "TUN mode is off on this server", errors.New("tun isn't enabled")))
+		return
+	}
+
+	rec := session.Begin(ctx, session.KindTUN, "quic", conn.RemoteAddr())
+	rec.StreamID = int64(stream.StreamID())
+	var fromClient, toClient atomic.Int64
+
+	packets := &packetSender{conn: conn, stream: stream, id: hdr.FlowID}
+	send := func(pkt []byte) {
+		toClient.Add(int64(len(pkt)))
+		if err := packets.send(pkt); err != nil && conn.Context().Err() == nil {
+			logger.WarnContext(ctx, "TUN link: sending a packet", "err", err)
+		}
+	}
+	kick := func() {
+		logger.InfoContext(ctx, "TUN link replaced by a newer one from the same client")
+		cancelStream(stream, TUNReplacedCode)
+	}
+
+	identity, _ := ctx.Value(helpers.Peer).(string)
+	if len(sw.Identities) > 0 && !slices.Contains(sw.Identities, identity) {
+		err := fmt.Errorf("identity %q isn't in tun.identities", identity)
+		logger.WarnContext(ctx, "TUN link refused", "err", services.Reply(stream, wire.StatusUnauthorized, "not allowed to use TUN mode", err))
+		return
+	}
+
+	// nothing can go out framed on the stream before the response and lease have
+	packets.mu.Lock()
+	port, err := sw.Connect(identity, fmt.Sprint(ctx.Value(helpers.ConnId)), send, kick)
+	if err != nil {
+		packets.mu.Unlock()
+		logger.WarnContext(ctx, "TUN link refused", "err", services.Reply(stream, wire.StatusBadRequest, err.Error(), err))
+		return
+	}
+	defer port.Detach()
+
+	// spoofed, isolated and denied packets are dropped quietly, the port logs the first spoofed and denied ones
+	inject := func(pkt []byte) {
+		fromClient.Add(int64(len(pkt)))
+		if err := port.Inject(pkt); err != nil && !errors.Is(err, tun.ErrSpoofed) && !errors.Is(err, tun.ErrIsolated) && !errors.Is(err, tun.ErrDenied) {
+			logger.WarnContext(ctx, "TUN link: injecting a packet", "err", err)
+		}
+	}
+	if !flows.add(hdr.FlowID, inject) {
+		packets.mu.Unlock()
+		logger.WarnContext(ctx, "TUN link refused", "err", services.Reply(stream, wire.StatusBadRequest, "flow id already in use", fmt.Errorf("duplicate flow id %d", hdr.FlowID)))
+		return
+	}
+	defer flows.remove(hdr.FlowID)
+
+	err = wire.WriteResponse(stream, wire.Response{Status: wire.StatusOK})
+	if err == nil {
+		err = wire.WriteLease(stream, port.Lease)
+	}
+	packets.mu.Unlock()
+	if err != nil {
+		logger.WarnContext(ctx, "TUN link", "err", err)
+		return
+	}
+	logger.InfoContext(ctx, "TUN link up", "addrs", port.Lease.Addresses)
+	rec.Target = fmt.Sprint(port.Lease.Addresses)
+	tracked := live.AddTunnel(rec, func() (int64, int64) { return fromClient.Load(), toClient.Load() }, func(error) { cancelStream(stream, session.KillCode) })
+	defer tracked.Done()
+
+	// the oversized packets, until the client closes the stream
+	for {
+		pkt, err := wire.ReadPacket(stream)
+		if err != nil {
+			// EOF is the client closing the link, a local stream error is us kicking it (or an admin killing it)
+			var streamErr *quic.StreamError
+			kicked := errors.As(err, &streamErr) && !streamErr.Remote && streamErr.ErrorCode == TUNReplacedCode
+			killed := errors.As(err, &streamErr) && !streamErr.Remote && streamErr.ErrorCode == session.KillCode
+			if !errors.Is(err, io.EOF) && !kicked && !killed && conn.Context().Err() == nil {
+				logger.WarnContext(ctx, "TUN link", "addrs", port.Lease.Addresses, "err", err)
+			}
+			rec.CloseReason = session.Reason(err)
+			if kicked {
+				rec.CloseReason = "replaced by a newer link"
+			}
+			break
+		}
+		inject(pkt)
+	}
+	logger.InfoContext(ctx, "TUN link down", "addrs", port.Lease.Addresses)
+	rec.End = time.Now()
+	rec.FromClient, rec.ToClient = fromClient.Load(), toClient.Load()
+	sessions.Record(rec)
+}
+
+// Resets both directions of a stream, the client sees code on it
+func cancelStream(stream quic.Stream, code quic.StreamErrorCode) {
+	stream.CancelRead(code)
+	stream.CancelWrite(code)
+}
@@ -0,0 +1,320 @@
+package quic
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"custom_vpn/config"
+	"custom_vpn/internal/metrics"
+	"custom_vpn/internal/services"
+	"custom_vpn/internal/session"
+	"custom_vpn/internal/wire"
+
+	"github.com/quic-go/quic-go"
+)
+
+/*
+	Server side of UDP associations.
+	Each QUIC connection gets a flow table. The datagram loop looks up the flow ID of every incoming datagram
+	and hands the payload to that flow's handler. Flows are added when a client opens a control stream with FlagUDP,
+	and removed when that stream ends.
+*/
+type flowTable struct {
+	mu    sync.Mutex
+	flows map[uint32]func(payload []byte)
+}
+
+func newFlowTable() *flowTable {
+	return &flowTable{flows: make(map[uint32]func([]byte))}
+}
+
+// false if the client is already using that flow ID
+func (t *flowTable) add(id uint32, handler func([]byte)) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, taken := t.flows[id]; taken || id == 0 {
+		return false
+	}
+	t.flows[id] = handler
+	return true
+}
+
+func (t *flowTable) remove(id uint32) {
+	t.mu.Lock()
+	delete(t.flows, id)
+	t.mu.Unlock()
+}
+
+func (t *flowTable) get(id uint32) func([]byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.flows[id]
+}
+
+// Reads datagrams off the connection until it dies, and routes them by flow ID
+func receiveDatagrams(conn quic.Connection, flows *flowTable) {
+	for {
+		msg, err := conn.ReceiveDatagram(conn.Context())
+		if err != nil {
+			return
+		}
+		id, payload, err := wire.ParseDatagram(msg)
+		if err != nil {
+			metrics.ServerDatagramDrops.WithLabelValues("malformed").Inc()
+			continue
+		}
+		if handler := flows.get(id); handler != nil {
+			handler(payload)
+		} else {
+			metrics.ServerDatagramDrops.WithLabelValues("unknown_flow").Inc()
+		}
+	}
+}
+
+// Biggest UDP payload we'll read off a backend socket
+const maxUDPPayload = 64 * 1024
+
+// Destinations of dynamic associations
+const (
+	// how many an association remembers the policy decision for, before starting over
+	maxCheckedDestinations = 1024
+	// how long a refused one stays refused before it's looked at again
+	deniedTTL = 10 * time.Second
+	// how many new ones an association looks up per second. Payloads for the rest are dropped
+	newDestinationsPerSecond = 32
+	// payloads waiting on a lookup, past that they're dropped
+	pendingPayloads = 64
+)
+
+// The policy decision for a destination. addr is nil when it was refused, until then
+type checkedDest struct {
+	addr  *net.UDPAddr
+	until time.Time
+}
+
+// A payload waiting for its destination to be looked up
+type pendingPayload struct {
+	dst  string
+	data []byte
+}
+
+/*
+	Runs one UDP association until the client closes its control stream, or nothing goes through it for idle.
+	A fresh UDP socket is used per association, so replies from the backend can be matched back to the flow.
+	With a fixed target (target.Addr set) payloads are raw UDP payloads.
+	Without one, each payload carries its destination (and replies carry their source), see wire/datagram.go
+	Payloads go as datagrams, and framed on the control stream when they're too big for one. See wire/packet.go
+*/
+func serveUDPAssociation(ctx context.Context, conn quic.Connection, live *session.Conn, stream quic.Stream, flows *flowTable, hdr wire.Header, target config.Service, registry *services.Registry, idle time.Duration) {
+	var fixed *net.UDPAddr
+	if target.Addr != "" {
+		addrs, err := registry.Authorize(ctx, hdr, target)
+		if err != nil {
+			logger.WarnContext(ctx, "UDP association refused", "err", services.Refuse(stream, hdr, err))
+			return
+		}
+		fixed = net.UDPAddrFromAddrPort(addrs[0])
+	}
+
+	sock, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		logger.ErrorContext(ctx, "opening a UDP socket", "err", services.Reply(stream, wire.StatusDialFailed, "server couldn't open a UDP socket", err))
+		return
+	}
+	defer sock.Close()
+
+	// nanoseconds since the association opened, at the last payload either way
+	start := time.Now()
+	var lastActive atomic.Int64
+	touch := func() { lastActive.Store(int64(time.Since(start))) }
+
+	rec := session.Begin(ctx, session.KindUDP, "quic", conn.RemoteAddr())
+	rec.StreamID = int64(stream.StreamID())
+	rec.Service = hdr.Service
+	if fixed != nil {
+		rec.Target = fixed.String()
+	}
+	// UDP payloads both ways, without the addresses dynamic associations put in front of them
+	var fromClient, toClient atomic.Int64
+	var idledOut atomic.Bool
+
+	/*
+		Every destination of a dynamic association goes through the policy, the first time it's seen.
+		That can mean a DNS lookup, which mustn't hold up the datagram loop (every other flow on the connection),
+		so new destinations queue up for the association's own resolver go-routine. See resolve below
+	*/
+	var checkedMu sync.Mutex
+	checked := make(map[string]checkedDest)
+	pending := make(chan pendingPayload, pendingPayloads)
+	handler := func(payload []byte) {
+		touch()
+		if fixed != nil {
+			fromClient.Add(int64(len(payload)))
+			sock.WriteToUDP(payload, fixed)
+			return
+		}
+		host, port, data, err := wire.ParseAddr(payload)
+		if err != nil {
+			return
+		}
+		dstStr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+		// datagrams and stream packets come in on different go-routines
+		checkedMu.Lock()
+		dst, seen := checked[dstStr]
+		checkedMu.Unlock()
+		switch {
+		case seen && dst.addr != nil:
+			fromClient.Add(int64(len(data)))
+			sock.WriteToUDP(data, dst.addr)
+		case seen && time.Now().Before(dst.until):
+			metrics.ServerDatagramDrops.WithLabelValues("denied").Inc()
+		default:
+			select {
+			case pending <- pendingPayload{dst: dstStr, data: slices.Clone(data)}:
+			default:
+				metrics.ServerDatagramDrops.WithLabelValues("queue_full").Inc()
+			}
+		}
+	}
+	resolveCtx, stopResolving := context.WithCancel(ctx)
+	defer stopResolving()
+	// runs pending payloads' destinations through the policy, a few new ones a second at most
+	resolve := func() {
+		var window time.Time
+		var lookups int
+		for {
+			var p pendingPayload
+			select {
+			case <-resolveCtx.Done():
+				return
+			case p = <-pending:
+			}
+			checkedMu.Lock()
+			dst, seen := checked[p.dst]
+			checkedMu.Unlock()
+			// an earlier payload may have had it looked up already
+			if !seen || (dst.addr == nil && time.Now().After(dst.until)) {
+				if now := time.Now(); now.Sub(window) >= time.Second {
+					window, lookups = now, 0
+				}
+				if lookups >= newDestinationsPerSecond {
+					metrics.ServerDatagramDrops.WithLabelValues("rate_limited").Inc()
+					continue
+				}
+				lookups++
+				dst = checkedDest{}
+				addrs, err := registry.Authorize(resolveCtx, hdr, config.Service{Addr: p.dst, Network: "udp"})
+				if err != nil {
+					if resolveCtx.Err() != nil {
+						return
+					}
+					// remembered for a while, so it's only logged (and looked up) every deniedTTL
+					logger.WarnContext(ctx, "UDP association: dropping datagrams", "flow", hdr.FlowID, "for", deniedTTL, "err", err)
+					dst.until = time.Now().Add(deniedTTL)
+				} else {
+					dst.addr = net.UDPAddrFromAddrPort(addrs[0])
+				}
+				checkedMu.Lock()
+				if len(checked) >= maxCheckedDestinations {
+					clear(checked)
+				}
+				checked[p.dst] = dst
+				checkedMu.Unlock()
+			}
+			if dst.addr == nil {
+				metrics.ServerDatagramDrops.WithLabelValues("denied").Inc()
+				continue
+			}
+			fromClient.Add(int64(len(p.data)))
+			sock.WriteToUDP(p.data, dst.addr)
+		}
+	}
+	if !flows.add(hdr.FlowID, handler) {
+		logger.WarnContext(ctx, "UDP association refused", "err", services.Reply(stream, wire.StatusBadRequest, "flow id already in use", fmt.Errorf("duplicate flow id %d", hdr.FlowID)))
+		return
+	}
+	defer flows.remove(hdr.FlowID)
+
+	if err := wire.WriteResponse(stream, wire.Response{Status: wire.StatusOK}); err != nil {
+		logger.WarnContext(ctx, "UDP association", "flow", hdr.FlowID, "err", err)
+		return
+	}
+	logger.InfoContext(ctx, "UDP association open", "flow", hdr.FlowID, "target", target.Addr)
+	if fixed == nil {
+		go resolve()
+	}
+	// only an admin kills one association, a shutdown closes the whole connection
+	tracked := live.AddTunnel(rec, func() (int64, int64) { return fromClient.Load(), toClient.Load() }, func(error) { cancelStream(stream, session.KillCode) })
+	defer tracked.Done()
+
+	// backend -> client
+	packets := &packetSender{conn: conn, stream: stream, id: hdr.FlowID}
+	go func() {
+		buf := make([]byte, maxUDPPayload)
+		for {
+			n, from, err := sock.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if fixed != nil && !from.IP.Equal(fixed.IP) {
+				continue
+			}
+			touch()
+			toClient.Add(int64(n))
+			var payload []byte
+			if fixed == nil {
+				payload, err = wire.AppendAddr(nil, from.IP.String(), uint16(from.Port))
+				if err != nil {
+					continue
+				}
+			}
+			payload = append(payload, buf[:n]...)
+			if err := packets.send(payload); err != nil && conn.Context().Err() != nil {
+				return
+			}
+		}
+	}()
+
+	// the client forgetting about the flow (or going quiet for good) shouldn't keep a socket open here forever
+	go func() {
+		ticker := time.NewTicker(max(idle/4, time.Second))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if time.Since(start)-time.Duration(lastActive.Load()) >= idle {
+				logger.InfoContext(ctx, "UDP association idle, closing it", "flow", hdr.FlowID, "idle", idle)
+				idledOut.Store(true)
+				stream.CancelRead(0)
+				stream.Close()
+				return
+			}
+		}
+	}()
+
+	// client -> backend, payloads too big for a datagram. The association lasts until the control stream ends
+	for {
+		payload, err := wire.ReadPacket(stream)
+		if err != nil {
+			rec.CloseReason = session.Reason(err)
+			break
+		}
+		handler(payload)
+	}
+	logger.InfoContext(ctx, "UDP association closed", "flow", hdr.FlowID)
+	if idledOut.Load() {
+		rec.CloseReason = "idle timeout"
+	}
+	rec.End = time.Now()
+	rec.FromClient, rec.ToClient = fromClient.Load(), toClient.Load()
+	registry.Sessions.Record(rec)
+}
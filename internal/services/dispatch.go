@@ -0,0 +1,199 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"custom_vpn/config"
+	"custom_vpn/internal/helpers"
+	"custom_vpn/internal/metrics"
+	"custom_vpn/internal/policy"
+	"custom_vpn/internal/wire"
+)
+
+var (
+	ErrDynamicTargets = errors.New("this server doesn't dial client-chosen destinations")
+	ErrNoTarget       = errors.New("header names neither a service nor a destination")
+	ErrUDPTransport   = errors.New("UDP associations need the QUIC transport")
+)
+
+/*
+	Works out where a header is asking to go.
+	Either a named service from the registry, or (when the server allows it) a host:port chosen by the client.
+	For UDP associations with no target at all, Addr comes back empty: every datagram carries its own destination.
+	Named services are looked up under the server name in ctx (helpers.ServerName), see Lookup().
+*/
+func (r *Registry) Target(ctx context.Context, hdr wire.Header) (config.Service, error) {
+	udp := hdr.Flags&wire.FlagUDP != 0
+
+	if hdr.Service != "" {
+		serverName, _ := ctx.Value(helpers.ServerName).(string)
+		svc, err := r.Lookup(serverName, hdr.Service)
+		if err != nil {
+			return svc, err
+		}
+		if udp != (svc.Network == "udp") {
+			return svc, fmt.Errorf("service %q is %v, not what the client asked for", hdr.Service, svc.Network)
+		}
+		return svc, nil
+	}
+
+	if !r.AllowDynamic {
+		return config.Service{}, ErrDynamicTargets
+	}
+	network := "tcp"
+	if udp {
+		network = "udp"
+		if hdr.TargetHost == "" {
+			return config.Service{Network: network}, nil
+		}
+	}
+	if hdr.TargetHost == "" || hdr.TargetPort == 0 {
+		return config.Service{}, ErrNoTarget
+	}
+	addr := net.JoinHostPort(hdr.TargetHost, strconv.Itoa(int(hdr.TargetPort)))
+	return config.Service{Addr: addr, Network: network}, nil
+}
+
+// Which response status an error from Target() should be reported with
+func StatusFor(err error) wire.Status {
+	var unknown *UnknownServiceError
+	var denied *policy.DeniedError
+	switch {
+	case errors.As(err, &unknown):
+		return wire.StatusUnknownService
+	case errors.Is(err, ErrDynamicTargets), errors.As(err, &denied):
+		return wire.StatusUnauthorized
+	}
+	return wire.StatusBadRequest
+}
+
+/*
+	Server side of the stream header exchange for the TLS and raw TCP listeners:
+	read the header, then Connect(). The auth exchange, when the listener wants one, has already happened.
+	UDP associations are refused here, they need QUIC datagrams.
+*/
+func (r *Registry) Dispatch(ctx context.Context, rw io.ReadWriter) (net.Conn, wire.Header, error) {
+	hdr, err := wire.ReadHeader(rw)
+	// a client with a token, and a listener without auth. Nothing to check, the real header comes next
+	if err == nil && hdr.Flags&wire.FlagAuth != 0 {
+		if err := wire.WriteResponse(rw, wire.Response{Status: wire.StatusOK}); err != nil {
+			return nil, hdr, err
+		}
+		hdr, err = wire.ReadHeader(rw)
+	}
+	if err != nil {
+		return nil, hdr, Reply(rw, wire.StatusBadRequest, err.Error(), err)
+	}
+	if hdr.Flags&wire.FlagUDP != 0 {
+		return nil, hdr, Reply(rw, wire.StatusBadRequest, ErrUDPTransport.Error(), ErrUDPTransport)
+	}
+	conn, err := r.Connect(ctx, rw, hdr)
+	return conn, hdr, err
+}
+
+/*
+	Finds the target, checks it against the policy, dials it, and tells the client how it went.
+	On success the caller gets the backend conn and pipes it to the client.
+	On failure the client has already been sent the reason, the caller only needs to close its end.
+*/
+func (r *Registry) Connect(ctx context.Context, w io.Writer, hdr wire.Header) (net.Conn, error) {
+	service := metrics.ServiceLabel(hdr.Service)
+	target, err := r.Target(ctx, hdr)
+	if err != nil {
+		metrics.DialFailures.WithLabelValues(service, failureReason(err, "bad_request")).Inc()
+		return nil, Reply(w, StatusFor(err), err.Error(), err)
+	}
+
+	addrs, err := r.Authorize(ctx, hdr, target)
+	if err != nil {
+		metrics.DialFailures.WithLabelValues(service, failureReason(err, "resolve")).Inc()
+		return nil, Refuse(w, hdr, err)
+	}
+
+	// dial the addresses the policy checked, not the name, so a second lookup can't land somewhere else
+	var dialer net.Dialer
+	var backService net.Conn
+	start := time.Now()
+	for _, addr := range addrs {
+		backService, err = dialer.DialContext(ctx, target.Network, addr.String())
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		metrics.DialFailures.WithLabelValues(service, "dial").Inc()
+		err = fmt.Errorf("error while connecting to %v on server: %v", target.Addr, err)
+		return nil, Reply(w, wire.StatusDialFailed, fmt.Sprintf("can't reach %s", describe(hdr)), err)
+	}
+
+	metrics.DialSeconds.WithLabelValues(service).Observe(time.Since(start).Seconds())
+
+	if err := wire.WriteResponse(w, wire.Response{Status: wire.StatusOK}); err != nil {
+		backService.Close()
+		return nil, err
+	}
+	return backService, nil
+}
+
+// The backend_dial_failures_total reason for an error from Target() or Authorize(), other when it's none of the known ones
+func failureReason(err error, other string) string {
+	var unknown *UnknownServiceError
+	var denied *policy.DeniedError
+	switch {
+	case errors.As(err, &unknown):
+		return "unknown_service"
+	case errors.Is(err, ErrDynamicTargets), errors.As(err, &denied):
+		return "denied"
+	}
+	return other
+}
+
+/*
+	Resolves target and runs it through the policy. Returns the addresses which may be dialed.
+	The client's identity is taken from ctx (helpers.Peer), set by the listener once the handshake is done.
+*/
+func (r *Registry) Authorize(ctx context.Context, hdr wire.Header, target config.Service) ([]netip.AddrPort, error) {
+	host, portStr, err := net.SplitHostPort(target.Addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad port %q", portStr)
+	}
+	identity, _ := ctx.Value(helpers.Peer).(string)
+	return r.Policy.Check(ctx, policy.Request{Identity: identity, Service: hdr.Service, Host: host, Port: uint16(port)})
+}
+
+// Tells the client why Authorize() failed. Policy denials don't say which rule, the server log does
+func Refuse(w io.Writer, hdr wire.Header, err error) error {
+	var denied *policy.DeniedError
+	if errors.As(err, &denied) {
+		return Reply(w, wire.StatusUnauthorized, fmt.Sprintf("%s is not allowed", describe(hdr)), err)
+	}
+	err = fmt.Errorf("error while resolving %s on server: %v", describe(hdr), err)
+	return Reply(w, wire.StatusDialFailed, fmt.Sprintf("can't reach %s", describe(hdr)), err)
+}
+
+// What the client asked for, in words. Doesn't leak backend addresses for named services
+func describe(hdr wire.Header) string {
+	if hdr.Service != "" {
+		return fmt.Sprintf("service %q", hdr.Service)
+	}
+	return net.JoinHostPort(hdr.TargetHost, strconv.Itoa(int(hdr.TargetPort)))
+}
+
+// Sends a failure response (the QUIC server uses it for UDP associations too). Returns cause, or the write error if the client couldn't be told
+func Reply(w io.Writer, status wire.Status, reason string, cause error) error {
+	if err := wire.WriteResponse(w, wire.Response{Status: status, Reason: reason}); err != nil {
+		return fmt.Errorf("%v (and failed to tell the client: %v)", cause, err)
+	}
+	return cause
+}
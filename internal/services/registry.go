@@ -0,0 +1,117 @@
+package services
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"custom_vpn/config"
+	"custom_vpn/internal/policy"
+	"custom_vpn/internal/session"
+)
+
+/*
+	The registry is the server's list of named backend services (grafana, postgres, ssh-pi, ...).
+	The client asks for a service by name in the stream header, and the server looks it up here.
+	No more mapping "HTTP" and "SSH" to hardcoded endpoints.
+*/
+type Registry struct {
+	mu       sync.RWMutex
+	services map[string]config.Service
+	// per server name (SNI) service sets, see config.VirtualHost
+	vhosts map[string]map[string]config.Service
+
+	// when set, clients may also ask for any host:port (SOCKS, HTTP proxy) instead of a named service
+	AllowDynamic bool
+	// checked before anything is dialed. nil allows everything
+	Policy *policy.Engine
+	// who may register reverse forwards. nil means nobody, they're off
+	Reverse *policy.Reverse
+	// gets a record of every tunnel when it's done. nil drops them
+	Sessions *session.Recorder
+	// the connections and tunnels still running, for the admin API. nil tracks nothing
+	Live *session.Table
+}
+
+// Error returned when a client asks for a service the server doesn't know about
+type UnknownServiceError struct {
+	Name string
+}
+
+func (e *UnknownServiceError) Error() string {
+	return fmt.Sprintf("unknown service %q", e.Name)
+}
+
+func NewRegistry(services map[string]config.Service) *Registry {
+	r := &Registry{}
+	r.Replace(services)
+	return r
+}
+
+/*
+	Returns the backend for the named service.
+	serverName is the name the client connected to (TLS SNI), when it's a virtual host only that host's services are looked at.
+*/
+func (r *Registry) Lookup(serverName, name string) (config.Service, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	services := r.services
+	if vhost, ok := r.vhosts[serverName]; ok {
+		services = vhost
+	}
+	svc, ok := services[name]
+	if !ok {
+		return config.Service{}, &UnknownServiceError{Name: name}
+	}
+	return svc, nil
+}
+
+// Swaps out the whole set of services. Streams already piping to a backend aren't affected
+func (r *Registry) Replace(services map[string]config.Service) {
+	copied := make(map[string]config.Service, len(services))
+	for name, svc := range services {
+		copied[name] = svc
+	}
+	r.mu.Lock()
+	r.services = copied
+	r.mu.Unlock()
+}
+
+// Swaps out the virtual hosts, same as Replace() does for the top level services
+func (r *Registry) ReplaceVirtualHosts(vhosts map[string]config.VirtualHost) {
+	copied := make(map[string]map[string]config.Service, len(vhosts))
+	for host, vhost := range vhosts {
+		services := make(map[string]config.Service, len(vhost.Services))
+		for name, svc := range vhost.Services {
+			services[name] = svc
+		}
+		copied[host] = services
+	}
+	r.mu.Lock()
+	r.vhosts = copied
+	r.mu.Unlock()
+}
+
+// Sorted virtual host names
+func (r *Registry) VirtualHosts() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	hosts := make([]string, 0, len(r.vhosts))
+	for host := range r.vhosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Sorted list of service names, handy for logging what the server offers
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.services))
+	for name := range r.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,520 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"custom_vpn/internal/helpers"
+	"custom_vpn/tunnel"
+)
+
+/*
+	What's running right now, for the admin API: the listeners, every client connection that got past auth,
+	and the tunnels on those. A record is written when a tunnel is over, this is the view of the ones that aren't yet.
+	Everything in here can be killed (or drained, for listeners). A nil Table tracks nothing, and kills nothing.
+	It's also what the server drains at shutdown, see Shutdown
+*/
+type Table struct {
+	mu        sync.Mutex
+	conns     map[string]*Conn
+	listeners map[string]*Listener
+
+	// set by Shutdown (under mu): first draining, then cutting once it's given up waiting, or there's nothing left to wait for
+	draining, cutting atomic.Bool
+	// closed when the last connection is done, while draining. Under mu
+	empty chan struct{}
+}
+
+// Error code the admin API closes QUIC connections and resets streams with
+const KillCode = 0x43
+
+// What a killed tunnel's pipe ends with
+var ErrKilled = errors.New("killed by an admin")
+
+// Error codes of a shutdown, for QUIC connections (and streams refused on them)
+const (
+	// nothing's running on the connection (anymore), the client should reconnect, here after a restart or elsewhere
+	GoAwayCode = 0x44
+	// the drain deadline passed with tunnels still running on it
+	CutCode = 0x45
+)
+
+var (
+	ErrGoingAway = errors.New("server shutting down")
+	// what the tunnels still running at the drain deadline end with
+	ErrCut = errors.New("cut at shutdown")
+)
+
+func NewTable() *Table {
+	return &Table{conns: make(map[string]*Conn), listeners: make(map[string]*Listener)}
+}
+
+// A client connection: a QUIC connection and its streams, or a TCP/TLS connection, which is one tunnel
+type Conn struct {
+	table     *Table
+	id        string
+	transport string
+	client    string
+	identity  string
+	start     time.Time
+	// closes the connection with an error code, nil when that's just killing its one tunnel (TCP, TLS)
+	close func(code uint64, reason string)
+	// closed when the server starts shutting down
+	leaving   chan struct{}
+	leaveOnce sync.Once
+
+	mu      sync.Mutex
+	tunnels map[int64]*Tunnel
+	// bytes of its tunnels which are done, so the connection's totals don't drop when one finishes
+	fromClient, toClient int64
+}
+
+// One tunnel (TCP, reverse, UDP, TUN) on a connection
+type Tunnel struct {
+	conn  *Conn
+	rec   Record
+	bytes func() (fromClient, toClient int64)
+	kill  func(cause error)
+}
+
+// A listener the admin API can drain: it stops accepting, the connections it has keep going
+type Listener struct {
+	table    *Table
+	name     string
+	addr     string
+	drain    func()
+	draining atomic.Bool
+}
+
+/*
+	Adds the connection ctx is about, see helpers.CtxKey for what's taken from it.
+	close closes it with an error code, nil when the connection is its one tunnel.
+	One coming in while the server shuts down is told to go away straight off
+*/
+func (t *Table) AddConn(ctx context.Context, close func(code uint64, reason string)) *Conn {
+	if t == nil {
+		return nil
+	}
+	c := &Conn{table: t, start: time.Now(), close: close, leaving: make(chan struct{}), tunnels: make(map[int64]*Tunnel)}
+	c.id, _ = ctx.Value(helpers.ConnId).(string)
+	c.transport, _ = ctx.Value(helpers.Transport).(string)
+	c.client, _ = ctx.Value(helpers.Client).(string)
+	c.identity, _ = ctx.Value(helpers.Peer).(string)
+	t.mu.Lock()
+	t.conns[c.id] = c
+	draining := t.draining.Load()
+	t.mu.Unlock()
+	if draining {
+		c.leave()
+		c.goAwayIfIdle()
+	}
+	return c
+}
+
+// Takes the connection out of the table, it's closed
+func (c *Conn) Done() {
+	if c == nil {
+		return
+	}
+	t := c.table
+	t.mu.Lock()
+	delete(t.conns, c.id)
+	if t.empty != nil && len(t.conns) == 0 {
+		close(t.empty)
+		t.empty = nil
+	}
+	t.mu.Unlock()
+}
+
+// Closed when the server starts shutting down. New tunnels shouldn't be started on the connection after that
+func (c *Conn) Leaving() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	return c.leaving
+}
+
+func (c *Conn) leave() {
+	c.leaveOnce.Do(func() { close(c.leaving) })
+}
+
+/*
+	Whether the connection has anything the drain waits for. c.mu is held.
+	A TUN link isn't waited for: it's the client's whole VPN, and never finishes on its own.
+	The client brings it back up on its next connection
+*/
+func (c *Conn) busy() bool {
+	for _, t := range c.tunnels {
+		if t.rec.Kind != KindTUN {
+			return true
+		}
+	}
+	return false
+}
+
+// Closes a QUIC connection with GoAwayCode if nothing's running on it. A TCP/TLS connection goes with its tunnel anyway
+func (c *Conn) goAwayIfIdle() {
+	if c.close == nil {
+		return
+	}
+	c.mu.Lock()
+	busy := c.busy()
+	c.mu.Unlock()
+	if !busy {
+		c.close(GoAwayCode, ErrGoingAway.Error())
+	}
+}
+
+// Closes the connection, or kills its tunnel, at the drain deadline. Returns how many tunnels that cut
+func (c *Conn) cut() int {
+	c.mu.Lock()
+	tunnels := make([]*Tunnel, 0, len(c.tunnels))
+	for _, t := range c.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	c.mu.Unlock()
+	if c.close != nil {
+		c.close(CutCode, ErrCut.Error())
+		return len(tunnels)
+	}
+	for _, t := range tunnels {
+		t.kill(ErrCut)
+	}
+	return len(tunnels)
+}
+
+/*
+	Adds a tunnel, described by its record as it is when it opens (stream ID, kind, service, target).
+	bytes says how much went each way so far, kill ends it (with cause, where the tunnel has a use for it).
+	After the drain deadline it's too late for new tunnels, they're cut as they're added
+*/
+func (c *Conn) AddTunnel(rec Record, bytes func() (fromClient, toClient int64), kill func(cause error)) *Tunnel {
+	if c == nil {
+		return nil
+	}
+	t := &Tunnel{conn: c, rec: rec, bytes: bytes, kill: kill}
+	c.mu.Lock()
+	c.tunnels[rec.StreamID] = t
+	c.mu.Unlock()
+	if c.table.cutting.Load() {
+		if c.close != nil {
+			c.close(CutCode, ErrCut.Error())
+		} else {
+			kill(ErrCut)
+		}
+	}
+	return t
+}
+
+// Takes the tunnel out of its connection, and adds what it moved to the connection's totals
+func (t *Tunnel) Done() {
+	if t == nil {
+		return
+	}
+	from, to := t.bytes()
+	c := t.conn
+	c.mu.Lock()
+	delete(c.tunnels, t.rec.StreamID)
+	c.fromClient += from
+	c.toClient += to
+	c.mu.Unlock()
+	// shutting down, and that was the last thing keeping the connection around
+	if c.table.draining.Load() {
+		c.goAwayIfIdle()
+	}
+}
+
+/*
+	Pipes a to b as a tunnel of c, so it's listed (with its bytes as they go) and can be killed while it runs.
+	As with Recorder.Finish, a is the far end and b is the client. c may be nil, then it's just a pipe
+*/
+func (c *Conn) Pipe(rec Record, a, b tunnel.Conn) tunnel.Result {
+	if c == nil {
+		return tunnel.Pipe(a, b)
+	}
+	ctx, kill := context.WithCancelCause(context.Background())
+	defer kill(nil)
+	var counters tunnel.Counters
+	t := c.AddTunnel(rec, func() (int64, int64) { return counters.BToA.Load(), counters.AToB.Load() }, kill)
+	defer t.Done()
+	return tunnel.PipeContext(ctx, a, b, &counters)
+}
+
+func (t *Table) AddListener(name, addr string, drain func()) *Listener {
+	if t == nil {
+		return nil
+	}
+	l := &Listener{table: t, name: name, addr: addr, drain: drain}
+	t.mu.Lock()
+	t.listeners[name] = l
+	t.mu.Unlock()
+	return l
+}
+
+// Whether the admin API drained it, rather than the server shutting down
+func (l *Listener) Draining() bool {
+	return l != nil && l.draining.Load()
+}
+
+func (l *Listener) Done() {
+	if l == nil {
+		return
+	}
+	l.table.mu.Lock()
+	delete(l.table.listeners, l.name)
+	l.table.mu.Unlock()
+}
+
+// What the admin API shows of a connection. Ages are in seconds, bytes include the tunnels which are done
+type ConnInfo struct {
+	ConnID     string       `json:"conn_id"`
+	Transport  string       `json:"transport"`
+	Client     string       `json:"client"`
+	Identity   string       `json:"identity,omitempty"`
+	Start      time.Time    `json:"start"`
+	Age        float64      `json:"age_seconds"`
+	FromClient int64        `json:"bytes_from_client"`
+	ToClient   int64        `json:"bytes_to_client"`
+	Tunnels    []TunnelInfo `json:"tunnels"`
+}
+
+type TunnelInfo struct {
+	// -1 for a TCP or TLS connection's tunnel, as in records
+	StreamID   int64     `json:"stream_id"`
+	Kind       Kind      `json:"kind"`
+	Service    string    `json:"service,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	Start      time.Time `json:"start"`
+	Age        float64   `json:"age_seconds"`
+	FromClient int64     `json:"bytes_from_client"`
+	ToClient   int64     `json:"bytes_to_client"`
+}
+
+type ListenerInfo struct {
+	Name     string `json:"name"`
+	Addr     string `json:"addr"`
+	Draining bool   `json:"draining"`
+	// connections which came in on it and are still open
+	Conns int `json:"conns"`
+}
+
+// Every connection, oldest first
+func (t *Table) Conns() []ConnInfo {
+	if t == nil {
+		return []ConnInfo{}
+	}
+	t.mu.Lock()
+	conns := t.all()
+	t.mu.Unlock()
+
+	now := time.Now()
+	out := make([]ConnInfo, 0, len(conns))
+	for _, c := range conns {
+		out = append(out, c.info(now))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Start.Before(out[j].Start) })
+	return out
+}
+
+func (c *Conn) info(now time.Time) ConnInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info := ConnInfo{
+		ConnID: c.id, Transport: c.transport, Client: c.client, Identity: c.identity,
+		Start: c.start, Age: now.Sub(c.start).Seconds(),
+		FromClient: c.fromClient, ToClient: c.toClient,
+		Tunnels: make([]TunnelInfo, 0, len(c.tunnels)),
+	}
+	for _, t := range c.tunnels {
+		from, to := t.bytes()
+		info.FromClient += from
+		info.ToClient += to
+		info.Tunnels = append(info.Tunnels, TunnelInfo{
+			StreamID: t.rec.StreamID, Kind: t.rec.Kind, Service: t.rec.Service, Target: t.rec.Target,
+			Start: t.rec.Start, Age: now.Sub(t.rec.Start).Seconds(),
+			FromClient: from, ToClient: to,
+		})
+	}
+	sort.Slice(info.Tunnels, func(i, j int) bool { return info.Tunnels[i].StreamID < info.Tunnels[j].StreamID })
+	return info
+}
+
+// A connection by its ID, or a prefix of it nothing else shares. UUIDs are a lot to type
+func (t *Table) Conn(id string) (ConnInfo, error) {
+	c, err := t.find(id)
+	if err != nil {
+		return ConnInfo{}, err
+	}
+	return c.info(time.Now()), nil
+}
+
+// Closes a connection, and with it every tunnel on it
+func (t *Table) KillConn(id string) error {
+	c, err := t.find(id)
+	if err != nil {
+		return err
+	}
+	if c.close != nil {
+		c.close(KillCode, ErrKilled.Error())
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tun := range c.tunnels {
+		tun.kill(ErrKilled)
+	}
+	return nil
+}
+
+// Ends one tunnel, the connection (and its other tunnels) stay up
+func (t *Table) KillTunnel(id string, streamID int64) error {
+	c, err := t.find(id)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	tun, ok := c.tunnels[streamID]
+	c.mu.Unlock()
+	if !ok {
+		return &NotFoundError{What: fmt.Sprintf("stream %d on connection %s", streamID, c.id)}
+	}
+	tun.kill(ErrKilled)
+	return nil
+}
+
+// The listeners, by name
+func (t *Table) Listeners() []ListenerInfo {
+	if t == nil {
+		return []ListenerInfo{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]ListenerInfo, 0, len(t.listeners))
+	for _, l := range t.listeners {
+		out = append(out, ListenerInfo{Name: l.name, Addr: l.addr, Draining: l.draining.Load(), Conns: t.connsOn(l.name)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Stops a listener accepting. Returns how many connections it still has, they're left to finish
+func (t *Table) Drain(name string) (int, error) {
+	if t == nil {
+		return 0, &NotFoundError{What: "listener " + name}
+	}
+	t.mu.Lock()
+	l, ok := t.listeners[name]
+	conns := t.connsOn(name)
+	t.mu.Unlock()
+	if !ok {
+		return 0, &NotFoundError{What: "listener " + name}
+	}
+	if l.draining.CompareAndSwap(false, true) {
+		l.drain()
+	}
+	return conns, nil
+}
+
+/*
+	Drains the connections for a shutdown, once the listeners have stopped accepting.
+	Every connection is told it's leaving (QUIC ones stop taking new streams), and QUIC connections go away
+	with GoAwayCode as soon as nothing's running on them, so their clients reconnect somewhere else.
+	What's still running after timeout is cut: CutCode for QUIC connections, ErrCut for TCP/TLS tunnels.
+	Returns how many tunnels that was, and on how many connections. 0 timeout cuts everything there is right away
+*/
+func (t *Table) Shutdown(timeout time.Duration) (tunnels, conns int) {
+	if t == nil {
+		return 0, 0
+	}
+	t.mu.Lock()
+	t.draining.Store(true)
+	empty := make(chan struct{})
+	if len(t.conns) == 0 {
+		close(empty)
+	} else {
+		t.empty = empty
+	}
+	all := t.all()
+	t.mu.Unlock()
+	for _, c := range all {
+		c.leave()
+		c.goAwayIfIdle()
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-empty:
+		// anything turning up now is too late to wait for
+		t.cutting.Store(true)
+		return 0, 0
+	case <-timer.C:
+	}
+	t.mu.Lock()
+	t.cutting.Store(true)
+	all = t.all()
+	t.mu.Unlock()
+	for _, c := range all {
+		tunnels += c.cut()
+	}
+	return tunnels, len(all)
+}
+
+// t.mu is held
+func (t *Table) all() []*Conn {
+	conns := make([]*Conn, 0, len(t.conns))
+	for _, c := range t.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// There's one listener per transport, so that's what a connection's listener is known by. t.mu is held
+func (t *Table) connsOn(name string) int {
+	n := 0
+	for _, c := range t.conns {
+		if c.transport == name {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *Table) find(id string) (*Conn, error) {
+	if t == nil || id == "" {
+		return nil, &NotFoundError{What: "connection " + id}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c, ok := t.conns[id]; ok {
+		return c, nil
+	}
+	var found *Conn
+	for connID, c := range t.conns {
+		if strings.HasPrefix(connID, id) {
+			if found != nil {
+				return nil, fmt.Errorf("more than one connection starts with %q", id)
+			}
+			found = c
+		}
+	}
+	if found == nil {
+		return nil, &NotFoundError{What: "connection " + id}
+	}
+	return found, nil
+}
+
+// Nothing in the table by that name (or ID)
+type NotFoundError struct {
+	What string
+}
+
+func (e *NotFoundError) Error() string {
+	return "no " + e.What
+}
@@ -0,0 +1,234 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"custom_vpn/internal/helpers"
+)
+
+/*
+	A client connection without the network: closing it records the code, then ends its tunnels
+	and takes it out of the table, the way a closed QUIC connection does.
+	quic false makes it a TCP/TLS connection, which only has its tunnel to kill
+*/
+type fakeConn struct {
+	c *Conn
+
+	mu      sync.Mutex
+	tunnels map[int64]*Tunnel
+
+	// what the connection was closed with, and each tunnel killed with. A lock of their own,
+	// AddTunnel can close or kill straight off, while mu is held
+	recMu  sync.Mutex
+	codes  []uint64
+	killed map[int64]error
+}
+
+func addFakeConn(t *testing.T, table *Table, id string, quic bool) *fakeConn {
+	t.Helper()
+	f := &fakeConn{tunnels: make(map[int64]*Tunnel), killed: make(map[int64]error)}
+	var close func(uint64, string)
+	if quic {
+		close = func(code uint64, _ string) {
+			f.recMu.Lock()
+			f.codes = append(f.codes, code)
+			f.recMu.Unlock()
+			// off the caller's goroutine, as a closed connection's streams end
+			go func() {
+				f.mu.Lock()
+				tunnels, c := f.tunnels, f.c
+				f.tunnels = map[int64]*Tunnel{}
+				f.mu.Unlock()
+				for _, tun := range tunnels {
+					tun.Done()
+				}
+				c.Done()
+			}()
+		}
+	}
+	// a connection coming in during a shutdown is closed before AddConn returns
+	f.mu.Lock()
+	f.c = table.AddConn(context.WithValue(context.Background(), helpers.ConnId, id), close)
+	f.mu.Unlock()
+	return f
+}
+
+func (f *fakeConn) addTunnel(id int64, kind Kind) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tunnels[id] = f.c.AddTunnel(Record{StreamID: id, Kind: kind},
+		func() (int64, int64) { return 0, 0 },
+		func(cause error) {
+			f.recMu.Lock()
+			f.killed[id] = cause
+			f.recMu.Unlock()
+			go f.finish(id)
+		})
+}
+
+// Ends the tunnel, on its own (the client finished with it) or after a kill
+func (f *fakeConn) finish(id int64) {
+	f.mu.Lock()
+	tun, ok := f.tunnels[id]
+	delete(f.tunnels, id)
+	f.mu.Unlock()
+	if !ok {
+		return
+	}
+	tun.Done()
+	// a TCP/TLS connection is its tunnel
+	if f.c.close == nil {
+		f.c.Done()
+	}
+}
+
+func (f *fakeConn) closedWith() []uint64 {
+	f.recMu.Lock()
+	defer f.recMu.Unlock()
+	return append([]uint64(nil), f.codes...)
+}
+
+func (f *fakeConn) killedWith(id int64) error {
+	f.recMu.Lock()
+	defer f.recMu.Unlock()
+	return f.killed[id]
+}
+
+func TestShutdown(t *testing.T) {
+	const drain = 300 * time.Millisecond
+	type conn struct {
+		quic    bool
+		tunnels []Kind
+		// how long until its tunnels finish by themselves, 0 for never
+		finishAfter time.Duration
+	}
+	tests := []struct {
+		name  string
+		conns []conn
+		// what Shutdown returns
+		tunnels, cut int
+		// what the QUIC connections are closed with
+		code uint64
+		// whether it has to wait for the deadline
+		waits bool
+	}{
+		{name: "nothing running"},
+		{name: "idle QUIC connection goes away", conns: []conn{{quic: true}}, code: GoAwayCode},
+		{name: "only a TUN link isn't waited for", conns: []conn{{quic: true, tunnels: []Kind{KindTUN}}}, code: GoAwayCode},
+		{
+			name:  "tunnels finish inside the drain timeout",
+			conns: []conn{{quic: true, tunnels: []Kind{KindTCP, KindUDP}, finishAfter: drain / 3}, {tunnels: []Kind{KindTCP}, finishAfter: drain / 3}},
+			code:  GoAwayCode,
+		},
+		{
+			name:    "QUIC tunnels still running are cut",
+			conns:   []conn{{quic: true, tunnels: []Kind{KindTCP, KindReverse}}, {quic: true}},
+			tunnels: 2, cut: 1, code: CutCode, waits: true,
+		},
+		{
+			name:    "a TCP connection's tunnel is killed",
+			conns:   []conn{{tunnels: []Kind{KindTCP}}},
+			tunnels: 1, cut: 1, waits: true,
+		},
+		{
+			name: "some finish, some are cut",
+			conns: []conn{
+				{quic: true, tunnels: []Kind{KindTCP}, finishAfter: drain / 3},
+				{quic: true, tunnels: []Kind{KindTCP, KindTUN}},
+				{tunnels: []Kind{KindTCP}},
+			},
+			tunnels: 3, cut: 2, code: CutCode, waits: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := NewTable()
+			var fakes []*fakeConn
+			for i, cc := range tt.conns {
+				f := addFakeConn(t, table, fmt.Sprint("conn", i), cc.quic)
+				for id, kind := range cc.tunnels {
+					f.addTunnel(int64(id), kind)
+				}
+				if cc.finishAfter > 0 {
+					time.AfterFunc(cc.finishAfter, func() {
+						for id := range cc.tunnels {
+							f.finish(int64(id))
+						}
+					})
+				}
+				fakes = append(fakes, f)
+			}
+
+			start := time.Now()
+			tunnels, cut := table.Shutdown(drain)
+			took := time.Since(start)
+			if tunnels != tt.tunnels || cut != tt.cut {
+				t.Errorf("Shutdown = %d tunnels, %d connections, want %d, %d", tunnels, cut, tt.tunnels, tt.cut)
+			}
+			if waited := took >= drain; waited != tt.waits {
+				t.Errorf("took %v with a drain timeout of %v", took, drain)
+			}
+
+			for i, f := range fakes {
+				select {
+				case <-f.c.Leaving():
+				default:
+					t.Errorf("conn %d wasn't told it's leaving", i)
+				}
+				if !tt.conns[i].quic {
+					continue
+				}
+				// a connection that went away is never cut too
+				codes := f.closedWith()
+				want := uint64(GoAwayCode)
+				if tt.conns[i].finishAfter == 0 && len(tt.conns[i].tunnels) > 0 && tt.conns[i].tunnels[0] != KindTUN {
+					want = tt.code
+				}
+				if len(codes) == 0 || slices.ContainsFunc(codes, func(code uint64) bool { return code != want }) {
+					t.Errorf("conn %d closed with %#x, want %#x", i, codes, want)
+				}
+			}
+			for i, f := range fakes {
+				if !tt.conns[i].quic && tt.conns[i].finishAfter == 0 && len(tt.conns[i].tunnels) > 0 {
+					if err := f.killedWith(0); !errors.Is(err, ErrCut) {
+						t.Errorf("conn %d's tunnel killed with %v, want ErrCut", i, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestShutdownLateArrivals(t *testing.T) {
+	table := NewTable()
+	busy := addFakeConn(t, table, "busy", true)
+	busy.addTunnel(0, KindTCP)
+	if tunnels, conns := table.Shutdown(50 * time.Millisecond); tunnels != 1 || conns != 1 {
+		t.Fatalf("Shutdown = %d, %d", tunnels, conns)
+	}
+
+	// a connection coming in now is sent away at once
+	late := addFakeConn(t, table, "late", true)
+	if codes := late.closedWith(); len(codes) != 1 || codes[0] != GoAwayCode {
+		t.Errorf("late connection closed with %#x", codes)
+	}
+	// and a tunnel turning up after the deadline is cut as it's added
+	tcp := addFakeConn(t, table, "tcp", false)
+	tcp.addTunnel(0, KindTCP)
+	if err := tcp.killedWith(0); !errors.Is(err, ErrCut) {
+		t.Errorf("late tunnel killed with %v", err)
+	}
+}
+
+func TestShutdownNilTable(t *testing.T) {
+	var table *Table
+	if tunnels, conns := table.Shutdown(time.Second); tunnels != 0 || conns != 0 {
+		t.Errorf("Shutdown = %d, %d", tunnels, conns)
+	}
+}
@@ -0,0 +1,154 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"custom_vpn/internal/helpers"
+	"custom_vpn/internal/logging"
+	"custom_vpn/tunnel"
+
+	"github.com/quic-go/quic-go"
+)
+
+var logger = logging.For("session")
+
+/*
+	One record per tunnel the server carried: a TCP tunnel (any listener), a reverse forward's connection,
+	a UDP association or a TUN link. Written once, when the tunnel is over, to every sink the server has.
+	That's what answers "how much did this client move today", the log only ever said a tunnel opened.
+*/
+type Record struct {
+	ConnID string `json:"conn_id"`
+	// The QUIC stream the tunnel ran on. -1 on the TCP and TLS listeners, the connection is the tunnel there
+	StreamID int64 `json:"stream_id"`
+	// Listener the client came in on: tcp, tls or quic
+	Transport string `json:"transport"`
+	Kind      Kind   `json:"kind"`
+	// The client's address
+	Client   string `json:"client"`
+	Identity string `json:"identity,omitempty"`
+	// Empty for dynamic targets (SOCKS, HTTP proxy) and everything that isn't a service
+	Service string `json:"service,omitempty"`
+	// What was dialed. For a reverse forward, who connected to it. For a TUN link, the leased addresses
+	Target string    `json:"target,omitempty"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	// Payload bytes, not counting our headers. For UDP and TUN, the datagrams (or packets) both ways
+	FromClient int64 `json:"bytes_from_client"`
+	ToClient   int64 `json:"bytes_to_client"`
+	// "closed" when both ends finished normally, otherwise what ended it
+	CloseReason string `json:"close_reason"`
+}
+
+type Kind string
+
+const (
+	KindTCP     Kind = "tcp"
+	KindReverse Kind = "reverse"
+	KindUDP     Kind = "udp"
+	KindTUN     Kind = "tun"
+)
+
+func (r Record) Duration() time.Duration {
+	return r.End.Sub(r.Start)
+}
+
+// Starts a record: the connection ID and identity come from ctx, see helpers.CtxKey
+func Begin(ctx context.Context, kind Kind, transport string, client net.Addr) Record {
+	rec := Record{
+		StreamID:  -1,
+		Transport: transport,
+		Kind:      kind,
+		Start:     time.Now(),
+	}
+	rec.ConnID, _ = ctx.Value(helpers.ConnId).(string)
+	rec.Identity, _ = ctx.Value(helpers.Peer).(string)
+	if client != nil {
+		rec.Client = client.String()
+	}
+	return rec
+}
+
+// What to put in CloseReason for a tunnel that ended with err
+func Reason(err error) string {
+	var appErr *quic.ApplicationError
+	var streamErr *quic.StreamError
+	switch {
+	case err == nil, errors.Is(err, io.EOF):
+		return "closed"
+	case errors.Is(err, tunnel.ErrHalfCloseTimeout):
+		return "half-close timeout"
+	// the client hanging up its QUIC connection takes the tunnels on it along
+	case errors.As(err, &appErr) && appErr.Remote:
+		return "connection closed: " + appErr.ErrorMessage
+	// so does an admin killing it, see Table.KillConn
+	case errors.As(err, &appErr) && appErr.ErrorCode == KillCode:
+		return "connection " + ErrKilled.Error()
+	case errors.Is(err, ErrKilled), errors.As(err, &streamErr) && !streamErr.Remote && streamErr.ErrorCode == KillCode:
+		return ErrKilled.Error()
+	// and the server shutting down, see Table.Shutdown
+	case errors.As(err, &appErr) && appErr.ErrorCode == CutCode:
+		return "connection " + ErrCut.Error()
+	case errors.As(err, &appErr) && appErr.ErrorCode == GoAwayCode:
+		return ErrGoingAway.Error()
+	case errors.Is(err, ErrCut):
+		return ErrCut.Error()
+	}
+	return err.Error()
+}
+
+// Somewhere records go. Sinks are written from many go-routines at once
+type Sink interface {
+	Write(rec Record) error
+}
+
+// Hands every record to each of its sinks. A nil Recorder drops them
+type Recorder struct {
+	sinks []Sink
+}
+
+func NewRecorder(sinks ...Sink) *Recorder {
+	return &Recorder{sinks: sinks}
+}
+
+// One sink failing (a full disk) doesn't stop the others getting the record
+func (r *Recorder) Record(rec Record) {
+	if r == nil {
+		return
+	}
+	for _, sink := range r.sinks {
+		if err := sink.Write(rec); err != nil {
+			logger.Error("writing a record", "err", err)
+		}
+	}
+}
+
+// Records a TCP tunnel, from what tunnel.Pipe returned. The pipe's a end is the far end, b is the client
+func (r *Recorder) Finish(rec Record, res tunnel.Result) {
+	rec.End = time.Now()
+	rec.ToClient = res.AToB
+	rec.FromClient = res.BToA
+	rec.CloseReason = Reason(res.Err)
+	r.Record(rec)
+}
+
+// Closes the sinks that hold something open (files)
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	var errs []error
+	for _, sink := range r.sinks {
+		if c, ok := sink.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("session: %v", err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,97 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// One log line per record, the attributes named like the JSON keys
+type LogSink struct{}
+
+func (LogSink) Write(rec Record) error {
+	logger.Info("session",
+		"conn_id", rec.ConnID, "stream_id", rec.StreamID, "transport", rec.Transport, "kind", rec.Kind,
+		"client", rec.Client, "identity", rec.Identity, "service", rec.Service, "target", rec.Target,
+		"bytes_from_client", rec.FromClient, "bytes_to_client", rec.ToClient,
+		"duration", rec.Duration().Round(time.Millisecond), "close_reason", rec.CloseReason)
+	return nil
+}
+
+/*
+	Appends records to a file, one JSON object per line (jq, or anything that reads JSON lines, can sum them up).
+	Opened in append mode, so logrotate's copytruncate works without telling the server
+*/
+type FileSink struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+func OpenFile(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("session file: %v", err)
+	}
+	return &FileSink{path: path, f: f}, nil
+}
+
+func (s *FileSink) Write(rec Record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	// one write per line, so lines from concurrent tunnels don't interleave
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.Write(line); err != nil {
+		return fmt.Errorf("writing to %s: %v", s.path, err)
+	}
+	return nil
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
+
+// The last n records, in memory. What the admin API shows
+type Ring struct {
+	mu   sync.Mutex
+	recs []Record
+	// where the next record goes, once recs is full
+	next int
+}
+
+func NewRing(n int) *Ring {
+	return &Ring{recs: make([]Record, 0, n)}
+}
+
+func (r *Ring) Write(rec Record) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.recs) < cap(r.recs) {
+		r.recs = append(r.recs, rec)
+		return nil
+	}
+	// a ring of 0 keeps nothing
+	if len(r.recs) == 0 {
+		return nil
+	}
+	r.recs[r.next] = rec
+	r.next = (r.next + 1) % len(r.recs)
+	return nil
+}
+
+// Everything the ring holds, oldest first
+func (r *Ring) Records() []Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]Record, 0, len(r.recs))
+	out = append(out, r.recs[r.next:]...)
+	return append(out, r.recs[:r.next]...)
+}
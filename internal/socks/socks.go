@@ -0,0 +1,261 @@
+package socks
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"custom_vpn/internal/helpers"
+	"custom_vpn/internal/logging"
+	"custom_vpn/internal/transport"
+	"custom_vpn/internal/wire"
+	"custom_vpn/tunnel"
+)
+
+/*
+	A SOCKS5 front-end for the client (RFC 1928).
+	Browsers and tools ask for any host:port, and the destination goes to the server in the stream header.
+	The server dials it, so this makes the tunnel a remote-egress proxy.
+
+	Supported:
+		- no-auth only. It's a local proxy, bind it to loopback
+		- CONNECT, over any transport
+		- UDP ASSOCIATE, over QUIC datagrams (needs a FlowOpener)
+	BIND isn't supported.
+*/
+
+var logger = logging.For("socks")
+
+const socksVersion = 5
+
+const (
+	cmdConnect      = 0x01
+	cmdBind         = 0x02
+	cmdUDPAssociate = 0x03
+)
+
+const (
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// reply codes
+const (
+	repSucceeded        = 0x00
+	repGeneralFailure   = 0x01
+	repNotAllowed       = 0x02
+	repHostUnreachable  = 0x04
+	repConnRefused      = 0x05
+	repCmdNotSupported  = 0x07
+	repAddrNotSupported = 0x08
+)
+
+type Server struct {
+	// Tunnels for CONNECT
+	Opener transport.Opener
+	// UDP associations. nil means UDP ASSOCIATE is refused
+	Flows transport.FlowOpener
+}
+
+// Accepts SOCKS clients on addr until ctx is cancelled
+func (s *Server) ListenAndServe(ctx context.Context, errCh chan<- error, wg *sync.WaitGroup, addr string) {
+	defer wg.Done()
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		errCh <- fmt.Errorf("SOCKS: error creating listener: %v", err)
+		return
+	}
+	logger.Info("listening", "addr", listener.Addr().String())
+	defer listener.Close()
+
+	wg.Add(1)
+	go helpers.CaptureCancel(ctx, wg, errCh, listener.Addr().(*net.TCPAddr).Port, listener)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		wg.Add(1)
+		go s.handle(ctx, wg, errCh, conn)
+	}
+}
+
+func (s *Server) handle(ctx context.Context, wg *sync.WaitGroup, errCh chan<- error, conn net.Conn) {
+	defer wg.Done()
+
+	if err := negotiate(conn); err != nil {
+		errCh <- fmt.Errorf("SOCKS: %v: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	cmd, host, port, err := readRequest(conn)
+	if err != nil {
+		errCh <- fmt.Errorf("SOCKS: %v: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	switch cmd {
+	case cmdConnect:
+		s.connect(ctx, errCh, conn, host, port)
+	case cmdUDPAssociate:
+		s.associate(ctx, errCh, conn)
+	default:
+		writeReply(conn, repCmdNotSupported, nil)
+		conn.Close()
+	}
+}
+
+// Method negotiation. We only offer "no authentication required"
+func negotiate(conn net.Conn) error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return fmt.Errorf("reading greeting: %v", err)
+	}
+	if hdr[0] != socksVersion {
+		return fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return fmt.Errorf("reading methods: %v", err)
+	}
+	for _, m := range methods {
+		if m == 0x00 {
+			_, err := conn.Write([]byte{socksVersion, 0x00})
+			return err
+		}
+	}
+	conn.Write([]byte{socksVersion, 0xff})
+	return fmt.Errorf("client doesn't offer no-auth")
+}
+
+// Reads the request: VER CMD RSV ATYP DST.ADDR DST.PORT
+func readRequest(conn net.Conn) (byte, string, uint16, error) {
+	var hdr [3]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return 0, "", 0, fmt.Errorf("reading request: %v", err)
+	}
+	if hdr[0] != socksVersion {
+		return 0, "", 0, fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	host, port, err := readAddr(conn)
+	if err != nil {
+		if errors.Is(err, errAddrType) {
+			writeReply(conn, repAddrNotSupported, nil)
+		}
+		return 0, "", 0, err
+	}
+	return hdr[1], host, port, nil
+}
+
+var errAddrType = errors.New("unsupported address type")
+
+// ATYP, address and port, as used in requests and UDP headers
+func readAddr(r io.Reader) (string, uint16, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", 0, err
+	}
+	var host string
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, 4)
+		if atyp[0] == atypIPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = ip.String()
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", 0, err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", 0, err
+		}
+		host = string(name)
+	default:
+		return "", 0, errAddrType
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", 0, err
+	}
+	return host, binary.BigEndian.Uint16(port[:]), nil
+}
+
+// Encodes host:port as ATYP, address and port
+func appendAddr(buf []byte, host string, port uint16) []byte {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, atypIPv4)
+			buf = append(buf, ip4...)
+		} else {
+			buf = append(buf, atypIPv6)
+			buf = append(buf, ip.To16()...)
+		}
+	} else {
+		buf = append(buf, atypDomain, byte(len(host)))
+		buf = append(buf, host...)
+	}
+	return binary.BigEndian.AppendUint16(buf, port)
+}
+
+// VER REP RSV BND.ADDR BND.PORT. A nil bind address is sent as 0.0.0.0:0
+func writeReply(conn net.Conn, rep byte, bind *net.TCPAddr) error {
+	buf := []byte{socksVersion, rep, 0x00}
+	if bind == nil {
+		buf = appendAddr(buf, "0.0.0.0", 0)
+	} else {
+		buf = appendAddr(buf, bind.IP.String(), uint16(bind.Port))
+	}
+	_, err := conn.Write(buf)
+	return err
+}
+
+// Maps the server's refusal onto the closest SOCKS reply code
+func replyFor(err error) byte {
+	var rejected *wire.RejectedError
+	if errors.As(err, &rejected) {
+		switch rejected.Status {
+		case wire.StatusUnauthorized:
+			return repNotAllowed
+		case wire.StatusDialFailed:
+			return repConnRefused
+		}
+		return repGeneralFailure
+	}
+	return repHostUnreachable
+}
+
+// CONNECT: one tunnel per request, the server dials host:port
+func (s *Server) connect(ctx context.Context, errCh chan<- error, conn net.Conn, host string, port uint16) {
+	remote, err := s.Opener.OpenTunnel(ctx, wire.Header{TargetHost: host, TargetPort: port})
+	if err != nil {
+		errCh <- fmt.Errorf("SOCKS: CONNECT %s: %v", net.JoinHostPort(host, strconv.Itoa(int(port))), err)
+		writeReply(conn, replyFor(err), nil)
+		conn.Close()
+		return
+	}
+	if err := writeReply(conn, repSucceeded, nil); err != nil {
+		remote.Close()
+		conn.Close()
+		return
+	}
+	tunnel.Pipe(remote, conn)
+}
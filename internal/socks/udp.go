@@ -0,0 +1,146 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+
+	"custom_vpn/internal/transport"
+	"custom_vpn/internal/wire"
+)
+
+/*
+	UDP ASSOCIATE.
+	We open a local UDP socket for the SOCKS client to send to, and a dynamic association (flow) to the server.
+	Each SOCKS UDP packet (RSV FRAG ATYP DST.ADDR DST.PORT DATA) becomes one datagram carrying the destination,
+	and the server's datagrams (carrying where they came from) become SOCKS UDP packets going the other way.
+	Per the RFC, the association ends when the SOCKS client's TCP conn closes.
+*/
+func (s *Server) associate(ctx context.Context, errCh chan<- error, conn net.Conn) {
+	defer conn.Close()
+
+	if s.Flows == nil {
+		writeReply(conn, repCmdNotSupported, nil)
+		return
+	}
+
+	// the relay socket lives on the same interface the SOCKS client reached us on
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		errCh <- fmt.Errorf("SOCKS: UDP ASSOCIATE: %v", err)
+		writeReply(conn, repGeneralFailure, nil)
+		return
+	}
+	defer relay.Close()
+
+	flow, err := s.Flows.OpenFlow(ctx, wire.Header{})
+	if err != nil {
+		errCh <- fmt.Errorf("SOCKS: UDP ASSOCIATE: %v", err)
+		writeReply(conn, replyFor(err), nil)
+		return
+	}
+	defer flow.Close()
+
+	bind := relay.LocalAddr().(*net.UDPAddr)
+	if err := writeReply(conn, repSucceeded, &net.TCPAddr{IP: bind.IP, Port: bind.Port}); err != nil {
+		return
+	}
+	logger.Info("UDP association", "client", conn.RemoteAddr().String(), "relay", bind.String())
+
+	// the TCP conn carries nothing else. When it closes, or the flow dies, we're done
+	go func() {
+		io.Copy(io.Discard, conn)
+		relay.Close()
+	}()
+	go func() {
+		<-flow.Done()
+		relay.Close()
+	}()
+
+	clientIP := conn.RemoteAddr().(*net.TCPAddr).IP
+	clientAddr := make(chan *net.UDPAddr, 1)
+
+	// server -> SOCKS client
+	go func() {
+		var peer *net.UDPAddr
+		for {
+			payload, err := flow.Receive(ctx)
+			if err != nil {
+				return
+			}
+			host, port, data, err := wire.ParseAddr(payload)
+			if err != nil {
+				continue
+			}
+			if peer == nil {
+				select {
+				case peer = <-clientAddr:
+				default:
+					continue // nobody to send it to yet
+				}
+			}
+			packet := appendAddr([]byte{0, 0, 0}, host, port)
+			relay.WriteToUDP(append(packet, data...), peer)
+		}
+	}()
+
+	// SOCKS client -> server
+	buf := make([]byte, 64*1024)
+	var peer *net.UDPAddr
+	for {
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		// only the client that asked for the association gets to use it
+		if !from.IP.Equal(clientIP) {
+			continue
+		}
+		if peer == nil {
+			peer = from
+			clientAddr <- from
+		}
+		packet := buf[:n]
+		// RSV RSV FRAG. Fragments aren't supported, the RFC lets us drop them
+		if len(packet) < 4 || packet[2] != 0 {
+			continue
+		}
+		host, port, err := readAddr(bytes.NewReader(packet[3:]))
+		if err != nil {
+			continue
+		}
+		data := packet[3+addrLen(packet[3:]):]
+		payload, err := wire.AppendAddr(nil, host, port)
+		if err != nil {
+			continue
+		}
+		if err := flow.Send(append(payload, data...)); err != nil {
+			if flowClosed(flow) {
+				return
+			}
+		}
+	}
+}
+
+// Length of the ATYP + address + port at the front of b. Only called after readAddr succeeded on it
+func addrLen(b []byte) int {
+	switch b[0] {
+	case atypIPv4:
+		return 1 + 4 + 2
+	case atypIPv6:
+		return 1 + 16 + 2
+	}
+	return 1 + 1 + int(b[1]) + 2
+}
+
+func flowClosed(flow transport.Flow) bool {
+	select {
+	case <-flow.Done():
+		return true
+	default:
+		return false
+	}
+}
@@ -1,52 +1,65 @@
 package tcp
 
 import (
+	"context"
 	"crypto/tls"
-	"custom_vpn/tlsconfig"
-	"custom_vpn/tunnel"
+	"custom_vpn/internal/auth"
+	"custom_vpn/internal/metrics"
+	"custom_vpn/internal/wire"
 	"fmt"
-	"log"
 	"net"
-	"sync"
 )
 
-// Connect via TCP to remote server with TLS
-func ConnectRemoteSecure(wg *sync.WaitGroup, errCh chan<- error, conn net.Conn, caCertLoc string, serverAddr *net.TCPAddr) error {
-	defer wg.Done()
-	
-	clientConfg, err := tlsconfig.ClientTLSConfig(caCertLoc)
-	if err != nil{
-		return fmt.Errorf("error fetching TLS config for client: %v",err)
-	}
+/*
+	Opens tunnels to the server's TLS or raw TCP listener. One TCP conn per tunnel.
+	TLSConf being nil means raw TCP. Token being nil means no auth exchange.
+*/
+type Dialer struct {
+	ServerAddr *net.TCPAddr
+	TLSConf    *tls.Config
+	Token      auth.TokenSource
+}
 
-	// if you wonder where the "conn.close()" are, they're in the tunnel logic
-	serverConn, err := tls.Dial("tcp",
-								serverAddr.String(), 
-								clientConfg)
-	if err != nil{
-		return fmt.Errorf("error dialing to server (%v): %v", serverAddr.String(), err)
+// Connect to remote server (with TLS when configured) and do the header exchange
+func (d *Dialer) OpenTunnel(ctx context.Context, hdr wire.Header) (net.Conn, error) {
+	var serverConn net.Conn
+	var err error
+	if d.TLSConf != nil {
+		dialer := tls.Dialer{Config: d.TLSConf}
+		serverConn, err = dialer.DialContext(ctx, "tcp", d.ServerAddr.String())
 	} else {
-		log.Printf("client: established secure TCP conn to server %v", serverAddr.String())
+		var dialer net.Dialer
+		serverConn, err = dialer.DialContext(ctx, "tcp", d.ServerAddr.String())
+	}
+	metrics.Dials.WithLabelValues(d.transport(), metrics.Result(err)).Inc()
+	if err != nil {
+		return nil, fmt.Errorf("error dialing to server (%v): %v", d.ServerAddr.String(), err)
 	}
-	defer serverConn.Close()
+	logger.DebugContext(ctx, "connected", "server", d.ServerAddr.String(), "transport", d.transport())
 
-	tunnel.CreateTunnel(serverConn, conn)
+	// every conn authenticates on its own, there's no connection to share like with QUIC
+	if d.Token != nil {
+		token, err := d.Token()
+		if err == nil {
+			err = wire.Authenticate(serverConn, token)
+		}
+		if err != nil {
+			serverConn.Close()
+			return nil, err
+		}
+	}
 
-	return nil
+	// same header exchange as a QUIC stream, the server picks the backend from it
+	if err := wire.Handshake(serverConn, hdr); err != nil {
+		serverConn.Close()
+		return nil, err
+	}
+	return serverConn, nil
 }
 
-// Connect to remote server with Raw TCP
-func ConnectRemoteUnsec(wg *sync.WaitGroup, errCh chan<- error, conn net.Conn, serverAddr *net.TCPAddr) error {
-	defer wg.Done()
-
-	serverConn, err := net.Dial("tcp", serverAddr.String())
-	if err != nil{
-		return fmt.Errorf("client: error dialing to server (%v): %v", serverAddr.String(), err)
-	} else{
-		log.Printf("client: established insecure connection to server %v", serverAddr.String())
+func (d *Dialer) transport() string {
+	if d.TLSConf != nil {
+		return "tls"
 	}
-
-	tunnel.CreateTunnel(serverConn, conn)
-
-	return nil
-}
\ No newline at end of file
+	return "tcp"
+}
@@ -5,28 +5,30 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
-	"log"
 	"net"
+	"strconv"
 	"sync"
+	"time"
 
+	"custom_vpn/config"
+	"custom_vpn/internal/auth"
 	"custom_vpn/internal/helpers"
+	"custom_vpn/internal/logging"
+	"custom_vpn/internal/metrics"
+	"custom_vpn/internal/services"
+	"custom_vpn/internal/session"
 	"custom_vpn/tlsconfig"
-	"custom_vpn/tunnel"
 )
 
+var logger = logging.For("tcp")
+
 // Creates a TCP connection on the specified port. Utilizes transport layer scurity
-func ListenAndServeWithTLS(cancelCtx context.Context, errCh chan<- error, wg *sync.WaitGroup, port int, endpointService net.TCPAddr) {
+func ListenAndServeWithTLS(cancelCtx context.Context, errCh chan<- error, wg *sync.WaitGroup, listenerConf config.Listener, registry *services.Registry, authenticator auth.Authenticator, serverConfig *tls.Config) {
 	defer wg.Done()
 
-	serverConfig, err := tlsconfig.ServerTLSConfig()
-	if err != nil {
-		errCh <- fmt.Errorf("TLS Server: error getting server config: %v", err)
-		return
-	}
-
 	tcpAddr := net.TCPAddr{
-		IP: net.ParseIP("0.0.0.0"),
-		Port: port,
+		IP:   net.ParseIP(listenerConf.Bind),
+		Port: listenerConf.Port,
 	}
 
 	listener, err := tls.Listen("tcp", tcpAddr.String(), serverConfig)
@@ -34,7 +36,7 @@ func ListenAndServeWithTLS(cancelCtx context.Context, errCh chan<- error, wg *sy
 		errCh <- fmt.Errorf("TLS Server: error while starting listener: %v", err)
 		return
 	} else {
-		log.Printf("TLS Server: listening on port %d",port)
+		logger.Info("TLS listener listening", "addr", listener.Addr().String(), "port", tcpAddr.Port)
 	}
 	defer listener.Close()
 
@@ -46,34 +48,44 @@ func ListenAndServeWithTLS(cancelCtx context.Context, errCh chan<- error, wg *sy
 	wg.Add(1)
 	go helpers.CaptureCancel(cancelCtx, wg, errCh, tcpAddr.Port, listener)
 
+	// draining through the admin API closes the listener too, the connections we have keep going
+	drained := registry.Live.AddListener("tls", listener.Addr().String(), func() { listener.Close() })
+	defer drained.Done()
+
 	for {
 		clientConn, err := listener.Accept()
 		if err != nil {
-			if errors.Is(err, net.ErrClosed){
+			if errors.Is(err, net.ErrClosed) {
+				if drained.Draining() {
+					logger.Info("drained, not accepting anymore", "port", tcpAddr.Port)
+				}
 				return
 			}
 			errCh <- fmt.Errorf("unable to accept connection: %v", err)
 			continue
 		}
-		go handleClientConn(clientConn, errCh, endpointService)
+		metrics.Accepted.WithLabelValues("tls", strconv.Itoa(tcpAddr.Port)).Inc()
+		// in the wait group, so the server waits for its tunnels to drain before it exits
+		wg.Add(1)
+		go handleClientConn(cancelCtx, wg, clientConn, registry, authenticator)
 	}
 }
 
 // Starts a raw TCP listener on given port
-func ListenAndServeNoTLS(cancelCtx context.Context, errCh chan<- error, wg *sync.WaitGroup, port int, endpointService net.TCPAddr) {
+func ListenAndServeNoTLS(cancelCtx context.Context, errCh chan<- error, wg *sync.WaitGroup, listenerConf config.Listener, registry *services.Registry, authenticator auth.Authenticator) {
 	defer wg.Done()
 
 	tcpAddr := net.TCPAddr{
-		IP: net.ParseIP("0.0.0.0"),
-		Port: port,
+		IP:   net.ParseIP(listenerConf.Bind),
+		Port: listenerConf.Port,
 	}
 	// start listener
 	listener, err := net.ListenTCP("tcp", &tcpAddr)
-	if err != nil{
+	if err != nil {
 		errCh <- fmt.Errorf("TCP Server: failed to start listener (on-tls): %v", err)
 		return
 	} else {
-		log.Printf("TCP Server: listening on port %d", tcpAddr.Port)
+		logger.Info("TCP listener listening", "addr", listener.Addr().String(), "port", tcpAddr.Port)
 	}
 	defer listener.Close()
 
@@ -81,29 +93,102 @@ func ListenAndServeNoTLS(cancelCtx context.Context, errCh chan<- error, wg *sync
 	wg.Add(1)
 	go helpers.CaptureCancel(cancelCtx, wg, errCh, tcpAddr.Port, listener)
 
+	// draining through the admin API closes the listener too, the connections we have keep going
+	drained := registry.Live.AddListener("tcp", listener.Addr().String(), func() { listener.Close() })
+	defer drained.Done()
+
 	// start accepting connections
 	for {
 		clientConn, err := listener.Accept()
-		if err != nil{
-			if errors.Is(err, net.ErrClosed){
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				if drained.Draining() {
+					logger.Info("drained, not accepting anymore", "port", tcpAddr.Port)
+				}
 				return
 			}
 			errCh <- fmt.Errorf("TCP Server: unable to accept connection: %v", err)
 			continue
 		}
-		go handleClientConn(clientConn, errCh, endpointService)
+		metrics.Accepted.WithLabelValues("tcp", strconv.Itoa(tcpAddr.Port)).Inc()
+		// in the wait group, so the server waits for its tunnels to drain before it exits
+		wg.Add(1)
+		go handleClientConn(cancelCtx, wg, clientConn, registry, authenticator)
 	}
 }
 
-// Dials the provided endpoint service 
-func handleClientConn(clientConn net.Conn, errCh chan<- error, endpointService net.TCPAddr) {
+// Checks the client's token (when authenticator isn't nil), then reads the stream header off the conn and dials the service it asks for
+func handleClientConn(ctx context.Context, wg *sync.WaitGroup, clientConn net.Conn, registry *services.Registry, authenticator auth.Authenticator) {
+	defer wg.Done()
+
+	transport := "tcp"
+	tlsConn, isTLS := clientConn.(*tls.Conn)
+	if isTLS {
+		transport = "tls"
+	}
+	connId, _ := helpers.GenUUID()
+	ctx = context.WithValue(ctx, helpers.ConnId, connId)
+	// the rest is for the logs
+	ctx = context.WithValue(ctx, helpers.Listener, clientConn.LocalAddr().String())
+	ctx = context.WithValue(ctx, helpers.Transport, transport)
+	ctx = context.WithValue(ctx, helpers.Client, clientConn.RemoteAddr().String())
+	logger.InfoContext(ctx, "connection accepted")
+
+	// until the tunnel is up there's nothing on the conn worth draining, shutting down just closes it
+	unwatch := context.AfterFunc(ctx, func() { clientConn.Close() })
+	defer unwatch()
+
+	// TLS conns finish the handshake up front, so a client cert (with mutual TLS) is verified before we read anything
+	if isTLS {
+		handshakeCtx, cancel := context.WithTimeout(ctx, config.TimeOutDuration)
+		err := tlsConn.HandshakeContext(handshakeCtx)
+		cancel()
+		if err != nil {
+			metrics.HandshakeFailures.WithLabelValues(transport, metrics.TLSFailureReason(err)).Inc()
+			logger.WarnContext(ctx, "TLS handshake failed", "err", err)
+			clientConn.Close()
+			return
+		}
+		state := tlsConn.ConnectionState()
+		identity := tlsconfig.PeerIdentity(state)
+		ctx = context.WithValue(context.WithValue(ctx, helpers.Peer, identity), helpers.ServerName, state.ServerName)
+		logger.DebugContext(ctx, "TLS handshake done", "server_name", state.ServerName)
+	}
 
-	log.Printf("server: Recieved a conn on %v from %v\n", clientConn.LocalAddr(), clientConn.RemoteAddr())
+	if authenticator != nil {
+		clientConn.SetDeadline(time.Now().Add(config.TimeOutDuration))
+		tokenIdentity, err := auth.Accept(ctx, clientConn, authenticator)
+		if err != nil {
+			metrics.HandshakeFailures.WithLabelValues(transport, "auth").Inc()
+			logger.WarnContext(ctx, "authentication failed", "err", err)
+			clientConn.Close()
+			return
+		}
+		clientConn.SetDeadline(time.Time{})
+		// a client cert says more than a token, it wins when there's both
+		if identity, _ := ctx.Value(helpers.Peer).(string); identity == "" {
+			ctx = context.WithValue(ctx, helpers.Peer, tokenIdentity)
+		}
+		logger.InfoContext(ctx, "authenticated", "token_identity", tokenIdentity)
+	}
 
-	targetConn, err := net.Dial("tcp", endpointService.String())
-	if err != nil{
-		errCh <- fmt.Errorf("error while connecting to ssh on server: %v", err)
+	targetConn, hdr, err := registry.Dispatch(ctx, clientConn)
+	if err != nil {
+		logger.WarnContext(ctx, "tunnel refused", "err", err)
+		clientConn.Close()
+		return
+	}
+	if !unwatch() {
+		targetConn.Close()
 		return
 	}
-	tunnel.CreateTunnel(targetConn, clientConn)
+	ctx = context.WithValue(ctx, helpers.Service, hdr.Service)
+	logger.InfoContext(ctx, "tunnel open", "target", targetConn.RemoteAddr().String())
+	rec := session.Begin(ctx, session.KindTCP, transport, clientConn.RemoteAddr())
+	rec.Service = hdr.Service
+	rec.Target = targetConn.RemoteAddr().String()
+	// the connection is the tunnel, killing it through the admin API (or at the drain deadline) ends the pipe
+	live := registry.Live.AddConn(ctx, nil)
+	defer live.Done()
+	registry.Sessions.Finish(rec, live.Pipe(rec, targetConn, clientConn))
 }
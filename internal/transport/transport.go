@@ -0,0 +1,65 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"custom_vpn/internal/wire"
+	"custom_vpn/tunnel"
+)
+
+/*
+	Client side view of the three transports (raw TCP, TLS, QUIC).
+	Forwards, the SOCKS front-end and anything else that needs to reach the server only care
+	about "give me a tunnel for this header", not about which transport carries it.
+	tcp.Dialer and quic.ConnManager both satisfy Opener.
+*/
+type Opener interface {
+	// Opens a tunnel to the server and does the header exchange on it.
+	// Returns a *wire.RejectedError if the server refused
+	OpenTunnel(ctx context.Context, hdr wire.Header) (net.Conn, error)
+}
+
+/*
+	A UDP association: payloads tagged with a flow ID and carried in QUIC datagrams,
+	kept alive by a control stream. Only the QUIC transport can do these.
+*/
+type Flow interface {
+	// Sends one payload to the server. Datagrams are unreliable, so no error doesn't mean it arrived
+	Send(payload []byte) error
+	// Blocks until the server sends a payload on this flow
+	Receive(ctx context.Context) ([]byte, error)
+	// Closed when the association ends (control stream closed, or the connection died)
+	Done() <-chan struct{}
+	Close() error
+}
+
+// What Receive returns on a TUN link the server dropped because another link took over its addresses
+var ErrFlowReplaced = errors.New("the server handed our tunnel addresses to a newer link with the same identity")
+
+type FlowOpener interface {
+	OpenFlow(ctx context.Context, hdr wire.Header) (Flow, error)
+}
+
+// Sends a local conn through a new tunnel. Runs as a go-routine, errors go down errCh
+func Forward(ctx context.Context, wg *sync.WaitGroup, errCh chan<- error, opener Opener, hdr wire.Header, conn net.Conn) {
+	defer wg.Done()
+
+	remote, err := opener.OpenTunnel(ctx, hdr)
+	if err != nil {
+		errCh <- fmt.Errorf("client: %s: %v", describe(hdr), err)
+		conn.Close()
+		return
+	}
+	tunnel.Pipe(remote, conn)
+}
+
+func describe(hdr wire.Header) string {
+	if hdr.Service != "" {
+		return fmt.Sprintf("service %q", hdr.Service)
+	}
+	return fmt.Sprintf("%s:%d", hdr.TargetHost, hdr.TargetPort)
+}
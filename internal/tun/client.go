@@ -0,0 +1,78 @@
+package tun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"custom_vpn/internal/transport"
+)
+
+/*
+	Client side of TUN mode. Packets read off dev go down the current link, packets off the link go into dev.
+	When the link dies (the QUIC connection went away) open is called for a new one, so the interface and its routes
+	stay put across reconnects. Packets read while there's no link are dropped, TCP will resend them.
+	The one exception is the server handing our addresses to another client with the same identity, then we give up.
+*/
+func RunClient(ctx context.Context, dev Device, open func(ctx context.Context) (transport.Flow, error)) error {
+	var current atomic.Pointer[transport.Flow]
+	linkErr := make(chan error, 1)
+
+	go func() {
+		defer dev.Close()
+		for {
+			link, err := open(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					linkErr <- err
+				}
+				return
+			}
+			current.Store(&link)
+			logger.Info("link connected", "dev", dev.Name())
+
+			for {
+				pkt, err := link.Receive(ctx)
+				// reconnecting would only kick the other link off in turn
+				if errors.Is(err, transport.ErrFlowReplaced) {
+					current.Store(nil)
+					link.Close()
+					linkErr <- err
+					return
+				}
+				if err != nil {
+					break
+				}
+				if _, err := dev.Write(pkt); err != nil {
+					logger.Warn("writing a packet", "dev", dev.Name(), "err", err)
+				}
+			}
+			current.Store(nil)
+			link.Close()
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Warn("lost the link, reconnecting", "dev", dev.Name())
+		}
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := dev.Read(buf)
+		if err != nil {
+			select {
+			case err := <-linkErr:
+				return err
+			default:
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("tun: reading %s: %v", dev.Name(), err)
+		}
+		if link := current.Load(); link != nil {
+			(*link).Send(buf[:n])
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package tun
+
+import (
+	"encoding/binary"
+	"io"
+	"net/netip"
+
+	"custom_vpn/internal/logging"
+)
+
+/*
+	Layer 3 mode. Instead of forwarding one service per local port, the client and server each get a TUN interface,
+	and every IP packet the kernel routes into it is carried across the QUIC connection and written out the other side.
+	The server then forwards it like any router would, to its LAN or to another client.
+
+	Only Linux for now. Opening a TUN device and touching addresses and routes needs root (or CAP_NET_ADMIN).
+*/
+
+var logger = logging.For("tun")
+
+// A TUN interface. Every Read returns one IP packet, every Write takes one
+type Device interface {
+	io.ReadWriteCloser
+	Name() string
+}
+
+type Config struct {
+	// Interface name. Empty lets the kernel pick one
+	Name string
+	// This end's tunnel addresses, with the tunnel's prefix lengths, eg. 10.99.0.1/24.
+	// The client's come from the server's lease, so it opens its device without any and calls SetAddresses later
+	Addresses []netip.Prefix
+	MTU       int
+}
+
+/*
+	Pulls the source and destination out of an IPv4 or IPv6 header.
+	ok is false for anything too short to be either.
+*/
+func Addrs(pkt []byte) (src, dst netip.Addr, ok bool) {
+	if len(pkt) == 0 {
+		return src, dst, false
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return src, dst, false
+		}
+		return netip.AddrFrom4([4]byte(pkt[12:16])), netip.AddrFrom4([4]byte(pkt[16:20])), true
+	case 6:
+		if len(pkt) < 40 {
+			return src, dst, false
+		}
+		return netip.AddrFrom16([16]byte(pkt[8:24])), netip.AddrFrom16([16]byte(pkt[24:40])), true
+	}
+	return src, dst, false
+}
+
+/*
+	The destination port of a TCP or UDP packet, 0 for anything else.
+	Fragments after the first carry no ports, so they get 0 too. IPv6 extension headers are skipped over.
+*/
+func DstPort(pkt []byte) uint16 {
+	var proto byte
+	var off int
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		if binary.BigEndian.Uint16(pkt[6:8])&0x1fff != 0 {
+			return 0
+		}
+		proto, off = pkt[9], int(pkt[0]&0x0f)*4
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		proto, off = pkt[6], 40
+	ext:
+		for len(pkt) >= off+8 {
+			switch proto {
+			case 0, 43, 60: // hop-by-hop, routing, destination options
+				proto, off = pkt[off], off+(int(pkt[off+1])+1)*8
+			case 44: // fragment
+				if binary.BigEndian.Uint16(pkt[off+2:off+4])>>3 != 0 {
+					return 0
+				}
+				proto, off = pkt[off], off+8
+			default:
+				break ext
+			}
+		}
+	default:
+		return 0
+	}
+	if (proto != 6 && proto != 17) || len(pkt) < off+4 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(pkt[off+2 : off+4])
+}
@@ -0,0 +1,117 @@
+package tun
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/songgao/water"
+	"github.com/vishvananda/netlink"
+)
+
+// Creates the interface, gives it conf.Address and brings it up
+func Open(conf Config) (Device, error) {
+	ifce, err := water.New(water.Config{
+		DeviceType:             water.TUN,
+		PlatformSpecificParams: water.PlatformSpecificParams{Name: conf.Name},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("tun: creating %q: %v", conf.Name, err)
+	}
+	if err := configure(ifce.Name(), conf); err != nil {
+		ifce.Close()
+		return nil, err
+	}
+	return ifce, nil
+}
+
+func configure(name string, conf Config) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("tun: %s: %v", name, err)
+	}
+	if conf.MTU > 0 {
+		if err := netlink.LinkSetMTU(link, conf.MTU); err != nil {
+			return fmt.Errorf("tun: %s: setting mtu %d: %v", name, conf.MTU, err)
+		}
+	}
+	for _, prefix := range conf.Addresses {
+		if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: prefixToIPNet(prefix)}); err != nil {
+			return fmt.Errorf("tun: %s: adding address %v: %v", name, prefix, err)
+		}
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return fmt.Errorf("tun: %s: bringing it up: %v", name, err)
+	}
+	return nil
+}
+
+// Makes prefixes dev's only addresses (link local ones aside), adding and removing as needed
+func SetAddresses(dev Device, prefixes []netip.Prefix) error {
+	link, err := netlink.LinkByName(dev.Name())
+	if err != nil {
+		return fmt.Errorf("tun: %s: %v", dev.Name(), err)
+	}
+	current, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("tun: %s: %v", dev.Name(), err)
+	}
+	have := make(map[netip.Prefix]bool)
+	for _, a := range current {
+		addr, _ := netip.AddrFromSlice(a.IP)
+		ones, _ := a.Mask.Size()
+		prefix := netip.PrefixFrom(addr.Unmap(), ones)
+		if addr.IsLinkLocalUnicast() {
+			continue
+		}
+		if !slices.Contains(prefixes, prefix) {
+			if err := netlink.AddrDel(link, &a); err != nil {
+				return fmt.Errorf("tun: %s: removing address %v: %v", dev.Name(), prefix, err)
+			}
+			continue
+		}
+		have[prefix] = true
+	}
+	for _, prefix := range prefixes {
+		if have[prefix] {
+			continue
+		}
+		if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: prefixToIPNet(prefix)}); err != nil {
+			return fmt.Errorf("tun: %s: adding address %v: %v", dev.Name(), prefix, err)
+		}
+	}
+	return nil
+}
+
+/*
+	Points the interface's DNS at servers, through systemd-resolved.
+	Without resolvectl there's nothing we can safely do (rewriting resolv.conf behind the user's back isn't it),
+	so the caller gets an error naming the servers and logs it.
+*/
+func SetDNS(dev Device, servers []netip.Addr) error {
+	if len(servers) == 0 {
+		return nil
+	}
+	args := []string{"dns", dev.Name()}
+	for _, a := range servers {
+		args = append(args, a.String())
+	}
+	if _, err := exec.LookPath("resolvectl"); err != nil {
+		return fmt.Errorf("tun: no resolvectl to set DNS with, point your resolver at %v by hand", servers)
+	}
+	if out, err := exec.Command("resolvectl", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("tun: resolvectl %s: %v: %s", strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func prefixToIPNet(p netip.Prefix) *net.IPNet {
+	return &net.IPNet{
+		IP:   net.IP(p.Addr().AsSlice()),
+		Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen()),
+	}
+}
@@ -0,0 +1,48 @@
+//go:build !linux
+
+package tun
+
+import (
+	"errors"
+	"net/netip"
+)
+
+var errUnsupported = errors.New("tun: TUN mode only works on Linux")
+
+func Open(conf Config) (Device, error) {
+	return nil, errUnsupported
+}
+
+func Bypass(dst netip.Prefix) (Route, error) {
+	return Route{}, errUnsupported
+}
+
+func addRoute(r Route) (bool, error) {
+	return false, errUnsupported
+}
+
+func delRoute(r Route) error {
+	return errUnsupported
+}
+
+func SetAddresses(dev Device, prefixes []netip.Prefix) error {
+	return errUnsupported
+}
+
+func SetDNS(dev Device, servers []netip.Addr) error {
+	return errUnsupported
+}
+
+type NAT struct{}
+
+func EnableNAT(dev string, prefixes []netip.Prefix) (*NAT, error) {
+	return nil, errUnsupported
+}
+
+func (n *NAT) Close() error {
+	return errUnsupported
+}
+
+func EnableForwarding(v4, v6 bool) error {
+	return errUnsupported
+}
@@ -0,0 +1,123 @@
+package tun
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+/*
+	Masquerade for TUN clients, so the LAN sees the server instead of tunnel addresses it has no route back to.
+	The rules live in a table of our own ("inet custom_vpn"), made at startup and deleted on shutdown.
+	A table left behind by a crash is replaced, never added to.
+	This only rewrites addresses. A firewall dropping forwarded packets in its own tables still gets the last word.
+*/
+type NAT struct {
+	conn  *nftables.Conn
+	table *nftables.Table
+}
+
+const natTable = "custom_vpn"
+
+// Masquerades packets from prefixes leaving through any interface but dev
+func EnableNAT(dev string, prefixes []netip.Prefix) (*NAT, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, fmt.Errorf("tun: nftables: %v", err)
+	}
+	table := &nftables.Table{Family: nftables.TableFamilyINet, Name: natTable}
+
+	// leftovers from a run which didn't get to clean up
+	tables, err := conn.ListTablesOfFamily(nftables.TableFamilyINet)
+	if err != nil {
+		return nil, fmt.Errorf("tun: nftables: %v", err)
+	}
+	for _, t := range tables {
+		if t.Name == natTable {
+			conn.DelTable(table)
+		}
+	}
+
+	conn.AddTable(table)
+	chain := conn.AddChain(&nftables.Chain{
+		Name:     "postrouting",
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+	for _, prefix := range prefixes {
+		conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: masquerade(dev, prefix.Masked())})
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("tun: nftables: adding the masquerade rules: %v", err)
+	}
+	logger.Info("masquerading", "prefixes", prefixes, "nft_table", "inet "+natTable)
+	return &NAT{conn: conn, table: table}, nil
+}
+
+// Deletes our table, and every rule in it
+func (n *NAT) Close() error {
+	n.conn.DelTable(n.table)
+	if err := n.conn.Flush(); err != nil {
+		return fmt.Errorf("tun: nftables: deleting table %s: %v", natTable, err)
+	}
+	return nil
+}
+
+// The rule `meta nfproto <family> <ip|ip6> saddr <prefix> oifname != <dev> masquerade`
+func masquerade(dev string, prefix netip.Prefix) []expr.Any {
+	family, offset := byte(unix.NFPROTO_IPV4), uint32(12)
+	if prefix.Addr().Is6() {
+		family, offset = byte(unix.NFPROTO_IPV6), 8
+	}
+	addr := prefix.Addr().AsSlice()
+	mask := netipMask(prefix)
+
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(len(addr))},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: uint32(len(addr)), Mask: mask, Xor: make([]byte, len(addr))},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr},
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: ifname(dev)},
+		&expr.Masq{},
+	}
+}
+
+func netipMask(prefix netip.Prefix) []byte {
+	mask := make([]byte, prefix.Addr().BitLen()/8)
+	for i := 0; i < prefix.Bits(); i++ {
+		mask[i/8] |= 0x80 >> (i % 8)
+	}
+	return mask
+}
+
+// Interface names are compared as the kernel keeps them, nul padded to IFNAMSIZ
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
+
+// Turns on routing between interfaces for the families in use. NAT is no use without it
+func EnableForwarding(v4, v6 bool) error {
+	paths := map[string]bool{
+		"/proc/sys/net/ipv4/ip_forward":          v4,
+		"/proc/sys/net/ipv6/conf/all/forwarding": v6,
+	}
+	for path, on := range paths {
+		if !on {
+			continue
+		}
+		if err := os.WriteFile(path, []byte("1"), 0); err != nil {
+			return fmt.Errorf("tun: turning on forwarding: %v", err)
+		}
+	}
+	return nil
+}
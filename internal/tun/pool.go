@@ -0,0 +1,266 @@
+package tun
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	The server's address pool for TUN clients.
+	A client gets the same address(es) every time it connects, keyed by its identity (client cert or token),
+	for as long as its lease lives. A lease nobody has used for the idle timeout is reclaimed.
+	Leases are kept in a JSON file, so a server restart doesn't reshuffle everyone.
+
+	Clients without an identity can't be recognised next time, so their leases are ephemeral:
+	keyed by connection, never written down, and freed as soon as the link goes.
+*/
+type Pool struct {
+	// either may be invalid, when the tunnel doesn't do that address family. Addr() is the server's own address
+	v4, v6 netip.Prefix
+	path   string
+	idle   time.Duration
+
+	mu     sync.Mutex
+	leases map[string]*Lease
+	inUse  map[netip.Addr]*Lease
+}
+
+type Lease struct {
+	Identity string     `json:"identity"`
+	IPv4     netip.Addr `json:"ipv4,omitzero"`
+	IPv6     netip.Addr `json:"ipv6,omitzero"`
+	// when a link using the lease last went away, or came up
+	LastSeen time.Time `json:"last_seen"`
+
+	ephemeral bool
+	// links using the lease right now
+	links int
+}
+
+var ErrPoolExhausted = errors.New("tun: no free addresses left in the pool")
+
+/*
+	Loads the leases in path (which may not exist yet). An empty path keeps leases in memory only.
+	Leases from the file which no longer fit the prefixes (the config changed) are dropped.
+*/
+func NewPool(v4, v6 netip.Prefix, path string, idle time.Duration) (*Pool, error) {
+	p := &Pool{
+		v4:     v4,
+		v6:     v6,
+		path:   path,
+		idle:   idle,
+		leases: make(map[string]*Lease),
+		inUse:  make(map[netip.Addr]*Lease),
+	}
+	if path == "" {
+		return p, nil
+	}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tun: %v", err)
+	}
+	var saved []*Lease
+	if err := json.Unmarshal(raw, &saved); err != nil {
+		return nil, fmt.Errorf("tun: %s: %v", path, err)
+	}
+	for _, l := range saved {
+		if (l.IPv4.IsValid() && !p.usable(p.v4, l.IPv4)) || (l.IPv6.IsValid() && !p.usable(p.v6, l.IPv6)) {
+			logger.Warn("dropping a lease, its addresses aren't in the pool anymore", "identity", l.Identity, "ipv4", l.IPv4, "ipv6", l.IPv6)
+			continue
+		}
+		if p.inUse[l.IPv4] != nil || p.inUse[l.IPv6] != nil {
+			continue
+		}
+		p.add(l)
+	}
+	return p, nil
+}
+
+// The server's own addresses, with the tunnel prefix lengths
+func (p *Pool) Prefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, prefix := range []netip.Prefix{p.v4, p.v6} {
+		if prefix.IsValid() {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+/*
+	Finds (or makes) the lease for identity, and marks it in use until Release.
+	An empty identity gets an ephemeral lease under connKey.
+*/
+func (p *Pool) Acquire(identity, connKey string) (Lease, error) {
+	key, ephemeral := identity, false
+	if identity == "" {
+		key, ephemeral = "conn/"+connKey, true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l := p.leases[key]
+	if l == nil {
+		l = &Lease{Identity: key, ephemeral: ephemeral}
+		var err error
+		if l.IPv4, err = p.next(p.v4); err != nil {
+			return Lease{}, err
+		}
+		if l.IPv6, err = p.next(p.v6); err != nil {
+			return Lease{}, err
+		}
+		p.add(l)
+		logger.Info("new lease", "identity", key, "addrs", l.Addrs())
+	}
+	l.links++
+	l.LastSeen = time.Now()
+	p.saveLocked()
+	return *l, nil
+}
+
+// The link using the lease went away. The idle timeout starts counting
+func (p *Pool) Release(l Lease) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cur := p.leases[l.Identity]
+	if cur == nil {
+		return
+	}
+	cur.links--
+	cur.LastSeen = time.Now()
+	if cur.links <= 0 && cur.ephemeral {
+		p.remove(cur)
+	}
+	p.saveLocked()
+}
+
+// Reclaims leases idle since before now - idle timeout
+func (p *Pool) Expire(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	expired := false
+	for _, l := range p.leases {
+		if l.links <= 0 && now.Sub(l.LastSeen) > p.idle {
+			logger.Info("lease expired", "identity", l.Identity, "addrs", l.Addrs())
+			p.remove(l)
+			expired = true
+		}
+	}
+	if expired {
+		p.saveLocked()
+	}
+}
+
+// Expires leases every minute (more often for short timeouts) until ctx is cancelled
+func (p *Pool) Run(ctx context.Context) {
+	ticker := time.NewTicker(max(min(time.Minute, p.idle/2), time.Second))
+	defer ticker.Stop()
+	p.Expire(time.Now())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.Expire(now)
+		}
+	}
+}
+
+func (p *Pool) add(l *Lease) {
+	p.leases[l.Identity] = l
+	for _, a := range []netip.Addr{l.IPv4, l.IPv6} {
+		if a.IsValid() {
+			p.inUse[a] = l
+		}
+	}
+}
+
+func (p *Pool) remove(l *Lease) {
+	delete(p.leases, l.Identity)
+	delete(p.inUse, l.IPv4)
+	delete(p.inUse, l.IPv6)
+}
+
+// The first free address of prefix. An invalid prefix (address family not in use) gives an invalid address
+func (p *Pool) next(prefix netip.Prefix) (netip.Addr, error) {
+	if !prefix.IsValid() {
+		return netip.Addr{}, nil
+	}
+	for a := prefix.Masked().Addr().Next(); prefix.Contains(a); a = a.Next() {
+		if p.usable(prefix, a) && p.inUse[a] == nil {
+			return a, nil
+		}
+	}
+	return netip.Addr{}, ErrPoolExhausted
+}
+
+// Inside the prefix, and not the network, broadcast or server address
+func (p *Pool) usable(prefix netip.Prefix, a netip.Addr) bool {
+	if !prefix.IsValid() || !prefix.Contains(a) || a == prefix.Addr() || a == prefix.Masked().Addr() {
+		return false
+	}
+	if a.Is4() && !prefix.Contains(a.Next()) {
+		return false // broadcast
+	}
+	return true
+}
+
+// Writes the lasting leases to the file. Failing to is logged, the pool carries on in memory
+func (p *Pool) saveLocked() {
+	if p.path == "" {
+		return
+	}
+	saved := []*Lease{}
+	for _, l := range p.leases {
+		if !l.ephemeral {
+			saved = append(saved, l)
+		}
+	}
+	slices.SortFunc(saved, func(a, b *Lease) int { return strings.Compare(a.Identity, b.Identity) })
+	raw, err := json.MarshalIndent(saved, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(p.path, append(raw, '\n'))
+	}
+	if err != nil {
+		logger.Error("saving leases", "path", p.path, "err", err)
+	}
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// The lease's valid addresses, IPv4 first
+func (l Lease) Addrs() []netip.Addr {
+	var addrs []netip.Addr
+	for _, a := range []netip.Addr{l.IPv4, l.IPv6} {
+		if a.IsValid() {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
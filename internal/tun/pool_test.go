@@ -0,0 +1,221 @@
+package tun
+
+import (
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestUsable(t *testing.T) {
+	tests := []struct {
+		prefix, addr string
+		want         bool
+	}{
+		{"10.99.0.1/24", "10.99.0.2", true},
+		{"10.99.0.1/24", "10.99.0.254", true},
+		{"10.99.0.1/24", "10.99.0.0", false},   // network
+		{"10.99.0.1/24", "10.99.0.1", false},   // the server
+		{"10.99.0.1/24", "10.99.0.255", false}, // broadcast
+		{"10.99.0.1/24", "10.99.1.2", false},   // outside
+		{"10.99.0.5/29", "10.99.0.1", true},
+		{"10.99.0.5/29", "10.99.0.5", false},
+		{"10.99.0.5/29", "10.99.0.7", false},
+		{"fd00:99::1/64", "fd00:99::2", true},
+		{"fd00:99::1/64", "fd00:99::", false},
+		{"fd00:99::1/64", "fd00:99::1", false},
+		// no broadcast in IPv6
+		{"fd00:99::1/126", "fd00:99::3", true},
+		{"fd00:99::1/64", "fd00:98::2", false},
+	}
+	p := &Pool{}
+	for _, tt := range tests {
+		if got := p.usable(netip.MustParsePrefix(tt.prefix), netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("usable(%s, %s) = %v, want %v", tt.prefix, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		taken  []string
+		want   string
+		err    error
+	}{
+		{name: "first after the server", prefix: "10.99.0.1/24", want: "10.99.0.2"},
+		{name: "skips taken ones", prefix: "10.99.0.1/24", taken: []string{"10.99.0.2", "10.99.0.3"}, want: "10.99.0.4"},
+		{name: "server in the middle", prefix: "10.99.0.5/29", want: "10.99.0.1"},
+		{name: "skips the server", prefix: "10.99.0.5/29", taken: []string{"10.99.0.1", "10.99.0.2", "10.99.0.3", "10.99.0.4"}, want: "10.99.0.6"},
+		{name: "a /30 has one", prefix: "10.99.0.1/30", want: "10.99.0.2"},
+		{name: "and only one", prefix: "10.99.0.1/30", taken: []string{"10.99.0.2"}, err: ErrPoolExhausted},
+		{name: "a /29 runs out too", prefix: "10.99.0.5/29", taken: []string{"10.99.0.1", "10.99.0.2", "10.99.0.3", "10.99.0.4", "10.99.0.6"}, err: ErrPoolExhausted},
+		{name: "IPv6", prefix: "fd00:99::1/64", want: "fd00:99::2"},
+		{name: "IPv6 has no broadcast", prefix: "fd00:99::1/126", taken: []string{"fd00:99::2"}, want: "fd00:99::3"},
+		{name: "family not in use", prefix: "", want: "invalid IP"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var prefix netip.Prefix
+			if tt.prefix != "" {
+				prefix = netip.MustParsePrefix(tt.prefix)
+			}
+			p := &Pool{inUse: make(map[netip.Addr]*Lease)}
+			for _, a := range tt.taken {
+				p.inUse[netip.MustParseAddr(a)] = &Lease{}
+			}
+			got, err := p.next(prefix)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && got.String() != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcquireExhausted(t *testing.T) {
+	p, err := NewPool(netip.MustParsePrefix("10.99.0.1/30"), netip.Prefix{}, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := p.Acquire("alice", "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.IPv4 != netip.MustParseAddr("10.99.0.2") {
+		t.Errorf("alice got %v", alice.IPv4)
+	}
+	if _, err := p.Acquire("bob", "c2"); !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("bob: err = %v, want ErrPoolExhausted", err)
+	}
+	// a second link for alice doesn't need another address
+	if again, err := p.Acquire("alice", "c3"); err != nil || again.IPv4 != alice.IPv4 {
+		t.Errorf("alice again: %v, %v", again.IPv4, err)
+	}
+}
+
+func TestNewPoolDropsLeasesThatDontFit(t *testing.T) {
+	lease := func(identity, v4, v6 string) *Lease {
+		l := &Lease{Identity: identity, LastSeen: time.Now()}
+		if v4 != "" {
+			l.IPv4 = netip.MustParseAddr(v4)
+		}
+		if v6 != "" {
+			l.IPv6 = netip.MustParseAddr(v6)
+		}
+		return l
+	}
+	saved := []*Lease{
+		lease("alice", "10.99.0.2", "fd00:99::2"),
+		lease("bob", "10.99.0.3", ""),
+		lease("moved", "10.98.0.2", "fd00:99::4"),
+		lease("server", "10.99.0.1", ""),
+		lease("network", "10.99.0.0", ""),
+		lease("broadcast", "10.99.0.255", ""),
+		lease("v6-moved", "10.99.0.5", "fd00:98::5"),
+		// a second lease with an address already taken loses it
+		lease("twin", "10.99.0.2", ""),
+	}
+	raw, err := json.Marshal(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "leases.json")
+	if err := os.WriteFile(path, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewPool(netip.MustParsePrefix("10.99.0.1/24"), netip.MustParsePrefix("fd00:99::1/64"), path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for identity := range p.leases {
+		kept = append(kept, identity)
+	}
+	slices.Sort(kept)
+	if want := []string{"alice", "bob"}; !slices.Equal(kept, want) {
+		t.Errorf("kept %v, want %v", kept, want)
+	}
+
+	// and they're the addresses the pool hands back
+	alice, err := p.Acquire("alice", "c1")
+	if err != nil || alice.IPv4 != netip.MustParseAddr("10.99.0.2") || alice.IPv6 != netip.MustParseAddr("fd00:99::2") {
+		t.Errorf("alice: %v, %v", alice.Addrs(), err)
+	}
+	carol, err := p.Acquire("carol", "c2")
+	if err != nil || carol.IPv4 != netip.MustParseAddr("10.99.0.4") {
+		t.Errorf("carol: %v, %v", carol.Addrs(), err)
+	}
+}
+
+func TestNewPoolBadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	if err := os.WriteFile(path, []byte("not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPool(netip.MustParsePrefix("10.99.0.1/24"), netip.Prefix{}, path, time.Hour); err == nil {
+		t.Error("NewPool took a broken leases file")
+	}
+	// a file that isn't there yet is fine
+	if _, err := NewPool(netip.MustParsePrefix("10.99.0.1/24"), netip.Prefix{}, filepath.Join(t.TempDir(), "nope.json"), time.Hour); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		links   int
+		seen    time.Duration
+		expires bool
+	}{
+		{name: "idle too long", seen: 2 * time.Hour, expires: true},
+		{name: "idle, not long enough", seen: 30 * time.Minute},
+		{name: "in use for ages", links: 1, seen: 2 * time.Hour},
+		{name: "in use twice", links: 2, seen: 2 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPool(netip.MustParsePrefix("10.99.0.1/24"), netip.Prefix{}, "", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := &Lease{Identity: "alice", IPv4: netip.MustParseAddr("10.99.0.2"), LastSeen: now.Add(-tt.seen), links: tt.links}
+			p.add(l)
+			p.Expire(now)
+			_, kept := p.leases["alice"]
+			if kept == tt.expires {
+				t.Errorf("kept = %v, want %v", kept, !tt.expires)
+			}
+			// an expired lease's address goes back in the pool
+			if _, taken := p.inUse[l.IPv4]; taken == tt.expires {
+				t.Errorf("address taken = %v, want %v", taken, !tt.expires)
+			}
+		})
+	}
+}
+
+func TestReleaseEphemeral(t *testing.T) {
+	p, err := NewPool(netip.MustParsePrefix("10.99.0.1/30"), netip.Prefix{}, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := p.Acquire("", "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Release(l)
+	// freed straight away, no idle timeout for a client we can't recognise again
+	if _, err := p.Acquire("", "c2"); err != nil {
+		t.Errorf("the address wasn't freed: %v", err)
+	}
+}
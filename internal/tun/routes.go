@@ -0,0 +1,115 @@
+package tun
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+)
+
+// A route in the main table: Dst through Dev, via Gateway when there is one
+type Route struct {
+	Dst     netip.Prefix `json:"dst"`
+	Gateway netip.Addr   `json:"gateway,omitzero"`
+	Dev     string       `json:"dev"`
+}
+
+func (r Route) String() string {
+	if r.Gateway.IsValid() {
+		return fmt.Sprintf("%v via %v dev %s", r.Dst, r.Gateway, r.Dev)
+	}
+	return fmt.Sprintf("%v dev %s", r.Dst, r.Dev)
+}
+
+/*
+	The routes the client added for split tunnelling: subnets sent into the tunnel, and bypasses pinned to the way
+	they went before it came up. Every route is noted in the state file as soon as the kernel has it,
+	so a client which crashed can take its routes back out on the next start (RestoreRoutes).
+	Routes already in the table are left alone and never noted, so we only ever take out what we put in.
+*/
+type RouteSet struct {
+	path   string
+	routes []Route
+}
+
+func NewRouteSet(path string) *RouteSet {
+	return &RouteSet{path: path}
+}
+
+// Makes routes the set's routes, taking out the ones which aren't any more
+func (r *RouteSet) Set(routes []Route) error {
+	var keep []Route
+	for i, route := range r.routes {
+		if slices.Contains(routes, route) {
+			keep = append(keep, route)
+			continue
+		}
+		if err := delRoute(route); err != nil {
+			// the ones not taken out yet stay noted
+			r.routes = append(keep, r.routes[i:]...)
+			return errors.Join(err, r.save())
+		}
+	}
+	r.routes = keep
+
+	for _, route := range routes {
+		if slices.Contains(r.routes, route) {
+			continue
+		}
+		added, err := addRoute(route)
+		if err != nil {
+			return errors.Join(err, r.save())
+		}
+		if !added {
+			logger.Info("there's a route already, leaving it be", "dst", route.Dst)
+			continue
+		}
+		r.routes = append(r.routes, route)
+		if err := r.save(); err != nil {
+			return err
+		}
+	}
+	return r.save()
+}
+
+// Takes every route in the set out, and the state file with them
+func (r *RouteSet) Clear() error {
+	return r.Set(nil)
+}
+
+func (r *RouteSet) save() error {
+	if len(r.routes) == 0 {
+		if err := os.Remove(r.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("tun: %v", err)
+		}
+		return nil
+	}
+	raw, err := json.MarshalIndent(r.routes, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(r.path, raw); err != nil {
+		return fmt.Errorf("tun: writing %s: %v", r.path, err)
+	}
+	return nil
+}
+
+// Takes out the routes a client which didn't get to clean up left in the state file at path
+func RestoreRoutes(path string) error {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("tun: %v", err)
+	}
+	var routes []Route
+	if err := json.Unmarshal(raw, &routes); err != nil {
+		return fmt.Errorf("tun: %s: %v", path, err)
+	}
+	logger.Warn("taking out the routes of a client which didn't exit cleanly", "path", path, "routes", len(routes))
+	set := &RouteSet{path: path, routes: routes}
+	return set.Clear()
+}
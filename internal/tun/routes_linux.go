@@ -0,0 +1,76 @@
+package tun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// The way packets to dst go right now, as a route for dst which keeps them going that way
+func Bypass(dst netip.Prefix) (Route, error) {
+	found, err := netlink.RouteGet(net.IP(dst.Addr().AsSlice()))
+	if err != nil {
+		return Route{}, fmt.Errorf("tun: no route to %v: %v", dst.Addr(), err)
+	}
+	link, err := netlink.LinkByIndex(found[0].LinkIndex)
+	if err != nil {
+		return Route{}, fmt.Errorf("tun: route to %v: %v", dst.Addr(), err)
+	}
+	route := Route{Dst: dst, Dev: link.Attrs().Name}
+	if gw, ok := netip.AddrFromSlice(found[0].Gw); ok {
+		route.Gateway = gw.Unmap()
+	}
+	return route, nil
+}
+
+// Whether the route went in. A route to the same place already there is left as it is
+func addRoute(r Route) (bool, error) {
+	route, err := toNetlink(r)
+	if err != nil {
+		return false, err
+	}
+	err = netlink.RouteAdd(route)
+	if errors.Is(err, syscall.EEXIST) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("tun: adding route %v: %v", r, err)
+	}
+	return true, nil
+}
+
+// Routes which are gone already (with their interface, say) are no error
+func delRoute(r Route) error {
+	route, err := toNetlink(r)
+	var notFound netlink.LinkNotFoundError
+	if errors.As(err, &notFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = netlink.RouteDel(route)
+	if errors.Is(err, syscall.ESRCH) || errors.Is(err, syscall.ENODEV) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("tun: removing route %v: %v", r, err)
+	}
+	return nil
+}
+
+func toNetlink(r Route) (*netlink.Route, error) {
+	link, err := netlink.LinkByName(r.Dev)
+	if err != nil {
+		return nil, err
+	}
+	route := &netlink.Route{LinkIndex: link.Attrs().Index, Dst: prefixToIPNet(r.Dst)}
+	if r.Gateway.IsValid() {
+		route.Gw = net.IP(r.Gateway.AsSlice())
+	}
+	return route, nil
+}
@@ -0,0 +1,195 @@
+package tun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"custom_vpn/internal/wire"
+)
+
+/*
+	Server side of TUN mode. One device for the whole server, shared by every client.
+	Each client is attached under the addresses the pool leased it. Packets the kernel routes into the device
+	are handed to whichever client owns the destination. Packets from clients are checked (a client can only send
+	from its own addresses), then go straight to another client when they're addressed to one, or into the device
+	and the kernel takes it from there (out to the LAN, NATed or not, or to the server itself).
+*/
+type Switch struct {
+	dev  Device
+	pool *Pool
+
+	// pushed to every client along with its addresses
+	Routes []netip.Prefix
+	DNS    []netip.Addr
+	// lets clients reach each other. Off, they only see the server and what's behind it
+	ClientToClient bool
+	// who may bring a link up, checked by the QUIC server. Empty lets in anyone the listener does
+	Identities []string
+	// checked on every packet a client sends into the device, by its identity and destination. nil lets them all through
+	Policy func(identity string, dst netip.AddrPort) error
+
+	mu      sync.RWMutex
+	clients map[netip.Addr]*client
+}
+
+// An attached link
+type client struct {
+	send func(pkt []byte)
+	kick func()
+}
+
+func NewSwitch(dev Device, pool *Pool) *Switch {
+	return &Switch{
+		dev:     dev,
+		pool:    pool,
+		clients: make(map[netip.Addr]*client),
+	}
+}
+
+// A client's place on the switch, from Connect until Detach
+type Port struct {
+	// what the client was given, to send it
+	Lease wire.Lease
+
+	sw       *Switch
+	identity string
+	lease    Lease
+	c        *client
+	warned   atomic.Bool
+	denied   atomic.Bool
+}
+
+// Why Inject dropped a packet
+var (
+	ErrSpoofed  = errors.New("tun: source address isn't the client's")
+	ErrIsolated = errors.New("tun: client to client traffic is off")
+	ErrDenied   = errors.New("tun: denied by the policy")
+)
+
+/*
+	Leases the client its addresses and attaches it, so packets for them go to send (which mustn't hold on
+	to the packet after returning). Call Detach when the link ends.
+	A client which reconnects before we noticed its old connection die takes its addresses over, the old link gets kicked.
+*/
+func (s *Switch) Connect(identity, connKey string, send func(pkt []byte), kick func()) (*Port, error) {
+	lease, err := s.pool.Acquire(identity, connKey)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &client{send: send, kick: kick}
+	kicked := make(map[*client]bool)
+	s.mu.Lock()
+	for _, a := range lease.Addrs() {
+		if old := s.clients[a]; old != nil {
+			kicked[old] = true
+		}
+		s.clients[a] = c
+	}
+	s.mu.Unlock()
+	for old := range kicked {
+		old.kick()
+	}
+
+	port := &Port{sw: s, identity: identity, lease: lease, c: c}
+	port.Lease = wire.Lease{Routes: s.Routes, DNS: s.DNS}
+	for _, a := range lease.Addrs() {
+		bits := s.pool.v6.Bits()
+		if a.Is4() {
+			bits = s.pool.v4.Bits()
+		}
+		port.Lease.Addresses = append(port.Lease.Addresses, netip.PrefixFrom(a, bits))
+	}
+	return port, nil
+}
+
+func (p *Port) Detach() {
+	s := p.sw
+	s.mu.Lock()
+	for _, a := range p.lease.Addrs() {
+		if s.clients[a] == p.c {
+			delete(s.clients, a)
+		}
+	}
+	s.mu.Unlock()
+	s.pool.Release(p.lease)
+}
+
+/*
+	Takes a packet from the client. Anything not from one of its own addresses is dropped, so nobody can
+	pass as another client (or as the server, or a LAN host). The first spoofed packet of a port is logged.
+	Packets into the device go through the Policy first, the first one it denies is logged too.
+*/
+func (p *Port) Inject(pkt []byte) error {
+	src, dst, ok := Addrs(pkt)
+	if !ok {
+		return fmt.Errorf("tun: dropping %d bytes which aren't an IP packet", len(pkt))
+	}
+	if src.IsLinkLocalUnicast() || src.IsUnspecified() {
+		// the client's kernel talking to its own link (router solicitations, DAD), it goes no further
+		return nil
+	}
+	if src != p.lease.IPv4 && src != p.lease.IPv6 {
+		if !p.warned.Swap(true) {
+			logger.Warn("client sent a packet from an address it wasn't leased, dropping those", "identity", p.lease.Identity, "src", src, "addrs", p.lease.Addrs())
+		}
+		return ErrSpoofed
+	}
+
+	s := p.sw
+	s.mu.RLock()
+	peer := s.clients[dst]
+	s.mu.RUnlock()
+	if peer != nil {
+		if !s.ClientToClient && peer != p.c {
+			return ErrIsolated
+		}
+		peer.send(pkt)
+		return nil
+	}
+	if s.Policy != nil {
+		if err := s.Policy(p.identity, netip.AddrPortFrom(dst, DstPort(pkt))); err != nil {
+			if !p.denied.Swap(true) {
+				logger.Info("client sent a packet the policy doesn't allow, dropping those", "identity", p.identity, "err", err)
+			}
+			return ErrDenied
+		}
+	}
+	_, err := s.dev.Write(pkt)
+	return err
+}
+
+// Reads the device until ctx is cancelled (which closes it), routing each packet to its client
+func (s *Switch) Run(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		s.dev.Close()
+	}()
+	logger.Info("device up", "dev", s.dev.Name(), "prefixes", s.pool.Prefixes())
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := s.dev.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("tun: reading %s: %v", s.dev.Name(), err)
+		}
+		_, dst, ok := Addrs(buf[:n])
+		if !ok {
+			continue
+		}
+		s.mu.RLock()
+		c := s.clients[dst]
+		s.mu.RUnlock()
+		// nobody has that address (yet), same as an unanswered ARP on a LAN
+		if c != nil {
+			c.send(buf[:n])
+		}
+	}
+}
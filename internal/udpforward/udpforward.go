@@ -0,0 +1,237 @@
+package udpforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"custom_vpn/internal/helpers"
+	"custom_vpn/internal/logging"
+	"custom_vpn/internal/transport"
+	"custom_vpn/internal/wire"
+)
+
+/*
+	UDP forwards: a local UDP port bound to a udp service on the server (DNS, WireGuard, game servers, syslog).
+	UDP has no connections, so we make them up. Every local sender (address and port) gets its own flow,
+	and with it its own socket on the server, which is how replies find their way back to the right sender.
+	A flow nothing went through for IdleTimeout is closed. The server times out its end of quiet flows as well.
+	Flows open in the background, a sender's payloads queue up until its flow is there.
+	When the server won't give us one, new senders are turned away for a while (failures aren't errCh material, UDP is lossy anyway).
+*/
+var logger = logging.For("udp")
+
+type Forwarder struct {
+	Flows transport.FlowOpener
+	// Named service on the server, it has to be a udp one
+	Service     string
+	IdleTimeout time.Duration
+}
+
+// Flows which won't open
+const (
+	// payloads a sender can have waiting while its flow opens, past that they're dropped
+	maxQueued = 32
+	// after a flow failed to open, new senders' payloads are dropped for a while. Doubles up to maxBackoff
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+	// failures are logged this often at most, with a count of the ones in between
+	warnEvery = 10 * time.Second
+)
+
+// One local sender's flow
+type session struct {
+	// nil until the flow has opened, payloads queue up meanwhile
+	mu     sync.Mutex
+	flow   transport.Flow
+	queued [][]byte
+	// unix nanoseconds of the last payload either way
+	last atomic.Int64
+}
+
+func (s *session) touch() {
+	s.last.Store(time.Now().UnixNano())
+}
+
+// Sends payload down the flow, or queues it while the flow is still opening
+func (s *session) send(payload []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.flow != nil {
+		s.flow.Send(payload)
+	} else if len(s.queued) < maxQueued {
+		s.queued = append(s.queued, slices.Clone(payload))
+	}
+}
+
+// Hands the session its flow, and sends what queued up while it opened
+func (s *session) opened(flow transport.Flow) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flow = flow
+	for _, payload := range s.queued {
+		flow.Send(payload)
+	}
+	s.queued = nil
+}
+
+func (s *session) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.flow != nil {
+		s.flow.Close()
+	}
+}
+
+// Relays datagrams sent to addr until ctx is cancelled
+func (f *Forwarder) ListenAndServe(ctx context.Context, errCh chan<- error, wg *sync.WaitGroup, addr string) {
+	defer wg.Done()
+
+	local, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		errCh <- fmt.Errorf("UDP forward: %v", err)
+		return
+	}
+	sock, err := net.ListenUDP("udp", local)
+	if err != nil {
+		errCh <- fmt.Errorf("UDP forward: error creating listener: %v", err)
+		return
+	}
+	logger.Info("UDP forward listening", "addr", sock.LocalAddr().String(), "service", f.Service)
+	defer sock.Close()
+
+	wg.Add(1)
+	go helpers.CaptureCancel(ctx, wg, errCh, sock.LocalAddr().(*net.UDPAddr).Port, sock)
+
+	var mu sync.Mutex
+	sessions := make(map[netip.AddrPort]*session)
+	defer func() {
+		mu.Lock()
+		for _, s := range sessions {
+			s.close()
+		}
+		mu.Unlock()
+	}()
+	// flows failing to open, see failed
+	var backoff time.Duration
+	var retryAt, lastWarn time.Time
+	var unwarned int
+
+	go func() {
+		ticker := time.NewTicker(max(f.IdleTimeout/4, time.Second))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			mu.Lock()
+			for from, s := range sessions {
+				if time.Since(time.Unix(0, s.last.Load())) >= f.IdleTimeout {
+					logger.Info("flow idle, closing it", "from", from, "idle", f.IdleTimeout)
+					s.close()
+					delete(sessions, from)
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	// a flow didn't open: backs off, and says so every warnEvery at most. Called with mu held
+	failed := func(from netip.AddrPort, err error) {
+		backoff = min(max(2*backoff, minBackoff), maxBackoff)
+		retryAt = time.Now().Add(backoff)
+		if time.Since(lastWarn) < warnEvery {
+			unwarned++
+			return
+		}
+		logger.Warn("can't open a flow, dropping new senders' payloads for a while", "from", from, "service", f.Service, "retry_in", backoff, "failed_since_last_warning", unwarned, "err", err)
+		lastWarn, unwarned = time.Now(), 0
+	}
+	// opened in its own go-routine, so a slow server doesn't hold up the senders which have flows
+	open := func(from netip.AddrPort, s *session) {
+		flow, err := f.open(ctx, sock, from, s)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			if sessions[from] == s {
+				delete(sessions, from)
+			}
+			if ctx.Err() == nil {
+				failed(from, err)
+			}
+			return
+		}
+		backoff = 0
+		if sessions[from] != s {
+			// idled out (or shut down) while it opened
+			flow.Close()
+			return
+		}
+		s.opened(flow)
+		go func() {
+			<-flow.Done()
+			mu.Lock()
+			if sessions[from] == s {
+				delete(sessions, from)
+			}
+			mu.Unlock()
+		}()
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := sock.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		mu.Lock()
+		s := sessions[from]
+		if s == nil {
+			if time.Now().Before(retryAt) {
+				mu.Unlock()
+				continue
+			}
+			s = &session{}
+			s.touch()
+			sessions[from] = s
+			go open(from, s)
+		}
+		mu.Unlock()
+		s.touch()
+		// the flow going away is picked up above, the next payload from this sender opens a new one
+		s.send(buf[:n])
+	}
+}
+
+// Opens a flow for the sender at from, and relays the server's payloads on it back to the sender
+func (f *Forwarder) open(ctx context.Context, sock *net.UDPConn, from netip.AddrPort, s *session) (transport.Flow, error) {
+	flow, err := f.Flows.OpenFlow(ctx, wire.Header{Service: f.Service})
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("new flow", "from", from, "service", f.Service)
+
+	go func() {
+		defer flow.Close()
+		for {
+			payload, err := flow.Receive(ctx)
+			if err != nil {
+				return
+			}
+			s.touch()
+			sock.WriteToUDPAddrPort(payload, from)
+		}
+	}()
+	return flow, nil
+}
@@ -0,0 +1,61 @@
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/*
+	QUIC datagrams belonging to a UDP association.
+
+	Every datagram starts with the 4 byte flow ID the client put in the association's header.
+	For dynamic associations (SOCKS UDP ASSOCIATE, no fixed target) the payload starts with an address:
+		host length 1 byte
+		host        ip or hostname
+		port        2 bytes
+	followed by the UDP payload. For the client->server direction the address is the destination,
+	for server->client it's where the packet came from.
+*/
+
+const flowIDLen = 4
+
+var ErrShortDatagram = errors.New("wire: datagram too short")
+
+// Prepends the flow ID to payload
+func AppendDatagram(buf []byte, flowID uint32, payload []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, flowID)
+	return append(buf, payload...)
+}
+
+// Splits a datagram into its flow ID and payload
+func ParseDatagram(b []byte) (uint32, []byte, error) {
+	if len(b) < flowIDLen {
+		return 0, nil, ErrShortDatagram
+	}
+	return binary.BigEndian.Uint32(b), b[flowIDLen:], nil
+}
+
+// Appends an address in the format described above
+func AppendAddr(buf []byte, host string, port uint16) ([]byte, error) {
+	if len(host) == 0 || len(host) > 0xff {
+		return nil, fmt.Errorf("wire: host must be 1-255 bytes, got %d", len(host))
+	}
+	buf = append(buf, byte(len(host)))
+	buf = append(buf, host...)
+	return binary.BigEndian.AppendUint16(buf, port), nil
+}
+
+// Reads an address off the front of b, returning what's left
+func ParseAddr(b []byte) (string, uint16, []byte, error) {
+	if len(b) < 1 {
+		return "", 0, nil, ErrShortDatagram
+	}
+	n := int(b[0])
+	if n == 0 || len(b) < 1+n+2 {
+		return "", 0, nil, ErrShortDatagram
+	}
+	host := string(b[1 : 1+n])
+	port := binary.BigEndian.Uint16(b[1+n:])
+	return host, port, b[1+n+2:], nil
+}
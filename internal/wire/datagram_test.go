@@ -0,0 +1,88 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseDatagram(t *testing.T) {
+	tests := []struct {
+		name    string
+		dgram   []byte
+		id      uint32
+		payload []byte
+		err     error
+	}{
+		{name: "nothing", dgram: nil, err: ErrShortDatagram},
+		{name: "short flow id", dgram: []byte{0, 0, 1}, err: ErrShortDatagram},
+		{name: "no payload", dgram: []byte{0, 0, 0, 1}, id: 1, payload: []byte{}},
+		{name: "payload", dgram: []byte{0xff, 0, 0, 2, 'h', 'i'}, id: 0xff000002, payload: []byte("hi")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, payload, err := ParseDatagram(tt.dgram)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if id != tt.id || !bytes.Equal(payload, tt.payload) {
+				t.Errorf("got %d %q, want %d %q", id, payload, tt.id, tt.payload)
+			}
+		})
+	}
+}
+
+func TestDatagramRoundTrip(t *testing.T) {
+	dgram := AppendDatagram(nil, 42, []byte("payload"))
+	id, payload, err := ParseDatagram(dgram)
+	if err != nil || id != 42 || string(payload) != "payload" {
+		t.Errorf("got %d %q %v", id, payload, err)
+	}
+}
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		host string
+		port uint16
+		rest string
+		err  error
+	}{
+		{name: "nothing", b: nil, err: ErrShortDatagram},
+		{name: "empty host", b: []byte{0, 0, 53}, err: ErrShortDatagram},
+		{name: "host cut short", b: []byte{5, 'a', 'b'}, err: ErrShortDatagram},
+		{name: "no port", b: []byte{1, 'a'}, err: ErrShortDatagram},
+		{name: "half a port", b: []byte{1, 'a', 0}, err: ErrShortDatagram},
+		{name: "no payload", b: []byte{1, 'a', 0, 53}, host: "a", port: 53},
+		{name: "payload", b: append([]byte{7, '1', '.', '1', '.', '1', '.', '1', 0, 53}, "query"...), host: "1.1.1.1", port: 53, rest: "query"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, port, rest, err := ParseAddr(tt.b)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if host != tt.host || port != tt.port || string(rest) != tt.rest {
+				t.Errorf("got %q %d %q, want %q %d %q", host, port, rest, tt.host, tt.port, tt.rest)
+			}
+		})
+	}
+}
+
+func TestAppendAddr(t *testing.T) {
+	b, err := AppendAddr(nil, "example.com", 443)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, rest, err := ParseAddr(append(b, "data"...))
+	if err != nil || host != "example.com" || port != 443 || string(rest) != "data" {
+		t.Errorf("got %q %d %q %v", host, port, rest, err)
+	}
+	for _, host := range []string{"", strings.Repeat("a", 256)} {
+		if _, err := AppendAddr(nil, host, 53); err == nil {
+			t.Errorf("%d byte host: no error", len(host))
+		}
+	}
+}
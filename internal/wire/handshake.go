@@ -0,0 +1,25 @@
+package wire
+
+import "io"
+
+// Client side of the exchange: send the header, wait for the server's answer.
+// Returns a *RejectedError if the server said no
+func Handshake(rw io.ReadWriter, h Header) error {
+	if err := WriteHeader(rw, h); err != nil {
+		return err
+	}
+	resp, err := ReadResponse(rw)
+	if err != nil {
+		return err
+	}
+	return resp.Err()
+}
+
+/*
+	Client side of the auth exchange, done once per QUIC connection (on its first stream) or TCP conn (before the header).
+	Same framing as a tunnel header, with FlagAuth set and the token in AuthToken.
+	Returns a *RejectedError with StatusAuthFailed if the server didn't accept the token
+*/
+func Authenticate(rw io.ReadWriter, token string) error {
+	return Handshake(rw, Header{AuthToken: token, Flags: FlagAuth})
+}
@@ -0,0 +1,231 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+	The stream header protocol. Every tunnel stream starts with a header from the client,
+	and the server answers with a response frame before any data flows.
+
+	Header frame:
+		magic   4 bytes  "CVPN"
+		version 1 byte
+		length  2 bytes  total length of the fields that follow
+		fields  TLVs:    type (1 byte), length (2 bytes), value
+
+	Response frame:
+		magic   4 bytes  "CVPN"
+		version 1 byte
+		status  1 byte
+		length  2 bytes  length of the reason
+		reason  utf-8 string, may be empty
+
+	Everything is big endian. Unknown field types are skipped, so a newer client can send fields
+	an older server doesn't understand without breaking it. Bump Version when the framing itself changes.
+*/
+
+var Magic = [4]byte{'C', 'V', 'P', 'N'}
+
+const Version uint8 = 1
+
+// Caps how much a peer can make us buffer for a single header
+const MaxHeaderLen = 16 * 1024
+
+// Field types for the TLVs in a header
+type FieldType uint8
+
+const (
+	FieldService    FieldType = 0x01
+	FieldTargetHost FieldType = 0x02
+	FieldTargetPort FieldType = 0x03
+	FieldAuthToken  FieldType = 0x04
+	FieldFlags      FieldType = 0x05
+	FieldFlowID     FieldType = 0x06
+)
+
+// Bit flags carried in FieldFlags
+type Flags uint32
+
+const (
+	// The stream is the control stream of a UDP association, the data goes in QUIC datagrams (or on the stream, see packet.go)
+	FlagUDP Flags = 1 << 0
+	// Not a tunnel: the client is proving who it is, with AuthToken. First thing on a QUIC conn or TCP conn, see Authenticate()
+	FlagAuth Flags = 1 << 1
+	// The stream is the control stream of a layer 3 tunnel (TUN mode). The server follows its response with a Lease,
+	// then IP packets go in QUIC datagrams under FlowID, see wire/lease.go and wire/packet.go
+	FlagTUN Flags = 1 << 2
+	/*
+		A reverse forward (QUIC only). From the client: please listen on TargetPort and send me what connects,
+		the stream stays open for as long as the registration lasts.
+		From the server, on a stream it opened: a connection for the registration with FlowID, from TargetHost:TargetPort.
+		The client answers that one with a response too, then the stream carries the connection
+	*/
+	FlagReverse Flags = 1 << 3
+)
+
+// Everything the client tells the server about a stream
+type Header struct {
+	// name of a service in the server's registry
+	Service string
+	// destination for the server to dial, when no service is named (SOCKS, HTTP proxy)
+	TargetHost string
+	TargetPort uint16
+	AuthToken  string
+	Flags      Flags
+	// tags the datagrams of a UDP association (or a reverse forward's connections), picked by the client
+	FlowID uint32
+}
+
+var ErrBadMagic = errors.New("wire: bad magic, peer isn't speaking our protocol")
+
+// Error for a frame with a version newer than ours
+type VersionError struct {
+	Version uint8
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("wire: unsupported protocol version %d (we speak %d)", e.Version, Version)
+}
+
+// Serializes the header. Fields left at their zero value aren't sent
+func (h Header) MarshalBinary() ([]byte, error) {
+	var fields []byte
+	var err error
+	appendField := func(t FieldType, value []byte) {
+		if err != nil {
+			return
+		}
+		if len(value) > 0xffff {
+			err = fmt.Errorf("wire: field %#x too long (%d bytes)", t, len(value))
+			return
+		}
+		fields = append(fields, byte(t))
+		fields = binary.BigEndian.AppendUint16(fields, uint16(len(value)))
+		fields = append(fields, value...)
+	}
+
+	if h.Service != "" {
+		appendField(FieldService, []byte(h.Service))
+	}
+	if h.TargetHost != "" {
+		appendField(FieldTargetHost, []byte(h.TargetHost))
+	}
+	if h.TargetPort != 0 {
+		appendField(FieldTargetPort, binary.BigEndian.AppendUint16(nil, h.TargetPort))
+	}
+	if h.AuthToken != "" {
+		appendField(FieldAuthToken, []byte(h.AuthToken))
+	}
+	if h.Flags != 0 {
+		appendField(FieldFlags, binary.BigEndian.AppendUint32(nil, uint32(h.Flags)))
+	}
+	if h.FlowID != 0 {
+		appendField(FieldFlowID, binary.BigEndian.AppendUint32(nil, h.FlowID))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) > MaxHeaderLen {
+		return nil, fmt.Errorf("wire: header too long (%d bytes)", len(fields))
+	}
+
+	buf := make([]byte, 0, 7+len(fields))
+	buf = append(buf, Magic[:]...)
+	buf = append(buf, Version)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(fields)))
+	return append(buf, fields...), nil
+}
+
+// Parses the TLV section of a header
+func (h *Header) UnmarshalBinary(fields []byte) error {
+	for len(fields) > 0 {
+		if len(fields) < 3 {
+			return fmt.Errorf("wire: truncated field")
+		}
+		t := FieldType(fields[0])
+		n := int(binary.BigEndian.Uint16(fields[1:3]))
+		if len(fields) < 3+n {
+			return fmt.Errorf("wire: field %#x claims %d bytes, only %d left", t, n, len(fields)-3)
+		}
+		value := fields[3 : 3+n]
+		fields = fields[3+n:]
+
+		switch t {
+		case FieldService:
+			h.Service = string(value)
+		case FieldTargetHost:
+			h.TargetHost = string(value)
+		case FieldTargetPort:
+			if n != 2 {
+				return fmt.Errorf("wire: target port must be 2 bytes, got %d", n)
+			}
+			h.TargetPort = binary.BigEndian.Uint16(value)
+		case FieldAuthToken:
+			h.AuthToken = string(value)
+		case FieldFlags:
+			if n != 4 {
+				return fmt.Errorf("wire: flags must be 4 bytes, got %d", n)
+			}
+			h.Flags = Flags(binary.BigEndian.Uint32(value))
+		case FieldFlowID:
+			if n != 4 {
+				return fmt.Errorf("wire: flow id must be 4 bytes, got %d", n)
+			}
+			h.FlowID = binary.BigEndian.Uint32(value)
+		default:
+			// from a newer peer, not ours to worry about
+		}
+	}
+	return nil
+}
+
+// Writes the header to w in one write
+func WriteHeader(w io.Writer, h Header) error {
+	buf, err := h.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("wire: writing header: %v", err)
+	}
+	return nil
+}
+
+// Reads a header frame from r
+func ReadHeader(r io.Reader) (Header, error) {
+	var h Header
+	length, err := readPreamble(r, 2)
+	if err != nil {
+		return h, err
+	}
+	n := int(binary.BigEndian.Uint16(length))
+	if n > MaxHeaderLen {
+		return h, fmt.Errorf("wire: header too long (%d bytes)", n)
+	}
+	fields := make([]byte, n)
+	if _, err := io.ReadFull(r, fields); err != nil {
+		return h, fmt.Errorf("wire: reading header fields: %v", err)
+	}
+	err = h.UnmarshalBinary(fields)
+	return h, err
+}
+
+// Reads and checks magic + version, then returns the next n bytes
+func readPreamble(r io.Reader, n int) ([]byte, error) {
+	buf := make([]byte, 5+n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("wire: reading frame: %w", err)
+	}
+	if !bytes.Equal(buf[:4], Magic[:]) {
+		return nil, ErrBadMagic
+	}
+	if buf[4] > Version || buf[4] == 0 {
+		return nil, &VersionError{Version: buf[4]}
+	}
+	return buf[5:], nil
+}
@@ -0,0 +1,128 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	headers := []Header{
+		{},
+		{Service: "ssh"},
+		{TargetHost: "example.com", TargetPort: 443},
+		{AuthToken: "secret", Flags: FlagAuth},
+		{Service: "dns", Flags: FlagUDP, FlowID: 7},
+		{Flags: FlagTUN | FlagReverse, FlowID: 0xffffffff},
+	}
+	for _, want := range headers {
+		var buf bytes.Buffer
+		if err := WriteHeader(&buf, want); err != nil {
+			t.Fatalf("WriteHeader(%+v): %v", want, err)
+		}
+		got, err := ReadHeader(&buf)
+		if err != nil {
+			t.Fatalf("ReadHeader(%+v): %v", want, err)
+		}
+		if got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+// frame puts magic, version and length in front of fields
+func frame(version byte, length int, fields []byte) []byte {
+	buf := append(Magic[:], version)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(length))
+	return append(buf, fields...)
+}
+
+func TestReadHeaderBad(t *testing.T) {
+	portField := []byte{byte(FieldTargetPort), 0, 2, 0x01, 0xbb}
+	tests := []struct {
+		name  string
+		frame []byte
+		is    error
+		msg   string
+	}{
+		{name: "nothing", frame: nil, is: io.EOF},
+		{name: "half a preamble", frame: []byte("CVP"), is: io.ErrUnexpectedEOF},
+		{name: "no length", frame: append(Magic[:], Version), is: io.ErrUnexpectedEOF},
+		{name: "bad magic", frame: append([]byte("HTTP"), 1, 0, 0), is: ErrBadMagic},
+		{name: "version 0", frame: frame(0, 0, nil), msg: "unsupported protocol version 0"},
+		{name: "newer version", frame: frame(Version+1, 0, nil), msg: "unsupported protocol version 2"},
+		{name: "too long", frame: frame(Version, MaxHeaderLen+1, nil), msg: "header too long"},
+		{name: "fields cut short", frame: frame(Version, len(portField)+1, portField), msg: "reading header fields"},
+		{name: "field header cut short", frame: frame(Version, 2, []byte{byte(FieldService), 0}), msg: "truncated field"},
+		{name: "field value cut short", frame: frame(Version, 4, []byte{byte(FieldService), 0, 5, 'x'}), msg: "claims 5 bytes, only 1 left"},
+		{name: "short port", frame: frame(Version, 4, []byte{byte(FieldTargetPort), 0, 1, 0x01}), msg: "target port must be 2 bytes"},
+		{name: "long flags", frame: frame(Version, 8, []byte{byte(FieldFlags), 0, 5, 0, 0, 0, 0, 1}), msg: "flags must be 4 bytes"},
+		{name: "short flow id", frame: frame(Version, 5, []byte{byte(FieldFlowID), 0, 2, 0, 1}), msg: "flow id must be 4 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadHeader(bytes.NewReader(tt.frame))
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if tt.is != nil && !errors.Is(err, tt.is) {
+				t.Errorf("err = %v, want %v", err, tt.is)
+			}
+			if tt.msg != "" && !strings.Contains(err.Error(), tt.msg) {
+				t.Errorf("err = %v, want it to say %q", err, tt.msg)
+			}
+		})
+	}
+}
+
+func TestReadHeaderVersionError(t *testing.T) {
+	_, err := ReadHeader(bytes.NewReader(frame(Version+1, 0, nil)))
+	var versionErr *VersionError
+	if !errors.As(err, &versionErr) || versionErr.Version != Version+1 {
+		t.Errorf("err = %v, want a VersionError for %d", err, Version+1)
+	}
+}
+
+// A frame claiming more than MaxHeaderLen is refused before anything past the preamble is read
+func TestReadHeaderTooLongReadsNoFurther(t *testing.T) {
+	r := bytes.NewReader(append(frame(Version, 0xffff, nil), make([]byte, 100)...))
+	if _, err := ReadHeader(r); err == nil {
+		t.Fatal("no error")
+	}
+	if r.Len() != 100 {
+		t.Errorf("read %d bytes of the fields", 100-r.Len())
+	}
+}
+
+func TestReadHeaderSkipsUnknownFields(t *testing.T) {
+	fields := []byte{0x7f, 0, 3, 'a', 'b', 'c', byte(FieldService), 0, 3, 's', 's', 'h'}
+	h, err := ReadHeader(bytes.NewReader(frame(Version, len(fields), fields)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != (Header{Service: "ssh"}) {
+		t.Errorf("got %+v", h)
+	}
+}
+
+func TestMarshalTooLong(t *testing.T) {
+	tests := []struct {
+		name string
+		h    Header
+		msg  string
+	}{
+		{name: "one field", h: Header{AuthToken: strings.Repeat("x", 0x10000)}, msg: "field 0x4 too long"},
+		{name: "the whole header", h: Header{AuthToken: strings.Repeat("x", MaxHeaderLen)}, msg: "header too long"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.h.MarshalBinary()
+			if err == nil || !strings.Contains(err.Error(), tt.msg) {
+				t.Errorf("err = %v, want it to say %q", err, tt.msg)
+			}
+		})
+	}
+}
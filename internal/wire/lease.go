@@ -0,0 +1,113 @@
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+)
+
+/*
+	What the server hands a TUN client, right after the OK response on the link's control stream.
+	Same framing as a header: magic, version, 2 byte length, then TLVs. Every field can repeat.
+	Values are text (CIDRs, addresses), like TargetHost in the header.
+*/
+
+const (
+	// One of the client's tunnel addresses, with the tunnel's prefix length. One per address family
+	LeaseFieldAddress FieldType = 0x01
+	// A subnet to send through the tunnel
+	LeaseFieldRoute FieldType = 0x02
+	// A DNS server to use while the tunnel is up
+	LeaseFieldDNS FieldType = 0x03
+)
+
+type Lease struct {
+	Addresses []netip.Prefix
+	Routes    []netip.Prefix
+	DNS       []netip.Addr
+}
+
+func WriteLease(w io.Writer, l Lease) error {
+	var fields []byte
+	add := func(t FieldType, value string) {
+		fields = append(fields, byte(t))
+		fields = binary.BigEndian.AppendUint16(fields, uint16(len(value)))
+		fields = append(fields, value...)
+	}
+	for _, p := range l.Addresses {
+		add(LeaseFieldAddress, p.String())
+	}
+	for _, p := range l.Routes {
+		add(LeaseFieldRoute, p.String())
+	}
+	for _, a := range l.DNS {
+		add(LeaseFieldDNS, a.String())
+	}
+	if len(fields) > MaxHeaderLen {
+		return fmt.Errorf("wire: lease too long (%d bytes)", len(fields))
+	}
+
+	buf := make([]byte, 0, 7+len(fields))
+	buf = append(buf, Magic[:]...)
+	buf = append(buf, Version)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(fields)))
+	if _, err := w.Write(append(buf, fields...)); err != nil {
+		return fmt.Errorf("wire: writing lease: %v", err)
+	}
+	return nil
+}
+
+func ReadLease(r io.Reader) (Lease, error) {
+	var l Lease
+	length, err := readPreamble(r, 2)
+	if err != nil {
+		return l, err
+	}
+	n := int(binary.BigEndian.Uint16(length))
+	if n > MaxHeaderLen {
+		return l, fmt.Errorf("wire: lease too long (%d bytes)", n)
+	}
+	fields := make([]byte, n)
+	if _, err := io.ReadFull(r, fields); err != nil {
+		return l, fmt.Errorf("wire: reading lease: %v", err)
+	}
+
+	for len(fields) > 0 {
+		if len(fields) < 3 {
+			return l, fmt.Errorf("wire: truncated lease field")
+		}
+		t := FieldType(fields[0])
+		n := int(binary.BigEndian.Uint16(fields[1:3]))
+		if len(fields) < 3+n {
+			return l, fmt.Errorf("wire: lease field %#x claims %d bytes, only %d left", t, n, len(fields)-3)
+		}
+		value := string(fields[3 : 3+n])
+		fields = fields[3+n:]
+
+		switch t {
+		case LeaseFieldAddress, LeaseFieldRoute:
+			p, err := netip.ParsePrefix(value)
+			if err != nil {
+				return l, fmt.Errorf("wire: lease: %v", err)
+			}
+			if t == LeaseFieldAddress {
+				l.Addresses = append(l.Addresses, p)
+			} else {
+				l.Routes = append(l.Routes, p)
+			}
+		case LeaseFieldDNS:
+			a, err := netip.ParseAddr(value)
+			if err != nil {
+				return l, fmt.Errorf("wire: lease: %v", err)
+			}
+			l.DNS = append(l.DNS, a)
+		default:
+			// from a newer server
+		}
+	}
+	if len(l.Addresses) == 0 {
+		return l, fmt.Errorf("wire: lease without an address")
+	}
+	return l, nil
+}
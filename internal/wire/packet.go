@@ -0,0 +1,56 @@
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+/*
+	Payloads of a flow: IP packets of a layer 3 tunnel (FlagTUN), UDP payloads of an association (FlagUDP).
+	They ride in QUIC datagrams, the flow ID followed by the whole packet.
+	A packet too big for a datagram (a datagram has to fit in one QUIC packet, so roughly 1200 bytes)
+	goes on the flow's control stream instead, framed as:
+		length  2 bytes
+		packet  length bytes
+*/
+
+// Biggest IP packet there is, the total length field is 2 bytes
+const MaxPacketLen = 0xffff
+
+// Writes one framed packet to w in one write
+func WritePacket(w io.Writer, pkt []byte) error {
+	if len(pkt) == 0 || len(pkt) > MaxPacketLen {
+		return fmt.Errorf("wire: packet must be 1-%d bytes, got %d", MaxPacketLen, len(pkt))
+	}
+	buf := make([]byte, 0, 2+len(pkt))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(pkt)))
+	if _, err := w.Write(append(buf, pkt...)); err != nil {
+		return fmt.Errorf("wire: writing packet: %v", err)
+	}
+	return nil
+}
+
+// Reads one framed packet from r. Returns io.EOF when the stream ends between packets
+func ReadPacket(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("wire: reading packet: %w", err)
+	}
+	n := int(binary.BigEndian.Uint16(length[:]))
+	if n == 0 {
+		return nil, fmt.Errorf("wire: empty packet")
+	}
+	pkt := make([]byte, n)
+	if _, err := io.ReadFull(r, pkt); err != nil {
+		// the length came, so this is the stream ending mid-packet, not between packets
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("wire: reading packet: %w", err)
+	}
+	return pkt, nil
+}
@@ -0,0 +1,86 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	for _, size := range []int{1, 1200, MaxPacketLen} {
+		pkt := bytes.Repeat([]byte{0xab}, size)
+		var buf bytes.Buffer
+		if err := WritePacket(&buf, pkt); err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		got, err := ReadPacket(&buf)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, pkt) {
+			t.Errorf("%d bytes: got %d bytes back", size, len(got))
+		}
+	}
+}
+
+func TestWritePacketSize(t *testing.T) {
+	for _, size := range []int{0, MaxPacketLen + 1} {
+		if err := WritePacket(io.Discard, make([]byte, size)); err == nil {
+			t.Errorf("%d bytes: no error", size)
+		}
+	}
+}
+
+func TestReadPacketBad(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		is    error
+		msg   string
+	}{
+		// the stream ending between packets is how a flow closes
+		{name: "nothing", frame: nil, is: io.EOF},
+		{name: "half a length", frame: []byte{0}, is: io.ErrUnexpectedEOF},
+		{name: "empty", frame: []byte{0, 0}, msg: "empty packet"},
+		{name: "cut short", frame: []byte{0, 4, 1, 2, 3}, is: io.ErrUnexpectedEOF},
+		{name: "no body", frame: []byte{0xff, 0xff}, is: io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadPacket(bytes.NewReader(tt.frame))
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if tt.is != nil && !errors.Is(err, tt.is) {
+				t.Errorf("err = %v, want %v", err, tt.is)
+			}
+			if tt.is == io.EOF && err != io.EOF {
+				t.Errorf("err = %v, want a bare io.EOF", err)
+			}
+			if tt.msg != "" && !strings.Contains(err.Error(), tt.msg) {
+				t.Errorf("err = %v, want it to say %q", err, tt.msg)
+			}
+		})
+	}
+}
+
+// Packets back to back come off one at a time, and the stream ends cleanly after the last
+func TestReadPacketStream(t *testing.T) {
+	var buf bytes.Buffer
+	for _, pkt := range []string{"one", "two", "three"} {
+		if err := WritePacket(&buf, []byte(pkt)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"one", "two", "three"} {
+		got, err := ReadPacket(&buf)
+		if err != nil || string(got) != want {
+			t.Fatalf("got %q, %v, want %q", got, err, want)
+		}
+	}
+	if _, err := ReadPacket(&buf); err != io.EOF {
+		t.Errorf("after the last packet: %v, want io.EOF", err)
+	}
+}
@@ -0,0 +1,98 @@
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Status the server sends back after reading a header
+type Status uint8
+
+const (
+	StatusOK             Status = 0x00
+	StatusUnknownService Status = 0x01
+	StatusDialFailed     Status = 0x02
+	StatusUnauthorized   Status = 0x03
+	StatusBadRequest     Status = 0x04
+	StatusAuthFailed     Status = 0x05
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusUnknownService:
+		return "unknown service"
+	case StatusDialFailed:
+		return "dial failed"
+	case StatusUnauthorized:
+		return "unauthorized"
+	case StatusBadRequest:
+		return "bad request"
+	case StatusAuthFailed:
+		return "authentication failed"
+	}
+	return fmt.Sprintf("status(%#x)", uint8(s))
+}
+
+// Maximum reason length, the length prefix is 2 bytes
+const maxReasonLen = 0xffff
+
+// The server's answer to a header
+type Response struct {
+	Status Status
+	Reason string
+}
+
+// Error returned to the client when the server refuses a stream
+type RejectedError struct {
+	Status Status
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("server rejected stream: %v", e.Status)
+	}
+	return fmt.Sprintf("server rejected stream: %v: %s", e.Status, e.Reason)
+}
+
+// nil for StatusOK, a *RejectedError for anything else
+func (r Response) Err() error {
+	if r.Status == StatusOK {
+		return nil
+	}
+	return &RejectedError{Status: r.Status, Reason: r.Reason}
+}
+
+func WriteResponse(w io.Writer, resp Response) error {
+	reason := resp.Reason
+	if len(reason) > maxReasonLen {
+		reason = reason[:maxReasonLen]
+	}
+	buf := make([]byte, 0, 8+len(reason))
+	buf = append(buf, Magic[:]...)
+	buf = append(buf, Version, byte(resp.Status))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(reason)))
+	buf = append(buf, reason...)
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("wire: writing response: %v", err)
+	}
+	return nil
+}
+
+func ReadResponse(r io.Reader) (Response, error) {
+	var resp Response
+	rest, err := readPreamble(r, 3)
+	if err != nil {
+		return resp, err
+	}
+	resp.Status = Status(rest[0])
+	reason := make([]byte, binary.BigEndian.Uint16(rest[1:3]))
+	if _, err := io.ReadFull(r, reason); err != nil {
+		return resp, fmt.Errorf("wire: reading response reason: %v", err)
+	}
+	resp.Reason = string(reason)
+	return resp, nil
+}
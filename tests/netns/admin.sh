@@ -0,0 +1,204 @@
+#!/bin/bash
+
+# The admin API and `custom_vpn ctl`: live connections with their tunnels and byte counts, killing a tunnel and a connection,
+# a reload picking up a new service (and refusing a broken file), log levels, draining listeners, and the socket itself.
+# Run as root: sudo tests/netns/admin.sh
+
+source "$(dirname "$0")/lib.sh"
+
+build
+make_pki
+make_topology
+
+write_server_config() {
+  cat >"$WORK/server.yaml" <<YAML
+listeners:
+  tcp: {enabled: true, bind: 0.0.0.0, port: 9000}
+  tls: {enabled: false}
+  quic: {enabled: true, bind: 0.0.0.0, port: 9002}
+tls:
+  cert: $WORK/pki/server.pem
+  key: $WORK/pki/server.key
+auth:
+  tokens:
+    alice: alice-token-alice-token
+services:
+  echo: 172.31.0.2:3000
+$1
+sessions:
+  file: $WORK/sessions.jsonl
+admin:
+  socket: $WORK/run/admin.sock
+YAML
+}
+write_server_config ""
+
+cat >"$WORK/client.yaml" <<YAML
+server: 192.168.77.1
+tls:
+  ca: $WORK/pki/ca/ca.pem
+auth:
+  token: alice-token-alice-token
+forwards:
+  - {local: "127.0.0.1:2000", service: echo, transport: tcp}
+  - {local: "127.0.0.1:2002", service: echo, transport: quic}
+  - {local: "127.0.0.1:2003", service: echo2, transport: quic}
+YAML
+
+ctl() {
+  "$WORK/bin/custom_vpn" ctl -socket "$WORK/run/admin.sock" "$@"
+}
+
+# An echo server on port 3000
+start cvpn-lan echo python3 -c '
+import socket, threading
+s = socket.socket()
+s.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+s.bind(("172.31.0.2", 3000))
+s.listen()
+def serve(c):
+    while data := c.recv(65536):
+        c.sendall(data)
+    c.close()
+while True:
+    c, _ = s.accept()
+    threading.Thread(target=serve, args=(c,)).start()
+'
+
+# talk <port>, 1000 bytes through the tunnel and back
+talk() {
+  ip netns exec cvpn-cli python3 -c '
+import socket, sys
+s = socket.create_connection(("127.0.0.1", int(sys.argv[1])), timeout=5)
+s.sendall(b"x" * 1000)
+got = b""
+while len(got) < 1000:
+    chunk = s.recv(65536)
+    if not chunk:
+        sys.exit("closed after %d bytes" % len(got))
+    got += chunk
+' "$1"
+}
+
+# hold <name> <port> [pause], talks once and keeps the connection open. With a pause, talks again after it and then hangs up
+hold() {
+  start cvpn-cli "hold-$1" python3 -u -c '
+import socket, sys, time
+s = socket.create_connection(("127.0.0.1", int(sys.argv[1])), timeout=30)
+def echo():
+    s.sendall(b"x" * 1000)
+    got = 0
+    while got < 1000:
+        chunk = s.recv(65536)
+        if not chunk:
+            print("cut")
+            sys.exit()
+        got += len(chunk)
+echo()
+print("echoed")
+if len(sys.argv) > 2:
+    time.sleep(float(sys.argv[2]))
+    echo()
+    print("echoed again")
+    sys.exit()
+try:
+    while s.recv(65536):
+        pass
+except OSError:
+    pass
+print("cut")
+' "$2" ${3:+"$3"}
+}
+
+# has_record <field=value>..., whether some line of sessions.jsonl matches every field given
+has_record() {
+  python3 -c '
+import json, sys
+want = dict(arg.split("=", 1) for arg in sys.argv[2:])
+for line in open(sys.argv[1]):
+    rec = json.loads(line)
+    if all(str(rec.get(k)) == v for k, v in want.items()):
+        sys.exit(0)
+sys.exit("no record with " + str(want))
+' "$WORK/sessions.jsonl" "$@"
+}
+
+# conns_json <python expression on conns>, eg. the ID of the QUIC connection
+conns_json() {
+  ctl -json conns | python3 -c 'import json, sys; conns = json.load(sys.stdin); print('"$1"')'
+}
+export -f ctl talk conns_json
+export WORK
+
+start cvpn-srv server "$WORK/bin/server" -config "$WORK/server.yaml"
+SERVER_PID=${PIDS[-1]}
+wait_for 5 grep -q "msg=listening subsystem=quic .*port=9002" "$WORK/server.log"
+start cvpn-cli client "$WORK/bin/client" -config "$WORK/client.yaml"
+wait_for 5 grep -q "listener started.*addr=127.0.0.1:2003" "$WORK/client.log"
+
+check "the socket is the server's alone" bash -c "[ \$(stat -c %a '$WORK/run/admin.sock') = 600 ]"
+
+hold quic 2002
+hold tcp 2000
+wait_for 5 grep -q echoed "$WORK/hold-quic.log"
+wait_for 5 grep -q echoed "$WORK/hold-tcp.log"
+check "ctl lists the QUIC connection" bash -c "ctl conns | grep -E ' quic +192.168.77.2:[0-9]+ +alice +1 '"
+check "and the TCP one" bash -c "ctl conns | grep -E ' tcp +192.168.77.2:[0-9]+ +alice +1 '"
+QUIC_ID=$(conns_json '[c["conn_id"] for c in conns if c["transport"] == "quic"][0]')
+TCP_ID=$(conns_json '[c["conn_id"] for c in conns if c["transport"] == "tcp"][0]')
+STREAM=$(conns_json '[c["tunnels"][0]["stream_id"] for c in conns if c["transport"] == "quic"][0]')
+check "with the bytes of tunnels still open" bash -c "[ \"\$(conns_json '[(t[\"service\"], t[\"bytes_from_client\"], t[\"bytes_to_client\"]) for c in conns for t in c[\"tunnels\"]]')\" = \"[('echo', 1000, 1000), ('echo', 1000, 1000)]\" ]"
+check "a prefix of the ID does" bash -c "ctl conn ${QUIC_ID:0:8} | grep -E '^$STREAM +tcp +echo +172.31.0.2:3000 '"
+check "an unknown ID is a 404" bash -c "ctl conn nope 2>&1 | grep -q 'no connection nope'"
+
+check "killing a tunnel" ctl kill "${QUIC_ID:0:8}" "$STREAM"
+check "cuts it" wait_for 5 grep -q cut "$WORK/hold-quic.log"
+check "and says so in its record" wait_for 5 has_record transport=quic stream_id="$STREAM" close_reason="killed by an admin"
+check "the connection stays up" bash -c "ctl conn $QUIC_ID | grep -q 'bytes:     1000B in, 1000B out'"
+check "and takes new tunnels" talk 2002
+
+check "killing a TCP connection" ctl kill "$TCP_ID"
+check "cuts its tunnel" wait_for 5 grep -q cut "$WORK/hold-tcp.log"
+check "which is recorded" wait_for 5 has_record transport=tcp conn_id="$TCP_ID" close_reason="killed by an admin"
+check "and it's gone" wait_for 5 fails ctl conn "$TCP_ID"
+
+check "a service that isn't there yet" fails talk 2003
+write_server_config "  echo2: 172.31.0.2:3000"
+check "reload" bash -c "ctl reload | grep -q 'reloaded certs, services, virtual_hosts, log_levels'"
+check "picks it up" talk 2003
+echo "bogus: true" >>"$WORK/server.yaml"
+check "a broken file isn't reloaded" bash -c "ctl reload 2>&1 | grep -q 'field bogus not found'"
+check "and changes nothing" talk 2003
+write_server_config "  echo2: 172.31.0.2:3000"
+
+check "log levels" bash -c "ctl log-level | grep -E '^quic +INFO'"
+check "can be turned up" bash -c "ctl log-level quic debug | grep -E '^quic +DEBUG'"
+talk 2002
+check "and the server logs debug lines" grep -q 'msg="stream accepted" subsystem=quic' "$WORK/server.log"
+check "a level has to be a level" bash -c "ctl log-level quic loud 2>&1 | grep -q 'unknown log level'"
+
+hold slow 2000 3
+wait_for 5 grep -q echoed "$WORK/hold-slow.log"
+check "draining the TCP listener" bash -c "ctl drain tcp | grep -q 'tcp isn.t accepting anymore, 1 connections still open on it'"
+check "stops new connections" wait_for 5 fails talk 2000
+check "but not the ones it has" wait_for 5 grep -q "echoed again" "$WORK/hold-slow.log"
+check "the server logs it" grep -q 'msg="drained, not accepting anymore" subsystem=tcp port=9000' "$WORK/server.log"
+
+check "draining the QUIC listener" ctl drain quic
+check "shows it draining, with its connection" bash -c "ctl listeners | grep -E '^quic +0.0.0.0:9002 +draining +1$'"
+check "which still takes new tunnels" talk 2002
+
+hold quic2 2002
+wait_for 5 grep -q echoed "$WORK/hold-quic2.log"
+check "killing the QUIC connection" ctl kill "$QUIC_ID"
+check "cuts the tunnels on it" wait_for 5 grep -q cut "$WORK/hold-quic2.log"
+check "which are recorded" wait_for 5 has_record transport=quic conn_id="$QUIC_ID" close_reason="connection killed by an admin"
+check "a drained listener goes once its connections have" wait_for 5 grep -q "drained listener's connections are all closed" "$WORK/server.log"
+check "ctl shows the last sessions" bash -c "ctl sessions 3 | grep -q 'connection killed by an admin'"
+
+kill -TERM "$SERVER_PID"
+wait "$SERVER_PID" || true
+check "the socket goes with the server" test ! -e "$WORK/run/admin.sock"
+check "ctl says when there's no server" bash -c "ctl conns 2>&1 | grep -q \"can't reach the admin API\""
+
+finish
@@ -0,0 +1,195 @@
+#!/bin/bash
+
+# Shutting the server down drains it: tunnels running get to finish, QUIC clients are told to go away (and come back
+# once the server's restarted), and what's still running at the drain deadline is cut and counted.
+# Run as root: sudo tests/netns/drain.sh
+
+source "$(dirname "$0")/lib.sh"
+
+build
+make_pki
+make_topology
+
+# write_server_config <drain_timeout>
+write_server_config() {
+  cat >"$WORK/server.yaml" <<YAML
+listeners:
+  tcp: {enabled: true, bind: 0.0.0.0, port: 9000}
+  tls: {enabled: false}
+  quic: {enabled: true, bind: 0.0.0.0, port: 9002}
+tls:
+  cert: $WORK/pki/server.pem
+  key: $WORK/pki/server.key
+services:
+  echo: 172.31.0.2:3000
+drain_timeout: $1
+sessions:
+  file: $WORK/sessions.jsonl
+YAML
+}
+
+cat >"$WORK/client.yaml" <<YAML
+server: 192.168.77.1
+tls:
+  ca: $WORK/pki/ca/ca.pem
+forwards:
+  - {local: "127.0.0.1:2000", service: echo, transport: tcp}
+  - {local: "127.0.0.1:2002", service: echo, transport: quic}
+YAML
+
+# An echo server on port 3000
+start cvpn-lan echo python3 -c '
+import socket, threading
+s = socket.socket()
+s.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+s.bind(("172.31.0.2", 3000))
+s.listen()
+def serve(c):
+    while data := c.recv(65536):
+        c.sendall(data)
+    c.close()
+while True:
+    c, _ = s.accept()
+    threading.Thread(target=serve, args=(c,)).start()
+'
+
+# hold <name> <port> [pause], talks once and keeps the connection open. With a pause, talks again after it and then hangs up
+hold() {
+  start cvpn-cli "hold-$1" python3 -u -c '
+import socket, sys, time
+s = socket.create_connection(("127.0.0.1", int(sys.argv[1])), timeout=30)
+def echo():
+    s.sendall(b"x" * 1000)
+    got = 0
+    while got < 1000:
+        chunk = s.recv(65536)
+        if not chunk:
+            print("cut")
+            sys.exit()
+        got += len(chunk)
+echo()
+print("echoed")
+if len(sys.argv) > 2:
+    time.sleep(float(sys.argv[2]))
+    echo()
+    print("echoed again")
+    sys.exit()
+try:
+    while s.recv(65536):
+        pass
+except OSError:
+    pass
+print("cut")
+' "$2" ${3:+"$3"}
+}
+
+# talk <port>, 1000 bytes through the tunnel and back
+talk() {
+  ip netns exec cvpn-cli python3 -c '
+import socket, sys
+s = socket.create_connection(("127.0.0.1", int(sys.argv[1])), timeout=5)
+s.sendall(b"x" * 1000)
+got = b""
+while len(got) < 1000:
+    chunk = s.recv(65536)
+    if not chunk:
+        sys.exit("closed after %d bytes" % len(got))
+    got += chunk
+' "$1"
+}
+
+# has_record <field=value>..., whether some line of sessions.jsonl matches every field given
+has_record() {
+  python3 -c '
+import json, sys
+want = dict(arg.split("=", 1) for arg in sys.argv[2:])
+for line in open(sys.argv[1]):
+    rec = json.loads(line)
+    if all(str(rec.get(k)) == v for k, v in want.items()):
+        sys.exit(0)
+sys.exit("no record with " + str(want))
+' "$WORK/sessions.jsonl" "$@"
+}
+
+# start_server <name>, and waits for it to listen
+start_server() {
+  start cvpn-srv "$1" "$WORK/bin/server" -config "$WORK/server.yaml"
+  SERVER_PID=${PIDS[-1]}
+  wait_for 5 grep -q "msg=listening subsystem=quic .*port=9002" "$WORK/$1.log"
+}
+
+# stop_server, SIGTERM and wait for it. SECONDS is how long that took
+stop_server() {
+  kill -TERM "$SERVER_PID"
+  SECONDS=0
+  wait "$SERVER_PID" || true
+}
+
+alive() {
+  kill -0 "$SERVER_PID" 2>/dev/null
+}
+
+write_server_config 10s
+start_server server1
+start cvpn-cli client "$WORK/bin/client" -config "$WORK/client.yaml"
+wait_for 5 grep -q "listener started.*addr=127.0.0.1:2002" "$WORK/client.log"
+
+# tunnels that finish on their own, well inside the deadline
+hold tcp 2000 3
+hold quic 2002 3
+wait_for 5 grep -q echoed "$WORK/hold-tcp.log"
+wait_for 5 grep -q echoed "$WORK/hold-quic.log"
+kill -TERM "$SERVER_PID"
+SECONDS=0
+check "a shutdown drains the connections" wait_for 2 grep -q 'msg="draining connections" subsystem=server conns=2 timeout=10s' "$WORK/server1.log"
+check "new TCP connections are refused" fails talk 2000
+check "the server waits for the tunnels" alive
+# the QUIC connection is busy, so it's still up: a new stream on it is refused, and the client takes it elsewhere
+start cvpn-cli late python3 -u -c '
+import socket
+s = socket.create_connection(("127.0.0.1", 2002), timeout=30)
+s.sendall(b"x" * 1000)
+got = 0
+while got < 1000:
+    chunk = s.recv(65536)
+    if not chunk:
+        break
+    got += len(chunk)
+print("echoed" if got == 1000 else "closed after %d bytes" % got)
+'
+check "a new stream on a leaving connection goes on a new one" wait_for 3 grep -q "server is going away, new streams go on a new connection" "$WORK/client.log"
+check "the TCP tunnel finishes" wait_for 5 grep -q "echoed again" "$WORK/hold-tcp.log"
+check "and the QUIC one" wait_for 5 grep -q "echoed again" "$WORK/hold-quic.log"
+check "then the QUIC connection is told to go away" wait_for 3 grep -q "server is going away, will redial on next request" "$WORK/client.log"
+check "nothing was cut" wait_for 3 grep -q 'msg="connections drained" subsystem=server' "$WORK/server1.log"
+wait "$SERVER_PID" || true
+check "and the server's gone well before the deadline" test "$SECONDS" -lt 8
+check "the tunnels' records say they closed" has_record transport=quic kind=tcp close_reason=closed
+check "both of them" has_record transport=tcp close_reason=closed
+
+start_server server2
+check "the client reconnects to the restarted server" wait_for 15 grep -q echoed "$WORK/late.log"
+
+# an idle connection goes away straight off
+stop_server
+check "with nothing running the server doesn't wait" test "$SECONDS" -lt 3
+check "the idle connection is told to go away too" bash -c "[ \$(grep -c 'server is going away, will redial on next request' '$WORK/client.log') = 2 ]"
+
+# and tunnels which don't finish are cut at the deadline
+write_server_config 2s
+start_server server3
+hold tcp-stuck 2000
+hold quic-stuck 2002
+wait_for 5 grep -q echoed "$WORK/hold-tcp-stuck.log"
+wait_for 5 grep -q echoed "$WORK/hold-quic-stuck.log"
+stop_server
+check "the server waits for the deadline" test "$SECONDS" -ge 2
+check "and no longer" test "$SECONDS" -lt 5
+check "it says what it cut" grep -q 'msg="drain timeout passed, cut what was still running" subsystem=server tunnels=2 conns=2' "$WORK/server3.log"
+check "the TCP tunnel is cut" wait_for 3 grep -q cut "$WORK/hold-tcp-stuck.log"
+check "and the QUIC one" wait_for 3 grep -q cut "$WORK/hold-quic-stuck.log"
+check "the TCP record says so" has_record transport=tcp close_reason="cut at shutdown"
+check "and the QUIC one" has_record transport=quic close_reason="connection cut at shutdown"
+check "the client logs the close code" grep -q "connection closed.*0x45" "$WORK/client.log"
+
+finish
@@ -0,0 +1,171 @@
+#!/bin/bash
+
+# Shared bits for the network namespace tests. Source it, don't run it.
+# Needs root (or CAP_NET_ADMIN + CAP_SYS_ADMIN), iproute2, python3 and a Go toolchain. No outside network is used.
+#
+# Topology, every box is its own namespace:
+#
+#   cvpn-cli (192.168.77.2) --- (192.168.77.1) cvpn-srv (172.31.0.1) --- (172.31.0.2) cvpn-lan
+#   cvpn-cli2 (192.168.78.2) --- (192.168.78.1) cvpn-srv, with make_client2
+#
+# the client reaches the server on the "internet" side, the LAN sits behind the server
+
+set -euo pipefail
+
+REPO="$(cd "$(dirname "${BASH_SOURCE[0]}")/../.." && pwd)"
+WORK="$(mktemp -d /tmp/cvpn-netns.XXXXXX)"
+PIDS=()
+FAILED=0
+
+cleanup() {
+  for pid in "${PIDS[@]}"; do
+    kill "$pid" 2>/dev/null || true
+  done
+  wait 2>/dev/null || true
+  for ns in cvpn-cli cvpn-cli2 cvpn-srv cvpn-lan; do
+    ip netns del "$ns" 2>/dev/null || true
+    rm -rf "/etc/netns/$ns"
+  done
+  if [ "$FAILED" -ne 0 ]; then
+    echo "logs left in $WORK"
+  else
+    rm -rf "$WORK"
+  fi
+}
+trap cleanup EXIT
+
+build() {
+  (cd "$REPO" && go build -o "$WORK/bin/" ./cmd/...)
+}
+
+# A throwaway CA, and a server cert valid for the server's "internet" address
+make_pki() {
+  "$WORK/bin/custom_vpn" pki init -dir "$WORK/pki" >/dev/null
+  "$WORK/bin/custom_vpn" pki issue-server -dir "$WORK/pki" -ip 192.168.77.1 >/dev/null
+}
+
+make_topology() {
+  for ns in cvpn-cli cvpn-srv cvpn-lan; do
+    ip netns del "$ns" 2>/dev/null || true
+    ip netns add "$ns"
+    ip -n "$ns" link set lo up
+  done
+
+  ip link add c0 netns cvpn-cli type veth peer name s0 netns cvpn-srv
+  ip -n cvpn-cli addr add 192.168.77.2/24 dev c0
+  ip -n cvpn-srv addr add 192.168.77.1/24 dev s0
+  ip -n cvpn-cli link set c0 up
+  ip -n cvpn-srv link set s0 up
+
+  ip link add s1 netns cvpn-srv type veth peer name l0 netns cvpn-lan
+  ip -n cvpn-srv addr add 172.31.0.1/24 dev s1
+  ip -n cvpn-lan addr add 172.31.0.2/24 dev l0
+  ip -n cvpn-srv link set s1 up
+  ip -n cvpn-lan link set l0 up
+  # the server is the LAN's router, so replies to tunnel addresses find their way back
+  ip -n cvpn-lan route add default via 172.31.0.1
+
+  ip netns exec cvpn-srv sysctl -qw net.ipv4.ip_forward=1 net.ipv6.conf.all.forwarding=1
+}
+
+# A second client box, cvpn-cli2 (192.168.78.2), which reaches the server's "internet" address through its default route
+make_client2() {
+  ip netns del cvpn-cli2 2>/dev/null || true
+  ip netns add cvpn-cli2
+  ip -n cvpn-cli2 link set lo up
+  ip link add c1 netns cvpn-cli2 type veth peer name s2 netns cvpn-srv
+  ip -n cvpn-cli2 addr add 192.168.78.2/24 dev c1
+  ip -n cvpn-srv addr add 192.168.78.1/24 dev s2
+  ip -n cvpn-cli2 link set c1 up
+  ip -n cvpn-srv link set s2 up
+  ip -n cvpn-cli2 route add default via 192.168.78.1
+}
+
+# start <ns> <log name> <cmd...>, in the background
+start() {
+  local ns="$1" name="$2"
+  shift 2
+  ip netns exec "$ns" "$@" >"$WORK/$name.log" 2>&1 &
+  PIDS+=($!)
+}
+
+# has_addr <ns> <dev> <addr>
+has_addr() {
+  ip -n "$1" addr show dev "$2" | grep -w "inet6\? $3/[0-9]*" >/dev/null
+}
+
+# wait_for <seconds> <cmd...>, until cmd succeeds
+wait_for() {
+  local tries=$(($1 * 10))
+  shift
+  for _ in $(seq "$tries"); do
+    if "$@" >/dev/null 2>&1; then
+      return 0
+    fi
+    sleep 0.1
+  done
+  return 1
+}
+
+# udp_echo_server <ns> <addr>, echoes datagrams on port 7
+udp_echo_server() {
+  start "$1" "echo-$2" python3 -c '
+import socket, sys
+s = socket.socket(socket.AF_INET6 if ":" in sys.argv[1] else socket.AF_INET, socket.SOCK_DGRAM)
+s.bind((sys.argv[1], 7))
+while True:
+    data, peer = s.recvfrom(65535)
+    s.sendto(data, peer)
+' "$2"
+}
+
+# udp_echo <ns> <addr> <size> [port], sends size random bytes to addr's echo port (7) and checks they come back
+udp_echo() {
+  ip netns exec "$1" python3 -c '
+import os, socket, sys
+s = socket.socket(socket.AF_INET6 if ":" in sys.argv[1] else socket.AF_INET, socket.SOCK_DGRAM)
+s.settimeout(2)
+data = os.urandom(int(sys.argv[2]))
+for _ in range(3):
+    s.sendto(data, (sys.argv[1], int(sys.argv[3])))
+    try:
+        got, _ = s.recvfrom(65535)
+    except socket.timeout:
+        continue
+    sys.exit(0 if got == data else "echo came back different")
+sys.exit("no echo")
+' "$2" "$3" "${4:-7}"
+}
+
+# goes_via <ns> <addr> <dev>, whether the kernel sends packets for addr out of dev
+goes_via() {
+  ip -n "$1" route get "$2" | grep -w "dev $3" >/dev/null
+}
+
+# fails <cmd...>, for checks which pass when cmd doesn't
+fails() {
+  ! "$@"
+}
+
+check() {
+  local name="$1"
+  shift
+  if "$@" >"$WORK/check.out" 2>&1; then
+    echo "ok   $name"
+  else
+    echo "FAIL $name"
+    sed 's/^/     /' "$WORK/check.out"
+    FAILED=1
+  fi
+}
+
+finish() {
+  if [ "$FAILED" -ne 0 ]; then
+    for log in "$WORK"/*.log; do
+      echo "--- $log"
+      tail -n 20 "$log"
+    done
+    exit 1
+  fi
+  echo "all passed"
+}
@@ -0,0 +1,107 @@
+#!/bin/bash
+
+# Structured logging: JSON lines on the server, every line about a tunnel carrying its connection's attributes,
+# a subsystem turned up to debug with a SIGHUP, and a clean shutdown that doesn't log errors.
+# Run as root: sudo tests/netns/logging.sh
+
+source "$(dirname "$0")/lib.sh"
+
+build
+make_pki
+make_topology
+
+write_server_config() {
+  cat >"$WORK/server.yaml" <<YAML
+listeners:
+  tcp: {enabled: true, bind: 0.0.0.0, port: 9000}
+  tls: {enabled: false}
+  quic: {enabled: true, bind: 0.0.0.0, port: 9002}
+tls:
+  cert: $WORK/pki/server.pem
+  key: $WORK/pki/server.key
+services:
+  web: 172.31.0.2:8080
+logging:
+  format: json
+  subsystems: {$1}
+YAML
+}
+write_server_config ""
+
+cat >"$WORK/client.yaml" <<YAML
+server: 192.168.77.1
+tls:
+  ca: $WORK/pki/ca/ca.pem
+forwards:
+  - {local: "127.0.0.1:2002", service: web, transport: quic}
+  - {local: "127.0.0.1:2000", service: web, transport: tcp}
+YAML
+
+# has_line <log> <key=value...>, whether a JSON line of the log has all of those (values compared as strings)
+has_line() {
+  python3 - "$@" <<'PY'
+import json, sys
+want = dict(kv.split("=", 1) for kv in sys.argv[2:])
+for line in open(sys.argv[1]):
+    rec = json.loads(line)
+    if all(str(rec.get(k)) == v for k, v in want.items()):
+        sys.exit(0)
+sys.exit(1)
+PY
+}
+
+# same_conn <log> <msg> <msg>, whether some connection logged both
+same_conn() {
+  python3 - "$@" <<'PY'
+import json, sys
+conns = {}
+for line in open(sys.argv[1]):
+    rec = json.loads(line)
+    conns.setdefault(rec.get("msg"), set()).add(rec.get("conn_id"))
+sys.exit(0 if conns.get(sys.argv[2], set()) & conns.get(sys.argv[3], set()) - {None} else 1)
+PY
+}
+
+fetch() {
+  ip netns exec cvpn-cli curl -sf --max-time 10 "http://127.0.0.1:$1/hello" >/dev/null
+}
+
+start cvpn-lan web python3 -m http.server --bind 172.31.0.2 8080 --directory "$WORK"
+echo hello >"$WORK/hello"
+start cvpn-srv server "$WORK/bin/server" -config "$WORK/server.yaml"
+SERVER_PID=${PIDS[-1]}
+wait_for 5 has_line "$WORK/server.log" msg=listening subsystem=quic port=9002
+start cvpn-cli client "$WORK/bin/client" -config "$WORK/client.yaml"
+CLIENT_PID=${PIDS[-1]}
+wait_for 5 grep -q "listener started.*addr=127.0.0.1:2000" "$WORK/client.log"
+
+check "a tunnel over QUIC" fetch 2002
+check "the server logs JSON lines" python3 -c "import json, sys; [json.loads(l) for l in open(sys.argv[1])]" "$WORK/server.log"
+check "with the stream's attributes" has_line "$WORK/server.log" msg="tunnel open" subsystem=quic transport=quic listener=0.0.0.0:9002 stream=0 service=web target=172.31.0.2:8080
+check "and the client's address" grep -q '"msg":"tunnel open".*"transport":"quic".*"client":"192.168.77.2:[0-9]*"' "$WORK/server.log"
+check "one conn ID from accept to tunnel" same_conn "$WORK/server.log" "connection accepted" "tunnel open"
+check "a tunnel over TCP" fetch 2000
+check "gets a conn ID too" same_conn "$WORK/server.log" "connection accepted" "tunnel open"
+check "and says which listener" has_line "$WORK/server.log" msg="tunnel open" subsystem=tcp transport=tcp listener=192.168.77.1:9000 service=web
+check "debug lines are off by default" fails has_line "$WORK/server.log" msg="stream accepted"
+
+write_server_config "quic: debug"
+kill -HUP "$SERVER_PID"
+check "SIGHUP reloads the levels" wait_for 5 has_line "$WORK/server.log" msg="log levels reloaded"
+fetch 2002
+check "and the turned up subsystem logs debug lines" has_line "$WORK/server.log" msg="stream accepted" level=DEBUG subsystem=quic transport=quic
+sed -i 's/quic: debug/quic: loud/' "$WORK/server.yaml"
+kill -HUP "$SERVER_PID"
+check "a bad level is refused" wait_for 5 grep -q "keeping the old levels" "$WORK/server.log"
+
+kill -TERM "$CLIENT_PID"
+wait "$CLIENT_PID" || true
+check "stopping the client isn't an error" fails grep -q "level=ERROR" "$WORK/client.log"
+check "it says its listeners closed" grep -q 'msg="listener closed, shutting down" port=2000' "$WORK/client.log"
+kill -TERM "$SERVER_PID"
+wait "$SERVER_PID" || true
+# the bad level is the one error it had
+check "nor is stopping the server" bash -c "[ \$(grep -c '\"level\":\"ERROR\"' '$WORK/server.log') -eq 1 ]"
+check "which logs its last line" has_line "$WORK/server.log" msg="all servers closed, exiting"
+
+finish
@@ -0,0 +1,127 @@
+#!/bin/bash
+
+# Prometheus metrics: the server's and client's /metrics move when tunnels are opened, backends fail,
+# clients get turned away at the handshake and the client reconnects.
+# Run as root: sudo tests/netns/metrics.sh
+
+source "$(dirname "$0")/lib.sh"
+
+build
+make_pki
+make_topology
+
+cat >"$WORK/server.yaml" <<YAML
+listeners:
+  tcp: {enabled: false}
+  tls: {enabled: true, bind: 0.0.0.0, port: 9001}
+  quic: {enabled: true, bind: 0.0.0.0, port: 9002}
+tls:
+  cert: $WORK/pki/server.pem
+  key: $WORK/pki/server.key
+auth:
+  tokens:
+    alice: alice-token-alice-token
+services:
+  web: 172.31.0.2:8080
+  # nothing listens there
+  gone: 172.31.0.2:8081
+metrics:
+  listen: 172.31.0.1:9100
+YAML
+
+# client_conf <token> <ca>
+client_conf() {
+  cat <<YAML
+server: 192.168.77.1
+tls:
+  ca: $2
+auth:
+  token: $1
+forwards:
+  - {local: "127.0.0.1:2001", service: web, transport: tls}
+  - {local: "127.0.0.1:2002", service: web, transport: quic}
+  - {local: "127.0.0.1:2003", service: gone, transport: quic}
+  - {local: "127.0.0.1:2004", service: nope, transport: quic}
+YAML
+}
+client_conf alice-token-alice-token "$WORK/pki/ca/ca.pem" >"$WORK/alice.yaml"
+client_conf wrong-token-wrong-token "$WORK/pki/ca/ca.pem" >"$WORK/wrong-token.yaml"
+# a CA that didn't sign the server's cert, so the client walks away mid handshake
+"$WORK/bin/custom_vpn" pki init -dir "$WORK/other-pki" >/dev/null
+client_conf alice-token-alice-token "$WORK/other-pki/ca/ca.pem" >"$WORK/wrong-ca.yaml"
+
+# metric <ns> <url> <name{labels}>, prints the value of one series
+metric() {
+  ip netns exec "$1" curl -sf --max-time 5 "$2" | awk -v series="$3" '$1 == series {print $2}'
+}
+server_metric() {
+  metric cvpn-lan http://172.31.0.1:9100/metrics "$1"
+}
+client_metric() {
+  metric cvpn-cli http://127.0.0.1:9101/metrics "$1"
+}
+export -f metric server_metric client_metric fails
+
+# is <expected> <cmd...>, whether cmd prints expected
+is() {
+  local want="$1"
+  shift
+  [ "$("$@")" = "$want" ]
+}
+
+start cvpn-lan web python3 -m http.server --bind 172.31.0.2 8080 --directory "$WORK"
+head -c 100000 /dev/urandom >"$WORK/blob"
+start cvpn-srv server "$WORK/bin/server" -config "$WORK/server.yaml"
+SERVER_PID=${PIDS[-1]}
+wait_for 5 grep -q "msg=listening subsystem=quic .*port=9002" "$WORK/server.log"
+start cvpn-cli alice "$WORK/bin/client" -config "$WORK/alice.yaml" -metrics 127.0.0.1:9101
+ALICE_PID=${PIDS[-1]}
+wait_for 5 grep -q "listener started.*addr=127.0.0.1:2004" "$WORK/alice.log"
+
+fetch() {
+  ip netns exec cvpn-cli curl -s --max-time 10 "http://127.0.0.1:$1/blob" -o "$WORK/fetched" || true
+}
+export -f fetch
+fetch 2001
+fetch 2002
+fetch 2003
+fetch 2004
+
+check "connections accepted per listener" bash -c "
+  [ \"\$(server_metric 'custom_vpn_server_connections_accepted_total{listener=\"tls\",port=\"9001\"}')\" = 1 ] &&
+  [ \"\$(server_metric 'custom_vpn_server_connections_accepted_total{listener=\"quic\",port=\"9002\"}')\" = 1 ]"
+check "active QUIC connections" is 1 server_metric custom_vpn_server_quic_connections_active
+check "backend dials are timed" is 2 server_metric 'custom_vpn_server_backend_dial_seconds_count{service="web"}'
+check "a backend that's down" is 1 server_metric 'custom_vpn_server_backend_dial_failures_total{reason="dial",service="gone"}'
+check "a service that doesn't exist" is 1 server_metric 'custom_vpn_server_backend_dial_failures_total{reason="unknown_service",service="nope"}'
+check "bytes per service, once the tunnels end" wait_for 5 bash -c "[ \"\$(server_metric 'custom_vpn_server_bytes_total{direction=\"to_client\",service=\"web\"}')\" -gt 200000 ]"
+check "finished tunnels" wait_for 5 is 2 server_metric 'custom_vpn_server_tunnels_total{kind="tcp"}'
+check "the client counts its dials" bash -c "
+  [ \"\$(client_metric 'custom_vpn_client_dials_total{result=\"ok\",transport=\"quic\"}')\" = 1 ] &&
+  [ \"\$(client_metric 'custom_vpn_client_dials_total{result=\"ok\",transport=\"tls\"}')\" = 1 ]"
+
+start cvpn-cli wrong-token "$WORK/bin/client" -config "$WORK/wrong-token.yaml" -p 2100 -forward 127.0.0.1:2100=web/quic
+BAD_PIDS=(${PIDS[-1]})
+wait_for 5 grep -q "listener started" "$WORK/wrong-token.log"
+fetch 2100
+check "a refused token" wait_for 5 is 1 server_metric 'custom_vpn_server_handshake_failures_total{listener="quic",reason="auth"}'
+start cvpn-cli wrong-ca "$WORK/bin/client" -config "$WORK/wrong-ca.yaml" -forward 127.0.0.1:2101=web/quic
+BAD_PIDS+=(${PIDS[-1]})
+wait_for 5 grep -q "listener started" "$WORK/wrong-ca.log"
+fetch 2101 &
+check "a client that doesn't trust the server's cert" wait_for 10 bash -c "[ -n \"\$(server_metric 'custom_vpn_server_handshake_failures_total{listener=\"quic\",reason=\"tls\"}')\" ]"
+kill -INT "${BAD_PIDS[@]}"
+wait "${BAD_PIDS[@]}" 2>/dev/null || true
+
+kill -INT "$SERVER_PID"
+wait "$SERVER_PID" || true
+start cvpn-srv server-restarted "$WORK/bin/server" -config "$WORK/server.yaml"
+wait_for 5 grep -q "msg=listening subsystem=quic .*port=9002" "$WORK/server-restarted.log"
+# the old connection has to idle out before the client notices
+check "the client reconnects after a server restart" wait_for 40 bash -c "fetch 2002; [ \"\$(client_metric custom_vpn_client_reconnects_total)\" = 1 ]"
+
+kill -INT "$ALICE_PID"
+wait "$ALICE_PID" || true
+check "a client hanging up isn't a failed handshake" bash -c "sleep 1; ip netns exec cvpn-lan curl -sf http://172.31.0.1:9100/metrics | grep -v '^#' | fails grep handshake_failures"
+
+finish
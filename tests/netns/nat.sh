@@ -0,0 +1,95 @@
+#!/bin/bash
+
+# The server side of TUN mode: with tun.nat the LAN needs no route back to the tunnel, clients only
+# reach each other with client_to_client on, and a client can't send from addresses it wasn't leased.
+# Run as root: sudo tests/netns/nat.sh
+
+source "$(dirname "$0")/lib.sh"
+
+build
+make_pki
+make_topology
+make_client2
+
+# no way back to the tunnel from the LAN, and forwarding off: the server has to sort out both
+ip -n cvpn-lan route del default
+ip netns exec cvpn-srv sysctl -qw net.ipv4.ip_forward=0
+
+cat >"$WORK/server.yaml" <<YAML
+listeners:
+  tcp: {enabled: false}
+  tls: {enabled: false}
+  quic: {enabled: true, bind: 0.0.0.0, port: 9002}
+tls:
+  cert: $WORK/pki/server.pem
+  key: $WORK/pki/server.key
+auth:
+  tokens:
+    alice: alice-token-alice-token
+    bob: bob-token-bob-token-bob
+tun:
+  enabled: true
+  address: 10.99.0.1/24
+  routes: [172.31.0.0/24]
+  nat: true
+  client_to_client: false
+YAML
+
+# client_conf <token>
+client_conf() {
+  cat <<YAML
+server: 192.168.77.1
+mode: tun
+tls:
+  ca: $WORK/pki/ca/ca.pem
+auth:
+  token: $1
+YAML
+}
+client_conf alice-token-alice-token >"$WORK/alice.yaml"
+client_conf bob-token-bob-token-bob >"$WORK/bob.yaml"
+
+start cvpn-srv server "$WORK/bin/server" -config "$WORK/server.yaml"
+SERVER_PID=${PIDS[-1]}
+wait_for 5 ip -n cvpn-srv link show cvpn0
+start cvpn-cli alice "$WORK/bin/client" -config "$WORK/alice.yaml"
+start cvpn-cli2 bob "$WORK/bin/client" -config "$WORK/bob.yaml"
+wait_for 10 has_addr cvpn-cli cvpn0 10.99.0.2
+wait_for 10 has_addr cvpn-cli2 cvpn0 10.99.0.3
+
+udp_echo_server cvpn-lan 172.31.0.2
+udp_echo_server cvpn-cli 10.99.0.2
+udp_echo_server cvpn-cli2 10.99.0.3
+start cvpn-lan web python3 -m http.server --bind 172.31.0.2 8080 --directory "$WORK"
+wait_for 5 ip netns exec cvpn-lan python3 -c 'import socket; socket.create_connection(("172.31.0.2", 8080))'
+echo hello >"$WORK/hello"
+
+check "the server turns forwarding on" bash -c "[ \"\$(ip netns exec cvpn-srv sysctl -n net.ipv4.ip_forward)\" = 1 ]"
+check "UDP to a LAN host with no route back" udp_echo cvpn-cli 172.31.0.2 100
+check "TCP to it too" bash -c "ip netns exec cvpn-cli curl -sf --max-time 10 http://172.31.0.2:8080/hello | grep hello"
+check "which sees the server, not the client" grep -q "^172.31.0.1 " "$WORK/web.log"
+check "clients can't reach each other by default" fails udp_echo cvpn-cli 10.99.0.3 100
+
+# a source address alice wasn't leased
+ip -n cvpn-cli addr add 10.99.0.3/32 dev cvpn0
+check "a spoofed source doesn't get through" fails ip netns exec cvpn-cli python3 -c '
+import socket, sys
+s = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+s.bind(("10.99.0.3", 0))
+s.settimeout(2)
+s.sendto(b"spoofed", ("172.31.0.2", 7))
+s.recvfrom(100)
+'
+check "and the server says so" wait_for 5 grep -q 'identity=alice src=10.99.0.3' "$WORK/server.log"
+ip -n cvpn-cli addr del 10.99.0.3/32 dev cvpn0
+
+kill -INT "$SERVER_PID"
+wait "$SERVER_PID" || true
+
+sed -i 's/client_to_client: false/client_to_client: true/' "$WORK/server.yaml"
+ip netns exec cvpn-srv sysctl -qw net.ipv4.ip_forward=1
+start cvpn-srv server-c2c "$WORK/bin/server" -config "$WORK/server.yaml"
+check "with client_to_client on, they can" wait_for 30 udp_echo cvpn-cli 10.99.0.3 100
+check "both ways" wait_for 10 udp_echo cvpn-cli2 10.99.0.2 100
+
+finish
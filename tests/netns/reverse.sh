@@ -0,0 +1,146 @@
+#!/bin/bash
+
+# Reverse forwards: the client has the server listen on a port, and connections to it reach a service on the client box.
+# The service here answers once it has read everything, so the request only gets an answer if the half-close makes it through.
+# Ports need an allow rule for the client's identity. Registrations come back after a server restart,
+# and go away with the client.
+# Run as root: sudo tests/netns/reverse.sh
+
+source "$(dirname "$0")/lib.sh"
+
+build
+make_pki
+make_topology
+
+cat >"$WORK/server.yaml" <<YAML
+listeners:
+  tcp: {enabled: false}
+  tls: {enabled: false}
+  quic: {enabled: true, bind: 0.0.0.0, port: 9002}
+tls:
+  cert: $WORK/pki/server.pem
+  key: $WORK/pki/server.key
+auth:
+  tokens:
+    alice: alice-token-alice-token
+    bob: bob-token-bob-token-bob
+reverse:
+  enabled: true
+  bind: 172.31.0.1
+  allow:
+    - identities: [alice]
+      ports: ["8443", "8500-8510"]
+YAML
+
+cat >"$WORK/alice.yaml" <<YAML
+server: 192.168.77.1
+tls:
+  ca: $WORK/pki/ca/ca.pem
+auth:
+  token: alice-token-alice-token
+reverse:
+  - {remote: 8443, local: "127.0.0.1:3000"}
+  # nothing listens there
+  - {remote: 8500, local: "127.0.0.1:3999"}
+YAML
+
+cat >"$WORK/bob.yaml" <<YAML
+server: 192.168.77.1
+tls:
+  ca: $WORK/pki/ca/ca.pem
+auth:
+  token: bob-token-bob-token-bob
+reverse:
+  - {remote: 8443, local: "127.0.0.1:3000"}
+YAML
+
+# reads until the other side is done sending, then answers with the sha256 of what it got
+start cvpn-cli hasher python3 -c '
+import hashlib, socket
+s = socket.socket()
+s.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+s.bind(("127.0.0.1", 3000))
+s.listen()
+while True:
+    c, _ = s.accept()
+    h = hashlib.sha256()
+    while chunk := c.recv(65536):
+        h.update(chunk)
+    c.sendall(h.hexdigest().encode())
+    c.close()
+'
+
+# send_and_hash <port>, from the LAN to the server's reverse listener. Sends a blob, half-closes, compares the answer
+send_and_hash() {
+  ip netns exec cvpn-lan python3 -c '
+import hashlib, os, socket, sys
+data = os.urandom(300000)
+s = socket.create_connection(("172.31.0.1", int(sys.argv[1])), timeout=10)
+s.sendall(data)
+s.shutdown(socket.SHUT_WR)
+answer = b""
+while chunk := s.recv(65536):
+    answer += chunk
+assert answer.decode() == hashlib.sha256(data).hexdigest(), answer
+' "$1"
+}
+
+# refused <port>, whether connecting to the server's port from the LAN fails, or gets closed without an answer
+refused() {
+  ip netns exec cvpn-lan python3 -c '
+import socket, sys
+try:
+    s = socket.create_connection(("172.31.0.1", int(sys.argv[1])), timeout=5)
+    s.sendall(b"hi")
+    s.shutdown(socket.SHUT_WR)
+    sys.exit(1 if s.recv(100) else 0)
+except OSError:
+    pass
+' "$1"
+}
+
+# at_once <n> <cmd...>, n copies of cmd side by side. Fails if any of them does
+at_once() {
+  local n="$1" failed=0 pids=()
+  shift
+  for _ in $(seq "$n"); do
+    "$@" &
+    pids+=($!)
+  done
+  for pid in "${pids[@]}"; do
+    wait "$pid" || failed=1
+  done
+  return $failed
+}
+
+start cvpn-srv server "$WORK/bin/server" -config "$WORK/server.yaml"
+SERVER_PID=${PIDS[-1]}
+wait_for 5 grep -q "msg=listening subsystem=quic .*port=9002" "$WORK/server.log"
+start cvpn-cli alice "$WORK/bin/client" -config "$WORK/alice.yaml"
+ALICE_PID=${PIDS[-1]}
+wait_for 10 grep -q 'msg="reverse forward open".*addr=172.31.0.1:8443' "$WORK/server.log"
+
+check "a LAN host reaches the client's service through the server" send_and_hash 8443
+check "the client sees where it came from" grep -q 'msg="reverse forward: connection".*from=172.31.0.2:' "$WORK/alice.log"
+check "connections at the same time" at_once 5 send_and_hash 8443
+check "a local address nobody listens on closes the connection" refused 8500
+check "and the client logs why" grep -q "127.0.0.1:3999.*connection refused" "$WORK/alice.log"
+
+start cvpn-cli bob "$WORK/bin/client" -config "$WORK/bob.yaml"
+check "a port the identity isn't allowed is refused" wait_for 10 grep -q "port 8443 is not allowed" "$WORK/bob.log"
+check "and the server says which rule was missing" grep -qF 'no reverse.allow rule lets \"bob\" listen on port 8443' "$WORK/server.log"
+check "alice's forward is still there" send_and_hash 8443
+
+kill -INT "$SERVER_PID"
+wait "$SERVER_PID" || true
+start cvpn-srv server-restarted "$WORK/bin/server" -config "$WORK/server.yaml"
+SERVER_PID=${PIDS[-1]}
+check "the client registers again after a server restart" wait_for 40 grep -q 'msg="reverse forward open".*addr=172.31.0.1:8443' "$WORK/server-restarted.log"
+check "and the forward works" send_and_hash 8443
+
+kill -INT "$ALICE_PID"
+wait "$ALICE_PID" || true
+check "the port closes when the client goes" wait_for 10 refused 8443
+check "the server logs it" wait_for 5 grep -q 'msg="reverse forward closed".*addr=172.31.0.1:8443' "$WORK/server-restarted.log"
+
+finish
@@ -0,0 +1,121 @@
+#!/bin/bash
+
+# Session records: every tunnel the server carries ends up as a line in sessions.file (and the log),
+# with the right byte counts each way. TCP tunnels on each listener, a reverse forward and a UDP association.
+# TUN links are checked in tun.sh
+# Run as root: sudo tests/netns/sessions.sh
+
+source "$(dirname "$0")/lib.sh"
+
+build
+make_pki
+make_topology
+
+cat >"$WORK/server.yaml" <<YAML
+listeners:
+  tcp: {enabled: true, bind: 0.0.0.0, port: 9000}
+  tls: {enabled: true, bind: 0.0.0.0, port: 9001}
+  quic: {enabled: true, bind: 0.0.0.0, port: 9002}
+tls:
+  cert: $WORK/pki/server.pem
+  key: $WORK/pki/server.key
+auth:
+  tokens:
+    alice: alice-token-alice-token
+services:
+  sink: 172.31.0.2:3000
+  echo: {addr: 172.31.0.2:7, network: udp}
+reverse:
+  enabled: true
+  bind: 172.31.0.1
+  allow:
+    - ports: ["8443"]
+sessions:
+  log: true
+  file: $WORK/sessions.jsonl
+YAML
+
+cat >"$WORK/client.yaml" <<YAML
+server: 192.168.77.1
+tls:
+  ca: $WORK/pki/ca/ca.pem
+auth:
+  token: alice-token-alice-token
+forwards:
+  - {local: "127.0.0.1:2000", service: sink, transport: tcp}
+  - {local: "127.0.0.1:2001", service: sink, transport: tls}
+  - {local: "127.0.0.1:2002", service: sink, transport: quic}
+  - {local: "127.0.0.1:5353", service: echo, network: udp, idle_timeout: 2s}
+reverse:
+  - {remote: 8443, local: "127.0.0.1:3000"}
+YAML
+
+# sink_server <ns> <addr>, on port 3000: reads until the other side is done sending, then answers with 12345 bytes
+sink_server() {
+  start "$1" "sink-$2" python3 -c '
+import socket, sys, threading
+s = socket.socket()
+s.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+s.bind((sys.argv[1], 3000))
+s.listen()
+def serve(c):
+    while c.recv(65536):
+        pass
+    c.sendall(b"x" * 12345)
+    c.close()
+while True:
+    c, _ = s.accept()
+    threading.Thread(target=serve, args=(c,)).start()
+' "$2"
+}
+
+# send_54321 <ns> <addr> <port>, sends 54321 bytes, half-closes and checks the sink's answer
+send_54321() {
+  ip netns exec "$1" python3 -c '
+import socket, sys
+s = socket.create_connection((sys.argv[1], int(sys.argv[2])), timeout=10)
+s.sendall(b"y" * 54321)
+s.shutdown(socket.SHUT_WR)
+got = 0
+while chunk := s.recv(65536):
+    got += len(chunk)
+assert got == 12345, got
+' "$2" "$3"
+}
+
+# has_record <field=value>..., whether some line of sessions.jsonl matches every field given
+has_record() {
+  python3 -c '
+import json, sys
+want = dict(arg.split("=", 1) for arg in sys.argv[2:])
+for line in open(sys.argv[1]):
+    rec = json.loads(line)
+    if rec["conn_id"] and all(str(rec.get(k)) == v for k, v in want.items()):
+        sys.exit(0)
+sys.exit("no record with " + str(want))
+' "$WORK/sessions.jsonl" "$@"
+}
+
+sink_server cvpn-lan 172.31.0.2
+sink_server cvpn-cli 127.0.0.1
+udp_echo_server cvpn-lan 172.31.0.2
+start cvpn-srv server "$WORK/bin/server" -config "$WORK/server.yaml"
+wait_for 5 grep -q "msg=listening subsystem=quic .*port=9002" "$WORK/server.log"
+start cvpn-cli client "$WORK/bin/client" -config "$WORK/client.yaml"
+wait_for 10 grep -q 'msg="reverse forward open".*addr=172.31.0.1:8443' "$WORK/server.log"
+
+send_54321 cvpn-cli 127.0.0.1 2000
+send_54321 cvpn-cli 127.0.0.1 2001
+send_54321 cvpn-cli 127.0.0.1 2002
+send_54321 cvpn-lan 172.31.0.1 8443
+udp_echo cvpn-cli 127.0.0.1 100 5353
+
+for transport in tcp tls; do
+  check "a tunnel on the $transport listener" wait_for 5 has_record transport=$transport kind=tcp stream_id=-1 identity=alice service=sink target=172.31.0.2:3000 bytes_from_client=54321 bytes_to_client=12345 close_reason=closed
+done
+check "a tunnel on a QUIC stream" wait_for 5 has_record transport=quic kind=tcp identity=alice service=sink bytes_from_client=54321 bytes_to_client=12345 close_reason=closed
+check "a reverse forward's connection" wait_for 5 has_record transport=quic kind=reverse identity=alice bytes_from_client=12345 bytes_to_client=54321 close_reason=closed
+check "a UDP association, once the client lets it go" wait_for 10 has_record transport=quic kind=udp identity=alice service=echo target=172.31.0.2:7 bytes_from_client=100 bytes_to_client=100 close_reason=closed
+check "and a log line each" bash -c "[ \$(grep -c 'msg=session ' '$WORK/server.log') -eq 5 ]"
+
+finish
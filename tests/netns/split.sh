@@ -0,0 +1,84 @@
+#!/bin/bash
+
+# Split tunnelling on the client: everything into the tunnel but the excluded subnets and hosts, and never the server.
+# Domains resolve through the client box's own hosts file. A client killed without cleaning up has its routes
+# taken out on the next start, and a clean exit leaves the routing table as it found it.
+# The client is cvpn-cli2, which reaches the server through its default route, so a tunnel carrying 0.0.0.0/0
+# would swallow its own packets if the server weren't kept off it.
+# Run as root: sudo tests/netns/split.sh
+
+source "$(dirname "$0")/lib.sh"
+
+build
+make_pki
+make_topology
+make_client2
+
+ip -n cvpn-lan addr add 172.31.0.3/24 dev l0
+mkdir -p /etc/netns/cvpn-cli2
+printf '172.31.0.4 skip.test\n172.31.0.5 via.test\n' >/etc/netns/cvpn-cli2/hosts
+
+cat >"$WORK/server.yaml" <<YAML
+listeners:
+  tcp: {enabled: false}
+  tls: {enabled: false}
+  quic: {enabled: true, bind: 0.0.0.0, port: 9002}
+tls:
+  cert: $WORK/pki/server.pem
+  key: $WORK/pki/server.key
+tun:
+  enabled: true
+  address: 10.99.0.1/24
+YAML
+
+cat >"$WORK/client.yaml" <<YAML
+server: 192.168.77.1
+mode: tun
+tls:
+  ca: $WORK/pki/ca/ca.pem
+tun:
+  routes: [0.0.0.0/0]
+  exclude: [172.31.0.2]
+  exclude_domains: [skip.test]
+  state_file: $WORK/routes.json
+YAML
+
+start cvpn-srv server "$WORK/bin/server" -config "$WORK/server.yaml"
+wait_for 5 ip -n cvpn-srv link show cvpn0
+start cvpn-cli2 client "$WORK/bin/client" -config "$WORK/client.yaml"
+CLIENT_PID=${PIDS[-1]}
+wait_for 10 grep -q 'msg="link connected" subsystem=tun dev=cvpn0' "$WORK/client.log"
+
+start cvpn-lan web python3 -m http.server --bind 0.0.0.0 8080 --directory "$WORK"
+wait_for 5 ip netns exec cvpn-lan python3 -c 'import socket; socket.create_connection(("172.31.0.2", 8080))'
+echo hello >"$WORK/hello"
+udp_echo_server cvpn-srv 10.99.0.1
+
+check "everything goes into the tunnel" goes_via cvpn-cli2 172.31.0.3 cvpn0
+check "but the server" goes_via cvpn-cli2 192.168.77.1 c1
+check "and the excluded subnet" goes_via cvpn-cli2 172.31.0.2 c1
+check "and the excluded domain" goes_via cvpn-cli2 172.31.0.4 c1
+check "the default route is left alone" bash -c "ip -n cvpn-cli2 route show default | grep 'via 192.168.78.1' >/dev/null"
+check "the tunnel works over it" udp_echo cvpn-cli2 10.99.0.1 100
+check "TCP through the tunnel comes from the tunnel address" bash -c "ip netns exec cvpn-cli2 curl -sf --max-time 10 http://172.31.0.3:8080/hello >/dev/null && grep '^10.99.0.2 ' '$WORK/web.log' >/dev/null"
+check "TCP to an excluded address doesn't" bash -c "ip netns exec cvpn-cli2 curl -sf --max-time 10 http://172.31.0.2:8080/hello >/dev/null && grep '^192.168.78.2 ' '$WORK/web.log' >/dev/null"
+check "the routes are noted down" grep -q '"172.31.0.2/32"' "$WORK/routes.json"
+
+# a crash leaves the bypasses behind (the tunnel routes go with the interface), the next start takes them out
+kill -KILL "$CLIENT_PID"
+wait "$CLIENT_PID" 2>/dev/null || true
+check "a crashed client's routes stay behind" bash -c "ip -n cvpn-cli2 route show 172.31.0.2/32 | grep c1"
+sed -i 's/^  routes: .*/  domains: [via.test]/; /^  exclude/d' "$WORK/client.yaml"
+start cvpn-cli2 client-restarted "$WORK/bin/client" -config "$WORK/client.yaml"
+CLIENT_PID=${PIDS[-1]}
+wait_for 10 grep -q 'msg="link connected" subsystem=tun dev=cvpn0' "$WORK/client-restarted.log"
+check "and are taken out on the next start" bash -c "[ -z \"\$(ip -n cvpn-cli2 route show 172.31.0.2/32)\" ]"
+check "a domain goes into the tunnel" goes_via cvpn-cli2 172.31.0.5 cvpn0
+check "nothing else does" goes_via cvpn-cli2 172.31.0.3 c1
+
+kill -INT "$CLIENT_PID"
+wait "$CLIENT_PID" 2>/dev/null || true
+check "a clean exit takes every route out" bash -c "[ -z \"\$(ip -n cvpn-cli2 route show 192.168.77.1/32)\" ]"
+check "and the state file" test ! -e "$WORK/routes.json"
+
+finish
@@ -0,0 +1,137 @@
+#!/bin/bash
+
+# TUN mode, end to end: clients in one namespace get their addresses from the server's pool,
+# then reach the server's tunnel address and a host on the server's LAN, with packets small enough for datagrams
+# and big enough to need the stream. Leases stick to identities, across reconnects and server restarts.
+# tun.identities keeps other clients from linking up, and the policy is checked on the packets of those which do.
+# Run as root: sudo tests/netns/tun.sh
+
+source "$(dirname "$0")/lib.sh"
+
+build
+make_pki
+make_topology
+
+cat >"$WORK/server.yaml" <<YAML
+listeners:
+  tcp: {enabled: false}
+  tls: {enabled: false}
+  quic: {enabled: true, bind: 0.0.0.0, port: 9002}
+tls:
+  cert: $WORK/pki/server.pem
+  key: $WORK/pki/server.key
+auth:
+  tokens:
+    alice: alice-token-alice-token
+    bob: bob-token-bob-token-bob
+tun:
+  enabled: true
+  address: 10.99.0.1/24
+  address6: fd00:99::1/64
+  routes: [172.31.0.0/24]
+  dns: [10.99.0.1]
+  leases_file: $WORK/leases.json
+YAML
+
+# client_conf <interface> <token>
+client_conf() {
+  cat <<YAML
+server: 192.168.77.1
+mode: tun
+tls:
+  ca: $WORK/pki/ca/ca.pem
+auth:
+  token: $2
+tun:
+  name: $1
+YAML
+}
+client_conf cvpn0 alice-token-alice-token >"$WORK/alice.yaml"
+client_conf cvpn1 bob-token-bob-token-bob >"$WORK/bob.yaml"
+client_conf cvpn2 alice-token-alice-token >"$WORK/alice2.yaml"
+
+start cvpn-srv server "$WORK/bin/server" -config "$WORK/server.yaml"
+SERVER_PID=${PIDS[-1]}
+wait_for 5 ip -n cvpn-srv link show cvpn0
+start cvpn-cli alice "$WORK/bin/client" -config "$WORK/alice.yaml"
+ALICE_PID=${PIDS[-1]}
+wait_for 10 grep -q 'msg="link connected" subsystem=tun dev=cvpn0' "$WORK/alice.log"
+
+check "the first client is leased the first addresses" has_addr cvpn-cli cvpn0 10.99.0.2
+check "and an IPv6 one" has_addr cvpn-cli cvpn0 fd00:99::2
+check "the server pushes its routes" bash -c "ip -n cvpn-cli route show 172.31.0.0/24 | grep cvpn0 >/dev/null"
+check "and DNS servers" grep -q "dns=\[10.99.0.1\]" "$WORK/alice.log"
+
+udp_echo_server cvpn-srv 10.99.0.1
+udp_echo_server cvpn-srv fd00:99::1
+udp_echo_server cvpn-lan 172.31.0.2
+start cvpn-lan web python3 -m http.server --bind 172.31.0.2 8080 --directory "$WORK"
+wait_for 5 ip netns exec cvpn-lan python3 -c 'import socket; socket.create_connection(("172.31.0.2", 8080))'
+head -c 300000 /dev/urandom >"$WORK/blob"
+
+check "UDP to the server's tunnel address" udp_echo cvpn-cli 10.99.0.1 100
+check "UDP over IPv6" udp_echo cvpn-cli fd00:99::1 100
+check "UDP to a LAN host through the server" udp_echo cvpn-cli 172.31.0.2 100
+# fragments the size of the MTU don't fit in one datagram, these go on the link's stream
+check "UDP with packets bigger than a datagram" udp_echo cvpn-cli 172.31.0.2 3000
+check "TCP download from the LAN" bash -c "ip netns exec cvpn-cli curl -sf --max-time 10 http://172.31.0.2:8080/blob | cmp - '$WORK/blob'"
+
+# the server going away doesn't take the client's interface with it, the link comes back on the new connection
+kill -INT "$SERVER_PID"
+wait "$SERVER_PID" || true
+start cvpn-srv server-restarted "$WORK/bin/server" -config "$WORK/server.yaml"
+SERVER_PID=${PIDS[-1]}
+check "the client relinks after a server restart" wait_for 30 udp_echo cvpn-cli 172.31.0.2 100
+check "with the same address" has_addr cvpn-cli cvpn0 10.99.0.2
+
+# alice's lease outlives her link, bob connecting first doesn't get her address
+kill -INT "$ALICE_PID"
+wait "$ALICE_PID" || true
+start cvpn-cli bob "$WORK/bin/client" -config "$WORK/bob.yaml"
+BOB_PID=${PIDS[-1]}
+check "a second identity gets the next address" wait_for 10 has_addr cvpn-cli cvpn1 10.99.0.3
+check "leases are written down" grep -q '"alice"' "$WORK/leases.json"
+
+# a second alice takes the addresses over, the first one gives up rather than fight over them
+start cvpn-cli alice "$WORK/bin/client" -config "$WORK/alice.yaml"
+wait_for 10 has_addr cvpn-cli cvpn0 10.99.0.2
+start cvpn-cli alice2 "$WORK/bin/client" -config "$WORK/alice2.yaml"
+check "the same identity gets the same address" wait_for 10 has_addr cvpn-cli cvpn2 10.99.0.2
+check "the older link is told it was replaced" wait_for 10 grep -q "newer link" "$WORK/alice.log"
+check "and its session record says so" wait_for 5 grep -q 'msg=session .*transport=quic kind=tun .*identity=alice .*close_reason="replaced by a newer link"' "$WORK/server-restarted.log"
+
+# a lease nobody has used for lease_timeout goes back in the pool
+kill -INT "$BOB_PID"
+wait "$BOB_PID" || true
+check "a link's session is recorded when the client goes" wait_for 5 grep -q 'msg=session .*transport=quic kind=tun .*identity=bob .*close_reason="connection closed: client shutting down"$' "$WORK/server-restarted.log"
+kill -INT "$SERVER_PID"
+wait "$SERVER_PID" || true
+sed -i 's/^  leases_file:.*/&\n  lease_timeout: 2s/' "$WORK/server.yaml"
+start cvpn-srv server-short-leases "$WORK/bin/server" -config "$WORK/server.yaml"
+SERVER_PID=${PIDS[-1]}
+check "an idle lease expires" wait_for 10 grep -q 'msg="lease expired" subsystem=tun identity=bob' "$WORK/server-short-leases.log"
+wait_for 30 grep -q 'msg="TUN link up".*identity=alice' "$WORK/server-short-leases.log"
+check "a lease in use doesn't" bash -c "sleep 3; grep '\"alice\"' '$WORK/leases.json' >/dev/null"
+
+# only alice may bring a link up, and the policy keeps her off the LAN host's echo port
+kill -INT "$SERVER_PID"
+wait "$SERVER_PID" || true
+pkill -INT -f "$WORK/bin/client" || true
+wait_for 10 fails pgrep -f "$WORK/bin/client"
+sed -i 's/^  leases_file:.*/&\n  identities: [alice]/' "$WORK/server.yaml"
+cat >>"$WORK/server.yaml" <<YAML
+policy:
+  rules:
+    - {action: deny, cidrs: [172.31.0.2], ports: ["7"]}
+YAML
+start cvpn-srv server-policy "$WORK/bin/server" -config "$WORK/server.yaml"
+start cvpn-cli alice-policy "$WORK/bin/client" -config "$WORK/alice.yaml"
+wait_for 30 grep -q 'msg="TUN link up".*identity=alice' "$WORK/server-policy.log"
+check "packets the policy allows go through" wait_for 10 udp_echo cvpn-cli 10.99.0.1 100
+check "to the LAN too" bash -c "ip netns exec cvpn-cli curl -sf --max-time 10 http://172.31.0.2:8080/blob | cmp - '$WORK/blob'"
+check "a port it denies doesn't" fails udp_echo cvpn-cli 172.31.0.2 100
+check "the first denied packet is logged" grep -q 'msg="client sent a packet the policy doesn.t allow, dropping those" subsystem=tun identity=alice .*denied by policy rule 0' "$WORK/server-policy.log"
+start cvpn-cli bob-refused "$WORK/bin/client" -config "$WORK/bob.yaml"
+check "an identity not in tun.identities can't bring a link up" wait_for 10 grep -q 'msg="TUN link refused".*identity=bob .*isn.t in tun.identities' "$WORK/server-policy.log"
+
+finish
@@ -0,0 +1,119 @@
+#!/bin/bash
+
+# UDP forwards: a local UDP port on the client bound to a udp service on the server, one flow per local sender.
+# Payloads too big for a datagram go on the flow's stream. Quiet flows are closed by the client,
+# and by the server when the client holds on to them longer than it does.
+# Flows that won't open make the forward back off. SOCKS5 UDP ASSOCIATE goes through the policy, one destination at a time.
+# Run as root: sudo tests/netns/udp.sh
+
+source "$(dirname "$0")/lib.sh"
+
+build
+make_pki
+make_topology
+
+cat >"$WORK/server.yaml" <<YAML
+listeners:
+  tcp: {enabled: false}
+  tls: {enabled: false}
+  quic: {enabled: true, bind: 0.0.0.0, port: 9002}
+tls:
+  cert: $WORK/pki/server.pem
+  key: $WORK/pki/server.key
+services:
+  echo: {addr: 172.31.0.2:7, network: udp}
+  web: 172.31.0.2:8080
+udp_idle_timeout: 3s
+allow_dynamic_targets: true
+policy:
+  rules:
+    - {action: deny, cidrs: [172.31.0.2], ports: ["9"]}
+YAML
+
+cat >"$WORK/client.yaml" <<YAML
+server: 192.168.77.1
+tls:
+  ca: $WORK/pki/ca/ca.pem
+forwards:
+  - {local: "127.0.0.1:5353", service: echo, network: udp, idle_timeout: 2s}
+  # longer than the server's, so the server gets there first
+  - {local: "127.0.0.1:5354", service: echo, network: udp, idle_timeout: 1m}
+  # the server has no such service, so its flows never open
+  - {local: "127.0.0.1:5355", service: nope, network: udp}
+  # TCP and UDP can share a port
+  - {local: "127.0.0.1:5353", service: web}
+socks:
+  listen: 127.0.0.1:1080
+  transport: quic
+YAML
+
+# socks_udp <host> <port>..., one UDP ASSOCIATE through the SOCKS proxy, a datagram to each destination in turn.
+# Prints which of them echoed
+socks_udp() {
+  ip netns exec cvpn-cli python3 -c '
+import socket, struct, sys
+c = socket.create_connection(("127.0.0.1", 1080), timeout=5)
+c.sendall(b"\x05\x01\x00")
+assert c.recv(2) == b"\x05\x00"
+c.sendall(b"\x05\x03\x00\x01" + bytes(6))
+reply = c.recv(10)
+assert reply[1] == 0, "associate refused"
+relay = (socket.inet_ntoa(reply[4:8]), struct.unpack(">H", reply[8:10])[0])
+s = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+s.settimeout(2)
+args = sys.argv[1:]
+for host, port in zip(args[::2], args[1::2]):
+    name = host.encode()
+    s.sendto(b"\x00\x00\x00\x03" + bytes([len(name)]) + name + struct.pack(">H", int(port)) + b"ping " + name, relay)
+    try:
+        got, _ = s.recvfrom(65535)
+        print("echoed", host, port, got[got.index(b"ping"):].decode())
+    except socket.timeout:
+        print("nothing from", host, port)
+' "$@"
+}
+export -f socks_udp
+
+udp_echo_server cvpn-lan 172.31.0.2
+start cvpn-lan web python3 -m http.server --bind 172.31.0.2 8080 --directory "$WORK"
+wait_for 5 ip netns exec cvpn-lan python3 -c 'import socket; socket.create_connection(("172.31.0.2", 8080))'
+echo hello >"$WORK/hello"
+start cvpn-srv server "$WORK/bin/server" -config "$WORK/server.yaml"
+wait_for 5 grep -q "msg=listening subsystem=quic .*port=9002" "$WORK/server.log"
+start cvpn-cli client "$WORK/bin/client" -config "$WORK/client.yaml"
+wait_for 5 grep -q 'msg="UDP forward listening" subsystem=udp addr=127.0.0.1:5354' "$WORK/client.log"
+
+check "UDP through the forward" udp_echo cvpn-cli 127.0.0.1 100 5353
+check "payloads bigger than a datagram" udp_echo cvpn-cli 127.0.0.1 3000 5353
+check "TCP on the same port" bash -c "ip netns exec cvpn-cli curl -sf --max-time 10 http://127.0.0.1:5353/hello | grep hello"
+# every udp_echo is a new socket, so a new sender
+check "each sender gets its own flow" bash -c "[ \$(grep -c 'msg=\"new flow\"' '$WORK/client.log') -ge 2 ]"
+check "senders at the same time get their own replies" bash -c "
+  for i in \$(seq 5); do ip netns exec cvpn-cli python3 -c '
+import os, socket
+s = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+s.settimeout(3)
+data = os.urandom(200)
+for _ in range(20):
+    s.sendto(data, (\"127.0.0.1\", 5353))
+    assert s.recvfrom(65535)[0] == data
+' & done
+  failed=0; for job in \$(jobs -p); do wait \$job || failed=1; done; exit \$failed"
+
+check "the client closes quiet flows" wait_for 10 grep -q 'msg="flow idle, closing it".*idle=2s' "$WORK/client.log"
+check "and the server's end goes with them" wait_for 5 grep -q 'msg="UDP association closed"' "$WORK/server.log"
+
+check "a flow the client holds on to" udp_echo cvpn-cli 127.0.0.1 100 5354
+check "is closed by the server when it goes quiet" wait_for 10 grep -q 'msg="UDP association idle, closing it".*idle=3s' "$WORK/server.log"
+check "and the next payload opens a new one" udp_echo cvpn-cli 127.0.0.1 100 5354
+
+check "a flow the server won't open" fails udp_echo cvpn-cli 127.0.0.1 100 5355
+check "is logged once" bash -c "[ \$(grep -c 'msg=\"can.t open a flow, dropping new senders. payloads for a while\".*service=nope .*retry_in=1s failed_since_last_warning=0' '$WORK/client.log') = 1 ]"
+check "and doesn't take the forward down" bash -c "! grep -q 'level=ERROR.*5355' '$WORK/client.log'"
+check "other forwards are fine" udp_echo cvpn-cli 127.0.0.1 100 5353
+
+check "SOCKS UDP to a destination the policy allows" bash -c "socks_udp 172.31.0.2 7 | grep -x 'echoed 172.31.0.2 7 ping 172.31.0.2'"
+check "not to one it denies" bash -c "socks_udp 172.31.0.2 9 | grep -x 'nothing from 172.31.0.2 9'"
+check "which the server logs" wait_for 5 grep -q 'msg="UDP association: dropping datagrams".* for=10s .*denied by policy rule 0' "$WORK/server.log"
+
+finish
@@ -0,0 +1,259 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"custom_vpn/internal/logging"
+)
+
+var logger = logging.For("tls")
+
+// How often the cert and key files are checked for changes
+const certPollInterval = 5 * time.Second
+
+/*
+	Holds the server's keypairs and swaps them out when the files change (or on SIGHUP),
+	so a renewed cert doesn't mean restarting the listeners and dropping every QUIC connection.
+	The TLS and QUIC listeners share one through tls.Config.GetCertificate, new handshakes pick up the new cert,
+	connections which are already up keep going on the old one.
+
+	Besides the main keypair there can be a directory of <name>.pem / <name>.key pairs (tls.cert_dir).
+	Each of those is presented to clients whose SNI matches one of its DNS names,
+	the main keypair is for everyone else (and clients which send no SNI).
+
+	The client CRL (tls.client_crl) is reloaded along with them, so `custom_vpn pki revoke` takes effect without a restart.
+*/
+type CertReloader struct {
+	certPath string
+	keyPath  string
+	dir      string
+
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	byName map[string]*tls.Certificate
+
+	// set by SetClientCRL. The CRL has to be signed by one of the certs in caPEM
+	crlPath string
+	caPEM   []byte
+	// revoked serials (big-endian bytes), read on every handshake
+	revoked atomic.Pointer[map[string]bool]
+}
+
+// Loads the keypairs once, a bad one at startup is fatal. dir may be empty
+func NewCertReloader(certPath, keyPath, dir string) (*CertReloader, error) {
+	if keyPath == "" {
+		return nil, fmt.Errorf("failed to find server priv-key")
+	}
+	if certPath == "" {
+		return nil, fmt.Errorf("failed to find server cert")
+	}
+	r := &CertReloader{certPath: certPath, keyPath: keyPath, dir: dir}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Picks a cert by SNI: exact name, then a wildcard one level up, then the main keypair
+func (r *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, ok := r.byName[name]; ok {
+		return cert, nil
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := r.byName["*."+parent]; ok {
+			return cert, nil
+		}
+	}
+	return r.cert, nil
+}
+
+// The names with a cert of their own, for logging
+func (r *CertReloader) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.byName))
+	for name := range r.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+	Loads the client CRL at path, and reloads it with the certs from then on. Call it before Watch.
+	See loadCRL for what caPEM is for
+*/
+func (r *CertReloader) SetClientCRL(path string, caPEM []byte) error {
+	revoked, err := loadCRL(path, caPEM)
+	if err != nil {
+		return err
+	}
+	r.crlPath, r.caPEM = path, caPEM
+	r.revoked.Store(&revoked)
+	logger.Info("loaded client CRL", "path", path, "revoked", len(revoked))
+	return nil
+}
+
+// Whether a client cert is on the CRL. Nothing is without one
+func (r *CertReloader) Revoked(cert *x509.Certificate) bool {
+	revoked := r.revoked.Load()
+	return revoked != nil && (*revoked)[string(cert.SerialNumber.Bytes())]
+}
+
+/*
+	Reads every keypair (and the client CRL) off disk and swaps them in, if they all check out.
+	A key which doesn't match its cert, a cert which is expired (or not valid yet), or a CRL which doesn't parse
+	or isn't signed by the client CA leaves the old set in place.
+*/
+func (r *CertReloader) Reload() error {
+	cert, err := loadKeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return err
+	}
+	var revoked map[string]bool
+	if r.crlPath != "" {
+		if revoked, err = loadCRL(r.crlPath, r.caPEM); err != nil {
+			return err
+		}
+	}
+
+	// names on the main cert stay with the main cert. `custom_vpn pki issue-server` puts localhost on every server cert,
+	// which would otherwise hand whichever dir cert loaded last to every client using the default server name
+	mainNames := make(map[string]bool)
+	for _, name := range cert.Leaf.DNSNames {
+		mainNames[strings.ToLower(name)] = true
+	}
+	byName := make(map[string]*tls.Certificate)
+	if r.dir != "" {
+		pems, err := filepath.Glob(filepath.Join(r.dir, "*.pem"))
+		if err != nil {
+			return fmt.Errorf("tls_server: %v", err)
+		}
+		for _, pemPath := range pems {
+			keyPath := strings.TrimSuffix(pemPath, ".pem") + ".key"
+			if _, err := os.Stat(keyPath); err != nil {
+				// a CA cert, or a cert whose key lives elsewhere. Not ours to serve
+				continue
+			}
+			dirCert, err := loadKeyPair(pemPath, keyPath)
+			if err != nil {
+				return err
+			}
+			names := dirCert.Leaf.DNSNames
+			if len(names) == 0 && dirCert.Leaf.Subject.CommonName != "" {
+				names = []string{dirCert.Leaf.Subject.CommonName}
+			}
+			for _, name := range names {
+				if !mainNames[strings.ToLower(name)] {
+					byName[strings.ToLower(name)] = dirCert
+				}
+			}
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = cert
+	r.byName = byName
+	r.mu.Unlock()
+	logger.Info("loaded cert", "path", r.certPath, "serial", fmt.Sprintf("%x", cert.Leaf.SerialNumber), "expires", cert.Leaf.NotAfter.Format(time.RFC3339))
+	if r.dir != "" {
+		logger.Info("certs by server name", "dir", r.dir, "names", r.Names())
+	}
+	if r.crlPath != "" {
+		r.revoked.Store(&revoked)
+		logger.Info("loaded client CRL", "path", r.crlPath, "revoked", len(revoked))
+	}
+	return nil
+}
+
+// Loads and checks one keypair
+func loadKeyPair(certPath, keyPath string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("tls_server: error loading KeyPair %v: %v", certPath, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("tls_server: error parsing %v: %v", certPath, err)
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("tls_server: %v is only valid from %v to %v", certPath, leaf.NotBefore, leaf.NotAfter)
+	}
+	cert.Leaf = leaf
+	return &cert, nil
+}
+
+/*
+	Reloads on SIGHUP, and whenever a cert or key file changes, until ctx is cancelled.
+	Files are polled rather than watched, renewals happen every few months, not every few milliseconds.
+	A failed reload is reported on errCh and tried again on the next change, eg. when the cert is written before its key.
+*/
+func (r *CertReloader) Watch(ctx context.Context, wg *sync.WaitGroup, errCh chan<- error) {
+	defer wg.Done()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(certPollInterval)
+	defer ticker.Stop()
+
+	last := r.fileStamp()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.Info("SIGHUP, reloading certs")
+		case <-ticker.C:
+			stamp := r.fileStamp()
+			if stamp == last {
+				continue
+			}
+			last = stamp
+			logger.Info("cert files changed, reloading")
+		}
+		if err := r.Reload(); err != nil {
+			errCh <- fmt.Errorf("%v (still using the previous certs)", err)
+		}
+	}
+}
+
+/*
+	Modification times and sizes of every file we load, as one comparable string.
+	Missing files stamp as nothing, so a file appearing (or going away) counts as a change
+*/
+func (r *CertReloader) fileStamp() string {
+	paths := []string{r.certPath, r.keyPath}
+	if r.crlPath != "" {
+		paths = append(paths, r.crlPath)
+	}
+	if r.dir != "" {
+		pems, _ := filepath.Glob(filepath.Join(r.dir, "*.pem"))
+		keys, _ := filepath.Glob(filepath.Join(r.dir, "*.key"))
+		paths = append(append(paths, pems...), keys...)
+	}
+	var b strings.Builder
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			fmt.Fprintf(&b, "%s %d %d\n", path, info.ModTime().UnixNano(), info.Size())
+		}
+	}
+	return b.String()
+}
@@ -1,31 +1,82 @@
 package tlsconfig
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"fmt"
 	"os"
+
+	"custom_vpn/config"
 )
 
 // Returns a TLS config for client
-// user can provide a CA certificate location
-// Default is retreived from an env-var
-func ClientTLSConfig(caCertLoc string) (*tls.Config, error){
-	
-	if caCertLoc == "" {
-		caCertLoc = os.Getenv("CA_CERT_LOC")
-	}
-	
-	caCert, err := os.ReadFile(caCertLoc)
-	if err != nil {
-		return nil, err
-	}
-	certPool := x509.NewCertPool()
-	certPool.AppendCertsFromPEM(caCert)
+// user provides a CA certificate location (see config.Client for where it comes from)
+// Cert and Key are the client's own cert, for servers which require mutual TLS. Empty means don't present one
+// ServerName is checked against the server's cert, and sent as SNI so the server can pick a cert (and virtual host)
+// Pins are checked against the server cert's public key, with or without a CA (see config.ClientTLS)
+func ClientTLSConfig(conf config.ClientTLS) (*tls.Config, error){
+	caCertLoc, certLoc, keyLoc := conf.CA, conf.Cert, conf.Key
+
 	clientConfig := tls.Config{
-		RootCAs: certPool,
-		ServerName: "localhost", // added to beat SAN warning
+		ServerName: conf.ServerName, // "localhost" unless told otherwise, added to beat SAN warning
 		// ClientSessionChache allows for TLS session resumption
 		// ClientSessionCache: tls.NewLRUClientSessionCache(100),
 	}
+
+	if caCertLoc != "" {
+		caCert, err := os.ReadFile(caCertLoc)
+		if err != nil {
+			return nil, err
+		}
+		certPool := x509.NewCertPool()
+		certPool.AppendCertsFromPEM(caCert)
+		clientConfig.RootCAs = certPool
+	}
+
+	if len(conf.Pins) > 0 {
+		pins := make([][]byte, 0, len(conf.Pins))
+		for _, pin := range conf.Pins {
+			sum, err := config.ParsePin(pin)
+			if err != nil {
+				return nil, fmt.Errorf("tls_client: %v", err)
+			}
+			pins = append(pins, sum)
+		}
+		if caCertLoc == "" {
+			// no CA to chain to, the pin is the only thing vouching for the server.
+			// the default verification (chain and name) is switched off, VerifyConnection still runs
+			clientConfig.InsecureSkipVerify = true
+		}
+		clientConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return fmt.Errorf("tls_client: server sent no certificate")
+			}
+			leaf := state.PeerCertificates[0]
+			sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(pin, sum[:]) {
+					return nil
+				}
+			}
+			return fmt.Errorf("tls_client: server key %s doesn't match any pin", SPKIPin(leaf))
+		}
+	}
+
+	if certLoc != "" {
+		clientCert, err := tls.LoadX509KeyPair(certLoc, keyLoc)
+		if err != nil {
+			return nil, fmt.Errorf("tls_client: error loading client KeyPair: %v", err)
+		}
+		clientConfig.Certificates = []tls.Certificate{clientCert}
+	}
 	return &clientConfig, nil
-}
\ No newline at end of file
+}
+
+// The pin for a cert, as "sha256/<base64>" of its SubjectPublicKeyInfo. Survives renewals which keep the key
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
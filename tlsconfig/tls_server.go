@@ -2,36 +2,121 @@ package tlsconfig
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"os"
+
+	"custom_vpn/config"
 )
 
 /*
 	- initially figured that pem, and key would be params.
 	- but since we don't have multiple server certs, decided against it.
+	- the config file changed that: the locations come from config.Server (file, SERVER_PEM/SERVER_KEY, or flags)
+	- now the keypair comes from a CertReloader, so it can be renewed without a restart (see reload.go)
+	- ClientCA turns on mutual TLS: every client has to present a cert signed by that CA. Empty means anyone gets in
+	- ClientCRL (eg. from `custom_vpn pki revoke`) turns away client certs which were revoked. certs reloads it (see reload.go),
+	  so its Watch has to start after this
 */
-func ServerTLSConfig() (*tls.Config, error) {
-	
-	serverKeyLoc := os.Getenv("SERVER_KEY")
-	if serverKeyLoc == "" {
-		return nil, fmt.Errorf("failed to find server priv-key")
+func ServerTLSConfig(conf config.ServerTLS, certs *CertReloader) (*tls.Config, error) {
+	clientCALoc := conf.ClientCA
+
+	serverConfig := tls.Config{
+		MinVersion: tls.VersionTLS13,
+		// asked on every handshake, so a reloaded cert is used straight away
+		GetCertificate: certs.GetCertificate,
+		Time: nil,
 	}
 
-	serverPemLoc := os.Getenv("SERVER_PEM")
-	if serverPemLoc == "" {
-		return nil, fmt.Errorf("failed to find server cert")
+	if clientCALoc != "" {
+		caCert, err := os.ReadFile(clientCALoc)
+		if err != nil {
+			return nil, fmt.Errorf("tls_server: error reading client CA: %v", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("tls_server: no certificates found in client CA %v", clientCALoc)
+		}
+		serverConfig.ClientCAs = clientCAs
+		serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+		if conf.ClientCRL != "" {
+			if err := certs.SetClientCRL(conf.ClientCRL, caCert); err != nil {
+				return nil, err
+			}
+			// not VerifyPeerCertificate, that's skipped when a session is resumed. A revoked cert could come back on a ticket
+			serverConfig.VerifyConnection = func(state tls.ConnectionState) error {
+				if len(state.PeerCertificates) > 0 && certs.Revoked(state.PeerCertificates[0]) {
+					return fmt.Errorf("client cert %x has been revoked", state.PeerCertificates[0].SerialNumber)
+				}
+				return nil
+			}
+		}
 	}
 
-	serverCert, err := tls.LoadX509KeyPair(serverPemLoc,serverKeyLoc)
+	return &serverConfig, nil
+}
+
+/*
+	Reads the CRL at crlLoc and returns the revoked serials (as big-endian bytes).
+	The CRL has to be signed by one of the certs in caPEM, otherwise anyone could hand us an empty one.
+*/
+func loadCRL(crlLoc string, caPEM []byte) (map[string]bool, error) {
+	raw, err := os.ReadFile(crlLoc)
 	if err != nil {
-		return nil, fmt.Errorf("tls_server: fatal error loading KeyPair: %v", err)
+		return nil, fmt.Errorf("tls_server: error reading client CRL: %v", err)
 	}
-	serverConfig := tls.Config{
-		MinVersion: tls.VersionTLS13,
-		// this key takes a slice of certs, you'd add more here if there were multiple domains. smart enough to do SNI for you
-		Certificates: []tls.Certificate{serverCert},
-		Time: nil,
+	if block, _ := pem.Decode(raw); block != nil {
+		raw = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(raw)
+	if err != nil {
+		return nil, fmt.Errorf("tls_server: error parsing client CRL %v: %v", crlLoc, err)
 	}
 
-	return &serverConfig, nil
-}
\ No newline at end of file
+	signed := false
+	for rest := caPEM; !signed; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		caCert, err := x509.ParseCertificate(block.Bytes)
+		if err == nil && crl.CheckSignatureFrom(caCert) == nil {
+			signed = true
+		}
+	}
+	if !signed {
+		return nil, fmt.Errorf("tls_server: client CRL %v isn't signed by the client CA", crlLoc)
+	}
+
+	revoked := make(map[string]bool, len(crl.RevokedCertificateEntries))
+	for _, entry := range crl.RevokedCertificateEntries {
+		revoked[string(entry.SerialNumber.Bytes())] = true
+	}
+	return revoked, nil
+}
+
+/*
+	The name a verified client cert goes by, used as the peer identity in logs and by the destination policy.
+	That's the subject common name, or the first SAN (DNS, email, then URI) for certs without one.
+	Empty when the client didn't present a verified cert (mTLS off, or the raw TCP listener).
+*/
+func PeerIdentity(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	leaf := state.VerifiedChains[0][0]
+	switch {
+	case leaf.Subject.CommonName != "":
+		return leaf.Subject.CommonName
+	case len(leaf.DNSNames) > 0:
+		return leaf.DNSNames[0]
+	case len(leaf.EmailAddresses) > 0:
+		return leaf.EmailAddresses[0]
+	case len(leaf.URIs) > 0:
+		return leaf.URIs[0].String()
+	}
+	return ""
+}
@@ -1,60 +1,168 @@
 package tunnel
 
 import (
+	"context"
+	"errors"
 	"io"
-	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/quic-go/quic-go"
 )
 
-// Use for copy between two net.conns
-func CreateTunnel(dst, src net.Conn){
-	var wg sync.WaitGroup
-	var once sync.Once
-	closeConns := func ()  {
-		dst.Close()
-		src.Close()
-	}
-
-	wg.Add(1)
-	go func(){
-		defer wg.Done()
-		io.Copy(dst, src)
-		once.Do(closeConns)
-	}()
-
-	wg.Add(1)
-	go func ()  {
-		defer wg.Done()
-		io.Copy(src, dst)
-		once.Do(closeConns)
-	}()
-	wg.Wait()
-}
-
-// Use for copy between QUIC Stream and net.conn
-func QuicTcpTunnel(conn net.Conn, stream quic.Stream){
-	var wg sync.WaitGroup
+/*
+	One pipe for every pair of tunnel ends: net.Conn to net.Conn (TCP, TLS), and net.Conn to quic.Stream.
+	The old CreateTunnel / QuicTcpTunnel closed both sides as soon as either direction hit EOF,
+	which cut off anything that half-closes (`ssh host cmd < file`, a request body followed by a wait for the reply).
+	Now EOF on one side is passed on as a FIN to the other (CloseWrite, or Close for a quic.Stream)
+	and the pipe keeps running until both directions are done. An error in either direction tears down both,
+	resetting a quic.Stream end with ResetCode so the peer doesn't take it for a clean FIN.
+*/
+
+// What a pipe end has to do. net.Conn, *tls.Conn and quic.Stream all fit
+type Conn interface {
+	io.ReadWriteCloser
+}
+
+/*
+	How long the direction still open after a half-close may go without passing anything on.
+	Stops half-closed peers holding a pipe open forever, without cutting a long download after an early FIN
+*/
+const HalfCloseTimeout = 2 * time.Minute
+
+// What the pipe actually uses, the tests shorten it
+var halfCloseTimeout = HalfCloseTimeout
+
+var ErrHalfCloseTimeout = errors.New("tunnel: the other direction went idle after a half-close")
+
+// What a quic.Stream end is reset with when the pipe is torn down by an error
+const ResetCode quic.StreamErrorCode = 0x46
+
+type Result struct {
+	// Bytes copied a -> b, and b -> a
+	AToB, BToA int64
+	// What ended the pipe, nil when both directions finished cleanly
+	Err error
+}
+
+// Bytes a pipe has copied so far, for watching it while it runs. The totals are in its Result too
+type Counters struct {
+	AToB, BToA atomic.Int64
+}
+
+// Copies a to b and b to a until both are done, then closes both
+func Pipe(a, b Conn) Result {
+	return PipeContext(context.Background(), a, b, nil)
+}
+
+/*
+	Pipe, but torn down when ctx is done, with context.Cause(ctx) as the Result's Err.
+	That's how the admin API kills a tunnel. Counts into c as it goes, when c isn't nil
+*/
+func PipeContext(ctx context.Context, a, b Conn, c *Counters) Result {
+	var res Result
 	var once sync.Once
-	close := func(){
-		stream.Close()
-		conn.Close()
-	}
-	
-	wg.Add(1)
-	go func(){
-		defer wg.Done()
-		io.Copy(stream, conn)
-		once.Do(close)
-	}()
-
-	wg.Add(1)
-	go func(){
-		defer wg.Done()
-		io.Copy(conn, stream)
-		once.Do(close)
-	}()
-
-	wg.Wait()
-}
\ No newline at end of file
+	teardown := func(err error) {
+		once.Do(func() {
+			res.Err = err
+			closeFully(a, err)
+			closeFully(b, err)
+		})
+	}
+	stop := context.AfterFunc(ctx, func() { teardown(context.Cause(ctx)) })
+	defer stop()
+
+	done := make(chan struct{}, 2)
+	// when either direction last wrote something, in unix nanoseconds
+	var lastWrite atomic.Int64
+	half := func(dst, src Conn, n *int64, live *atomic.Int64) {
+		defer func() { done <- struct{}{} }()
+		written, err := io.Copy(&countingWriter{w: dst, n: live, last: &lastWrite}, src)
+		*n = written
+		if err != nil {
+			teardown(err)
+			return
+		}
+		// src is done sending, so is dst. Without a way to say that, closing it is all we can do
+		if !closeWrite(dst) {
+			teardown(nil)
+		}
+	}
+	var aToB, bToA *atomic.Int64
+	if c != nil {
+		aToB, bToA = &c.AToB, &c.BToA
+	}
+	go half(b, a, &res.AToB, aToB)
+	go half(a, b, &res.BToA, bToA)
+
+	<-done
+	lastWrite.Store(time.Now().UnixNano())
+	idle := time.NewTimer(halfCloseTimeout)
+	defer idle.Stop()
+	for waiting := true; waiting; {
+		select {
+		case <-done:
+			waiting = false
+		case <-idle.C:
+			since := time.Since(time.Unix(0, lastWrite.Load()))
+			if since < halfCloseTimeout {
+				idle.Reset(halfCloseTimeout - since)
+				continue
+			}
+			teardown(ErrHalfCloseTimeout)
+			<-done
+			waiting = false
+		}
+	}
+	teardown(nil)
+	return res
+}
+
+// Sends a FIN, and keeps reading. False if c can't do that
+func closeWrite(c Conn) bool {
+	switch c := c.(type) {
+	case interface{ CloseWrite() error }:
+		c.CloseWrite()
+		return true
+	case quic.Stream:
+		// closing a stream only closes our sending side
+		c.Close()
+		return true
+	}
+	return false
+}
+
+// Closes c both ways. A quic.Stream torn down by err is reset rather than closed, Close would send a FIN
+func closeFully(c Conn, err error) {
+	s, ok := c.(quic.Stream)
+	if !ok {
+		c.Close()
+		return
+	}
+	if err == nil {
+		s.CancelRead(0)
+		s.Close()
+		return
+	}
+	s.CancelRead(ResetCode)
+	s.CancelWrite(ResetCode)
+}
+
+// Notes when something was last written, and counts it into n when n isn't nil
+type countingWriter struct {
+	w    io.Writer
+	n    *atomic.Int64
+	last *atomic.Int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	if n > 0 {
+		cw.last.Store(time.Now().UnixNano())
+	}
+	if cw.n != nil {
+		cw.n.Add(int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,205 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dialed, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := ln.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return dialed, accepted
+}
+
+/*
+	left <-> a ==pipe== b <-> right
+	Returns the two outer ends and the pipe's Result, once it's done
+*/
+func startPipe(t *testing.T, ctx context.Context) (left, right *net.TCPConn, result <-chan Result) {
+	t.Helper()
+	left, a := tcpPair(t)
+	b, right := tcpPair(t)
+	res := make(chan Result, 1)
+	go func() { res <- PipeContext(ctx, a, b, nil) }()
+	return left, right, res
+}
+
+func waitResult(t *testing.T, res <-chan Result) Result {
+	t.Helper()
+	select {
+	case r := <-res:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("the pipe is still running")
+		return Result{}
+	}
+}
+
+// Reads until EOF, failing on anything else
+func readAll(t *testing.T, c net.Conn) string {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(b)
+}
+
+func TestHalfClose(t *testing.T) {
+	for _, first := range []string{"left", "right"} {
+		t.Run(first+" finishes first", func(t *testing.T) {
+			left, right, res := startPipe(t, context.Background())
+			early, late := left, right
+			if first == "right" {
+				early, late = right, left
+			}
+			if _, err := early.Write([]byte("request")); err != nil {
+				t.Fatal(err)
+			}
+			early.CloseWrite()
+			// the FIN got through, and the other direction still works
+			if got := readAll(t, late); got != "request" {
+				t.Fatalf("got %q", got)
+			}
+			if _, err := late.Write([]byte("the reply")); err != nil {
+				t.Fatal(err)
+			}
+			late.CloseWrite()
+			if got := readAll(t, early); got != "the reply" {
+				t.Fatalf("got %q", got)
+			}
+
+			r := waitResult(t, res)
+			if r.Err != nil {
+				t.Errorf("err = %v", r.Err)
+			}
+			toRight, toLeft := int64(len("request")), int64(len("the reply"))
+			if first == "right" {
+				toRight, toLeft = toLeft, toRight
+			}
+			if r.AToB != toRight || r.BToA != toLeft {
+				t.Errorf("copied %d / %d, want %d / %d", r.AToB, r.BToA, toRight, toLeft)
+			}
+		})
+	}
+}
+
+func TestHalfCloseTimeout(t *testing.T) {
+	halfCloseTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { halfCloseTimeout = HalfCloseTimeout })
+
+	left, right, res := startPipe(t, context.Background())
+	left.CloseWrite()
+	if got := readAll(t, right); got != "" {
+		t.Fatalf("got %q", got)
+	}
+	// traffic the other way keeps the pipe up past the timeout
+	for range 5 {
+		if _, err := right.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(halfCloseTimeout / 2)
+	}
+	select {
+	case r := <-res:
+		t.Fatalf("torn down while still in use: %v", r.Err)
+	default:
+	}
+
+	// then it goes quiet, and both ends get closed
+	r := waitResult(t, res)
+	if !errors.Is(r.Err, ErrHalfCloseTimeout) {
+		t.Errorf("err = %v, want ErrHalfCloseTimeout", r.Err)
+	}
+	if r.BToA != 5 {
+		t.Errorf("copied %d", r.BToA)
+	}
+	if got := readAll(t, left); got != "xxxxx" {
+		t.Errorf("left got %q", got)
+	}
+	right.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := right.Read(make([]byte, 1)); err == nil {
+		t.Error("right end still open")
+	}
+}
+
+func TestErrorClosesBoth(t *testing.T) {
+	for _, broken := range []string{"left", "right"} {
+		t.Run(broken+" resets", func(t *testing.T) {
+			left, right, res := startPipe(t, context.Background())
+			bad, other := left, right
+			if broken == "right" {
+				bad, other = right, left
+			}
+			// with the other end half-closed already, only the error can end the pipe
+			other.CloseWrite()
+			bad.SetLinger(0)
+			bad.Close()
+
+			r := waitResult(t, res)
+			if r.Err == nil {
+				t.Error("the reset didn't come through as an error")
+			}
+			if got := readAll(t, other); got != "" {
+				t.Errorf("got %q", got)
+			}
+		})
+	}
+}
+
+func TestNoCloseWrite(t *testing.T) {
+	// a net.Pipe end can't be half-closed, so the FIN meant for it closes the lot
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	left, a := tcpPair(t)
+	res := make(chan Result, 1)
+	go func() { res <- Pipe(a, p2) }()
+	left.CloseWrite()
+	r := waitResult(t, res)
+	if r.Err != nil {
+		t.Errorf("err = %v", r.Err)
+	}
+	if _, err := p1.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("net.Pipe end: err = %v, want EOF", err)
+	}
+	if got := readAll(t, left); got != "" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestPipeContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	left, right, res := startPipe(t, ctx)
+	killed := errors.New("killed")
+	cancel(killed)
+	if r := waitResult(t, res); !errors.Is(r.Err, killed) {
+		t.Errorf("err = %v, want the cause", r.Err)
+	}
+	for _, c := range []net.Conn{left, right} {
+		if got := readAll(t, c); got != "" {
+			t.Errorf("got %q", got)
+		}
+	}
+}